@@ -0,0 +1,57 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SortableAlbumFields lists the Album fields accepted by the sort query parameter.
+var SortableAlbumFields = []string{"title", "artist", "price", "timeCreated"}
+
+// DefaultAlbumSort is applied when a listing does not ask for an order.
+var DefaultAlbumSort = []SortField{{Field: "timeCreated"}}
+
+type SortField struct {
+	Field      string
+	Descending bool
+}
+
+// ParseAlbumSort parses a comma separated list such as "price,-timeCreated",
+// where a leading '-' sorts that field in descending order.
+func ParseAlbumSort(raw string) ([]SortField, error) {
+	if raw == "" {
+		return DefaultAlbumSort, nil
+	}
+
+	var fields []SortField
+	seen := map[string]bool{}
+	for _, part := range strings.Split(raw, ",") {
+		field := SortField{Field: strings.TrimSpace(part)}
+		if strings.HasPrefix(field.Field, "-") {
+			field.Field = field.Field[1:]
+			field.Descending = true
+		}
+
+		if !isSortableAlbumField(field.Field) {
+			return nil, fmt.Errorf("unsupported sort field %q, expected one of %s", field.Field, strings.Join(SortableAlbumFields, ", "))
+		}
+		if seen[field.Field] {
+			return nil, fmt.Errorf("duplicate sort field %q", field.Field)
+		}
+
+		seen[field.Field] = true
+		fields = append(fields, field)
+	}
+
+	return fields, nil
+}
+
+func isSortableAlbumField(name string) bool {
+	for _, v := range SortableAlbumFields {
+		if v == name {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,30 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAlbumSort_Empty_ReturnDefault(t *testing.T) {
+	fields, err := ParseAlbumSort("")
+
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultAlbumSort, fields)
+}
+
+func TestParseAlbumSort_ValidFields_ReturnSortFields(t *testing.T) {
+	fields, err := ParseAlbumSort("price,-timeCreated")
+
+	assert.NoError(t, err)
+	assert.Equal(t, []SortField{{Field: "price"}, {Field: "timeCreated", Descending: true}}, fields)
+}
+
+func TestParseAlbumSort_InvalidFields_ReturnError(t *testing.T) {
+	for _, raw := range []string{"id", "price,", "-", "title,-title"} {
+		fields, err := ParseAlbumSort(raw)
+
+		assert.Nil(t, fields)
+		assert.Error(t, err, raw)
+	}
+}
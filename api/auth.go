@@ -0,0 +1,42 @@
+package api
+
+import "context"
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	// Subject identifies the caller, the sub claim of a JWT
+	Subject string
+	Issuer  string
+	// Method is how the caller authenticated, e.g. "jwt"
+	Method string
+	Scopes []string
+	// Roles are the AccessPolicyConfig roles held by the caller
+	Roles []string
+	// Tenant is the only tenant the caller may act for, empty when the
+	// caller isn't bound to one
+	Tenant string
+	Claims map[string]any
+}
+
+type principalKey struct{}
+
+// ContextWithPrincipal returns a copy of ctx carrying principal.
+func ContextWithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the caller of the request ctx belongs to, or
+// nil when the request wasn't authenticated.
+func PrincipalFromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+	return principal
+}
+
+// SubjectFromContext returns the subject of the caller of the request ctx
+// belongs to, or an empty string when the request wasn't authenticated.
+func SubjectFromContext(ctx context.Context) string {
+	if principal := PrincipalFromContext(ctx); principal != nil {
+		return principal.Subject
+	}
+	return ""
+}
@@ -1,28 +1,225 @@
 package api
 
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// StatusClientClosedRequest is the non-standard status reported when the client
+// cancels a request before the backend call completes.
+const StatusClientClosedRequest = 499
+
 type AppConfig struct {
-	DbType         string
-	MongoConfig    MongoConfig
-	DynamoDbConfig DynamoDbConfig
+	DbType            string
+	PaginationConfig  PaginationConfig
+	IdempotencyConfig IdempotencyConfig
+	TracingConfig     TracingConfig
+	LoggingConfig     LoggingConfig
+	HealthConfig      HealthConfig
+	ServerConfig      ServerConfig
+	ReloadConfig      ReloadConfig
+	AuthConfig        AuthConfig
+	AccessPolicy      AccessPolicyConfig
+	TenancyConfig     TenancyConfig
+	RateLimitConfig   RateLimitConfig
+	AuditConfig       AuditConfig
+	MongoConfig       MongoConfig
+	DynamoDbConfig    DynamoDbConfig
+	SqliteConfig      SqliteConfig
+	PostgresConfig    PostgresConfig
+	BackendConfigs    map[string]json.RawMessage
+}
+
+type PaginationConfig struct {
+	DefaultPageSize int
+	MaxPageSize     int
+}
+
+type IdempotencyConfig struct {
+	TtlSeconds int
+}
+
+// TracingConfig selects where spans are exported: "otlp" sends them over
+// OTLP/HTTP to OtlpEndpoint, "stdout" prints them and "off" or empty disables
+// tracing. SampleRatio applies to traces started here, a zero ratio samples all.
+type TracingConfig struct {
+	Exporter     string
+	ServiceName  string
+	OtlpEndpoint string
+	OtlpInsecure bool
+	SampleRatio  float64
+}
+
+// LoggingConfig sets the minimum Level ("debug", "info", "warn" or "error",
+// info by default) and the Format ("json" or "text", json by default) of logs.
+type LoggingConfig struct {
+	Level  string
+	Format string
+}
+
+// ServerConfig sets the listen Addr and controls shutdown. On SIGTERM or
+// SIGINT readiness fails right away, the listener stays open for
+// DrainDelayMillis so load balancers notice, then in-flight requests get
+// DrainTimeoutSeconds to complete. The client IP is only taken from the
+// X-Forwarded-For header of TrustedProxies, IPs or CIDRs, none by default.
+type ServerConfig struct {
+	Addr                string
+	DrainDelayMillis    int
+	DrainTimeoutSeconds int
+	TrustedProxies      []string
+}
+
+// AuthConfig lists the accepted authentication Modes, "jwt" for bearer
+// tokens and "apiKey" for X-API-Key headers checked against the keys kept in
+// the backend. The album endpoints are public when Modes is empty.
+type AuthConfig struct {
+	Modes []string
+	Jwt   JwtConfig
+}
+
+// Album operations granted by an AccessPolicyConfig.
+const (
+	OperationRead   = "read"
+	OperationCreate = "create"
+	OperationUpdate = "update"
+	OperationDelete = "delete"
+)
+
+// AccessPolicyConfig grants album operations to the Roles of authenticated
+// callers, and OwnerOperations to the caller who created an album. Every
+// operation is allowed when Roles is empty, or the request isn't authenticated.
+type AccessPolicyConfig struct {
+	Roles           map[string][]string
+	OwnerOperations []string
+}
+
+// TenancyConfig resolves the tenant of every album request, from the tenant
+// of the authenticated caller, then the Header, then the subdomain of Domain,
+// and finally DefaultTenant. Requests naming another tenant than the one of
+// their caller are rejected. When Tenants is set, other tenants are unknown.
+type TenancyConfig struct {
+	Enabled       bool
+	Header        string
+	Domain        string
+	DefaultTenant string
+	Tenants       map[string]TenantConfig
+}
+
+// TenantConfig overrides the settings of one tenant, nil ones are inherited.
+type TenantConfig struct {
+	PaginationConfig *PaginationConfig
+	AccessPolicy     *AccessPolicyConfig
+}
+
+// RateLimitConfig gives every client of the album routes a token bucket for
+// reads and another for writes. Clients are told apart by API key, then by
+// authenticated subject, then by IP, and Clients overrides the rules of some
+// of them, keyed by API key id, subject or IP. Store "backend" shares the buckets
+// through the backend so that every instance enforces one limit, "memory"
+// keeps them in each process. With authentication, Ip also limits every
+// request of an IP before its credentials are checked, and defaults to Read.
+type RateLimitConfig struct {
+	Enabled bool
+	Store   string
+	Read    RateLimitRule
+	Write   RateLimitRule
+	Ip      RateLimitRule
+	Clients map[string]RateLimitRules
+}
+
+// RateLimitRule refills a bucket at RequestsPerMinute up to Burst requests,
+// Burst defaults to RequestsPerMinute and zero RequestsPerMinute is unlimited.
+type RateLimitRule struct {
+	RequestsPerMinute int
+	Burst             int
+}
+
+// RateLimitRules overrides the rules of one client, nil ones are inherited.
+type RateLimitRules struct {
+	Read  *RateLimitRule
+	Write *RateLimitRule
+}
+
+// AuditConfig records every album change in Sink: "backend" keeps the records
+// next to the albums, "file" appends them as JSON lines to File and "stdout"
+// writes them to the standard output. The stdout sink can't be queried.
+type AuditConfig struct {
+	Enabled bool
+	Sink    string
+	File    string
+}
+
+// JwtConfig verifies HS256, RS256 and ES256 bearer tokens against the keys of
+// a JWKS read from JwksFile or fetched from JwksUrl. Tokens must carry exp and
+// match Issuer and Audience when those are set. TenantClaim names the claim
+// binding a caller to a tenant.
+type JwtConfig struct {
+	JwksFile      string
+	JwksUrl       string
+	Issuer        string
+	Audience      string
+	LeewaySeconds int
+	TenantClaim   string
+}
+
+// ReloadConfig polls the config file every WatchIntervalSeconds and reloads
+// it when it changed, zero only reloads on SIGHUP.
+type ReloadConfig struct {
+	WatchIntervalSeconds int
+}
+
+// HealthConfig bounds the dependency checks behind /readyz. Results are reused
+// for CacheMillis so frequent probes don't reach the database every time.
+type HealthConfig struct {
+	CacheMillis        int
+	CheckTimeoutMillis int
 }
 
 type MongoConfig struct {
-	Hosts               []string
-	Database            string
-	Collection          string
-	QueryTimeoutSeconds int
+	Hosts                 []string
+	Database              string
+	Collection            string
+	IdempotencyCollection string
+	ApiKeyCollection      string
+	RateLimitCollection   string
+	AuditCollection       string
+	QueryTimeoutSeconds   int
 }
 
 type DynamoDbConfig struct {
-	LocalEndpoint       string
-	TableName           string
-	Region              string
+	LocalEndpoint        string
+	TableName            string
+	IdempotencyTableName string
+	ApiKeyTableName      string
+	RateLimitTableName   string
+	AuditTableName       string
+	Region               string
+	QueryTimeoutSeconds  int
+}
+
+// SqliteConfig points at a database file that is created and migrated on startup.
+type SqliteConfig struct {
+	Path                string
+	BusyTimeoutMillis   int
 	QueryTimeoutSeconds int
 }
 
+// PostgresConfig sizes the connection pool, StatementTimeoutMillis is enforced
+// by the server on every statement in addition to QueryTimeoutSeconds.
+type PostgresConfig struct {
+	Dsn                    string
+	MaxOpenConns           int
+	MaxIdleConns           int
+	ConnMaxLifetimeSeconds int
+	StatementTimeoutMillis int
+	QueryTimeoutSeconds    int
+}
+
 type ResponseBody struct {
 	Data    any    `json:",omitempty"`
 	Message string `json:",omitempty"`
+	Next    string `json:",omitempty"`
 }
 
 type HandlerResponse struct {
@@ -31,6 +228,25 @@ type HandlerResponse struct {
 	Error error
 }
 
+// AlbumQueryDTO carries listing parameters. Cursor is an opaque token taken
+// from the Next field of a previous page. A zero Limit lists without a page
+// bound; ApiHandler always resolves it to the configured page size.
+//
+// Zero valued filters are ignored. TitleContains is case sensitive and
+// CreatedAfter is exclusive, in unix milliseconds like TimeCreated. Sort is
+// parsed by ApiHandler from the sort query parameter, an empty Sort means
+// DefaultAlbumSort. Every backend breaks ties by ascending Id.
+type AlbumQueryDTO struct {
+	Limit         int         `form:"limit" validate:"gte=0"`
+	Cursor        string      `form:"cursor"`
+	Artist        string      `form:"artist"`
+	TitleContains string      `form:"titleContains"`
+	MinPrice      float64     `form:"minPrice" validate:"gte=0"`
+	MaxPrice      float64     `form:"maxPrice" validate:"omitempty,gtefield=MinPrice"`
+	CreatedAfter  int64       `form:"createdAfter" validate:"gte=0"`
+	Sort          []SortField `form:"-"`
+}
+
 type AlbumPropertiesDTO struct {
 	Title  string  `validate:"required"`
 	Artist string  `validate:"required"`
@@ -43,10 +259,102 @@ type AlbumUpdatesDTO struct {
 	Price  float64 `validate:"required_without_all=Title Artist"`
 }
 
+// Album.Version starts at 1 and increments on every write, it is exposed as the ETag.
+// TimeUpdated is the unix milliseconds of the latest write, exposed as Last-Modified.
 type Album struct {
 	Id          string `bson:"_id"`
 	Title       string
 	Artist      string
 	Price       float64
 	TimeCreated int64
+	TimeUpdated int64
+	Version     int64
+	// OwnerId is the subject of the caller who created the album, empty when
+	// the request wasn't authenticated.
+	OwnerId string
+}
+
+// IdempotencyRecord is the first response produced for an Idempotency-Key.
+// StatusCode stays zero while the original request is still being processed.
+type IdempotencyRecord struct {
+	Key         string `bson:"_id"`
+	Fingerprint string
+	StatusCode  int
+	Header      http.Header
+	Body        []byte
+	ExpiresAt   time.Time `dynamodbav:",unixtime"`
+}
+
+// ApiKey is a credential of server to server callers, only the SHA-256 Hash
+// of the key is stored. It is valid from NotBefore until ExpiresAt, a zero
+// ExpiresAt never expires, so a rotated key can overlap with its replacement.
+type ApiKey struct {
+	Id          string `bson:"_id"`
+	Hash        string
+	Subject     string
+	Scopes      []string
+	Roles       []string
+	Tenant      string
+	TimeCreated time.Time
+	NotBefore   time.Time
+	ExpiresAt   time.Time
+	LastUsedAt  time.Time
+}
+
+// RateLimitBucket holds the Tokens a client had left at UpdatedAt. Revision
+// changes on every write so that concurrent instances can't lose a request,
+// and the bucket can be dropped once it is full again at ExpiresAt.
+type RateLimitBucket struct {
+	Key       string `bson:"_id"`
+	Tokens    float64
+	Revision  int64
+	UpdatedAt time.Time
+	ExpiresAt time.Time `dynamodbav:",unixtime"`
+}
+
+// Actions of the album changes recorded by an AuditSink. Denied operations
+// are recorded as AuditActionDenied followed by the operation, such as
+// "denied:update".
+const (
+	AuditActionInsert  = "insert"
+	AuditActionReplace = "replace"
+	AuditActionUpdate  = "update"
+	AuditActionDelete  = "delete"
+	AuditActionDenied  = "denied:"
+)
+
+// AuditRecord describes one change of an album by Actor, the subject of the
+// caller, empty when the request wasn't authenticated. Before is nil for an
+// insert and After is nil for a delete, both are nil for a denial, whose
+// AlbumId is empty when the operation wasn't on one album. Unverified is set
+// when another change may have been made between Before and the change.
+type AuditRecord struct {
+	Id         string `bson:"_id"`
+	Tenant     string `json:",omitempty"`
+	AlbumId    string
+	Action     string
+	Actor      string
+	Method     string `json:",omitempty"`
+	RequestId  string `json:",omitempty"`
+	Time       int64
+	Before     *Album `json:",omitempty"`
+	After      *Album `json:",omitempty"`
+	Unverified bool   `json:",omitempty"`
+}
+
+// AuditQuery selects the records of Tenant since the Since unix millisecond,
+// of one album or actor when AlbumId or Actor are set, up to Limit records.
+type AuditQuery struct {
+	Tenant  string
+	AlbumId string
+	Actor   string
+	Since   int64
+	Limit   int
+}
+
+// AuditQueryDTO carries the parameters of an audit trail listing.
+type AuditQueryDTO struct {
+	Actor string `form:"actor"`
+	Since int64  `form:"since" validate:"gte=0"`
+	Limit int    `form:"limit" validate:"gte=0"`
 }
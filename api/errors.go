@@ -0,0 +1,141 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ProblemContentType is the media type of error responses, see RFC 7807.
+const ProblemContentType = "application/problem+json"
+
+const problemTypePrefix = "/problems/"
+
+// ErrorKind is a class of failure. Type is stable and is what clients should
+// branch on, Title is a short human readable summary of the kind.
+type ErrorKind struct {
+	Type   string
+	Title  string
+	Status int
+}
+
+var (
+	KindMalformedRequest   = ErrorKind{Type: problemTypePrefix + "malformed-request", Title: "Malformed request", Status: http.StatusBadRequest}
+	KindValidationFailed   = ErrorKind{Type: problemTypePrefix + "validation-failed", Title: "Validation failed", Status: http.StatusBadRequest}
+	KindUnauthorized       = ErrorKind{Type: problemTypePrefix + "unauthorized", Title: "Authentication required", Status: http.StatusUnauthorized}
+	KindForbidden          = ErrorKind{Type: problemTypePrefix + "forbidden", Title: "Permission denied", Status: http.StatusForbidden}
+	KindNotFound           = ErrorKind{Type: problemTypePrefix + "not-found", Title: "Resource not found", Status: http.StatusNotFound}
+	KindConflict           = ErrorKind{Type: problemTypePrefix + "conflict", Title: "Conflicting request", Status: http.StatusConflict}
+	KindPreconditionFailed = ErrorKind{Type: problemTypePrefix + "precondition-failed", Title: "Precondition failed", Status: http.StatusPreconditionFailed}
+	KindUnprocessable      = ErrorKind{Type: problemTypePrefix + "unprocessable", Title: "Request cannot be processed", Status: http.StatusUnprocessableEntity}
+	KindTooManyRequests    = ErrorKind{Type: problemTypePrefix + "too-many-requests", Title: "Too many requests", Status: http.StatusTooManyRequests}
+	KindRequestCancelled   = ErrorKind{Type: problemTypePrefix + "request-cancelled", Title: "Request cancelled", Status: StatusClientClosedRequest}
+	KindInternal           = ErrorKind{Type: problemTypePrefix + "internal", Title: "Internal error", Status: http.StatusInternalServerError}
+	KindBackendUnavailable = ErrorKind{Type: problemTypePrefix + "backend-unavailable", Title: "Backend unavailable", Status: http.StatusServiceUnavailable}
+	KindTimeout            = ErrorKind{Type: problemTypePrefix + "timeout", Title: "Backend timed out", Status: http.StatusGatewayTimeout}
+)
+
+var errorKinds = []ErrorKind{
+	KindMalformedRequest,
+	KindValidationFailed,
+	KindUnauthorized,
+	KindForbidden,
+	KindNotFound,
+	KindConflict,
+	KindPreconditionFailed,
+	KindUnprocessable,
+	KindTooManyRequests,
+	KindRequestCancelled,
+	KindInternal,
+	KindBackendUnavailable,
+	KindTimeout,
+}
+
+// KindForStatus picks the kind reported for an untyped error. Statuses
+// without a kind of their own get the RFC 7807 about:blank type.
+func KindForStatus(status int) ErrorKind {
+	for _, kind := range errorKinds {
+		if kind.Status == status && kind != KindValidationFailed {
+			return kind
+		}
+	}
+
+	return ErrorKind{Type: "about:blank", Title: http.StatusText(status), Status: status}
+}
+
+// FieldError describes why a single request field was rejected.
+type FieldError struct {
+	Field  string `json:"field"`
+	Rule   string `json:"rule"`
+	Detail string `json:"detail"`
+}
+
+// Error is the error every Service and handler reports. Detail is safe to show
+// to clients, Cause keeps the underlying error for logs and is never rendered.
+type Error struct {
+	Kind   ErrorKind
+	Detail string
+	Fields []FieldError
+	Cause  error
+}
+
+func NewError(kind ErrorKind, detail string) *Error {
+	return &Error{Kind: kind, Detail: detail}
+}
+
+func (this *Error) Error() string {
+	if this.Detail != "" {
+		return this.Detail
+	}
+
+	return this.Kind.Title
+}
+
+func (this *Error) Unwrap() error {
+	return this.Cause
+}
+
+// Response reports the error with the status of its kind.
+func (this *Error) Response() HandlerResponse {
+	return HandlerResponse{Code: this.Kind.Status, Error: this}
+}
+
+// AsError finds the *Error in err's chain. Any other error becomes one of the
+// kind matching status, hiding its message.
+func AsError(err error, status int) *Error {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	return &Error{Kind: KindForStatus(status), Cause: err}
+}
+
+// IsKind reports whether err carries an *Error of the given kind.
+func IsKind(err error, kind ErrorKind) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.Kind == kind
+}
+
+// Problem is the application/problem+json rendering of an Error.
+type Problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Errors   []FieldError `json:"errors,omitempty"`
+}
+
+func (this *Error) Problem(instance string) Problem {
+	return Problem{
+		Type:     this.Kind.Type,
+		Title:    this.Kind.Title,
+		Status:   this.Kind.Status,
+		Detail:   this.Detail,
+		Instance: instance,
+		Errors:   this.Fields,
+	}
+}
+
+// ErrAlbumNotFound is the error every Service reports for a missing album.
+var ErrAlbumNotFound = NewError(KindNotFound, "album data not found")
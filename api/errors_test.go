@@ -0,0 +1,50 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAsError_WrappedError_ReturnTypedError(t *testing.T) {
+	err := fmt.Errorf("lookup: %w", ErrAlbumNotFound)
+
+	assert.Same(t, ErrAlbumNotFound, AsError(err, http.StatusInternalServerError))
+	assert.True(t, IsKind(err, KindNotFound))
+}
+
+func TestAsError_UntypedError_HideMessageKeepCause(t *testing.T) {
+	cause := errors.New("driver detail")
+	apiErr := AsError(cause, http.StatusServiceUnavailable)
+
+	assert.Equal(t, KindBackendUnavailable, apiErr.Kind)
+	assert.Equal(t, KindBackendUnavailable.Title, apiErr.Error())
+	assert.ErrorIs(t, apiErr, cause)
+	assert.Empty(t, apiErr.Problem("/albums").Detail)
+}
+
+func TestKindForStatus_UnknownStatus_ReturnAboutBlank(t *testing.T) {
+	kind := KindForStatus(http.StatusTeapot)
+
+	assert.Equal(t, "about:blank", kind.Type)
+	assert.Equal(t, http.StatusText(http.StatusTeapot), kind.Title)
+	assert.Equal(t, KindMalformedRequest, KindForStatus(http.StatusBadRequest))
+}
+
+func TestErrorProblem_FieldErrors_RenderedWithKind(t *testing.T) {
+	apiErr := &Error{
+		Kind:   KindValidationFailed,
+		Detail: "request has invalid fields",
+		Fields: []FieldError{{Field: "Price", Rule: "required", Detail: "is required"}},
+	}
+
+	problem := apiErr.Problem("/albums")
+	assert.Equal(t, KindValidationFailed.Type, problem.Type)
+	assert.Equal(t, KindValidationFailed.Title, problem.Title)
+	assert.Equal(t, http.StatusBadRequest, problem.Status)
+	assert.Equal(t, "/albums", problem.Instance)
+	assert.Equal(t, apiErr.Fields, problem.Errors)
+}
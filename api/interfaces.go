@@ -1,6 +1,11 @@
 package api
 
-import "github.com/gin-gonic/gin"
+import (
+	"context"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
 
 type IdGenerator interface {
 	NextId() string
@@ -15,11 +20,62 @@ type Handler interface {
 	DeleteAlbum(c *gin.Context)
 }
 
+// Service implementations must honor ctx cancellation and deadlines for every backend call.
+//
+// A non-zero expectedVersion makes a write conditional on the stored Album.Version,
+// a mismatch is reported as 412 Precondition Failed and a missing album as 404.
 type Service interface {
-	GetAlbums() HandlerResponse
-	GetAlbumById(id string) HandlerResponse
-	InsertAlbum(props AlbumPropertiesDTO) HandlerResponse
-	ReplaceAlbum(id string, props AlbumPropertiesDTO) HandlerResponse
-	UpdateAlbum(id string, updates AlbumUpdatesDTO) HandlerResponse
-	DeleteAlbum(id string) HandlerResponse
+	GetAlbums(ctx context.Context, query AlbumQueryDTO) HandlerResponse
+	GetAlbumById(ctx context.Context, id string) HandlerResponse
+	InsertAlbum(ctx context.Context, props AlbumPropertiesDTO) HandlerResponse
+	ReplaceAlbum(ctx context.Context, id string, props AlbumPropertiesDTO, expectedVersion int64) HandlerResponse
+	UpdateAlbum(ctx context.Context, id string, updates AlbumUpdatesDTO, expectedVersion int64) HandlerResponse
+	DeleteAlbum(ctx context.Context, id string, expectedVersion int64) HandlerResponse
+	// Close releases the backend connections once requests have drained,
+	// giving up on the ones still in use when ctx is done.
+	Close(ctx context.Context) error
+}
+
+// IdempotencyStore keeps responses keyed by Idempotency-Key until they expire.
+type IdempotencyStore interface {
+	// Reserve atomically claims record.Key and returns nil, or returns the
+	// unexpired record already holding the key.
+	Reserve(ctx context.Context, record IdempotencyRecord) (*IdempotencyRecord, error)
+	// Complete stores the final response for a reserved key.
+	Complete(ctx context.Context, record IdempotencyRecord) error
+	// Release drops a reservation so the request can be retried.
+	Release(ctx context.Context, key string) error
+}
+
+// ApiKeyStore keeps the API keys callers authenticate with.
+type ApiKeyStore interface {
+	// GetApiKey returns the key with id, or nil when there is none.
+	GetApiKey(ctx context.Context, id string) (*ApiKey, error)
+	// PutApiKey creates or replaces key.
+	PutApiKey(ctx context.Context, key ApiKey) error
+	// TouchApiKey records usedAt as the last time the key authenticated a request.
+	TouchApiKey(ctx context.Context, id string, usedAt time.Time) error
+}
+
+// RateLimitStore keeps the token buckets of rate limited clients.
+type RateLimitStore interface {
+	// GetBucket returns the bucket with key, or nil when there is none.
+	GetBucket(ctx context.Context, key string) (*RateLimitBucket, error)
+	// PutBucket stores bucket when the stored one still has revision, or when
+	// there is none and revision is zero, and reports whether it did.
+	PutBucket(ctx context.Context, bucket RateLimitBucket, revision int64) (bool, error)
+}
+
+// AuditSink keeps the audit trail of album changes.
+type AuditSink interface {
+	// Append adds record to the trail, records are never changed afterwards.
+	Append(ctx context.Context, record AuditRecord) error
+	// Query returns the records matching query, oldest first.
+	Query(ctx context.Context, query AuditQuery) ([]AuditRecord, error)
+}
+
+// HealthChecker is implemented by backends and stores that depend on an
+// external service. CheckHealth reports whether that service can be reached.
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
 }
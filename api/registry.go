@@ -0,0 +1,128 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Backend describes an album storage selectable through AppConfig.DbType.
+//
+// ConfigKey names the appconfig.json block the backend reads and ConfigSchema
+// is a zero value of its config struct. Backends living outside this module
+// read their block from AppConfig.BackendConfigs[ConfigKey] with DecodeBackendConfig.
+type Backend struct {
+	Name         string
+	Description  string
+	ConfigKey    string
+	ConfigSchema any
+	NewService   func(config AppConfig, idGen IdGenerator) (Service, error)
+	// NewIdempotencyStore is optional, records are kept in memory when it is nil.
+	NewIdempotencyStore func(config AppConfig, service Service) (IdempotencyStore, error)
+	// NewApiKeyStore is optional, keys are kept in memory when it is nil.
+	NewApiKeyStore func(config AppConfig, service Service) (ApiKeyStore, error)
+	// NewRateLimitStore is optional, buckets are kept in memory when it is nil.
+	NewRateLimitStore func(config AppConfig, service Service) (RateLimitStore, error)
+	// NewAuditSink is optional, records are kept in memory when it is nil.
+	NewAuditSink func(config AppConfig, service Service) (AuditSink, error)
+	// ValidateConfig is optional, it reports every missing or invalid setting
+	// of the backend before any connection is attempted.
+	ValidateConfig func(config AppConfig) error
+}
+
+// BackendInfo is the self-description of a registered backend.
+type BackendInfo struct {
+	Name         string            `json:"name"`
+	Description  string            `json:"description"`
+	ConfigKey    string            `json:"configKey,omitempty"`
+	ConfigSchema map[string]string `json:"configSchema,omitempty"`
+}
+
+var (
+	backendsLock sync.RWMutex
+	backends     = map[string]Backend{}
+)
+
+// RegisterBackend makes a backend available by name, it is meant to be called
+// from an init function and panics when the name is empty or already taken.
+func RegisterBackend(backend Backend) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+
+	if backend.Name == "" || backend.NewService == nil {
+		panic("api: RegisterBackend requires a name and a NewService factory")
+	}
+	if _, exists := backends[backend.Name]; exists {
+		panic("api: RegisterBackend called twice for backend " + backend.Name)
+	}
+
+	backends[backend.Name] = backend
+}
+
+func LookupBackend(name string) (Backend, bool) {
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+
+	backend, ok := backends[name]
+	return backend, ok
+}
+
+// Backends describes every registered backend, sorted by name.
+func Backends() []BackendInfo {
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+
+	infos := make([]BackendInfo, 0, len(backends))
+	for _, backend := range backends {
+		infos = append(infos, BackendInfo{
+			Name:         backend.Name,
+			Description:  backend.Description,
+			ConfigKey:    backend.ConfigKey,
+			ConfigSchema: DescribeConfig(backend.ConfigSchema),
+		})
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// DescribeConfig maps the appconfig.json keys of a config struct to their Go types.
+func DescribeConfig(schema any) map[string]string {
+	if schema == nil {
+		return nil
+	}
+
+	schemaType := reflect.TypeOf(schema)
+	if schemaType.Kind() == reflect.Pointer {
+		schemaType = schemaType.Elem()
+	}
+	if schemaType.Kind() != reflect.Struct {
+		return nil
+	}
+
+	fields := map[string]string{}
+	for _, field := range reflect.VisibleFields(schemaType) {
+		if field.IsExported() && !field.Anonymous {
+			fields[configKey(field.Name)] = field.Type.String()
+		}
+	}
+
+	return fields
+}
+
+// DecodeBackendConfig unmarshals the BackendConfigs block registered under key into target.
+func DecodeBackendConfig(config AppConfig, key string, target any) error {
+	raw, ok := config.BackendConfigs[key]
+	if !ok {
+		return fmt.Errorf("missing backendConfigs.%s", key)
+	}
+
+	return json.Unmarshal(raw, target)
+}
+
+func configKey(fieldName string) string {
+	return strings.ToLower(fieldName[:1]) + fieldName[1:]
+}
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type sampleBackendConfig struct {
+	ConnectionString string
+	Shards           []string
+}
+
+// registerTestBackend registers backend for the duration of t only, so that
+// test backends don't show up in the other tests of the package.
+func registerTestBackend(t *testing.T, backend Backend) {
+	t.Cleanup(func() {
+		backendsLock.Lock()
+		defer backendsLock.Unlock()
+		delete(backends, backend.Name)
+	})
+	RegisterBackend(backend)
+}
+
+func TestRegisterBackend_Registered_LookupAndDescribe(t *testing.T) {
+	registerTestBackend(t, Backend{
+		Name:         "test-registered",
+		Description:  "sample backend",
+		ConfigKey:    "sampleConfig",
+		ConfigSchema: sampleBackendConfig{},
+		NewService: func(config AppConfig, idGen IdGenerator) (Service, error) {
+			return nil, nil
+		},
+	})
+
+	backend, ok := LookupBackend("test-registered")
+	assert.True(t, ok)
+	assert.Equal(t, "sample backend", backend.Description)
+
+	var info BackendInfo
+	for _, v := range Backends() {
+		if v.Name == "test-registered" {
+			info = v
+		}
+	}
+	assert.Equal(t, "sampleConfig", info.ConfigKey)
+	assert.Equal(t, map[string]string{"connectionString": "string", "shards": "[]string"}, info.ConfigSchema)
+}
+
+func TestRegisterBackend_InvalidOrDuplicate_Panics(t *testing.T) {
+	factory := func(config AppConfig, idGen IdGenerator) (Service, error) { return nil, nil }
+	registerTestBackend(t, Backend{Name: "test-duplicate", NewService: factory})
+
+	assert.Panics(t, func() { RegisterBackend(Backend{Name: "test-duplicate", NewService: factory}) })
+	assert.Panics(t, func() { RegisterBackend(Backend{NewService: factory}) })
+	assert.Panics(t, func() { RegisterBackend(Backend{Name: "test-no-factory"}) })
+}
+
+func TestRegisterBackend_TestBackend_RemovedAfterTest(t *testing.T) {
+	t.Run("register", func(t *testing.T) {
+		registerTestBackend(t, Backend{Name: "test-scoped", NewService: func(config AppConfig, idGen IdGenerator) (Service, error) { return nil, nil }})
+	})
+
+	_, ok := LookupBackend("test-scoped")
+	assert.False(t, ok)
+}
+
+func TestLookupBackend_Unknown_ReturnFalse(t *testing.T) {
+	_, ok := LookupBackend("test-unknown")
+	assert.False(t, ok)
+}
+
+func TestDecodeBackendConfig_BlockPresent_DecodeIntoTarget(t *testing.T) {
+	config := AppConfig{BackendConfigs: map[string]json.RawMessage{
+		"sampleConfig": json.RawMessage(`{"connectionString":"conn","shards":["a","b"]}`),
+	}}
+
+	var target sampleBackendConfig
+	assert.NoError(t, DecodeBackendConfig(config, "sampleConfig", &target))
+	assert.Equal(t, sampleBackendConfig{ConnectionString: "conn", Shards: []string{"a", "b"}}, target)
+
+	assert.Error(t, DecodeBackendConfig(config, "missing", &target))
+}
@@ -0,0 +1,401 @@
+// Package servicetest is a conformance suite for api.Service implementations.
+// Backends run it from their own tests so that every DbType answers the
+// handlers the same way:
+//
+//	func TestMyService_Conformance(t *testing.T) {
+//		servicetest.Run(t, func(t *testing.T) api.Service {
+//			return newEmptyService(t)
+//		})
+//	}
+package servicetest
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// NewService returns a service holding no albums, it is called once per case.
+type NewService func(t *testing.T) api.Service
+
+// Run exercises every case of the suite as a subtest of t.
+func Run(t *testing.T, newService NewService) {
+	cases := []struct {
+		name string
+		run  func(t *testing.T, service api.Service)
+	}{
+		{"InsertAndGet", testInsertAndGet},
+		{"ReplaceAndUpdate", testReplaceAndUpdate},
+		{"Delete", testDelete},
+		{"NotFound", testNotFound},
+		{"StaleVersion", testStaleVersion},
+		{"ListUnbounded", testListUnbounded},
+		{"ListPaged", testListPaged},
+		{"ListFiltered", testListFiltered},
+		{"ListSortedDescending", testListSortedDescending},
+		{"InvalidCursor", testInvalidCursor},
+		{"CancelledContext", testCancelledContext},
+		{"ConcurrentInserts", testConcurrentInserts},
+		{"ConcurrentVersionedWrites", testConcurrentVersionedWrites},
+		{"TenantIsolation", testTenantIsolation},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			c.run(t, newService(t))
+		})
+	}
+}
+
+func insert(t *testing.T, service api.Service, props api.AlbumPropertiesDTO) api.Album {
+	response := service.InsertAlbum(context.Background(), props)
+	require.Equal(t, http.StatusOK, response.Code, "insert failed: %v", response.Error)
+
+	return response.Body.Data.(api.Album)
+}
+
+func list(t *testing.T, service api.Service, query api.AlbumQueryDTO) ([]api.Album, string) {
+	response := service.GetAlbums(context.Background(), query)
+	require.Equal(t, http.StatusOK, response.Code, "list failed: %v", response.Error)
+
+	return response.Body.Data.([]api.Album), response.Body.Next
+}
+
+// listAll follows Next until the last page.
+func listAll(t *testing.T, service api.Service, query api.AlbumQueryDTO) ([]api.Album, int) {
+	albums := []api.Album{}
+	pages := 0
+	for {
+		page, next := list(t, service, query)
+		albums = append(albums, page...)
+		pages++
+		if next == "" {
+			return albums, pages
+		}
+
+		require.Less(t, pages, 100, "pagination does not terminate")
+		query.Cursor = next
+	}
+}
+
+func titles(albums []api.Album) []string {
+	result := make([]string, 0, len(albums))
+	for _, album := range albums {
+		result = append(result, album.Title)
+	}
+
+	return result
+}
+
+func testInsertAndGet(t *testing.T, service api.Service) {
+	props := api.AlbumPropertiesDTO{Title: "title 1", Artist: "artist 1", Price: 1.11}
+	album := insert(t, service, props)
+
+	assert.NotEmpty(t, album.Id)
+	assert.Equal(t, props.Title, album.Title)
+	assert.Equal(t, props.Artist, album.Artist)
+	assert.Equal(t, props.Price, album.Price)
+	assert.NotZero(t, album.TimeCreated)
+	assert.Equal(t, album.TimeCreated, album.TimeUpdated)
+	assert.Equal(t, int64(1), album.Version)
+
+	response := service.GetAlbumById(context.Background(), album.Id)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, album, response.Body.Data)
+}
+
+func testReplaceAndUpdate(t *testing.T, service api.Service) {
+	album := insert(t, service, api.AlbumPropertiesDTO{Title: "title 1", Artist: "artist 1", Price: 1.11})
+
+	response := service.ReplaceAlbum(context.Background(), album.Id, api.AlbumPropertiesDTO{Title: "title 2", Artist: "artist 2", Price: 2.22}, 0)
+	require.Equal(t, http.StatusOK, response.Code)
+	replaced := response.Body.Data.(api.Album)
+	assert.Equal(t, album.Id, replaced.Id)
+	assert.Equal(t, "title 2", replaced.Title)
+	assert.Equal(t, "artist 2", replaced.Artist)
+	assert.Equal(t, 2.22, replaced.Price)
+	assert.Equal(t, album.TimeCreated, replaced.TimeCreated)
+	assert.GreaterOrEqual(t, replaced.TimeUpdated, album.TimeUpdated)
+	assert.Equal(t, int64(2), replaced.Version)
+
+	// zero values in an update leave the stored fields alone
+	response = service.UpdateAlbum(context.Background(), album.Id, api.AlbumUpdatesDTO{Price: 3.33}, replaced.Version)
+	require.Equal(t, http.StatusOK, response.Code)
+	updated := response.Body.Data.(api.Album)
+	assert.Equal(t, "title 2", updated.Title)
+	assert.Equal(t, "artist 2", updated.Artist)
+	assert.Equal(t, 3.33, updated.Price)
+	assert.Equal(t, int64(3), updated.Version)
+
+	response = service.GetAlbumById(context.Background(), album.Id)
+	assert.Equal(t, updated, response.Body.Data)
+}
+
+func testDelete(t *testing.T, service api.Service) {
+	album := insert(t, service, api.AlbumPropertiesDTO{Title: "title 1", Artist: "artist 1", Price: 1.11})
+
+	response := service.DeleteAlbum(context.Background(), album.Id, album.Version)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	response = service.GetAlbumById(context.Background(), album.Id)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	response = service.DeleteAlbum(context.Background(), album.Id, 0)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+	assert.ErrorIs(t, response.Error, api.ErrAlbumNotFound)
+}
+
+func testNotFound(t *testing.T, service api.Service) {
+	props := api.AlbumPropertiesDTO{Title: "title 1", Artist: "artist 1", Price: 1.11}
+	ctx := context.Background()
+
+	for _, expectedVersion := range []int64{0, 1} {
+		responses := map[string]api.HandlerResponse{
+			"replace": service.ReplaceAlbum(ctx, "missing", props, expectedVersion),
+			"update":  service.UpdateAlbum(ctx, "missing", api.AlbumUpdatesDTO{Price: 1}, expectedVersion),
+			"delete":  service.DeleteAlbum(ctx, "missing", expectedVersion),
+		}
+		if expectedVersion == 0 {
+			responses["get"] = service.GetAlbumById(ctx, "missing")
+		}
+
+		for name, response := range responses {
+			msg := fmt.Sprintf("%s with version %d", name, expectedVersion)
+			assert.Equal(t, http.StatusNotFound, response.Code, msg)
+			assert.ErrorIs(t, response.Error, api.ErrAlbumNotFound, msg)
+		}
+	}
+
+	albums, _ := list(t, service, api.AlbumQueryDTO{})
+	assert.Empty(t, albums, "a write to a missing album must not create it")
+}
+
+func testStaleVersion(t *testing.T, service api.Service) {
+	props := api.AlbumPropertiesDTO{Title: "title 1", Artist: "artist 1", Price: 1.11}
+	album := insert(t, service, props)
+	ctx := context.Background()
+
+	responses := []api.HandlerResponse{
+		service.ReplaceAlbum(ctx, album.Id, props, 2),
+		service.UpdateAlbum(ctx, album.Id, api.AlbumUpdatesDTO{Price: 2.22}, 2),
+		service.DeleteAlbum(ctx, album.Id, 2),
+	}
+	for _, response := range responses {
+		assert.Equal(t, http.StatusPreconditionFailed, response.Code)
+		assert.True(t, api.IsKind(response.Error, api.KindPreconditionFailed))
+	}
+
+	response := service.GetAlbumById(ctx, album.Id)
+	assert.Equal(t, album, response.Body.Data, "a rejected write must leave the album untouched")
+}
+
+func testListUnbounded(t *testing.T, service api.Service) {
+	albums, next := list(t, service, api.AlbumQueryDTO{})
+	assert.Equal(t, []api.Album{}, albums)
+	assert.Empty(t, next)
+
+	for i := 0; i < 5; i++ {
+		insert(t, service, api.AlbumPropertiesDTO{Title: fmt.Sprintf("title %d", i), Artist: "artist", Price: 1.11})
+	}
+
+	albums, next = list(t, service, api.AlbumQueryDTO{})
+	assert.Len(t, albums, 5)
+	assert.Empty(t, next)
+}
+
+func testListPaged(t *testing.T, service api.Service) {
+	expected := []string{}
+	for i := 0; i < 7; i++ {
+		title := fmt.Sprintf("title %d", i)
+		insert(t, service, api.AlbumPropertiesDTO{Title: title, Artist: "artist", Price: 1.11})
+		expected = append(expected, title)
+	}
+
+	albums, pages := listAll(t, service, api.AlbumQueryDTO{Limit: 3, Sort: []api.SortField{{Field: "title"}}})
+	assert.Equal(t, expected, titles(albums))
+	assert.Equal(t, 3, pages)
+
+	// the default order pages through every album exactly once
+	albums, pages = listAll(t, service, api.AlbumQueryDTO{Limit: 3})
+	actual := titles(albums)
+	sort.Strings(actual)
+	assert.Equal(t, expected, actual)
+	assert.Equal(t, 3, pages)
+}
+
+func testListFiltered(t *testing.T, service api.Service) {
+	insert(t, service, api.AlbumPropertiesDTO{Title: "first song", Artist: "artist 1", Price: 1.11})
+	second := insert(t, service, api.AlbumPropertiesDTO{Title: "second song", Artist: "artist 1", Price: 5.55})
+	insert(t, service, api.AlbumPropertiesDTO{Title: "third song", Artist: "artist 2", Price: 5.55})
+	insert(t, service, api.AlbumPropertiesDTO{Title: "Second Song", Artist: "artist 1", Price: 5.55})
+	insert(t, service, api.AlbumPropertiesDTO{Title: "song (live).", Artist: "artist 1", Price: 9.99})
+
+	query := api.AlbumQueryDTO{Artist: "artist 1", TitleContains: "song", MinPrice: 5.55, MaxPrice: 5.55}
+	albums, _ := list(t, service, query)
+	assert.Equal(t, []string{"second song"}, titles(albums), "title match is case sensitive and prices are inclusive")
+
+	albums, _ = list(t, service, api.AlbumQueryDTO{TitleContains: "(live)."})
+	assert.Equal(t, []string{"song (live)."}, titles(albums), "title match is literal")
+
+	albums, _ = list(t, service, api.AlbumQueryDTO{Artist: "artist 1", Limit: 1})
+	assert.Len(t, albums, 1)
+
+	albums, _ = listAll(t, service, api.AlbumQueryDTO{CreatedAfter: second.TimeCreated})
+	for _, album := range albums {
+		assert.Greater(t, album.TimeCreated, second.TimeCreated)
+	}
+
+	albums, _ = list(t, service, api.AlbumQueryDTO{Artist: "nobody"})
+	assert.Equal(t, []api.Album{}, albums)
+}
+
+func testListSortedDescending(t *testing.T, service api.Service) {
+	insert(t, service, api.AlbumPropertiesDTO{Title: "title 1", Artist: "artist 1", Price: 3.33})
+	insert(t, service, api.AlbumPropertiesDTO{Title: "title 2", Artist: "artist 1", Price: 1.11})
+	insert(t, service, api.AlbumPropertiesDTO{Title: "title 3", Artist: "artist 1", Price: 3.33})
+	insert(t, service, api.AlbumPropertiesDTO{Title: "title 4", Artist: "artist 1", Price: 2.22})
+
+	sortFields := []api.SortField{{Field: "price", Descending: true}, {Field: "title"}}
+	albums, _ := listAll(t, service, api.AlbumQueryDTO{Limit: 1, Sort: sortFields})
+	assert.Equal(t, []string{"title 1", "title 3", "title 4", "title 2"}, titles(albums))
+
+	albums, _ = listAll(t, service, api.AlbumQueryDTO{Limit: 3, Artist: "artist 1", Sort: []api.SortField{{Field: "timeCreated", Descending: true}}})
+	assert.Len(t, albums, 4)
+	for i := 1; i < len(albums); i++ {
+		assert.GreaterOrEqual(t, albums[i-1].TimeCreated, albums[i].TimeCreated)
+	}
+}
+
+func testInvalidCursor(t *testing.T, service api.Service) {
+	for i := 0; i < 3; i++ {
+		insert(t, service, api.AlbumPropertiesDTO{Title: fmt.Sprintf("title %d", i), Artist: "artist", Price: 1.11})
+	}
+
+	response := service.GetAlbums(context.Background(), api.AlbumQueryDTO{Limit: 1, Cursor: "not a cursor"})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	assert.True(t, api.IsKind(response.Error, api.KindValidationFailed))
+
+	_, next := list(t, service, api.AlbumQueryDTO{Limit: 1, Sort: []api.SortField{{Field: "title"}}})
+	require.NotEmpty(t, next)
+	response = service.GetAlbums(context.Background(), api.AlbumQueryDTO{Limit: 1, Cursor: next, Sort: []api.SortField{{Field: "price"}}})
+	assert.Equal(t, http.StatusBadRequest, response.Code, "a cursor only continues the order it was issued for")
+
+	_, next = list(t, service, api.AlbumQueryDTO{Limit: 1, Sort: []api.SortField{{Field: "timeCreated"}}})
+	require.NotEmpty(t, next)
+	response = service.GetAlbums(context.Background(), api.AlbumQueryDTO{Limit: 1, Cursor: next, Sort: []api.SortField{{Field: "timeCreated", Descending: true}}})
+	assert.Equal(t, http.StatusBadRequest, response.Code, "a cursor only continues the order it was issued for")
+
+	_, next = list(t, service, api.AlbumQueryDTO{Limit: 1, Artist: "artist"})
+	require.NotEmpty(t, next)
+	response = service.GetAlbums(context.Background(), api.AlbumQueryDTO{Limit: 1, Cursor: next, Artist: "artist", Sort: []api.SortField{{Field: "timeCreated", Descending: true}}})
+	assert.Equal(t, http.StatusBadRequest, response.Code, "a cursor only continues the order it was issued for")
+}
+
+func testCancelledContext(t *testing.T, service api.Service) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	response := service.GetAlbums(ctx, api.AlbumQueryDTO{})
+	assert.Equal(t, api.StatusClientClosedRequest, response.Code)
+	assert.True(t, api.IsKind(response.Error, api.KindRequestCancelled))
+
+	response = service.InsertAlbum(ctx, api.AlbumPropertiesDTO{Title: "title 1", Artist: "artist 1", Price: 1.11})
+	assert.Equal(t, api.StatusClientClosedRequest, response.Code)
+}
+
+func testConcurrentInserts(t *testing.T, service api.Service) {
+	const count = 20
+	var wg sync.WaitGroup
+	responses := make([]api.HandlerResponse, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			props := api.AlbumPropertiesDTO{Title: fmt.Sprintf("title %d", i), Artist: "artist", Price: 1.11}
+			responses[i] = service.InsertAlbum(context.Background(), props)
+		}(i)
+	}
+	wg.Wait()
+
+	ids := map[string]bool{}
+	for _, response := range responses {
+		require.Equal(t, http.StatusOK, response.Code, "insert failed: %v", response.Error)
+		ids[response.Body.Data.(api.Album).Id] = true
+	}
+	assert.Len(t, ids, count)
+
+	albums, _ := list(t, service, api.AlbumQueryDTO{})
+	assert.Len(t, albums, count)
+}
+
+func testConcurrentVersionedWrites(t *testing.T, service api.Service) {
+	album := insert(t, service, api.AlbumPropertiesDTO{Title: "title 1", Artist: "artist 1", Price: 1.11})
+
+	const writers = 10
+	var wg sync.WaitGroup
+	codes := make([]int, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			updates := api.AlbumUpdatesDTO{Title: fmt.Sprintf("title %d", i+2)}
+			codes[i] = service.UpdateAlbum(context.Background(), album.Id, updates, album.Version).Code
+		}(i)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for _, code := range codes {
+		if code == http.StatusOK {
+			succeeded++
+		} else {
+			assert.Equal(t, http.StatusPreconditionFailed, code)
+		}
+	}
+	assert.Equal(t, 1, succeeded, "exactly one writer holding the same version wins")
+
+	response := service.GetAlbumById(context.Background(), album.Id)
+	assert.Equal(t, album.Version+1, response.Body.Data.(api.Album).Version)
+}
+
+func testTenantIsolation(t *testing.T, service api.Service) {
+	props := api.AlbumPropertiesDTO{Title: "title 1", Artist: "artist 1", Price: 1.11}
+	owner := api.ContextWithTenant(context.Background(), "tenant-a")
+	response := service.InsertAlbum(owner, props)
+	require.Equal(t, http.StatusOK, response.Code, "insert failed: %v", response.Error)
+	album := response.Body.Data.(api.Album)
+	assert.Equal(t, props.Artist, album.Artist)
+
+	for _, tenant := range []string{"", "tenant-b"} {
+		ctx := api.ContextWithTenant(context.Background(), tenant)
+		responses := map[string]api.HandlerResponse{
+			"get":     service.GetAlbumById(ctx, album.Id),
+			"replace": service.ReplaceAlbum(ctx, album.Id, props, 0),
+			"update":  service.UpdateAlbum(ctx, album.Id, api.AlbumUpdatesDTO{Price: 2.22}, 0),
+			"delete":  service.DeleteAlbum(ctx, album.Id, album.Version),
+		}
+		for name, response := range responses {
+			assert.Equal(t, http.StatusNotFound, response.Code, "%s from tenant %q", name, tenant)
+		}
+
+		for _, query := range []api.AlbumQueryDTO{{}, {Artist: props.Artist}} {
+			response := service.GetAlbums(ctx, query)
+			require.Equal(t, http.StatusOK, response.Code, "list failed: %v", response.Error)
+			assert.Empty(t, response.Body.Data, "albums of tenant-a listed for tenant %q", tenant)
+		}
+	}
+
+	response = service.GetAlbumById(owner, album.Id)
+	assert.Equal(t, album, response.Body.Data, "other tenants must leave the album untouched")
+
+	response = service.GetAlbums(owner, api.AlbumQueryDTO{Artist: props.Artist})
+	assert.Equal(t, []api.Album{album}, response.Body.Data)
+}
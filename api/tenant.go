@@ -0,0 +1,18 @@
+package api
+
+import "context"
+
+type tenantKey struct{}
+
+// ContextWithTenant returns a copy of ctx scoped to tenant.
+func ContextWithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant every Service call made with ctx is
+// scoped to. It is empty when multi-tenancy is off, which backends treat as a
+// tenant of its own.
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
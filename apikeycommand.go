@@ -0,0 +1,111 @@
+package main
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"andrewsaputra/go-rest-sample/internal"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const apiKeyUsage = "usage: apikey issue -subject name [-scopes albums:read,albums:write] [-roles editor] [-tenant name] [-not-before time] [-expires-in duration] | rotate -id id [-overlap duration] | revoke -id id"
+
+// RunApiKeyCommand manages the API keys kept in the configured backend:
+//
+//	apikey issue -subject billing -scopes albums:read,albums:write -roles editor -expires-in 2160h
+//	apikey rotate -id <id> -overlap 24h
+//	apikey revoke -id <id>
+//
+// New keys are written to out, they can't be shown again.
+func RunApiKeyCommand(ctx context.Context, config api.AppConfig, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(apiKeyUsage)
+	}
+	if config.DbType == "inmemory" {
+		return errors.New("the inmemory backend doesn't keep api keys across processes, pick another dbType")
+	}
+
+	flags := flag.NewFlagSet("apikey "+args[0], flag.ContinueOnError)
+	flags.SetOutput(out)
+	id := flags.String("id", "", "id of the key to rotate or revoke")
+	subject := flags.String("subject", "", "caller the key is issued to")
+	scopes := flags.String("scopes", internal.ScopeAlbumsRead, "comma separated scopes of the key")
+	roles := flags.String("roles", "", "comma separated access policy roles of the key")
+	tenant := flags.String("tenant", "", "tenant the key is bound to")
+	notBefore := flags.String("not-before", "", "RFC 3339 time the key becomes valid, defaults to now")
+	expiresIn := flags.Duration("expires-in", 0, "lifetime of the key, 0 never expires")
+	overlap := flags.Duration("overlap", 24*time.Hour, "how long a rotated key stays valid next to its replacement")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	service, err := InitService(config, internal.NewXidGenerator())
+	if err != nil {
+		return err
+	}
+	defer service.Close(context.Background())
+
+	store, err := InitApiKeyStore(config, service)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "issue":
+		if *subject == "" {
+			return errors.New("-subject is required")
+		}
+		if *tenant == "" && config.TenancyConfig.Enabled {
+			return errors.New("-tenant is required when tenancy is enabled")
+		}
+		grant := api.ApiKey{Subject: *subject, Scopes: splitList(*scopes), Roles: splitList(*roles), Tenant: *tenant}
+		if *notBefore != "" {
+			if grant.NotBefore, err = time.Parse(time.RFC3339, *notBefore); err != nil {
+				return fmt.Errorf("-not-before: %w", err)
+			}
+		}
+		if *expiresIn > 0 {
+			grant.ExpiresAt = time.Now().Add(*expiresIn)
+		}
+		plain, key, err := internal.IssueApiKey(ctx, store, internal.NewXidGenerator(), grant)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "id: %s\nkey: %s\n", key.Id, plain)
+	case "rotate":
+		if *id == "" {
+			return errors.New("-id is required")
+		}
+		plain, key, err := internal.RotateApiKey(ctx, store, internal.NewXidGenerator(), *id, *overlap)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "id: %s\nkey: %s\n%s stays valid for %s\n", key.Id, plain, *id, *overlap)
+	case "revoke":
+		if *id == "" {
+			return errors.New("-id is required")
+		}
+		if err := internal.RevokeApiKey(ctx, store, *id); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "revoked %s\n", *id)
+	default:
+		return errors.New(apiKeyUsage)
+	}
+
+	return nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,28 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"strings"
+)
+
+// matchesQuery reports whether album satisfies every filter set on query,
+// for backends that filter in process.
+func matchesQuery(album api.Album, query api.AlbumQueryDTO) bool {
+	if query.Artist != "" && album.Artist != query.Artist {
+		return false
+	}
+	if query.TitleContains != "" && !strings.Contains(album.Title, query.TitleContains) {
+		return false
+	}
+	if query.MinPrice > 0 && album.Price < query.MinPrice {
+		return false
+	}
+	if query.MaxPrice > 0 && album.Price > query.MaxPrice {
+		return false
+	}
+	if query.CreatedAfter > 0 && album.TimeCreated <= query.CreatedAfter {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"sort"
+	"strings"
+)
+
+// albumSortKey maps a sortable api field onto each backend's representation.
+type albumSortKey struct {
+	MongoField string
+	SqlColumn  string
+	Compare    func(a, b api.Album) int
+	Value      func(album api.Album) any
+	// FromCursor restores a Value that has been through a JSON encoded cursor
+	FromCursor func(raw any) (any, bool)
+}
+
+var albumSortKeys = map[string]albumSortKey{
+	"title": {
+		MongoField: "title",
+		SqlColumn:  "title",
+		Compare:    func(a, b api.Album) int { return strings.Compare(a.Title, b.Title) },
+		Value:      func(album api.Album) any { return album.Title },
+		FromCursor: stringCursorValue,
+	},
+	"artist": {
+		MongoField: "artist",
+		SqlColumn:  "artist",
+		Compare:    func(a, b api.Album) int { return strings.Compare(a.Artist, b.Artist) },
+		Value:      func(album api.Album) any { return album.Artist },
+		FromCursor: stringCursorValue,
+	},
+	"price": {
+		MongoField: "price",
+		SqlColumn:  "price",
+		Compare:    func(a, b api.Album) int { return compareOrdered(a.Price, b.Price) },
+		Value:      func(album api.Album) any { return album.Price },
+		FromCursor: float64CursorValue,
+	},
+	"timeCreated": {
+		MongoField: "timecreated",
+		SqlColumn:  "time_created",
+		Compare:    func(a, b api.Album) int { return compareOrdered(a.TimeCreated, b.TimeCreated) },
+		Value:      func(album api.Album) any { return album.TimeCreated },
+		FromCursor: int64CursorValue,
+	},
+}
+
+// resolveSort falls back to the default order for an unsorted query.
+func resolveSort(fields []api.SortField) []api.SortField {
+	if len(fields) == 0 {
+		return api.DefaultAlbumSort
+	}
+
+	return fields
+}
+
+// sortAlbums orders albums in place by fields, breaking ties by ascending Id.
+func sortAlbums(albums []api.Album, fields []api.SortField) {
+	fields = resolveSort(fields)
+	sort.SliceStable(albums, func(i, j int) bool {
+		for _, field := range fields {
+			cmp := albumSortKeys[field.Field].Compare(albums[i], albums[j])
+			if field.Descending {
+				cmp = -cmp
+			}
+			if cmp != 0 {
+				return cmp < 0
+			}
+		}
+
+		return albums[i].Id < albums[j].Id
+	})
+}
+
+func stringCursorValue(raw any) (any, bool) {
+	value, ok := raw.(string)
+	return value, ok
+}
+
+func float64CursorValue(raw any) (any, bool) {
+	value, ok := raw.(float64)
+	return value, ok
+}
+
+func int64CursorValue(raw any) (any, bool) {
+	value, ok := raw.(float64)
+	if !ok || value != float64(int64(value)) {
+		return nil, false
+	}
+
+	return int64(value), true
+}
+
+func compareOrdered[T int64 | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// sortSignature identifies an order so cursors can't be replayed against a different one.
+func sortSignature(fields []api.SortField) string {
+	parts := make([]string, 0, len(fields))
+	for _, field := range resolveSort(fields) {
+		if field.Descending {
+			parts = append(parts, "-"+field.Field)
+		} else {
+			parts = append(parts, field.Field)
+		}
+	}
+
+	return strings.Join(parts, ",")
+}
@@ -7,97 +7,217 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func NewApiHandler(service api.Service) *ApiHandler {
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+func NewApiHandler(service api.Service, config api.AppConfig) *ApiHandler {
 	var propsFields []string
 	for _, field := range reflect.VisibleFields(reflect.TypeOf(api.AlbumPropertiesDTO{})) {
 		propsFields = append(propsFields, field.Name)
 	}
 
+	tenantPagination := map[string]api.PaginationConfig{}
+	for tenant, override := range config.TenancyConfig.Tenants {
+		if override.PaginationConfig != nil {
+			tenantPagination[tenant] = normalizePagination(*override.PaginationConfig)
+		}
+	}
+
+	validate := validator.New(validator.WithRequiredStructEnabled())
+	validate.RegisterTagNameFunc(requestFieldName)
+
 	return &ApiHandler{
 		Service:          service,
-		Validator:        validator.New(validator.WithRequiredStructEnabled()),
+		Validator:        validate,
 		AlbumPropsFields: propsFields,
+		Pagination:       normalizePagination(config.PaginationConfig),
+		TenantPagination: tenantPagination,
+	}
+}
+
+func normalizePagination(pagination api.PaginationConfig) api.PaginationConfig {
+	if pagination.MaxPageSize <= 0 {
+		pagination.MaxPageSize = maxPageSize
+	}
+	if pagination.DefaultPageSize <= 0 {
+		pagination.DefaultPageSize = defaultPageSize
 	}
+	if pagination.DefaultPageSize > pagination.MaxPageSize {
+		pagination.DefaultPageSize = pagination.MaxPageSize
+	}
+	return pagination
 }
 
 type ApiHandler struct {
 	Service          api.Service
 	Validator        *validator.Validate
 	AlbumPropsFields []string
+	Pagination       api.PaginationConfig
+	TenantPagination map[string]api.PaginationConfig
 }
 
 func (this *ApiHandler) GetAlbums(c *gin.Context) {
-	resp := this.Service.GetAlbums()
+	span := this.startSpan(c, "GetAlbums")
+	defer span.End()
+
+	var query api.AlbumQueryDTO
+	if err := c.ShouldBindQuery(&query); err != nil {
+		this.HandleResponse(c, requestError(err).Response())
+		return
+	}
+
+	if err := this.Validator.Struct(query); err != nil {
+		this.HandleResponse(c, requestError(err).Response())
+		return
+	}
+
+	sortFields, err := api.ParseAlbumSort(c.Query("sort"))
+	if err != nil {
+		this.HandleResponse(c, fieldError("sort", "sort", err.Error(), err).Response())
+		return
+	}
+	query.Sort = sortFields
+
+	pagination, found := this.TenantPagination[api.TenantFromContext(c.Request.Context())]
+	if !found {
+		pagination = this.Pagination
+	}
+	switch {
+	case query.Limit == 0:
+		query.Limit = pagination.DefaultPageSize
+	case query.Limit > pagination.MaxPageSize:
+		query.Limit = pagination.MaxPageSize
+	}
+
+	resp := this.Service.GetAlbums(c.Request.Context(), query)
 	this.HandleResponse(c, resp)
 }
 
 func (this *ApiHandler) GetAlbumById(c *gin.Context) {
+	span := this.startSpan(c, "GetAlbumById")
+	defer span.End()
+
 	id := c.Param("id")
-	resp := this.Service.GetAlbumById(id)
+	resp := this.Service.GetAlbumById(c.Request.Context(), id)
 	this.HandleResponse(c, resp)
 }
 
 func (this *ApiHandler) InsertAlbum(c *gin.Context) {
+	span := this.startSpan(c, "InsertAlbum")
+	defer span.End()
+
 	var props api.AlbumPropertiesDTO
-	if err := c.BindJSON(&props); err != nil {
-		this.HandleResponse(c, api.HandlerResponse{Code: http.StatusBadRequest, Error: err})
+	if err := c.ShouldBindJSON(&props); err != nil {
+		this.HandleResponse(c, requestError(err).Response())
 		return
 	}
 
 	if err := this.Validator.Struct(props); err != nil {
-		this.HandleResponse(c, api.HandlerResponse{Code: http.StatusBadRequest, Error: err})
+		this.HandleResponse(c, requestError(err).Response())
 		return
 	}
 
-	resp := this.Service.InsertAlbum(props)
+	resp := this.Service.InsertAlbum(c.Request.Context(), props)
 	this.HandleResponse(c, resp)
 }
 
 func (this *ApiHandler) ReplaceAlbum(c *gin.Context) {
+	span := this.startSpan(c, "ReplaceAlbum")
+	defer span.End()
+
 	id := c.Param("id")
+	expectedVersion, ok := parseIfMatch(c.GetHeader("If-Match"))
+	if !ok {
+		this.HandleResponse(c, versionMismatchResponse())
+		return
+	}
+
 	var props api.AlbumPropertiesDTO
-	if err := c.BindJSON(&props); err != nil {
-		this.HandleResponse(c, api.HandlerResponse{Code: http.StatusBadRequest, Error: err})
+	if err := c.ShouldBindJSON(&props); err != nil {
+		this.HandleResponse(c, requestError(err).Response())
 		return
 	}
 
 	if err := this.Validator.Struct(props); err != nil {
-		this.HandleResponse(c, api.HandlerResponse{Code: http.StatusBadRequest, Error: err})
+		this.HandleResponse(c, requestError(err).Response())
 		return
 	}
 
-	resp := this.Service.ReplaceAlbum(id, props)
+	resp := this.Service.ReplaceAlbum(c.Request.Context(), id, props, expectedVersion)
 	this.HandleResponse(c, resp)
 }
 
 func (this *ApiHandler) UpdateAlbum(c *gin.Context) {
+	span := this.startSpan(c, "UpdateAlbum")
+	defer span.End()
+
 	id := c.Param("id")
+	expectedVersion, ok := parseIfMatch(c.GetHeader("If-Match"))
+	if !ok {
+		this.HandleResponse(c, versionMismatchResponse())
+		return
+	}
+
 	var updates api.AlbumUpdatesDTO
-	if err := c.BindJSON(&updates); err != nil {
-		this.HandleResponse(c, api.HandlerResponse{Code: http.StatusBadRequest, Error: err})
+	if err := c.ShouldBindJSON(&updates); err != nil {
+		this.HandleResponse(c, requestError(err).Response())
 		return
 	}
 
 	if err := this.Validator.Struct(updates); err != nil {
-		this.HandleResponse(c, api.HandlerResponse{Code: http.StatusBadRequest, Error: err})
+		this.HandleResponse(c, requestError(err).Response())
 		return
 	}
 
-	resp := this.Service.UpdateAlbum(id, updates)
+	resp := this.Service.UpdateAlbum(c.Request.Context(), id, updates, expectedVersion)
 	this.HandleResponse(c, resp)
 }
 
 func (this *ApiHandler) DeleteAlbum(c *gin.Context) {
+	span := this.startSpan(c, "DeleteAlbum")
+	defer span.End()
+
 	id := c.Param("id")
-	resp := this.Service.DeleteAlbum(id)
+	expectedVersion, ok := parseIfMatch(c.GetHeader("If-Match"))
+	if !ok {
+		this.HandleResponse(c, versionMismatchResponse())
+		return
+	}
+
+	resp := this.Service.DeleteAlbum(c.Request.Context(), id, expectedVersion)
 	this.HandleResponse(c, resp)
 }
 
+// startSpan starts the span of an ApiHandler method as a child of the request span.
+func (this *ApiHandler) startSpan(c *gin.Context, method string) trace.Span {
+	ctx, span := startSpan(c.Request.Context(), "ApiHandler."+method)
+	c.Request = c.Request.WithContext(ctx)
+	return span
+}
+
 func (this *ApiHandler) HandleResponse(c *gin.Context, resp api.HandlerResponse) {
+	recordResponse(trace.SpanFromContext(c.Request.Context()), resp)
 	if resp.Error != nil {
-		c.JSON(resp.Code, gin.H{"message": resp.Error.Error()})
+		writeProblem(c, resp.Code, resp.Error)
+		return
+	}
+
+	etag, lastModified := responseValidators(resp.Body)
+	if etag != "" {
+		c.Header("ETag", etag)
+	}
+	if !lastModified.IsZero() {
+		c.Header("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if c.Request.Method == http.MethodGet && resp.Code == http.StatusOK && isNotModified(c.Request, etag, lastModified) {
+		c.Status(http.StatusNotModified)
+		c.Writer.WriteHeaderNow()
 		return
 	}
 
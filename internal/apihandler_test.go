@@ -3,12 +3,14 @@ package internal
 import (
 	"andrewsaputra/go-rest-sample/api"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
@@ -17,8 +19,10 @@ import (
 
 func TestHandlerGetAlbums_ServiceReturnOK_ReturnOK(t *testing.T) {
 	handler, service, ginContext, respWriter := InitHandlerWithMocks()
+	ginContext.Request, _ = http.NewRequest(http.MethodGet, "/", nil)
+
 	expectedResponse := api.HandlerResponse{Code: http.StatusOK, Body: api.ResponseBody{Message: "message"}}
-	service.On("GetAlbums").Return(expectedResponse)
+	service.On("GetAlbums", mock.Anything, mock.Anything).Return(expectedResponse)
 
 	handler.GetAlbums(ginContext)
 
@@ -32,23 +36,103 @@ func TestHandlerGetAlbums_ServiceReturnOK_ReturnOK(t *testing.T) {
 
 func TestHandlerGetAlbums_ServiceReturnError_ReturnError(t *testing.T) {
 	handler, service, ginContext, respWriter := InitHandlerWithMocks()
-	expectedResponse := api.HandlerResponse{Code: http.StatusNotFound, Error: errors.New("sample error")}
-	service.On("GetAlbums").Return(expectedResponse)
+	ginContext.Request, _ = http.NewRequest(http.MethodGet, "/", nil)
+
+	expectedResponse := api.HandlerResponse{Code: http.StatusNotFound, Error: api.ErrAlbumNotFound}
+	service.On("GetAlbums", mock.Anything, mock.Anything).Return(expectedResponse)
 
 	handler.GetAlbums(ginContext)
 
-	var respBody api.ResponseBody
+	var respBody api.Problem
 	json.Unmarshal(respWriter.Body.Bytes(), &respBody)
 
 	service.AssertNumberOfCalls(t, "GetAlbums", 1)
 	assert.Equal(t, expectedResponse.Code, respWriter.Code)
-	assert.Equal(t, expectedResponse.Error.Error(), respBody.Message)
+	assert.Equal(t, api.ProblemContentType, respWriter.Header().Get("Content-Type"))
+	assert.Equal(t, api.KindNotFound.Type, respBody.Type)
+	assert.Equal(t, expectedResponse.Error.Error(), respBody.Detail)
+}
+
+func TestHandlerGetAlbums_PageLimits_ResolvedBeforeServiceCall(t *testing.T) {
+	handler, service, ginContext, _ := InitHandlerWithMocks()
+	expectedResponse := api.HandlerResponse{Code: http.StatusOK, Body: api.ResponseBody{Message: "message"}}
+	service.On("GetAlbums", mock.Anything, mock.Anything).Return(expectedResponse)
+
+	ginContext.Request, _ = http.NewRequest(http.MethodGet, "/?cursor=abc", nil)
+	handler.GetAlbums(ginContext)
+	service.AssertCalled(t, "GetAlbums", mock.Anything, api.AlbumQueryDTO{Limit: defaultPageSize, Cursor: "abc", Sort: api.DefaultAlbumSort})
+
+	ginContext.Request, _ = http.NewRequest(http.MethodGet, "/?limit=1000", nil)
+	handler.GetAlbums(ginContext)
+	service.AssertCalled(t, "GetAlbums", mock.Anything, api.AlbumQueryDTO{Limit: maxPageSize, Sort: api.DefaultAlbumSort})
+}
+
+func TestHandlerGetAlbums_FilterParams_PassedToService(t *testing.T) {
+	handler, service, ginContext, respWriter := InitHandlerWithMocks()
+	expectedResponse := api.HandlerResponse{Code: http.StatusOK, Body: api.ResponseBody{Message: "message"}}
+	service.On("GetAlbums", mock.Anything, mock.Anything).Return(expectedResponse)
+
+	ginContext.Request, _ = http.NewRequest(http.MethodGet, "/?artist=singer&titleContains=song&minPrice=1.5&maxPrice=9.99&createdAfter=1700000000000", nil)
+	handler.GetAlbums(ginContext)
+
+	assert.Equal(t, http.StatusOK, respWriter.Code)
+	service.AssertCalled(t, "GetAlbums", mock.Anything, api.AlbumQueryDTO{
+		Limit:         defaultPageSize,
+		Artist:        "singer",
+		TitleContains: "song",
+		MinPrice:      1.5,
+		MaxPrice:      9.99,
+		CreatedAfter:  1700000000000,
+		Sort:          api.DefaultAlbumSort,
+	})
+}
+
+func TestHandlerGetAlbums_SortParam_PassedToService(t *testing.T) {
+	handler, service, ginContext, _ := InitHandlerWithMocks()
+	expectedResponse := api.HandlerResponse{Code: http.StatusOK, Body: api.ResponseBody{Message: "message"}}
+	service.On("GetAlbums", mock.Anything, mock.Anything).Return(expectedResponse)
+
+	ginContext.Request, _ = http.NewRequest(http.MethodGet, "/?sort=price,-timeCreated", nil)
+	handler.GetAlbums(ginContext)
+
+	service.AssertCalled(t, "GetAlbums", mock.Anything, api.AlbumQueryDTO{
+		Limit: defaultPageSize,
+		Sort:  []api.SortField{{Field: "price"}, {Field: "timeCreated", Descending: true}},
+	})
+}
+
+func TestHandlerGetAlbums_InvalidQuery_ReturnBadRequest(t *testing.T) {
+	handler, service, ginContext, respWriter := InitHandlerWithMocks()
+
+	ginContext.Request, _ = http.NewRequest(http.MethodGet, "/?limit=-1", nil)
+	handler.GetAlbums(ginContext)
+	assert.Equal(t, http.StatusBadRequest, respWriter.Code)
+
+	ginContext.Request, _ = http.NewRequest(http.MethodGet, "/?limit=abc", nil)
+	handler.GetAlbums(ginContext)
+	assert.Equal(t, http.StatusBadRequest, respWriter.Code)
+
+	ginContext.Request, _ = http.NewRequest(http.MethodGet, "/?minPrice=10&maxPrice=5", nil)
+	handler.GetAlbums(ginContext)
+	assert.Equal(t, http.StatusBadRequest, respWriter.Code)
+
+	ginContext.Request, _ = http.NewRequest(http.MethodGet, "/?createdAfter=-1", nil)
+	handler.GetAlbums(ginContext)
+	assert.Equal(t, http.StatusBadRequest, respWriter.Code)
+
+	ginContext.Request, _ = http.NewRequest(http.MethodGet, "/?sort=id", nil)
+	handler.GetAlbums(ginContext)
+	assert.Equal(t, http.StatusBadRequest, respWriter.Code)
+
+	service.AssertNumberOfCalls(t, "GetAlbums", 0)
 }
 
 func TestHandlerGetAlbumById_ServiceReturnOK_ReturnOK(t *testing.T) {
 	handler, service, ginContext, respWriter := InitHandlerWithMocks()
+	ginContext.Request, _ = http.NewRequest(http.MethodGet, "/", nil)
+
 	expectedResponse := api.HandlerResponse{Code: http.StatusOK, Body: api.ResponseBody{Message: "message"}}
-	service.On("GetAlbumById", mock.Anything).Return(expectedResponse)
+	service.On("GetAlbumById", mock.Anything, mock.Anything).Return(expectedResponse)
 
 	handler.GetAlbumById(ginContext)
 
@@ -62,17 +146,21 @@ func TestHandlerGetAlbumById_ServiceReturnOK_ReturnOK(t *testing.T) {
 
 func TestHandlerGetAlbumById_ServiceReturnError_ReturnError(t *testing.T) {
 	handler, service, ginContext, respWriter := InitHandlerWithMocks()
-	expectedResponse := api.HandlerResponse{Code: http.StatusNotFound, Error: errors.New("sample error")}
-	service.On("GetAlbumById", mock.Anything).Return(expectedResponse)
+	ginContext.Request, _ = http.NewRequest(http.MethodGet, "/", nil)
+
+	expectedResponse := api.HandlerResponse{Code: http.StatusNotFound, Error: api.ErrAlbumNotFound}
+	service.On("GetAlbumById", mock.Anything, mock.Anything).Return(expectedResponse)
 
 	handler.GetAlbumById(ginContext)
 
-	var respBody api.ResponseBody
+	var respBody api.Problem
 	json.Unmarshal(respWriter.Body.Bytes(), &respBody)
 
 	service.AssertNumberOfCalls(t, "GetAlbumById", 1)
 	assert.Equal(t, expectedResponse.Code, respWriter.Code)
-	assert.Equal(t, expectedResponse.Error.Error(), respBody.Message)
+	assert.Equal(t, api.ProblemContentType, respWriter.Header().Get("Content-Type"))
+	assert.Equal(t, api.KindNotFound.Type, respBody.Type)
+	assert.Equal(t, expectedResponse.Error.Error(), respBody.Detail)
 
 }
 
@@ -82,7 +170,7 @@ func TestHandlerInsertAlbum_ServiceReturnOK_ReturnOK(t *testing.T) {
 	ginContext.Request, _ = http.NewRequest(http.MethodPost, "/", io.NopCloser(bytes.NewReader(requestDto)))
 
 	expectedResponse := api.HandlerResponse{Code: http.StatusOK, Body: api.ResponseBody{Message: "message"}}
-	service.On("InsertAlbum", mock.Anything).Return(expectedResponse)
+	service.On("InsertAlbum", mock.Anything, mock.Anything).Return(expectedResponse)
 
 	handler.InsertAlbum(ginContext)
 
@@ -99,17 +187,19 @@ func TestHandlerInsertAlbum_ServiceReturnError_ReturnError(t *testing.T) {
 	requestDto, _ := json.Marshal(api.AlbumPropertiesDTO{Title: "title", Artist: "artist", Price: 9.99})
 	ginContext.Request, _ = http.NewRequest(http.MethodPost, "/", io.NopCloser(bytes.NewReader(requestDto)))
 
-	expectedResponse := api.HandlerResponse{Code: http.StatusNotFound, Error: errors.New("sample error")}
-	service.On("InsertAlbum", mock.Anything).Return(expectedResponse)
+	expectedResponse := api.HandlerResponse{Code: http.StatusNotFound, Error: api.ErrAlbumNotFound}
+	service.On("InsertAlbum", mock.Anything, mock.Anything).Return(expectedResponse)
 
 	handler.InsertAlbum(ginContext)
 
-	var respBody api.ResponseBody
+	var respBody api.Problem
 	json.Unmarshal(respWriter.Body.Bytes(), &respBody)
 
 	service.AssertNumberOfCalls(t, "InsertAlbum", 1)
 	assert.Equal(t, expectedResponse.Code, respWriter.Code)
-	assert.Equal(t, expectedResponse.Error.Error(), respBody.Message)
+	assert.Equal(t, api.ProblemContentType, respWriter.Header().Get("Content-Type"))
+	assert.Equal(t, api.KindNotFound.Type, respBody.Type)
+	assert.Equal(t, expectedResponse.Error.Error(), respBody.Detail)
 }
 
 func TestHandlerInsertAlbum_InvalidRequests_ReturnBadRequest(t *testing.T) {
@@ -163,7 +253,7 @@ func TestHandlerReplaceAlbum_ServiceReturnOK_ReturnOK(t *testing.T) {
 	ginContext.Request, _ = http.NewRequest(http.MethodPut, "/", io.NopCloser(bytes.NewReader(requestDto)))
 
 	expectedResponse := api.HandlerResponse{Code: http.StatusOK, Body: api.ResponseBody{Message: "message"}}
-	service.On("ReplaceAlbum", mock.Anything, mock.Anything).Return(expectedResponse)
+	service.On("ReplaceAlbum", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(expectedResponse)
 
 	handler.ReplaceAlbum(ginContext)
 
@@ -180,17 +270,19 @@ func TestHandlerReplaceAlbum_ServiceReturnError_ReturnError(t *testing.T) {
 	requestDto, _ := json.Marshal(api.AlbumPropertiesDTO{Title: "title", Artist: "artist", Price: 9.99})
 	ginContext.Request, _ = http.NewRequest(http.MethodPut, "/", io.NopCloser(bytes.NewReader(requestDto)))
 
-	expectedResponse := api.HandlerResponse{Code: http.StatusNotFound, Error: errors.New("sample error")}
-	service.On("ReplaceAlbum", mock.Anything, mock.Anything).Return(expectedResponse)
+	expectedResponse := api.HandlerResponse{Code: http.StatusNotFound, Error: api.ErrAlbumNotFound}
+	service.On("ReplaceAlbum", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(expectedResponse)
 
 	handler.ReplaceAlbum(ginContext)
 
-	var respBody api.ResponseBody
+	var respBody api.Problem
 	json.Unmarshal(respWriter.Body.Bytes(), &respBody)
 
 	service.AssertNumberOfCalls(t, "ReplaceAlbum", 1)
 	assert.Equal(t, expectedResponse.Code, respWriter.Code)
-	assert.Equal(t, expectedResponse.Error.Error(), respBody.Message)
+	assert.Equal(t, api.ProblemContentType, respWriter.Header().Get("Content-Type"))
+	assert.Equal(t, api.KindNotFound.Type, respBody.Type)
+	assert.Equal(t, expectedResponse.Error.Error(), respBody.Detail)
 }
 
 func TestHandlerReplaceAlbum_InvalidRequests_ReturnBadRequest(t *testing.T) {
@@ -244,7 +336,7 @@ func TestHandlerUpdateAlbum_ServiceReturnOK_ReturnOK(t *testing.T) {
 	ginContext.Request, _ = http.NewRequest(http.MethodPatch, "/", io.NopCloser(bytes.NewReader(requestDto)))
 
 	expectedResponse := api.HandlerResponse{Code: http.StatusOK, Body: api.ResponseBody{Message: "message"}}
-	service.On("UpdateAlbum", mock.Anything, mock.Anything).Return(expectedResponse)
+	service.On("UpdateAlbum", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(expectedResponse)
 
 	handler.UpdateAlbum(ginContext)
 
@@ -261,17 +353,19 @@ func TestHandlerUpdateAlbum_ServiceReturnError_ReturnError(t *testing.T) {
 	requestDto, _ := json.Marshal(api.AlbumUpdatesDTO{Title: "title", Artist: "artist", Price: 9.99})
 	ginContext.Request, _ = http.NewRequest(http.MethodPatch, "/", io.NopCloser(bytes.NewReader(requestDto)))
 
-	expectedResponse := api.HandlerResponse{Code: http.StatusNotFound, Error: errors.New("sample error")}
-	service.On("UpdateAlbum", mock.Anything, mock.Anything).Return(expectedResponse)
+	expectedResponse := api.HandlerResponse{Code: http.StatusNotFound, Error: api.ErrAlbumNotFound}
+	service.On("UpdateAlbum", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(expectedResponse)
 
 	handler.UpdateAlbum(ginContext)
 
-	var respBody api.ResponseBody
+	var respBody api.Problem
 	json.Unmarshal(respWriter.Body.Bytes(), &respBody)
 
 	service.AssertNumberOfCalls(t, "UpdateAlbum", 1)
 	assert.Equal(t, expectedResponse.Code, respWriter.Code)
-	assert.Equal(t, expectedResponse.Error.Error(), respBody.Message)
+	assert.Equal(t, api.ProblemContentType, respWriter.Header().Get("Content-Type"))
+	assert.Equal(t, api.KindNotFound.Type, respBody.Type)
+	assert.Equal(t, expectedResponse.Error.Error(), respBody.Detail)
 }
 
 func TestHandlerUpdateAlbum_InvalidRequests_ReturnBadRequest(t *testing.T) {
@@ -306,7 +400,7 @@ func TestHandlerDeleteAlbum_ServiceReturnOK_ReturnOK(t *testing.T) {
 	ginContext.Request, _ = http.NewRequest(http.MethodDelete, "/", nil)
 
 	expectedResponse := api.HandlerResponse{Code: http.StatusOK, Body: api.ResponseBody{Message: "message"}}
-	service.On("DeleteAlbum", mock.Anything, mock.Anything).Return(expectedResponse)
+	service.On("DeleteAlbum", mock.Anything, mock.Anything, mock.Anything).Return(expectedResponse)
 
 	handler.DeleteAlbum(ginContext)
 
@@ -322,24 +416,124 @@ func TestHandlerDeleteAlbum_ServiceReturnError_ReturnError(t *testing.T) {
 	handler, service, ginContext, respWriter := InitHandlerWithMocks()
 	ginContext.Request, _ = http.NewRequest(http.MethodDelete, "/", nil)
 
-	expectedResponse := api.HandlerResponse{Code: http.StatusNotFound, Error: errors.New("sample error")}
-	service.On("DeleteAlbum", mock.Anything, mock.Anything).Return(expectedResponse)
+	expectedResponse := api.HandlerResponse{Code: http.StatusNotFound, Error: api.ErrAlbumNotFound}
+	service.On("DeleteAlbum", mock.Anything, mock.Anything, mock.Anything).Return(expectedResponse)
 
 	handler.DeleteAlbum(ginContext)
 
-	var respBody api.ResponseBody
+	var respBody api.Problem
 	json.Unmarshal(respWriter.Body.Bytes(), &respBody)
 
 	service.AssertNumberOfCalls(t, "DeleteAlbum", 1)
 	assert.Equal(t, expectedResponse.Code, respWriter.Code)
-	assert.Equal(t, expectedResponse.Error.Error(), respBody.Message)
+	assert.Equal(t, api.ProblemContentType, respWriter.Header().Get("Content-Type"))
+	assert.Equal(t, api.KindNotFound.Type, respBody.Type)
+	assert.Equal(t, expectedResponse.Error.Error(), respBody.Detail)
+}
+
+func TestHandlerGetAlbumById_ServiceReturnAlbum_ReturnETag(t *testing.T) {
+	handler, service, ginContext, respWriter := InitHandlerWithMocks()
+	ginContext.Request, _ = http.NewRequest(http.MethodGet, "/", nil)
+
+	album := api.Album{Id: "id", Title: "title", Artist: "artist", Price: 9.99, Version: 3}
+	service.On("GetAlbumById", mock.Anything, mock.Anything).Return(api.HandlerResponse{Code: http.StatusOK, Body: api.ResponseBody{Data: album}})
+
+	handler.GetAlbumById(ginContext)
+
+	assert.Equal(t, http.StatusOK, respWriter.Code)
+	assert.Equal(t, `"3"`, respWriter.Header().Get("ETag"))
+}
+
+func TestHandlerGetAlbumById_IfNoneMatchCurrent_ReturnNotModified(t *testing.T) {
+	handler, service, ginContext, respWriter := InitHandlerWithMocks()
+	ginContext.Request, _ = http.NewRequest(http.MethodGet, "/", nil)
+	ginContext.Request.Header.Set("If-None-Match", `"2", "3"`)
+
+	album := api.Album{Id: "id", Version: 3, TimeCreated: 1700000000000, TimeUpdated: 1700000005000}
+	service.On("GetAlbumById", mock.Anything, mock.Anything).Return(api.HandlerResponse{Code: http.StatusOK, Body: api.ResponseBody{Data: album}})
+
+	handler.GetAlbumById(ginContext)
+
+	assert.Equal(t, http.StatusNotModified, respWriter.Code)
+	assert.Empty(t, respWriter.Body.Bytes())
+	assert.Equal(t, `"3"`, respWriter.Header().Get("ETag"))
+	assert.Equal(t, time.UnixMilli(album.TimeUpdated).UTC().Format(http.TimeFormat), respWriter.Header().Get("Last-Modified"))
+}
+
+func TestHandlerGetAlbumById_IfModifiedSince_ComparedToTimeUpdated(t *testing.T) {
+	album := api.Album{Id: "id", Version: 3, TimeCreated: 1700000000000, TimeUpdated: 1700000005000}
+	cases := map[time.Time]int{
+		time.UnixMilli(album.TimeUpdated):                   http.StatusNotModified,
+		time.UnixMilli(album.TimeUpdated).Add(-time.Second): http.StatusOK,
+	}
+
+	for since, expectedCode := range cases {
+		handler, service, ginContext, respWriter := InitHandlerWithMocks()
+		ginContext.Request, _ = http.NewRequest(http.MethodGet, "/", nil)
+		ginContext.Request.Header.Set("If-Modified-Since", since.UTC().Format(http.TimeFormat))
+		service.On("GetAlbumById", mock.Anything, mock.Anything).Return(api.HandlerResponse{Code: http.StatusOK, Body: api.ResponseBody{Data: album}})
+
+		handler.GetAlbumById(ginContext)
+
+		assert.Equal(t, expectedCode, respWriter.Code)
+	}
+}
+
+func TestHandlerGetAlbums_IfNoneMatchCurrent_ReturnNotModified(t *testing.T) {
+	albums := []api.Album{{Id: "id 1", Version: 1}, {Id: "id 2", Version: 4}}
+	service := new(MockService)
+	service.On("GetAlbums", mock.Anything, mock.Anything).Return(api.HandlerResponse{Code: http.StatusOK, Body: api.ResponseBody{Data: albums}})
+	handler := NewApiHandler(service, api.AppConfig{})
+
+	respWriter := httptest.NewRecorder()
+	ginContext, _ := gin.CreateTestContext(respWriter)
+	ginContext.Request, _ = http.NewRequest(http.MethodGet, "/", nil)
+	handler.GetAlbums(ginContext)
+	etag := respWriter.Header().Get("ETag")
+	assert.Equal(t, http.StatusOK, respWriter.Code)
+	assert.NotEmpty(t, etag)
+
+	respWriter = httptest.NewRecorder()
+	ginContext, _ = gin.CreateTestContext(respWriter)
+	ginContext.Request, _ = http.NewRequest(http.MethodGet, "/", nil)
+	ginContext.Request.Header.Set("If-None-Match", etag)
+	handler.GetAlbums(ginContext)
+	assert.Equal(t, http.StatusNotModified, respWriter.Code)
+}
+
+func TestHandlerReplaceAlbum_IfMatchHeader_PassedAsExpectedVersion(t *testing.T) {
+	handler, service, ginContext, _ := InitHandlerWithMocks()
+	props := api.AlbumPropertiesDTO{Title: "title", Artist: "artist", Price: 9.99}
+	requestDto, _ := json.Marshal(props)
+	ginContext.Request, _ = http.NewRequest(http.MethodPut, "/", io.NopCloser(bytes.NewReader(requestDto)))
+	ginContext.Request.Header.Set("If-Match", `"7"`)
+
+	expectedResponse := api.HandlerResponse{Code: http.StatusOK, Body: api.ResponseBody{Message: "message"}}
+	service.On("ReplaceAlbum", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(expectedResponse)
+
+	handler.ReplaceAlbum(ginContext)
+
+	service.AssertCalled(t, "ReplaceAlbum", mock.Anything, mock.Anything, props, int64(7))
+}
+
+func TestHandlerWrites_UnmatchableIfMatch_ReturnPreconditionFailed(t *testing.T) {
+	handler, service, ginContext, respWriter := InitHandlerWithMocks()
+
+	for _, header := range []string{`W/"1"`, "1", `"abc"`, `"0"`} {
+		ginContext.Request, _ = http.NewRequest(http.MethodDelete, "/", nil)
+		ginContext.Request.Header.Set("If-Match", header)
+		handler.DeleteAlbum(ginContext)
+		assert.Equal(t, http.StatusPreconditionFailed, respWriter.Code, header)
+	}
+
+	service.AssertNumberOfCalls(t, "DeleteAlbum", 0)
 }
 
 func InitHandlerWithMocks() (api.Handler, *MockService, *gin.Context, *httptest.ResponseRecorder) {
 	respWriter := httptest.NewRecorder()
 	context, _ := gin.CreateTestContext(respWriter)
 	service := new(MockService)
-	handler := NewApiHandler(service)
+	handler := NewApiHandler(service, api.AppConfig{})
 	return handler, service, context, respWriter
 }
 
@@ -347,32 +541,112 @@ type MockService struct {
 	mock.Mock
 }
 
-func (t *MockService) GetAlbums() api.HandlerResponse {
-	args := t.Called()
+func (t *MockService) GetAlbums(ctx context.Context, query api.AlbumQueryDTO) api.HandlerResponse {
+	args := t.Called(ctx, query)
 	return args.Get(0).(api.HandlerResponse)
 }
 
-func (t *MockService) GetAlbumById(id string) api.HandlerResponse {
-	args := t.Called(id)
+func (t *MockService) GetAlbumById(ctx context.Context, id string) api.HandlerResponse {
+	args := t.Called(ctx, id)
 	return args.Get(0).(api.HandlerResponse)
 }
 
-func (t *MockService) InsertAlbum(props api.AlbumPropertiesDTO) api.HandlerResponse {
-	args := t.Called(props)
+func (t *MockService) InsertAlbum(ctx context.Context, props api.AlbumPropertiesDTO) api.HandlerResponse {
+	args := t.Called(ctx, props)
 	return args.Get(0).(api.HandlerResponse)
 }
 
-func (t *MockService) ReplaceAlbum(id string, props api.AlbumPropertiesDTO) api.HandlerResponse {
-	args := t.Called(id, props)
+func (t *MockService) ReplaceAlbum(ctx context.Context, id string, props api.AlbumPropertiesDTO, expectedVersion int64) api.HandlerResponse {
+	args := t.Called(ctx, id, props, expectedVersion)
 	return args.Get(0).(api.HandlerResponse)
 }
 
-func (t *MockService) UpdateAlbum(id string, updates api.AlbumUpdatesDTO) api.HandlerResponse {
-	args := t.Called(id, updates)
+func (t *MockService) UpdateAlbum(ctx context.Context, id string, updates api.AlbumUpdatesDTO, expectedVersion int64) api.HandlerResponse {
+	args := t.Called(ctx, id, updates, expectedVersion)
 	return args.Get(0).(api.HandlerResponse)
 }
 
-func (t *MockService) DeleteAlbum(id string) api.HandlerResponse {
-	args := t.Called(id)
+func (t *MockService) DeleteAlbum(ctx context.Context, id string, expectedVersion int64) api.HandlerResponse {
+	args := t.Called(ctx, id, expectedVersion)
 	return args.Get(0).(api.HandlerResponse)
 }
+
+func (t *MockService) Close(ctx context.Context) error {
+	args := t.Called(ctx)
+	return args.Error(0)
+}
+
+func TestHandlerHandleResponse_UntypedError_HideMessage(t *testing.T) {
+	handler, _, ginContext, respWriter := InitHandlerWithMocks()
+	ginContext.Request, _ = http.NewRequest(http.MethodGet, "/albums/id", nil)
+
+	handler.(*ApiHandler).HandleResponse(ginContext, api.HandlerResponse{Code: http.StatusInternalServerError, Error: errors.New("mongo: connection refused")})
+
+	var respBody api.Problem
+	json.Unmarshal(respWriter.Body.Bytes(), &respBody)
+
+	assert.Equal(t, http.StatusInternalServerError, respWriter.Code)
+	assert.Equal(t, api.KindInternal.Type, respBody.Type)
+	assert.Equal(t, http.StatusInternalServerError, respBody.Status)
+	assert.Equal(t, "/albums/id", respBody.Instance)
+	assert.NotContains(t, respWriter.Body.String(), "mongo")
+}
+
+func TestHandlerInsertAlbum_InvalidFields_ReturnFieldErrors(t *testing.T) {
+	handler, service, ginContext, respWriter := InitHandlerWithMocks()
+	body := []byte(`{"Title": "title", "Price": -1}`)
+	ginContext.Request, _ = http.NewRequest(http.MethodPost, "/albums", bytes.NewReader(body))
+
+	handler.InsertAlbum(ginContext)
+
+	var respBody api.Problem
+	json.Unmarshal(respWriter.Body.Bytes(), &respBody)
+
+	service.AssertNumberOfCalls(t, "InsertAlbum", 0)
+	assert.Equal(t, http.StatusBadRequest, respWriter.Code)
+	assert.Equal(t, api.ProblemContentType, respWriter.Header().Get("Content-Type"))
+	assert.Equal(t, api.KindValidationFailed.Type, respBody.Type)
+	assert.Equal(t, []api.FieldError{{Field: "Artist", Rule: "required", Detail: "is required"}}, respBody.Errors)
+}
+
+func TestHandlerInsertAlbum_WrongFieldType_ReturnFieldErrors(t *testing.T) {
+	handler, _, ginContext, respWriter := InitHandlerWithMocks()
+	body := []byte(`{"Title": "title", "Artist": "artist", "Price": "cheap"}`)
+	ginContext.Request, _ = http.NewRequest(http.MethodPost, "/albums", bytes.NewReader(body))
+
+	handler.InsertAlbum(ginContext)
+
+	var respBody api.Problem
+	json.Unmarshal(respWriter.Body.Bytes(), &respBody)
+
+	assert.Equal(t, http.StatusBadRequest, respWriter.Code)
+	assert.Equal(t, api.KindValidationFailed.Type, respBody.Type)
+	assert.Equal(t, []api.FieldError{{Field: "Price", Rule: "type", Detail: "must be a float64"}}, respBody.Errors)
+}
+
+func TestHandlerInsertAlbum_MalformedJson_ReturnMalformedRequest(t *testing.T) {
+	handler, _, ginContext, respWriter := InitHandlerWithMocks()
+	ginContext.Request, _ = http.NewRequest(http.MethodPost, "/albums", bytes.NewReader([]byte(`{"Title": `)))
+
+	handler.InsertAlbum(ginContext)
+
+	var respBody api.Problem
+	json.Unmarshal(respWriter.Body.Bytes(), &respBody)
+
+	assert.Equal(t, http.StatusBadRequest, respWriter.Code)
+	assert.Equal(t, api.KindMalformedRequest.Type, respBody.Type)
+	assert.Empty(t, respBody.Errors)
+}
+
+func TestHandlerGetAlbums_InvalidQuery_ReturnQueryFieldNames(t *testing.T) {
+	handler, _, ginContext, respWriter := InitHandlerWithMocks()
+	ginContext.Request, _ = http.NewRequest(http.MethodGet, "/albums?minPrice=-1&sort=color", nil)
+
+	handler.GetAlbums(ginContext)
+
+	var respBody api.Problem
+	json.Unmarshal(respWriter.Body.Bytes(), &respBody)
+
+	assert.Equal(t, http.StatusBadRequest, respWriter.Code)
+	assert.Equal(t, []api.FieldError{{Field: "minPrice", Rule: "gte", Detail: "must be greater than or equal to 0"}}, respBody.Errors)
+}
@@ -0,0 +1,206 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	authModeApiKey = "apiKey"
+	ApiKeyHeader   = "X-API-Key"
+
+	ScopeAlbumsRead  = "albums:read"
+	ScopeAlbumsWrite = "albums:write"
+
+	// apiKeyTouchInterval limits LastUsedAt writes to one per key and interval.
+	apiKeyTouchInterval = time.Minute
+)
+
+// IssueApiKey stores a new key with the Subject, Scopes, Roles, Tenant,
+// NotBefore and ExpiresAt of grant, and returns it in plain text, which is
+// never stored and can't be recovered later. A zero NotBefore is valid from
+// now on.
+func IssueApiKey(ctx context.Context, store api.ApiKeyStore, idGen api.IdGenerator, grant api.ApiKey) (string, *api.ApiKey, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+
+	id := idGen.NextId()
+	plain := id + "." + base64.RawURLEncoding.EncodeToString(secret)
+	now := time.Now()
+	if grant.NotBefore.IsZero() {
+		grant.NotBefore = now
+	}
+	key := api.ApiKey{
+		Id:          id,
+		Hash:        hashApiKey(plain),
+		Subject:     grant.Subject,
+		Scopes:      grant.Scopes,
+		Roles:       grant.Roles,
+		Tenant:      grant.Tenant,
+		TimeCreated: now,
+		NotBefore:   grant.NotBefore,
+		ExpiresAt:   grant.ExpiresAt,
+	}
+	if err := store.PutApiKey(ctx, key); err != nil {
+		return "", nil, err
+	}
+
+	return plain, &key, nil
+}
+
+// RotateApiKey issues a replacement of key id with the same subject, scopes,
+// roles and tenant, and keeps the old key valid for overlap so callers can
+// switch over.
+func RotateApiKey(ctx context.Context, store api.ApiKeyStore, idGen api.IdGenerator, id string, overlap time.Duration) (string, *api.ApiKey, error) {
+	old, err := store.GetApiKey(ctx, id)
+	if err != nil {
+		return "", nil, err
+	}
+	if old == nil {
+		return "", nil, fmt.Errorf("api key %q not found", id)
+	}
+
+	plain, key, err := IssueApiKey(ctx, store, idGen, api.ApiKey{Subject: old.Subject, Scopes: old.Scopes, Roles: old.Roles, Tenant: old.Tenant})
+	if err != nil {
+		return "", nil, err
+	}
+
+	expiresAt := time.Now().Add(overlap)
+	if old.ExpiresAt.IsZero() || old.ExpiresAt.After(expiresAt) {
+		old.ExpiresAt = expiresAt
+		if err := store.PutApiKey(ctx, *old); err != nil {
+			return "", nil, err
+		}
+	}
+
+	return plain, key, nil
+}
+
+// RevokeApiKey expires key id immediately.
+func RevokeApiKey(ctx context.Context, store api.ApiKeyStore, id string) error {
+	key, err := store.GetApiKey(ctx, id)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return fmt.Errorf("api key %q not found", id)
+	}
+
+	key.ExpiresAt = time.Now()
+	return store.PutApiKey(ctx, *key)
+}
+
+func hashApiKey(plain string) string {
+	sum := sha256.Sum256([]byte(plain))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewApiKeyAuthenticator accepts the keys of store sent in the X-API-Key header.
+func NewApiKeyAuthenticator(store api.ApiKeyStore, logger *slog.Logger) *ApiKeyAuthenticator {
+	return &ApiKeyAuthenticator{Store: store, Logger: logger}
+}
+
+type ApiKeyAuthenticator struct {
+	Store  api.ApiKeyStore
+	Logger *slog.Logger
+}
+
+func (this *ApiKeyAuthenticator) Challenge() string {
+	return `ApiKey realm="albums"`
+}
+
+func (this *ApiKeyAuthenticator) Authenticate(request *http.Request) (*api.Principal, error) {
+	plain := request.Header.Get(ApiKeyHeader)
+	if plain == "" {
+		return nil, nil
+	}
+
+	id, _, found := strings.Cut(plain, ".")
+	if !found || id == "" {
+		return nil, errors.New("api key rejected: malformed key")
+	}
+
+	ctx := request.Context()
+	key, err := this.Store.GetApiKey(ctx, id)
+	if err != nil {
+		return nil, &api.Error{Kind: api.KindBackendUnavailable, Detail: "api keys can't be checked right now", Cause: err}
+	}
+	if key == nil || subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashApiKey(plain))) != 1 {
+		return nil, errors.New("api key rejected: unknown key")
+	}
+
+	now := time.Now()
+	if now.Before(key.NotBefore) {
+		return nil, errors.New("api key rejected: key is not valid yet")
+	}
+	if !key.ExpiresAt.IsZero() && !now.Before(key.ExpiresAt) {
+		return nil, errors.New("api key rejected: key has expired")
+	}
+
+	if now.Sub(key.LastUsedAt) >= apiKeyTouchInterval {
+		if err := this.Store.TouchApiKey(ctx, key.Id, now); err != nil {
+			this.Logger.WarnContext(ctx, "failed to record api key use", slog.String("apiKeyId", key.Id), slog.Any("error", err))
+		}
+	}
+
+	return &api.Principal{
+		Subject: key.Subject,
+		Method:  authModeApiKey,
+		Scopes:  key.Scopes,
+		Roles:   key.Roles,
+		Tenant:  key.Tenant,
+		Claims:  map[string]any{"apiKeyId": key.Id},
+	}, nil
+}
+
+// NewScopeMiddleware rejects callers without scope with 403, API keys and
+// tokens with a scope or scp claim. Tokens without one are only authorized by
+// the access policy, and the routes are public when no authentication is
+// configured.
+func NewScopeMiddleware(scope string) gin.HandlerFunc {
+	return scopeMiddleware(scope, false)
+}
+
+// NewRequiredScopeMiddleware rejects every caller without scope with 403, for
+// the routes the access policy has no operation for.
+func NewRequiredScopeMiddleware(scope string) gin.HandlerFunc {
+	return scopeMiddleware(scope, true)
+}
+
+func scopeMiddleware(scope string, required bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := api.PrincipalFromContext(c.Request.Context())
+		if principal != nil && (required || hasScopes(principal)) && !slices.Contains(principal.Scopes, scope) {
+			writeProblem(c, http.StatusForbidden, api.NewError(api.KindForbidden, fmt.Sprintf("scope %s is required", scope)))
+			return
+		}
+		c.Next()
+	}
+}
+
+// hasScopes reports whether the caller was granted scopes at all, which
+// tokens only are through a scope or scp claim.
+func hasScopes(principal *api.Principal) bool {
+	if principal.Method == authModeApiKey {
+		return true
+	}
+	_, scope := principal.Claims["scope"]
+	_, scp := principal.Claims["scp"]
+	return scope || scp
+}
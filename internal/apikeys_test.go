@@ -0,0 +1,198 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func InitApiKeyRouter(store api.ApiKeyStore) *gin.Engine {
+	authenticators := []Authenticator{NewApiKeyAuthenticator(store, slog.Default())}
+
+	router := gin.New()
+	router.Use(NewAuthMiddleware(authenticators))
+	router.GET("/albums", NewScopeMiddleware(ScopeAlbumsRead), func(c *gin.Context) {
+		c.JSON(http.StatusOK, api.PrincipalFromContext(c.Request.Context()))
+	})
+	router.POST("/albums", NewScopeMiddleware(ScopeAlbumsWrite), func(c *gin.Context) {
+		c.Status(http.StatusCreated)
+	})
+	return router
+}
+
+func SendApiKeyRequest(router *gin.Engine, method string, key string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(method, "/albums", nil)
+	if key != "" {
+		request.Header.Set(ApiKeyHeader, key)
+	}
+
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	return response
+}
+
+func TestApiKeyAuthenticator_ValidKey_PrincipalInContextAndLastUsedRecorded(t *testing.T) {
+	store := NewInMemoryApiKeyStore()
+	plain, key, err := IssueApiKey(context.Background(), store, NewXidGenerator(), api.ApiKey{Subject: "billing", Scopes: []string{ScopeAlbumsRead}})
+	assert.Nil(t, err)
+	assert.NotContains(t, key.Hash, plain)
+
+	response := SendApiKeyRequest(InitApiKeyRouter(store), http.MethodGet, plain)
+
+	var principal api.Principal
+	json.Unmarshal(response.Body.Bytes(), &principal)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "billing", principal.Subject)
+	assert.Equal(t, authModeApiKey, principal.Method)
+	assert.Equal(t, []string{ScopeAlbumsRead}, principal.Scopes)
+
+	stored, _ := store.GetApiKey(context.Background(), key.Id)
+	assert.False(t, stored.LastUsedAt.IsZero())
+}
+
+func TestApiKeyAuthenticator_InvalidKeys_ReturnUnauthorized(t *testing.T) {
+	store := NewInMemoryApiKeyStore()
+	ctx := context.Background()
+	plain, key, _ := IssueApiKey(ctx, store, NewXidGenerator(), api.ApiKey{Subject: "billing", Scopes: []string{ScopeAlbumsRead}})
+	future, _, _ := IssueApiKey(ctx, store, NewXidGenerator(), api.ApiKey{Subject: "billing", NotBefore: time.Now().Add(time.Hour)})
+	expired, _, _ := IssueApiKey(ctx, store, NewXidGenerator(), api.ApiKey{Subject: "billing", ExpiresAt: time.Now().Add(-time.Minute)})
+	router := InitApiKeyRouter(store)
+
+	for name, value := range map[string]string{
+		"malformed":     "not-a-key",
+		"unknown id":    "unknown." + plain[len(key.Id)+1:],
+		"wrong secret":  key.Id + ".secret",
+		"not yet valid": future,
+		"expired":       expired,
+	} {
+		response := SendApiKeyRequest(router, http.MethodGet, value)
+
+		assert.Equal(t, http.StatusUnauthorized, response.Code, name)
+		assert.Contains(t, response.Header().Get("WWW-Authenticate"), "ApiKey", name)
+	}
+}
+
+func TestApiKeyAuthenticator_StoreFailure_ReturnServiceUnavailable(t *testing.T) {
+	response := SendApiKeyRequest(InitApiKeyRouter(failingApiKeyStore{}), http.MethodGet, "id.secret")
+
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code)
+	assert.NotContains(t, response.Body.String(), "connection refused")
+}
+
+func TestScopeMiddleware_MissingScope_ReturnForbidden(t *testing.T) {
+	store := NewInMemoryApiKeyStore()
+	plain, _, _ := IssueApiKey(context.Background(), store, NewXidGenerator(), api.ApiKey{Subject: "reporting", Scopes: []string{ScopeAlbumsRead}})
+	router := InitApiKeyRouter(store)
+
+	response := SendApiKeyRequest(router, http.MethodPost, plain)
+
+	var problem api.Problem
+	json.Unmarshal(response.Body.Bytes(), &problem)
+	assert.Equal(t, http.StatusForbidden, response.Code)
+	assert.Equal(t, api.KindForbidden.Type, problem.Type)
+}
+
+func InitTokenScopeRouter(claims map[string]any) *gin.Engine {
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		principal := &api.Principal{Subject: "user-1", Method: authModeJwt, Scopes: jwtScopes(claims), Claims: claims}
+		c.Request = c.Request.WithContext(api.ContextWithPrincipal(c.Request.Context(), principal))
+	})
+	router.POST("/albums", NewScopeMiddleware(ScopeAlbumsWrite), func(c *gin.Context) {
+		c.Status(http.StatusCreated)
+	})
+	router.GET("/audit", NewRequiredScopeMiddleware(ScopeAuditRead), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	return router
+}
+
+func SendScopeRequest(router *gin.Engine, method string, url string) int {
+	request, _ := http.NewRequest(method, url, nil)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	return response.Code
+}
+
+func TestScopeMiddleware_TokenWithoutScopeClaim_PassAlbumRoutesOnly(t *testing.T) {
+	router := InitTokenScopeRouter(map[string]any{"sub": "user-1"})
+
+	assert.Equal(t, http.StatusCreated, SendScopeRequest(router, http.MethodPost, "/albums"))
+	assert.Equal(t, http.StatusForbidden, SendScopeRequest(router, http.MethodGet, "/audit"))
+}
+
+func TestScopeMiddleware_TokenScopeClaim_Enforced(t *testing.T) {
+	router := InitTokenScopeRouter(map[string]any{"sub": "user-1", "scope": "albums:read"})
+
+	assert.Equal(t, http.StatusForbidden, SendScopeRequest(router, http.MethodPost, "/albums"))
+	assert.Equal(t, http.StatusForbidden, SendScopeRequest(router, http.MethodGet, "/audit"))
+
+	router = InitTokenScopeRouter(map[string]any{"sub": "user-1", "scp": []any{"albums:write", "audit:read"}})
+
+	assert.Equal(t, http.StatusCreated, SendScopeRequest(router, http.MethodPost, "/albums"))
+	assert.Equal(t, http.StatusOK, SendScopeRequest(router, http.MethodGet, "/audit"))
+}
+
+func TestRotateApiKey_OldKeyValidUntilOverlapEnds(t *testing.T) {
+	store := NewInMemoryApiKeyStore()
+	ctx := context.Background()
+	oldPlain, oldKey, _ := IssueApiKey(ctx, store, NewXidGenerator(), api.ApiKey{Subject: "billing", Scopes: []string{ScopeAlbumsRead, ScopeAlbumsWrite}})
+	router := InitApiKeyRouter(store)
+
+	newPlain, newKey, err := RotateApiKey(ctx, store, NewXidGenerator(), oldKey.Id, time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, oldKey.Scopes, newKey.Scopes)
+	assert.Equal(t, http.StatusOK, SendApiKeyRequest(router, http.MethodGet, oldPlain).Code)
+	assert.Equal(t, http.StatusOK, SendApiKeyRequest(router, http.MethodGet, newPlain).Code)
+
+	assert.Nil(t, RevokeApiKey(ctx, store, oldKey.Id))
+	assert.Equal(t, http.StatusUnauthorized, SendApiKeyRequest(router, http.MethodGet, oldPlain).Code)
+	assert.Equal(t, http.StatusOK, SendApiKeyRequest(router, http.MethodGet, newPlain).Code)
+}
+
+func TestSqliteApiKeyStore_PutAndTouch_RoundTrip(t *testing.T) {
+	service := InitSqliteService(t, filepath.Join(t.TempDir(), "albums.db"))
+	store := NewSqlApiKeyStore(&service.SqlService)
+	ctx := context.Background()
+
+	missing, err := store.GetApiKey(ctx, "unknown")
+	assert.Nil(t, err)
+	assert.Nil(t, missing)
+
+	_, key, err := IssueApiKey(ctx, store, NewXidGenerator(), api.ApiKey{Subject: "billing", Scopes: []string{ScopeAlbumsRead, ScopeAlbumsWrite}, ExpiresAt: time.Now().Add(time.Hour)})
+	assert.Nil(t, err)
+	usedAt := time.Now()
+	assert.Nil(t, store.TouchApiKey(ctx, key.Id, usedAt))
+
+	stored, err := store.GetApiKey(ctx, key.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, key.Hash, stored.Hash)
+	assert.Equal(t, key.Scopes, stored.Scopes)
+	assert.Equal(t, key.ExpiresAt.UnixMilli(), stored.ExpiresAt.UnixMilli())
+	assert.Equal(t, usedAt.UnixMilli(), stored.LastUsedAt.UnixMilli())
+}
+
+// failingApiKeyStore fails every call, as when the backend is unreachable.
+type failingApiKeyStore struct{}
+
+func (this failingApiKeyStore) GetApiKey(ctx context.Context, id string) (*api.ApiKey, error) {
+	return nil, errors.New("dial tcp: connection refused")
+}
+
+func (this failingApiKeyStore) PutApiKey(ctx context.Context, key api.ApiKey) error {
+	return errors.New("dial tcp: connection refused")
+}
+
+func (this failingApiKeyStore) TouchApiKey(ctx context.Context, id string, usedAt time.Time) error {
+	return errors.New("dial tcp: connection refused")
+}
@@ -0,0 +1,228 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+const (
+	auditSinkBackend = "backend"
+	auditSinkFile    = "file"
+	auditSinkStdout  = "stdout"
+	// ScopeAuditRead is required to read the audit trail
+	ScopeAuditRead = "audit:read"
+)
+
+// auditsToBackend reports whether config keeps audit records in the backend.
+func auditsToBackend(config api.AppConfig) bool {
+	return config.AuditConfig.Enabled && config.AuditConfig.Sink == auditSinkBackend
+}
+
+// NewAuditedService decorates service so that every album change it makes is
+// appended to sink. Records that can't be appended are logged as errors
+// instead, the change itself having already been made.
+func NewAuditedService(service api.Service, sink api.AuditSink, idGen api.IdGenerator, logger *slog.Logger) *AuditedService {
+	return &AuditedService{
+		Service: service,
+		Sink:    sink,
+		IdGen:   idGen,
+		Logger:  logger,
+	}
+}
+
+type AuditedService struct {
+	Service api.Service
+	Sink    api.AuditSink
+	IdGen   api.IdGenerator
+	Logger  *slog.Logger
+}
+
+// auditChangeAttempts bounds the retries of a change raced by another one.
+const auditChangeAttempts = 3
+
+// snapshot returns the album with id as it is before a change, or nil when
+// it can't be read, in which case the change fails the same way.
+func (this *AuditedService) snapshot(ctx context.Context, id string) *api.Album {
+	resp := this.Service.GetAlbumById(ctx, id)
+	if album, ok := resp.Body.Data.(api.Album); ok && resp.Error == nil {
+		return &album
+	}
+	return nil
+}
+
+// change makes a change of album id with write, conditional on the version
+// of the snapshot so that the snapshot is the state the change replaced. A
+// change without an expected version of its own is retried when another one
+// was made in between, the last attempt being unconditional. The snapshot is
+// returned with whether the change was made on it.
+func (this *AuditedService) change(ctx context.Context, id string, expectedVersion int64, write func(version int64) api.HandlerResponse) (*api.Album, bool, api.HandlerResponse) {
+	for attempt := 1; ; attempt++ {
+		before := this.snapshot(ctx, id)
+		version := expectedVersion
+		if version == 0 && before != nil && attempt < auditChangeAttempts {
+			version = before.Version
+		}
+
+		resp := write(version)
+		if expectedVersion != 0 || version == 0 || resp.Code != http.StatusPreconditionFailed {
+			return before, before != nil && before.Version == version, resp
+		}
+	}
+}
+
+func (this *AuditedService) record(ctx context.Context, action string, id string, before *api.Album, verified bool, resp api.HandlerResponse) {
+	if resp.Error != nil || resp.Code != http.StatusOK {
+		return
+	}
+
+	record := api.AuditRecord{
+		Id:         this.IdGen.NextId(),
+		Tenant:     api.TenantFromContext(ctx),
+		AlbumId:    id,
+		Action:     action,
+		RequestId:  RequestIdFromContext(ctx),
+		Time:       time.Now().UnixMilli(),
+		Before:     before,
+		Unverified: !verified,
+	}
+	if principal := api.PrincipalFromContext(ctx); principal != nil {
+		record.Actor = principal.Subject
+		record.Method = principal.Method
+	}
+	if album, ok := resp.Body.Data.(api.Album); ok && action != api.AuditActionDelete {
+		record.After = &album
+		record.AlbumId = album.Id
+	}
+
+	// the change is made, so the record must not depend on the client still waiting
+	if err := this.Sink.Append(context.WithoutCancel(ctx), record); err != nil {
+		this.Logger.LogAttrs(ctx, slog.LevelError, "failed to append audit record",
+			slog.Any("error", err),
+			slog.Any("record", record),
+		)
+	}
+}
+
+func (this *AuditedService) GetAlbums(ctx context.Context, query api.AlbumQueryDTO) api.HandlerResponse {
+	return this.Service.GetAlbums(ctx, query)
+}
+
+func (this *AuditedService) GetAlbumById(ctx context.Context, id string) api.HandlerResponse {
+	return this.Service.GetAlbumById(ctx, id)
+}
+
+func (this *AuditedService) InsertAlbum(ctx context.Context, props api.AlbumPropertiesDTO) api.HandlerResponse {
+	resp := this.Service.InsertAlbum(ctx, props)
+	this.record(ctx, api.AuditActionInsert, "", nil, true, resp)
+	return resp
+}
+
+func (this *AuditedService) ReplaceAlbum(ctx context.Context, id string, props api.AlbumPropertiesDTO, expectedVersion int64) api.HandlerResponse {
+	before, verified, resp := this.change(ctx, id, expectedVersion, func(version int64) api.HandlerResponse {
+		return this.Service.ReplaceAlbum(ctx, id, props, version)
+	})
+	this.record(ctx, api.AuditActionReplace, id, before, verified, resp)
+	return resp
+}
+
+func (this *AuditedService) UpdateAlbum(ctx context.Context, id string, updates api.AlbumUpdatesDTO, expectedVersion int64) api.HandlerResponse {
+	before, verified, resp := this.change(ctx, id, expectedVersion, func(version int64) api.HandlerResponse {
+		return this.Service.UpdateAlbum(ctx, id, updates, version)
+	})
+	this.record(ctx, api.AuditActionUpdate, id, before, verified, resp)
+	return resp
+}
+
+func (this *AuditedService) DeleteAlbum(ctx context.Context, id string, expectedVersion int64) api.HandlerResponse {
+	before, verified, resp := this.change(ctx, id, expectedVersion, func(version int64) api.HandlerResponse {
+		return this.Service.DeleteAlbum(ctx, id, version)
+	})
+	this.record(ctx, api.AuditActionDelete, id, before, verified, resp)
+	return resp
+}
+
+func (this *AuditedService) Close(ctx context.Context) error {
+	return this.Service.Close(ctx)
+}
+
+// matchesAuditQuery reports whether record is selected by query, for the
+// sinks that can't filter records themselves.
+func matchesAuditQuery(record api.AuditRecord, query api.AuditQuery) bool {
+	return record.Tenant == query.Tenant &&
+		(query.AlbumId == "" || record.AlbumId == query.AlbumId) &&
+		(query.Actor == "" || record.Actor == query.Actor) &&
+		record.Time >= query.Since
+}
+
+// NewAuditHandler serves the audit trail kept in sink, listings are bounded
+// like album listings by the pagination config.
+func NewAuditHandler(sink api.AuditSink, config api.AppConfig) *AuditHandler {
+	validate := validator.New(validator.WithRequiredStructEnabled())
+	validate.RegisterTagNameFunc(requestFieldName)
+
+	return &AuditHandler{
+		Sink:       sink,
+		Validator:  validate,
+		Pagination: normalizePagination(config.PaginationConfig),
+	}
+}
+
+type AuditHandler struct {
+	Sink       api.AuditSink
+	Validator  *validator.Validate
+	Pagination api.PaginationConfig
+}
+
+// GetAlbumAudit lists the changes of one album.
+func (this *AuditHandler) GetAlbumAudit(c *gin.Context) {
+	this.listRecords(c, c.Param("id"))
+}
+
+// GetAudit lists the changes of every album, of one actor when actor is set.
+func (this *AuditHandler) GetAudit(c *gin.Context) {
+	this.listRecords(c, "")
+}
+
+func (this *AuditHandler) listRecords(c *gin.Context, albumId string) {
+	var params api.AuditQueryDTO
+	if err := c.ShouldBindQuery(&params); err != nil {
+		writeProblem(c, http.StatusBadRequest, requestError(err))
+		return
+	}
+	if err := this.Validator.Struct(params); err != nil {
+		writeProblem(c, http.StatusBadRequest, requestError(err))
+		return
+	}
+
+	query := api.AuditQuery{
+		Tenant:  api.TenantFromContext(c.Request.Context()),
+		AlbumId: albumId,
+		Actor:   params.Actor,
+		Since:   params.Since,
+		Limit:   params.Limit,
+	}
+	switch {
+	case query.Limit == 0:
+		query.Limit = this.Pagination.DefaultPageSize
+	case query.Limit > this.Pagination.MaxPageSize:
+		query.Limit = this.Pagination.MaxPageSize
+	}
+
+	records, err := this.Sink.Query(c.Request.Context(), query)
+	if err != nil {
+		resp := NewErrorResponse(err)
+		writeProblem(c, resp.Code, resp.Error)
+		return
+	}
+	if records == nil {
+		records = []api.AuditRecord{}
+	}
+
+	c.JSON(http.StatusOK, api.ResponseBody{Data: records})
+}
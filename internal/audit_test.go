@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func InitAuditedService(t *testing.T) (*AuditedService, *InMemoryAuditSink) {
+	logger, err := NewLogger(api.LoggingConfig{}, &bytes.Buffer{}, nil)
+	assert.Nil(t, err)
+
+	backend, _ := NewInMemoryService(NewXidGenerator())
+	sink := NewInMemoryAuditSink()
+	return NewAuditedService(backend, sink, NewXidGenerator(), logger), sink
+}
+
+func AuditContext(subject string, requestId string) context.Context {
+	ctx := api.ContextWithPrincipal(context.Background(), &api.Principal{Subject: subject, Method: authModeJwt})
+	return ContextWithRequestId(ctx, requestId)
+}
+
+func TestAuditedService_AlbumChanges_RecordSnapshots(t *testing.T) {
+	service, sink := InitAuditedService(t)
+	ctx := AuditContext("editor-1", "request-1")
+
+	album := service.InsertAlbum(ctx, api.AlbumPropertiesDTO{Title: "title 1", Artist: "artist 1", Price: 1.11}).Body.Data.(api.Album)
+	updated := service.UpdateAlbum(ctx, album.Id, api.AlbumUpdatesDTO{Price: 2.22}, 0).Body.Data.(api.Album)
+	service.DeleteAlbum(ctx, album.Id, 0)
+
+	assert.Len(t, sink.Records, 3)
+	insert, update, deletion := sink.Records[0], sink.Records[1], sink.Records[2]
+
+	assert.Equal(t, api.AuditActionInsert, insert.Action)
+	assert.Equal(t, album.Id, insert.AlbumId)
+	assert.Equal(t, "editor-1", insert.Actor)
+	assert.Equal(t, authModeJwt, insert.Method)
+	assert.Equal(t, "request-1", insert.RequestId)
+	assert.Nil(t, insert.Before)
+	assert.Equal(t, album, *insert.After)
+
+	assert.Equal(t, api.AuditActionUpdate, update.Action)
+	assert.Equal(t, album, *update.Before)
+	assert.Equal(t, updated, *update.After)
+
+	assert.Equal(t, api.AuditActionDelete, deletion.Action)
+	assert.Equal(t, album.Id, deletion.AlbumId)
+	assert.Equal(t, updated, *deletion.Before)
+	assert.Nil(t, deletion.After)
+}
+
+// racingService makes another change of an album before each of the first
+// Races updates, as a concurrent request would between snapshot and write.
+type racingService struct {
+	api.Service
+	Races int
+}
+
+func (this *racingService) UpdateAlbum(ctx context.Context, id string, updates api.AlbumUpdatesDTO, expectedVersion int64) api.HandlerResponse {
+	if this.Races > 0 {
+		this.Races--
+		this.Service.UpdateAlbum(ctx, id, api.AlbumUpdatesDTO{Title: "raced"}, 0)
+	}
+	return this.Service.UpdateAlbum(ctx, id, updates, expectedVersion)
+}
+
+func TestAuditedService_RacedChange_RetryOrMarkUnverified(t *testing.T) {
+	service, sink := InitAuditedService(t)
+	ctx := AuditContext("editor-1", "request-1")
+	album := service.InsertAlbum(ctx, api.AlbumPropertiesDTO{Title: "title 1", Artist: "artist 1", Price: 1.11}).Body.Data.(api.Album)
+	racing := &racingService{Service: service.Service}
+	service.Service = racing
+
+	racing.Races = 1
+	resp := service.UpdateAlbum(ctx, album.Id, api.AlbumUpdatesDTO{Price: 2.22}, 0)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	update := sink.Records[1]
+	assert.Equal(t, int64(2), update.Before.Version)
+	assert.Equal(t, "raced", update.Before.Title)
+	assert.False(t, update.Unverified)
+
+	racing.Races = auditChangeAttempts
+	resp = service.UpdateAlbum(ctx, album.Id, api.AlbumUpdatesDTO{Price: 3.33}, 0)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.True(t, sink.Records[2].Unverified)
+
+	racing.Races = 1
+	resp = service.UpdateAlbum(ctx, album.Id, api.AlbumUpdatesDTO{Price: 4.44}, resp.Body.Data.(api.Album).Version)
+	assert.Equal(t, http.StatusPreconditionFailed, resp.Code)
+	assert.Len(t, sink.Records, 3)
+}
+
+func TestAuditedService_FailedChange_NotRecorded(t *testing.T) {
+	service, sink := InitAuditedService(t)
+	ctx := AuditContext("editor-1", "request-1")
+
+	resp := service.ReplaceAlbum(ctx, "missing", api.AlbumPropertiesDTO{Title: "title 1", Artist: "artist 1", Price: 1.11}, 0)
+
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	assert.Empty(t, sink.Records)
+}
+
+func TestSqliteAuditSink_Query_FilterRecords(t *testing.T) {
+	sink := NewSqlAuditSink(&InitSqliteService(t, ":memory:").SqlService)
+	AssertAuditSinkQuery(t, sink)
+}
+
+func TestFileAuditSink_Query_FilterRecords(t *testing.T) {
+	sink, err := NewFileAuditSink(filepath.Join(t.TempDir(), "audit.log"))
+	assert.Nil(t, err)
+	defer sink.Close()
+
+	AssertAuditSinkQuery(t, sink)
+}
+
+func TestStdoutAuditSink_Query_ReturnNotImplemented(t *testing.T) {
+	var output bytes.Buffer
+	sink := &JsonLinesAuditSink{Writer: &output}
+
+	assert.Nil(t, sink.Append(context.Background(), api.AuditRecord{Id: "1", AlbumId: "a", Action: api.AuditActionInsert}))
+	_, err := sink.Query(context.Background(), api.AuditQuery{Limit: 10})
+
+	assert.Equal(t, "{\"Id\":\"1\",\"AlbumId\":\"a\",\"Action\":\"insert\",\"Actor\":\"\",\"Time\":0}\n", output.String())
+	assert.Equal(t, http.StatusNotImplemented, api.AsError(err, 0).Kind.Status)
+}
+
+func TestAuditHandler_GetAudit_ListRecordsOfActor(t *testing.T) {
+	sink := NewInMemoryAuditSink()
+	records := AppendAuditRecords(t, sink)
+	handler := NewAuditHandler(sink, api.AppConfig{})
+
+	router := gin.New()
+	router.GET("/albums/:id/audit", handler.GetAlbumAudit)
+	router.GET("/audit", handler.GetAudit)
+
+	var body struct{ Data []api.AuditRecord }
+	response := SendAuditRequest(router, "/audit?actor=editor-2")
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, []api.AuditRecord{records[2]}, body.Data)
+
+	response = SendAuditRequest(router, "/albums/album-1/audit?since=2000&limit=1")
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, []api.AuditRecord{records[1]}, body.Data)
+
+	assert.Equal(t, http.StatusBadRequest, SendAuditRequest(router, "/audit?since=-1").Code)
+}
+
+// AssertAuditSinkQuery checks the filters and ordering every sink must honor.
+func AssertAuditSinkQuery(t *testing.T, sink api.AuditSink) {
+	records := AppendAuditRecords(t, sink)
+	ctx := context.Background()
+
+	found, err := sink.Query(ctx, api.AuditQuery{AlbumId: "album-1", Limit: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, []api.AuditRecord{records[0], records[1]}, found)
+
+	found, _ = sink.Query(ctx, api.AuditQuery{Actor: "editor-2", Limit: 10})
+	assert.Equal(t, []api.AuditRecord{records[2]}, found)
+
+	found, _ = sink.Query(ctx, api.AuditQuery{Since: 2000, Limit: 1})
+	assert.Equal(t, []api.AuditRecord{records[1]}, found)
+
+	found, _ = sink.Query(ctx, api.AuditQuery{Tenant: "acme", Limit: 10})
+	assert.Equal(t, []api.AuditRecord{records[3]}, found)
+}
+
+func AppendAuditRecords(t *testing.T, sink api.AuditSink) []api.AuditRecord {
+	album := api.Album{Id: "album-1", Title: "title 1", Artist: "artist 1", Price: 1.11, Version: 1}
+	replaced := album
+	replaced.Price, replaced.Version = 2.22, 2
+
+	records := []api.AuditRecord{
+		{Id: "1", AlbumId: "album-1", Action: api.AuditActionInsert, Actor: "editor-1", Method: authModeJwt, RequestId: "request-1", Time: 1000, After: &album},
+		{Id: "2", AlbumId: "album-1", Action: api.AuditActionReplace, Actor: "editor-1", Method: authModeJwt, RequestId: "request-2", Time: 2000, Before: &album, After: &replaced},
+		{Id: "3", AlbumId: "album-2", Action: api.AuditActionDelete, Actor: "editor-2", Time: 3000, Before: &album},
+		{Id: "4", Tenant: "acme", AlbumId: "album-1", Action: api.AuditActionUpdate, Actor: "editor-1", Time: 4000, Before: &album, After: &replaced, Unverified: true},
+	}
+	for _, record := range records {
+		assert.Nil(t, sink.Append(context.Background(), record))
+	}
+	return records
+}
+
+func SendAuditRequest(router *gin.Engine, url string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(http.MethodGet, url, nil)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	return response
+}
@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	authModeJwt = "jwt"
+)
+
+// Authenticator is one way for callers to prove who they are.
+type Authenticator interface {
+	// Authenticate returns nil and no error when request carries no
+	// credential of this kind, so another Authenticator can be tried. An
+	// *api.Error of another kind than KindUnauthorized is reported as is.
+	Authenticate(request *http.Request) (*api.Principal, error)
+	// Challenge is the WWW-Authenticate value sent with 401 responses.
+	Challenge() string
+}
+
+// NewAuthenticators builds an Authenticator per mode of config, in order.
+// API keys are looked up in apiKeys.
+func NewAuthenticators(ctx context.Context, config api.AuthConfig, apiKeys api.ApiKeyStore, logger *slog.Logger) ([]Authenticator, error) {
+	var authenticators []Authenticator
+	for _, mode := range config.Modes {
+		switch mode {
+		case authModeJwt:
+			authenticator, err := NewJwtAuthenticator(ctx, config.Jwt)
+			if err != nil {
+				return nil, err
+			}
+			authenticators = append(authenticators, authenticator)
+		case authModeApiKey:
+			authenticators = append(authenticators, NewApiKeyAuthenticator(apiKeys, logger))
+		default:
+			return nil, fmt.Errorf("unsupported auth mode %q", mode)
+		}
+	}
+
+	return authenticators, nil
+}
+
+// NewAuthMiddleware rejects requests that don't authenticate with one of
+// authenticators with 401, and puts the caller of the others in the request
+// context, see api.PrincipalFromContext.
+func NewAuthMiddleware(authenticators []Authenticator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, authenticator := range authenticators {
+			principal, err := authenticator.Authenticate(c.Request)
+			var apiErr *api.Error
+			if errors.As(err, &apiErr) && apiErr.Kind != api.KindUnauthorized {
+				writeProblem(c, apiErr.Kind.Status, err)
+				return
+			}
+			if err != nil {
+				c.Header("WWW-Authenticate", authenticator.Challenge()+`, error="invalid_token"`)
+				writeProblem(c, http.StatusUnauthorized, &api.Error{Kind: api.KindUnauthorized, Detail: err.Error(), Cause: err})
+				return
+			}
+			if principal != nil {
+				c.Request = c.Request.WithContext(api.ContextWithPrincipal(c.Request.Context(), principal))
+				c.Next()
+				return
+			}
+		}
+
+		for _, authenticator := range authenticators {
+			c.Header("WWW-Authenticate", authenticator.Challenge())
+		}
+		writeProblem(c, http.StatusUnauthorized, api.NewError(api.KindUnauthorized, "request has no credentials"))
+	}
+}
+
+// NewJwtAuthenticator accepts bearer tokens signed by a key of the configured JWKS.
+func NewJwtAuthenticator(ctx context.Context, config api.JwtConfig) (*JwtAuthenticator, error) {
+	keys, err := NewJwksKeySource(ctx, config.JwksFile, config.JwksUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"HS256", "RS256", "ES256"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Duration(config.LeewaySeconds) * time.Second),
+	}
+	if config.Issuer != "" {
+		options = append(options, jwt.WithIssuer(config.Issuer))
+	}
+	if config.Audience != "" {
+		options = append(options, jwt.WithAudience(config.Audience))
+	}
+
+	return &JwtAuthenticator{Keys: keys, Parser: jwt.NewParser(options...), TenantClaim: config.TenantClaim}, nil
+}
+
+type JwtAuthenticator struct {
+	Keys        *JwksKeySource
+	Parser      *jwt.Parser
+	TenantClaim string
+}
+
+func (this *JwtAuthenticator) Challenge() string {
+	return `Bearer realm="albums"`
+}
+
+func (this *JwtAuthenticator) Authenticate(request *http.Request) (*api.Principal, error) {
+	scheme, token, found := strings.Cut(request.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return nil, nil
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := this.Parser.ParseWithClaims(strings.TrimSpace(token), claims, func(token *jwt.Token) (any, error) {
+		id, _ := token.Header["kid"].(string)
+		return this.Keys.Lookup(request.Context(), id, token.Method.Alg())
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bearer token rejected: %w", err)
+	}
+
+	subject, err := claims.GetSubject()
+	if err != nil || subject == "" {
+		return nil, errors.New("bearer token rejected: token has no sub claim")
+	}
+	issuer, _ := claims.GetIssuer()
+	var tenant string
+	if this.TenantClaim != "" {
+		tenant, _ = claims[this.TenantClaim].(string)
+	}
+
+	return &api.Principal{
+		Subject: subject,
+		Issuer:  issuer,
+		Method:  authModeJwt,
+		Scopes:  jwtScopes(claims),
+		Roles:   jwtList(claims["roles"]),
+		Tenant:  tenant,
+		Claims:  claims,
+	}, nil
+}
+
+// jwtScopes reads the space separated scope claim, or the scp list some
+// issuers use instead.
+func jwtScopes(claims jwt.MapClaims) []string {
+	if scope, ok := claims["scope"]; ok {
+		return jwtList(scope)
+	}
+	return jwtList(claims["scp"])
+}
+
+// jwtList reads a claim holding either a list or a space separated string.
+func jwtList(claim any) []string {
+	if value, ok := claim.(string); ok {
+		return strings.Fields(value)
+	}
+
+	var items []string
+	if list, ok := claim.([]any); ok {
+		for _, item := range list {
+			if value, ok := item.(string); ok {
+				items = append(items, value)
+			}
+		}
+	}
+
+	return items
+}
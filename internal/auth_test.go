@@ -0,0 +1,249 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+type TestSigningKeys struct {
+	Rsa    *rsa.PrivateKey
+	Ec     *ecdsa.PrivateKey
+	Secret []byte
+}
+
+func NewTestSigningKeys(t *testing.T) TestSigningKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	return TestSigningKeys{Rsa: rsaKey, Ec: ecKey, Secret: []byte("0123456789abcdef0123456789abcdef")}
+}
+
+func (this TestSigningKeys) Jwks() []byte {
+	encode := func(value *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(value.Bytes())
+	}
+
+	raw, _ := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa-1", "alg": "RS256", "use": "sig", "n": encode(this.Rsa.N), "e": encode(big.NewInt(int64(this.Rsa.E)))},
+		{"kty": "EC", "kid": "ec-1", "crv": "P-256", "x": encode(this.Ec.X), "y": encode(this.Ec.Y)},
+		{"kty": "oct", "kid": "hs-1", "k": base64.RawURLEncoding.EncodeToString(this.Secret)},
+	}})
+	return raw
+}
+
+func (this TestSigningKeys) Sign(t *testing.T, method jwt.SigningMethod, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+
+	var key any
+	switch method {
+	case jwt.SigningMethodRS256:
+		key = this.Rsa
+	case jwt.SigningMethodES256:
+		key = this.Ec
+	default:
+		key = this.Secret
+	}
+
+	signed, err := token.SignedString(key)
+	assert.Nil(t, err)
+	return signed
+}
+
+func ValidClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"sub":   "user-1",
+		"iss":   "https://issuer.example",
+		"aud":   "albums-api",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"scope": "albums:read albums:write",
+	}
+}
+
+func InitAuthRouter(t *testing.T, keys TestSigningKeys) *gin.Engine {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	assert.Nil(t, os.WriteFile(path, keys.Jwks(), 0o600))
+
+	config := api.AuthConfig{
+		Modes: []string{"jwt"},
+		Jwt:   api.JwtConfig{JwksFile: path, Issuer: "https://issuer.example", Audience: "albums-api"},
+	}
+	authenticators, err := NewAuthenticators(context.Background(), config, nil, nil)
+	assert.Nil(t, err)
+
+	router := gin.New()
+	router.GET("/albums", NewAuthMiddleware(authenticators), func(c *gin.Context) {
+		c.JSON(http.StatusOK, api.PrincipalFromContext(c.Request.Context()))
+	})
+	return router
+}
+
+func SendAuthRequest(router *gin.Engine, authorization string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(http.MethodGet, "/albums", nil)
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	return response
+}
+
+func TestAuthMiddleware_ValidTokens_PrincipalInContext(t *testing.T) {
+	keys := NewTestSigningKeys(t)
+	router := InitAuthRouter(t, keys)
+
+	for method, kid := range map[jwt.SigningMethod]string{
+		jwt.SigningMethodRS256: "rsa-1",
+		jwt.SigningMethodES256: "ec-1",
+		jwt.SigningMethodHS256: "hs-1",
+	} {
+		response := SendAuthRequest(router, "Bearer "+keys.Sign(t, method, kid, ValidClaims()))
+
+		var principal api.Principal
+		json.Unmarshal(response.Body.Bytes(), &principal)
+		assert.Equal(t, http.StatusOK, response.Code, method.Alg())
+		assert.Equal(t, "user-1", principal.Subject)
+		assert.Equal(t, "jwt", principal.Method)
+		assert.Equal(t, []string{"albums:read", "albums:write"}, principal.Scopes)
+	}
+}
+
+func TestAuthMiddleware_InvalidTokens_ReturnUnauthorized(t *testing.T) {
+	keys := NewTestSigningKeys(t)
+	router := InitAuthRouter(t, keys)
+	withClaim := func(name string, value any) jwt.MapClaims {
+		claims := ValidClaims()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	cases := map[string]string{
+		"expired":        keys.Sign(t, jwt.SigningMethodRS256, "rsa-1", withClaim("exp", time.Now().Add(-time.Minute).Unix())),
+		"no exp":         keys.Sign(t, jwt.SigningMethodRS256, "rsa-1", withClaim("exp", nil)),
+		"not yet valid":  keys.Sign(t, jwt.SigningMethodRS256, "rsa-1", withClaim("nbf", time.Now().Add(time.Hour).Unix())),
+		"wrong issuer":   keys.Sign(t, jwt.SigningMethodRS256, "rsa-1", withClaim("iss", "https://other.example")),
+		"wrong audience": keys.Sign(t, jwt.SigningMethodRS256, "rsa-1", withClaim("aud", "other-api")),
+		"no subject":     keys.Sign(t, jwt.SigningMethodRS256, "rsa-1", withClaim("sub", nil)),
+		"unknown kid":    keys.Sign(t, jwt.SigningMethodRS256, "rsa-2", ValidClaims()),
+		"kid of HS key":  keys.Sign(t, jwt.SigningMethodRS256, "hs-1", ValidClaims()),
+		"unsigned":       "eyJhbGciOiJub25lIiwidHlwIjoiSldUIn0.eyJzdWIiOiJ1c2VyLTEifQ.",
+		"not a jwt":      "garbage",
+		"truncated":      keys.Sign(t, jwt.SigningMethodHS256, "hs-1", ValidClaims())[:20] + "x",
+		"HS512":          keys.Sign(t, jwt.SigningMethodHS512, "hs-1", ValidClaims()),
+	}
+	for name, token := range cases {
+		response := SendAuthRequest(router, "Bearer "+token)
+
+		assert.Equal(t, http.StatusUnauthorized, response.Code, name)
+		assert.Equal(t, api.ProblemContentType, response.Header().Get("Content-Type"), name)
+		assert.Contains(t, response.Header().Get("WWW-Authenticate"), `error="invalid_token"`, name)
+	}
+}
+
+func TestAuthMiddleware_NoCredentials_ReturnChallenge(t *testing.T) {
+	router := InitAuthRouter(t, NewTestSigningKeys(t))
+
+	for _, authorization := range []string{"", "Basic dXNlcjpwYXNz"} {
+		response := SendAuthRequest(router, authorization)
+
+		assert.Equal(t, http.StatusUnauthorized, response.Code)
+		assert.Equal(t, `Bearer realm="albums"`, response.Header().Get("WWW-Authenticate"))
+		assert.Contains(t, response.Body.String(), api.KindUnauthorized.Type)
+	}
+}
+
+func TestJwksKeySource_Url_RefetchOnUnknownKeyId(t *testing.T) {
+	keys := NewTestSigningKeys(t)
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write(keys.Jwks())
+	}))
+	defer server.Close()
+
+	source, err := NewJwksKeySource(context.Background(), "", server.URL)
+	assert.Nil(t, err)
+
+	key, err := source.Lookup(context.Background(), "ec-1", "ES256")
+	assert.Nil(t, err)
+	assert.Equal(t, &keys.Ec.PublicKey, key)
+
+	_, err = source.Lookup(context.Background(), "rsa-2", "RS256")
+	assert.Error(t, err)
+	assert.Equal(t, 1, fetches, "refetched before the refresh interval")
+
+	source.fetchedAt = time.Now().Add(-jwksRefreshInterval)
+	_, err = source.Lookup(context.Background(), "rsa-2", "RS256")
+	assert.Error(t, err)
+	assert.Equal(t, 2, fetches)
+}
+
+func TestJwksKeySource_SlowRefetch_KnownKeysStillServed(t *testing.T) {
+	keys := NewTestSigningKeys(t)
+	release := make(chan struct{})
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) > 1 {
+			<-release
+		}
+		w.Write(keys.Jwks())
+	}))
+	defer server.Close()
+	defer close(release)
+
+	source, err := NewJwksKeySource(context.Background(), "", server.URL)
+	assert.Nil(t, err)
+	source.fetchedAt = time.Now().Add(-jwksRefreshInterval)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			source.Lookup(context.Background(), "rsa-2", "RS256")
+		}()
+	}
+	assert.Eventually(t, func() bool { return fetches.Load() == 2 }, time.Second, time.Millisecond)
+
+	key, err := source.Lookup(context.Background(), "ec-1", "ES256")
+	assert.Nil(t, err, "a known key doesn't wait for the refetch")
+	assert.Equal(t, &keys.Ec.PublicKey, key)
+
+	release <- struct{}{}
+	wg.Wait()
+	assert.Equal(t, int32(2), fetches.Load(), "concurrent lookups share one refetch")
+}
+
+func TestParseJwks_NoSigningKeys_ReturnError(t *testing.T) {
+	_, err := parseJwks([]byte(`{"keys": [{"kty": "RSA", "use": "enc", "n": "AQAB", "e": "AQAB"}]}`))
+	assert.Error(t, err)
+
+	_, err = parseJwks([]byte(`{"keys": [{"kty": "EC", "crv": "P-256", "x": "AQAB", "y": "AQAB"}]}`))
+	assert.ErrorContains(t, err, "P-256")
+}
@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// NewAuthorizedService decorates service with the access policy, operations
+// the caller isn't granted fail with 403, are logged as audit entries and
+// appended to sink unless it is nil. Tenants with their own policy in
+// config.TenancyConfig use it instead.
+func NewAuthorizedService(service api.Service, config api.AppConfig, sink api.AuditSink, idGen api.IdGenerator, logger *slog.Logger) *AuthorizedService {
+	tenantPolicies := map[string]api.AccessPolicyConfig{}
+	for tenant, override := range config.TenancyConfig.Tenants {
+		if override.AccessPolicy != nil {
+			tenantPolicies[tenant] = *override.AccessPolicy
+		}
+	}
+
+	return &AuthorizedService{
+		Service:        service,
+		Policy:         config.AccessPolicy,
+		TenantPolicies: tenantPolicies,
+		Sink:           sink,
+		IdGen:          idGen,
+		Logger:         logger,
+	}
+}
+
+type AuthorizedService struct {
+	Service        api.Service
+	Policy         api.AccessPolicyConfig
+	TenantPolicies map[string]api.AccessPolicyConfig
+	Sink           api.AuditSink
+	IdGen          api.IdGenerator
+	Logger         *slog.Logger
+}
+
+// authorize returns nil when the caller may perform operation, on album id
+// when it isn't empty, or the response to send instead.
+func (this *AuthorizedService) authorize(ctx context.Context, operation string, id string) *api.HandlerResponse {
+	tenant := api.TenantFromContext(ctx)
+	policy, found := this.TenantPolicies[tenant]
+	if !found {
+		policy = this.Policy
+	}
+
+	principal := api.PrincipalFromContext(ctx)
+	if principal == nil || len(policy.Roles) == 0 {
+		return nil
+	}
+
+	for _, role := range principal.Roles {
+		if slices.Contains(policy.Roles[role], operation) {
+			return nil
+		}
+	}
+
+	if id != "" && slices.Contains(policy.OwnerOperations, operation) {
+		resp := this.Service.GetAlbumById(ctx, id)
+		if resp.Error != nil && resp.Code != http.StatusNotFound {
+			return &resp
+		}
+		if album, ok := resp.Body.Data.(api.Album); ok && album.OwnerId != "" && album.OwnerId == principal.Subject {
+			return nil
+		}
+	}
+
+	this.Logger.LogAttrs(ctx, slog.LevelWarn, "access denied",
+		slog.String("audit", "access_denied"),
+		slog.String("actor", principal.Subject),
+		slog.String("method", principal.Method),
+		slog.String("tenant", tenant),
+		slog.Any("roles", principal.Roles),
+		slog.String("operation", operation),
+		slog.String("albumId", id),
+	)
+	this.recordDenial(ctx, operation, id, principal)
+	resp := api.NewError(api.KindForbidden, "operation "+operation+" is not granted to the caller").Response()
+	return &resp
+}
+
+// recordDenial appends the denial of operation to the audit sink, failures
+// being logged since the denial itself is already logged.
+func (this *AuthorizedService) recordDenial(ctx context.Context, operation string, id string, principal *api.Principal) {
+	if this.Sink == nil {
+		return
+	}
+
+	record := api.AuditRecord{
+		Id:        this.IdGen.NextId(),
+		Tenant:    api.TenantFromContext(ctx),
+		AlbumId:   id,
+		Action:    api.AuditActionDenied + operation,
+		Actor:     principal.Subject,
+		Method:    principal.Method,
+		RequestId: RequestIdFromContext(ctx),
+		Time:      time.Now().UnixMilli(),
+	}
+	if err := this.Sink.Append(context.WithoutCancel(ctx), record); err != nil {
+		this.Logger.LogAttrs(ctx, slog.LevelError, "failed to append audit record",
+			slog.Any("error", err),
+			slog.Any("record", record),
+		)
+	}
+}
+
+func (this *AuthorizedService) GetAlbums(ctx context.Context, query api.AlbumQueryDTO) api.HandlerResponse {
+	if denied := this.authorize(ctx, api.OperationRead, ""); denied != nil {
+		return *denied
+	}
+	return this.Service.GetAlbums(ctx, query)
+}
+
+func (this *AuthorizedService) GetAlbumById(ctx context.Context, id string) api.HandlerResponse {
+	if denied := this.authorize(ctx, api.OperationRead, id); denied != nil {
+		return *denied
+	}
+	return this.Service.GetAlbumById(ctx, id)
+}
+
+func (this *AuthorizedService) InsertAlbum(ctx context.Context, props api.AlbumPropertiesDTO) api.HandlerResponse {
+	if denied := this.authorize(ctx, api.OperationCreate, ""); denied != nil {
+		return *denied
+	}
+	return this.Service.InsertAlbum(ctx, props)
+}
+
+func (this *AuthorizedService) ReplaceAlbum(ctx context.Context, id string, props api.AlbumPropertiesDTO, expectedVersion int64) api.HandlerResponse {
+	if denied := this.authorize(ctx, api.OperationUpdate, id); denied != nil {
+		return *denied
+	}
+	return this.Service.ReplaceAlbum(ctx, id, props, expectedVersion)
+}
+
+func (this *AuthorizedService) UpdateAlbum(ctx context.Context, id string, updates api.AlbumUpdatesDTO, expectedVersion int64) api.HandlerResponse {
+	if denied := this.authorize(ctx, api.OperationUpdate, id); denied != nil {
+		return *denied
+	}
+	return this.Service.UpdateAlbum(ctx, id, updates, expectedVersion)
+}
+
+func (this *AuthorizedService) DeleteAlbum(ctx context.Context, id string, expectedVersion int64) api.HandlerResponse {
+	if denied := this.authorize(ctx, api.OperationDelete, id); denied != nil {
+		return *denied
+	}
+	return this.Service.DeleteAlbum(ctx, id, expectedVersion)
+}
+
+func (this *AuthorizedService) Close(ctx context.Context) error {
+	return this.Service.Close(ctx)
+}
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func InitAuthorizedService(t *testing.T) (*AuthorizedService, *bytes.Buffer) {
+	var output bytes.Buffer
+	logger, err := NewLogger(api.LoggingConfig{}, &output, nil)
+	assert.Nil(t, err)
+
+	backend, _ := NewInMemoryService(NewXidGenerator())
+	config := api.AppConfig{}
+	config.AccessPolicy = api.AccessPolicyConfig{
+		Roles: map[string][]string{
+			"viewer":      {api.OperationRead},
+			"contributor": {api.OperationRead, api.OperationCreate},
+			"editor":      {api.OperationRead, api.OperationCreate, api.OperationUpdate},
+			"admin":       {api.OperationRead, api.OperationCreate, api.OperationUpdate, api.OperationDelete},
+		},
+		OwnerOperations: []string{api.OperationUpdate},
+	}
+
+	config.TenancyConfig.Tenants = map[string]api.TenantConfig{
+		"readonly": {AccessPolicy: &api.AccessPolicyConfig{
+			Roles: map[string][]string{"admin": {api.OperationRead}},
+		}},
+	}
+
+	return NewAuthorizedService(backend, config, NewInMemoryAuditSink(), NewXidGenerator(), logger), &output
+}
+
+func CallerContext(subject string, roles ...string) context.Context {
+	return api.ContextWithPrincipal(context.Background(), &api.Principal{Subject: subject, Roles: roles})
+}
+
+func TestAuthorizedService_RolePolicy_GrantOperationsOfRoles(t *testing.T) {
+	service, _ := InitAuthorizedService(t)
+	props := api.AlbumPropertiesDTO{Title: "title 1", Artist: "artist 1", Price: 1.11}
+	album := service.InsertAlbum(CallerContext("editor-1", "editor"), props).Body.Data.(api.Album)
+
+	viewer := CallerContext("viewer-1", "viewer")
+	assert.Equal(t, http.StatusOK, service.GetAlbumById(viewer, album.Id).Code)
+	assert.Equal(t, http.StatusForbidden, service.InsertAlbum(viewer, props).Code)
+
+	editor := CallerContext("editor-2", "editor")
+	assert.Equal(t, http.StatusOK, service.ReplaceAlbum(editor, album.Id, props, 0).Code)
+	assert.Equal(t, http.StatusForbidden, service.DeleteAlbum(editor, album.Id, 0).Code)
+
+	assert.Equal(t, http.StatusOK, service.DeleteAlbum(CallerContext("admin-1", "admin"), album.Id, 0).Code)
+}
+
+func TestAuthorizedService_OwnerOperations_GrantOwnAlbumsOnly(t *testing.T) {
+	service, _ := InitAuthorizedService(t)
+	owner := CallerContext("contributor-1", "contributor")
+	album := service.InsertAlbum(owner, api.AlbumPropertiesDTO{Title: "title 1", Artist: "artist 1", Price: 1.11}).Body.Data.(api.Album)
+	assert.Equal(t, "contributor-1", album.OwnerId)
+
+	updates := api.AlbumUpdatesDTO{Price: 2.22}
+	assert.Equal(t, http.StatusOK, service.UpdateAlbum(owner, album.Id, updates, 0).Code)
+	assert.Equal(t, http.StatusForbidden, service.UpdateAlbum(CallerContext("contributor-2", "contributor"), album.Id, updates, 0).Code)
+	assert.Equal(t, http.StatusForbidden, service.UpdateAlbum(owner, "missing", updates, 0).Code)
+	assert.Equal(t, http.StatusForbidden, service.DeleteAlbum(owner, album.Id, 0).Code)
+}
+
+func TestAuthorizedService_Denied_ProblemAndAuditEntry(t *testing.T) {
+	service, output := InitAuthorizedService(t)
+
+	resp := service.DeleteAlbum(ContextWithRequestId(CallerContext("viewer-1", "viewer"), "request-1"), "albumId", 0)
+
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Equal(t, api.KindForbidden, api.AsError(resp.Error, resp.Code).Kind)
+
+	lines := DecodeLogLines(t, output)
+	assert.Len(t, lines, 1)
+	assert.Equal(t, "access_denied", lines[0]["audit"])
+	assert.Equal(t, "viewer-1", lines[0]["actor"])
+	assert.Equal(t, api.OperationDelete, lines[0]["operation"])
+	assert.Equal(t, "albumId", lines[0]["albumId"])
+
+	records := service.Sink.(*InMemoryAuditSink).Records
+	assert.Len(t, records, 1)
+	assert.Equal(t, "denied:delete", records[0].Action)
+	assert.Equal(t, "albumId", records[0].AlbumId)
+	assert.Equal(t, "viewer-1", records[0].Actor)
+	assert.Equal(t, "request-1", records[0].RequestId)
+	assert.Nil(t, records[0].Before)
+}
+
+func TestAuthorizedService_Unauthenticated_AllowEverything(t *testing.T) {
+	service, output := InitAuthorizedService(t)
+
+	resp := service.InsertAlbum(context.Background(), api.AlbumPropertiesDTO{Title: "title 1", Artist: "artist 1", Price: 1.11})
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Empty(t, resp.Body.Data.(api.Album).OwnerId)
+	assert.Empty(t, output.String())
+}
+
+func TestAuthorizedService_TenantPolicy_OverrideDefaultPolicy(t *testing.T) {
+	service, _ := InitAuthorizedService(t)
+	props := api.AlbumPropertiesDTO{Title: "title 1", Artist: "artist 1", Price: 1.11}
+
+	admin := api.ContextWithTenant(CallerContext("admin-1", "admin"), "readonly")
+	assert.Equal(t, http.StatusForbidden, service.InsertAlbum(admin, props).Code)
+	assert.Equal(t, http.StatusOK, service.GetAlbums(admin, api.AlbumQueryDTO{Limit: 10}).Code)
+
+	other := api.ContextWithTenant(CallerContext("admin-1", "admin"), "other")
+	assert.Equal(t, http.StatusOK, service.InsertAlbum(other, props).Code)
+}
@@ -0,0 +1,355 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ConfigFileEnv names the config file when the -config flag isn't given.
+const ConfigFileEnv = "APP_CONFIG_FILE"
+
+const (
+	configEnvPrefix     = "APP"
+	configEnvFileSuffix = "_FILE"
+)
+
+// DefaultAppConfig is the configuration before the config file and the
+// environment are applied, it runs the in memory backend on :8080.
+func DefaultAppConfig() api.AppConfig {
+	return api.AppConfig{
+		DbType:            "inmemory",
+		PaginationConfig:  api.PaginationConfig{DefaultPageSize: defaultPageSize, MaxPageSize: maxPageSize},
+		IdempotencyConfig: api.IdempotencyConfig{TtlSeconds: 86400},
+		TracingConfig:     api.TracingConfig{Exporter: "off", ServiceName: defaultServiceName},
+		LoggingConfig:     api.LoggingConfig{Level: "info", Format: "json"},
+		HealthConfig:      api.HealthConfig{CacheMillis: defaultHealthCacheMillis, CheckTimeoutMillis: defaultHealthCheckTimeoutMillis},
+		ServerConfig:      api.ServerConfig{Addr: ":8080", DrainTimeoutSeconds: 30},
+		RateLimitConfig: api.RateLimitConfig{
+			Store: rateLimitStoreMemory,
+			Read:  api.RateLimitRule{RequestsPerMinute: 600, Burst: 100},
+			Write: api.RateLimitRule{RequestsPerMinute: 60, Burst: 20},
+		},
+		AuditConfig: api.AuditConfig{Sink: auditSinkBackend},
+		MongoConfig: api.MongoConfig{
+			Database:              "db-music",
+			Collection:            "albums",
+			IdempotencyCollection: "idempotency_keys",
+			ApiKeyCollection:      "api_keys",
+			RateLimitCollection:   "rate_limits",
+			AuditCollection:       "audit_log",
+			QueryTimeoutSeconds:   5,
+		},
+		DynamoDbConfig: api.DynamoDbConfig{
+			TableName:            "albums",
+			IdempotencyTableName: "idempotency_keys",
+			ApiKeyTableName:      "api_keys",
+			RateLimitTableName:   "rate_limits",
+			AuditTableName:       "audit_log",
+			QueryTimeoutSeconds:  5,
+		},
+		SqliteConfig: api.SqliteConfig{Path: "data/albums.db", BusyTimeoutMillis: 5000, QueryTimeoutSeconds: 5},
+		PostgresConfig: api.PostgresConfig{
+			MaxOpenConns:           10,
+			MaxIdleConns:           5,
+			ConnMaxLifetimeSeconds: 1800,
+			StatementTimeoutMillis: 5000,
+			QueryTimeoutSeconds:    5,
+		},
+	}
+}
+
+// LoadAppConfig layers the JSON file at path, skipped when path is empty,
+// and then the APP_* variables of environ over DefaultAppConfig, and
+// validates the result.
+//
+// Variables are named after the config keys, APP_DBTYPE sets dbType and
+// APP_MONGOCONFIG_HOSTS sets mongoConfig.hosts, lists being comma separated.
+// With the _FILE suffix, as in APP_POSTGRESCONFIG_DSN_FILE, a value is read
+// from a file so secrets can be mounted instead of set in the environment.
+func LoadAppConfig(path string, environ []string) (*api.AppConfig, error) {
+	config := DefaultAppConfig()
+	if path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		if err := json.Unmarshal(raw, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+	}
+
+	if err := applyConfigEnv(&config, environ); err != nil {
+		return nil, err
+	}
+
+	if err := ValidateAppConfig(config); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+func applyConfigEnv(config *api.AppConfig, environ []string) error {
+	values := map[string]string{}
+	for _, entry := range environ {
+		name, value, _ := strings.Cut(entry, "=")
+		if strings.HasPrefix(name, configEnvPrefix+"_") {
+			values[name] = value
+		}
+	}
+
+	var errs []error
+	forEachConfigField(reflect.ValueOf(config).Elem(), configEnvPrefix, func(name string, field reflect.Value) {
+		value, err := configEnvValue(values, name)
+		if err == nil && value != nil {
+			err = setConfigField(field, *value)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	})
+
+	return errors.Join(errs...)
+}
+
+// forEachConfigField calls fn with the variable name of every settable
+// field, maps such as BackendConfigs can only be set from the file.
+func forEachConfigField(value reflect.Value, prefix string, fn func(name string, field reflect.Value)) {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		name := prefix + "_" + strings.ToUpper(value.Type().Field(i).Name)
+		switch field.Kind() {
+		case reflect.Struct:
+			forEachConfigField(field, name, fn)
+		case reflect.Map:
+		default:
+			fn(name, field)
+		}
+	}
+}
+
+// configEnvValue returns the value of name, or the content of the file named
+// by name_FILE, or nil when neither is set.
+func configEnvValue(values map[string]string, name string) (*string, error) {
+	value, isSet := values[name]
+	path, isFileSet := values[name+configEnvFileSuffix]
+	switch {
+	case isSet && isFileSet:
+		return nil, fmt.Errorf("only one of %s and %s%s can be set", name, name, configEnvFileSuffix)
+	case isFileSet:
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s%s: %w", name, configEnvFileSuffix, err)
+		}
+		value = strings.TrimRight(string(content), "\r\n")
+		return &value, nil
+	case isSet:
+		return &value, nil
+	default:
+		return nil, nil
+	}
+}
+
+func setConfigField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int, reflect.Int64:
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		field.SetInt(parsed)
+	case reflect.Float64:
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		field.SetFloat(parsed)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		field.SetBool(parsed)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported list of %s", field.Type().Elem())
+		}
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+
+	return nil
+}
+
+// ValidateAppConfig reports every invalid setting at once, named by its
+// config key, including the ones the selected backend requires.
+func ValidateAppConfig(config api.AppConfig) error {
+	var errs []error
+	backend, ok := api.LookupBackend(config.DbType)
+	if !ok {
+		var names []string
+		for _, info := range api.Backends() {
+			names = append(names, info.Name)
+		}
+		errs = append(errs, fmt.Errorf("dbType %q is not one of %s", config.DbType, strings.Join(names, ", ")))
+	} else if backend.ValidateConfig != nil {
+		errs = append(errs, backend.ValidateConfig(config))
+	}
+
+	errs = append(errs, validatePagination("paginationConfig", config.PaginationConfig)...)
+
+	if _, err := NewLogger(config.LoggingConfig, io.Discard, nil); err != nil {
+		errs = append(errs, fmt.Errorf("loggingConfig: %w", err))
+	}
+
+	switch config.TracingConfig.Exporter {
+	case "", "off", "stdout", "otlp":
+	default:
+		errs = append(errs, fmt.Errorf("tracingConfig.exporter %q is not one of otlp, stdout, off", config.TracingConfig.Exporter))
+	}
+	if ratio := config.TracingConfig.SampleRatio; ratio < 0 || ratio > 1 {
+		errs = append(errs, fmt.Errorf("tracingConfig.sampleRatio %v is not between 0 and 1", ratio))
+	}
+
+	errs = append(errs, requireConfig("serverConfig.addr", config.ServerConfig.Addr))
+	if config.ServerConfig.DrainDelayMillis < 0 || config.ServerConfig.DrainTimeoutSeconds < 0 {
+		errs = append(errs, errors.New("serverConfig drain durations can't be negative"))
+	}
+	for _, proxy := range config.ServerConfig.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			errs = append(errs, fmt.Errorf("serverConfig.trustedProxies %q is not an IP or CIDR", proxy))
+		}
+	}
+
+	for _, mode := range config.AuthConfig.Modes {
+		switch mode {
+		case authModeJwt:
+			if config.AuthConfig.Jwt.JwksFile == "" && config.AuthConfig.Jwt.JwksUrl == "" {
+				errs = append(errs, errors.New("authConfig.jwt.jwksFile or jwksUrl is required"))
+			}
+		case authModeApiKey:
+			// keys are issued by the apikey command, a store in memory never sees them
+			if ok && backend.NewApiKeyStore == nil {
+				errs = append(errs, fmt.Errorf("authConfig.modes %q needs a dbType that keeps api keys, %q doesn't", mode, config.DbType))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("authConfig.modes %q is not one of %s, %s", mode, authModeJwt, authModeApiKey))
+		}
+	}
+
+	errs = append(errs, validateAccessPolicy("accessPolicy", config.AccessPolicy)...)
+
+	switch config.RateLimitConfig.Store {
+	case "", rateLimitStoreMemory, rateLimitStoreBackend:
+	default:
+		errs = append(errs, fmt.Errorf("rateLimitConfig.store %q is not one of %s, %s", config.RateLimitConfig.Store, rateLimitStoreMemory, rateLimitStoreBackend))
+	}
+	errs = append(errs, validateRateLimitRule("rateLimitConfig.read", config.RateLimitConfig.Read)...)
+	errs = append(errs, validateRateLimitRule("rateLimitConfig.write", config.RateLimitConfig.Write)...)
+	errs = append(errs, validateRateLimitRule("rateLimitConfig.ip", config.RateLimitConfig.Ip)...)
+	for client, rules := range config.RateLimitConfig.Clients {
+		if rules.Read != nil {
+			errs = append(errs, validateRateLimitRule("rateLimitConfig.clients."+client+".read", *rules.Read)...)
+		}
+		if rules.Write != nil {
+			errs = append(errs, validateRateLimitRule("rateLimitConfig.clients."+client+".write", *rules.Write)...)
+		}
+	}
+
+	switch config.AuditConfig.Sink {
+	case "", auditSinkBackend, auditSinkStdout:
+	case auditSinkFile:
+		if config.AuditConfig.Enabled {
+			errs = append(errs, requireConfig("auditConfig.file", config.AuditConfig.File))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("auditConfig.sink %q is not one of %s, %s, %s", config.AuditConfig.Sink, auditSinkBackend, auditSinkFile, auditSinkStdout))
+	}
+
+	tenancy := config.TenancyConfig
+	if tenancy.DefaultTenant != "" && !tenantPattern.MatchString(tenancy.DefaultTenant) {
+		errs = append(errs, fmt.Errorf("tenancyConfig.defaultTenant %q must be lowercase letters, digits and dashes", tenancy.DefaultTenant))
+	}
+	for tenant, override := range tenancy.Tenants {
+		key := "tenancyConfig.tenants." + tenant
+		if !tenantPattern.MatchString(tenant) {
+			errs = append(errs, fmt.Errorf("%s must be named with lowercase letters, digits and dashes", key))
+		}
+		if override.PaginationConfig != nil {
+			errs = append(errs, validatePagination(key+".paginationConfig", *override.PaginationConfig)...)
+		}
+		if override.AccessPolicy != nil {
+			errs = append(errs, validateAccessPolicy(key+".accessPolicy", *override.AccessPolicy)...)
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+
+	return nil
+}
+
+func validatePagination(key string, pagination api.PaginationConfig) []error {
+	var errs []error
+	if pagination.DefaultPageSize < 0 || pagination.MaxPageSize < 0 {
+		errs = append(errs, fmt.Errorf("%s page sizes can't be negative", key))
+	}
+	if pagination.MaxPageSize > 0 && pagination.DefaultPageSize > pagination.MaxPageSize {
+		errs = append(errs, fmt.Errorf("%s.defaultPageSize can't exceed maxPageSize", key))
+	}
+	return errs
+}
+
+func validateRateLimitRule(key string, rule api.RateLimitRule) []error {
+	if rule.RequestsPerMinute < 0 || rule.Burst < 0 {
+		return []error{fmt.Errorf("%s can't be negative", key)}
+	}
+	return nil
+}
+
+func validateAccessPolicy(key string, policy api.AccessPolicyConfig) []error {
+	var errs []error
+	operations := []string{api.OperationRead, api.OperationCreate, api.OperationUpdate, api.OperationDelete}
+	for role, granted := range policy.Roles {
+		for _, operation := range granted {
+			if !slices.Contains(operations, operation) {
+				errs = append(errs, fmt.Errorf("%s.roles.%s %q is not one of %s", key, role, operation, strings.Join(operations, ", ")))
+			}
+		}
+	}
+	for _, operation := range policy.OwnerOperations {
+		if !slices.Contains(operations, operation) {
+			errs = append(errs, fmt.Errorf("%s.ownerOperations %q is not one of %s", key, operation, strings.Join(operations, ", ")))
+		}
+	}
+	return errs
+}
+
+// requireConfig reports key as missing when value is empty.
+func requireConfig(key string, value any) error {
+	reflected := reflect.ValueOf(value)
+	if reflected.IsZero() || (reflected.Kind() == reflect.Slice && reflected.Len() == 0) {
+		return fmt.Errorf("%s is required", key)
+	}
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func WriteConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "appconfig.json")
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadAppConfig_NoFileNoEnv_ReturnDefaults(t *testing.T) {
+	config, err := LoadAppConfig("", nil)
+
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultAppConfig(), *config)
+	assert.Equal(t, "inmemory", config.DbType)
+	assert.Equal(t, ":8080", config.ServerConfig.Addr)
+}
+
+func TestLoadAppConfig_FileAndEnv_EnvOverridesFileOverridesDefaults(t *testing.T) {
+	path := WriteConfigFile(t, `{"dbType": "inmemory", "mongoConfig": {"hosts": ["file-host"], "database": "file-db"}}`)
+	environ := []string{
+		"APP_DBTYPE=mongodb",
+		"APP_MONGOCONFIG_HOSTS=host1:27017, host2:27017",
+		"APP_MONGOCONFIG_QUERYTIMEOUTSECONDS=9",
+		"APP_TRACINGCONFIG_OTLPINSECURE=true",
+		"APP_TRACINGCONFIG_SAMPLERATIO=0.5",
+		"APP_SERVERCONFIG_ADDR=:9090",
+		"OTHER_DBTYPE=ignored",
+	}
+
+	config, err := LoadAppConfig(path, environ)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "mongodb", config.DbType)
+	assert.Equal(t, []string{"host1:27017", "host2:27017"}, config.MongoConfig.Hosts)
+	assert.Equal(t, "file-db", config.MongoConfig.Database)
+	assert.Equal(t, "albums", config.MongoConfig.Collection)
+	assert.Equal(t, 9, config.MongoConfig.QueryTimeoutSeconds)
+	assert.True(t, config.TracingConfig.OtlpInsecure)
+	assert.Equal(t, 0.5, config.TracingConfig.SampleRatio)
+	assert.Equal(t, ":9090", config.ServerConfig.Addr)
+}
+
+func TestLoadAppConfig_SecretFile_ReadValueFromFile(t *testing.T) {
+	secretPath := filepath.Join(t.TempDir(), "dsn")
+	assert.Nil(t, os.WriteFile(secretPath, []byte("postgres://user:secret@db/albums\n"), 0o600))
+
+	config, err := LoadAppConfig("", []string{"APP_DBTYPE=postgres", "APP_POSTGRESCONFIG_DSN_FILE=" + secretPath})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "postgres://user:secret@db/albums", config.PostgresConfig.Dsn)
+}
+
+func TestLoadAppConfig_InvalidEnv_ReturnErrorNamingVariable(t *testing.T) {
+	_, err := LoadAppConfig("", []string{"APP_PAGINATIONCONFIG_MAXPAGESIZE=many"})
+	assert.ErrorContains(t, err, `APP_PAGINATIONCONFIG_MAXPAGESIZE: "many" is not an integer`)
+
+	_, err = LoadAppConfig("", []string{"APP_POSTGRESCONFIG_DSN=a", "APP_POSTGRESCONFIG_DSN_FILE=b"})
+	assert.ErrorContains(t, err, "only one of APP_POSTGRESCONFIG_DSN and APP_POSTGRESCONFIG_DSN_FILE")
+
+	_, err = LoadAppConfig("", []string{"APP_POSTGRESCONFIG_DSN_FILE=" + filepath.Join(t.TempDir(), "missing")})
+	assert.ErrorContains(t, err, "APP_POSTGRESCONFIG_DSN_FILE")
+}
+
+func TestLoadAppConfig_MissingOrMalformedFile_ReturnError(t *testing.T) {
+	_, err := LoadAppConfig(filepath.Join(t.TempDir(), "missing.json"), nil)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = LoadAppConfig(WriteConfigFile(t, `{"dbType": `), nil)
+	assert.ErrorContains(t, err, "failed to parse config file")
+}
+
+func TestValidateAppConfig_InvalidSettings_ReportEveryError(t *testing.T) {
+	config := DefaultAppConfig()
+	config.DbType = "mongodb"
+	config.MongoConfig.Database = ""
+	config.PaginationConfig = api.PaginationConfig{DefaultPageSize: 50, MaxPageSize: 10}
+	config.LoggingConfig.Level = "verbose"
+	config.TracingConfig.Exporter = "jaeger"
+	config.ServerConfig.Addr = ""
+	config.ServerConfig.TrustedProxies = []string{"10.0.0.0/8", "proxy"}
+	config.AccessPolicy = api.AccessPolicyConfig{Roles: map[string][]string{"editor": {"write"}}, OwnerOperations: []string{"own"}}
+	config.RateLimitConfig.Store = "redis"
+	config.RateLimitConfig.Write.Burst = -1
+	config.AuditConfig = api.AuditConfig{Enabled: true, Sink: auditSinkFile}
+
+	err := ValidateAppConfig(config)
+
+	for _, message := range []string{
+		"mongoConfig.hosts is required",
+		"mongoConfig.database is required",
+		"paginationConfig.defaultPageSize can't exceed maxPageSize",
+		"loggingConfig: unsupported log level",
+		`tracingConfig.exporter "jaeger"`,
+		"serverConfig.addr is required",
+		`serverConfig.trustedProxies "proxy" is not an IP or CIDR`,
+		`accessPolicy.roles.editor "write" is not one of`,
+		`accessPolicy.ownerOperations "own" is not one of`,
+		`rateLimitConfig.store "redis" is not one of`,
+		"rateLimitConfig.write can't be negative",
+		"auditConfig.file is required",
+	} {
+		assert.ErrorContains(t, err, message)
+	}
+	assert.NotContains(t, err.Error(), "dynamoDbConfig")
+
+	config.DbType = "cassandra"
+	assert.ErrorContains(t, ValidateAppConfig(config), `dbType "cassandra" is not one of`)
+}
+
+func TestValidateAppConfig_ApiKeysInMemory_ReturnError(t *testing.T) {
+	config := DefaultAppConfig()
+	config.AuthConfig.Modes = []string{authModeApiKey}
+
+	assert.ErrorContains(t, ValidateAppConfig(config), `authConfig.modes "apiKey" needs a dbType that keeps api keys, "inmemory" doesn't`)
+
+	config.DbType = "sqlite"
+	assert.Nil(t, ValidateAppConfig(config))
+}
@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Reloadable is implemented by components whose settings can change while
+// the app is running. ApplyConfig only receives configs that passed validation.
+type Reloadable interface {
+	ApplyConfig(config api.AppConfig)
+}
+
+// copyLiveSettings copies the settings a reload may change from src to dst.
+// Any other difference needs a restart.
+func copyLiveSettings(dst *api.AppConfig, src api.AppConfig) {
+	dst.LoggingConfig.Level = src.LoggingConfig.Level
+	dst.HealthConfig = src.HealthConfig
+	dst.RateLimitConfig.Read = src.RateLimitConfig.Read
+	dst.RateLimitConfig.Write = src.RateLimitConfig.Write
+	dst.RateLimitConfig.Clients = src.RateLimitConfig.Clients
+	dst.MongoConfig.QueryTimeoutSeconds = src.MongoConfig.QueryTimeoutSeconds
+	dst.DynamoDbConfig.QueryTimeoutSeconds = src.DynamoDbConfig.QueryTimeoutSeconds
+	dst.SqliteConfig.QueryTimeoutSeconds = src.SqliteConfig.QueryTimeoutSeconds
+	dst.PostgresConfig.QueryTimeoutSeconds = src.PostgresConfig.QueryTimeoutSeconds
+}
+
+// NewConfigReloader reloads the config the app was started with from path
+// and the environment, see LoadAppConfig.
+func NewConfigReloader(path string, current api.AppConfig, components []Reloadable, logger *slog.Logger) *ConfigReloader {
+	return &ConfigReloader{
+		Path:       path,
+		Components: components,
+		Logger:     logger,
+		current:    current,
+	}
+}
+
+type ConfigReloader struct {
+	Path       string
+	Components []Reloadable
+	Logger     *slog.Logger
+
+	mutex   sync.Mutex
+	current api.AppConfig
+}
+
+// Current returns the config last applied.
+func (this *ConfigReloader) Current() api.AppConfig {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	return this.current
+}
+
+// Reload loads and validates the config, then applies it to every component
+// and returns the keys that changed. Nothing is applied when the config is
+// invalid or changes settings that can't be changed live, the returned error
+// explains why.
+func (this *ConfigReloader) Reload() ([]string, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	config, err := LoadAppConfig(this.Path, os.Environ())
+	if err != nil {
+		return nil, err
+	}
+
+	pinned := *config
+	copyLiveSettings(&pinned, this.current)
+	if fixed := configDiff(reflect.ValueOf(this.current), reflect.ValueOf(pinned), ""); len(fixed) > 0 {
+		return nil, fmt.Errorf("%s can't be changed without a restart", strings.Join(fixed, ", "))
+	}
+
+	changed := configDiff(reflect.ValueOf(this.current), reflect.ValueOf(*config), "")
+	if len(changed) == 0 {
+		return nil, nil
+	}
+
+	for _, component := range this.Components {
+		component.ApplyConfig(*config)
+	}
+	this.current = *config
+
+	return changed, nil
+}
+
+// Watch reloads on SIGHUP and, with a positive interval, whenever the
+// modification time of the config file changes, until ctx is done. Results
+// are logged, a rejected reload leaves the running config in place.
+func (this *ConfigReloader) Watch(ctx context.Context, interval time.Duration) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	var poll <-chan time.Time
+	if interval > 0 && this.Path != "" {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	modTime := this.modTime()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			this.reloadAndLog(ctx, "SIGHUP")
+		case <-poll:
+			if latest := this.modTime(); !latest.Equal(modTime) {
+				modTime = latest
+				this.reloadAndLog(ctx, "file change")
+			}
+		}
+	}
+}
+
+func (this *ConfigReloader) reloadAndLog(ctx context.Context, trigger string) {
+	changed, err := this.Reload()
+	switch {
+	case err != nil:
+		this.Logger.ErrorContext(ctx, "config reload rejected, keeping the running config",
+			slog.String("trigger", trigger),
+			slog.Any("error", err),
+		)
+	case len(changed) == 0:
+		this.Logger.InfoContext(ctx, "config reloaded without changes", slog.String("trigger", trigger))
+	default:
+		this.Logger.InfoContext(ctx, "config reloaded",
+			slog.String("trigger", trigger),
+			slog.Any("changed", changed),
+		)
+	}
+}
+
+func (this *ConfigReloader) modTime() time.Time {
+	info, err := os.Stat(this.Path)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
+
+// configDiff lists the config keys, such as mongoConfig.hosts, whose values
+// differ between a and b.
+func configDiff(a, b reflect.Value, prefix string) []string {
+	if a.Kind() != reflect.Struct {
+		if reflect.DeepEqual(a.Interface(), b.Interface()) {
+			return nil
+		}
+		return []string{prefix}
+	}
+
+	var keys []string
+	for i := 0; i < a.NumField(); i++ {
+		name := a.Type().Field(i).Name
+		key := strings.ToLower(name[:1]) + name[1:]
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		keys = append(keys, configDiff(a.Field(i), b.Field(i), key)...)
+	}
+
+	return keys
+}
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func InitConfigReloader(t *testing.T, content string) (*ConfigReloader, *LogLevel, *SqliteService) {
+	path := WriteConfigFile(t, content)
+	config, err := LoadAppConfig(path, nil)
+	assert.Nil(t, err)
+
+	logLevel := new(LogLevel)
+	_, err = NewLogger(config.LoggingConfig, io.Discard, logLevel)
+	assert.Nil(t, err)
+	service := InitSqliteService(t, ":memory:")
+
+	return NewConfigReloader(path, *config, []Reloadable{logLevel, service}, slog.Default()), logLevel, service
+}
+
+func TestConfigReload_LiveSettingsChanged_ApplyToComponents(t *testing.T) {
+	reloader, logLevel, service := InitConfigReloader(t, `{"loggingConfig": {"level": "info"}}`)
+	os.WriteFile(reloader.Path, []byte(`{"loggingConfig": {"level": "debug"}, "sqliteConfig": {"queryTimeoutSeconds": 9}}`), 0o600)
+
+	changed, err := reloader.Reload()
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"loggingConfig.level", "sqliteConfig.queryTimeoutSeconds"}, changed)
+	assert.Equal(t, slog.LevelDebug, logLevel.Level())
+	assert.Equal(t, 9*time.Second, service.Timeout.Get())
+	assert.Equal(t, "debug", reloader.Current().LoggingConfig.Level)
+}
+
+func TestConfigReload_RestartOnlySettingChanged_RejectWithoutApplying(t *testing.T) {
+	reloader, logLevel, _ := InitConfigReloader(t, `{"dbType": "inmemory"}`)
+	os.WriteFile(reloader.Path, []byte(`{"dbType": "sqlite", "loggingConfig": {"level": "debug"}}`), 0o600)
+
+	changed, err := reloader.Reload()
+
+	assert.Nil(t, changed)
+	assert.ErrorContains(t, err, "dbType can't be changed without a restart")
+	assert.Equal(t, slog.LevelInfo, logLevel.Level())
+	assert.Equal(t, "inmemory", reloader.Current().DbType)
+}
+
+func TestConfigReload_InvalidConfig_RejectWithoutApplying(t *testing.T) {
+	reloader, logLevel, _ := InitConfigReloader(t, `{}`)
+	os.WriteFile(reloader.Path, []byte(`{"loggingConfig": {"level": "verbose"}}`), 0o600)
+
+	_, err := reloader.Reload()
+
+	assert.ErrorContains(t, err, "unsupported log level")
+	assert.Equal(t, slog.LevelInfo, logLevel.Level())
+}
+
+func TestConfigReloadWatch_FileModified_ReloadConfig(t *testing.T) {
+	reloader, logLevel, _ := InitConfigReloader(t, `{}`)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reloader.Watch(ctx, 10*time.Millisecond)
+
+	time.Sleep(20 * time.Millisecond)
+	os.WriteFile(reloader.Path, []byte(`{"loggingConfig": {"level": "warn"}}`), 0o600)
+	modified := time.Now().Add(time.Minute)
+	os.Chtimes(reloader.Path, modified, modified)
+
+	assert.Eventually(t, func() bool {
+		return logLevel.Level() == slog.LevelWarn
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestReadinessChecker_ApplyConfig_ChangeCacheAndTimeout(t *testing.T) {
+	readiness := NewReadinessChecker(api.HealthConfig{}, nil, slog.Default())
+
+	readiness.ApplyConfig(api.AppConfig{HealthConfig: api.HealthConfig{CacheMillis: 50, CheckTimeoutMillis: 100}})
+
+	assert.Equal(t, 50*time.Millisecond, readiness.CacheTtl)
+	assert.Equal(t, 100*time.Millisecond, readiness.Timeout)
+}
@@ -0,0 +1,41 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"encoding/base64"
+	"encoding/json"
+)
+
+var errInvalidCursor = &api.Error{
+	Kind:   api.KindValidationFailed,
+	Detail: "invalid pagination cursor",
+	Fields: []api.FieldError{{Field: "cursor", Rule: "cursor", Detail: "must be the Next value of a previous page with the same sort"}},
+}
+
+// encodeCursor turns a backend specific position into an opaque, url safe token.
+func encodeCursor(position any) (string, error) {
+	raw, err := json.Marshal(position)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// decodeCursor restores a position previously produced by encodeCursor.
+func decodeCursor(cursor string, position any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return errInvalidCursor
+	}
+
+	if err := json.Unmarshal(raw, position); err != nil {
+		return errInvalidCursor
+	}
+
+	return nil
+}
+
+func invalidCursorResponse() api.HandlerResponse {
+	return errInvalidCursor.Response()
+}
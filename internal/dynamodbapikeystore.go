@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+/*
+CLI command for local table creation :
+aws dynamodb create-table \
+--endpoint-url http://localhost:8000 \
+--table-name api_keys \
+--billing-mode PAY_PER_REQUEST \
+--attribute-definitions AttributeName=Id,AttributeType=S \
+--key-schema AttributeName=Id,KeyType=HASH
+
+*/
+
+func NewDynamoDbApiKeyStore(service *DynamoDbService, tableName string) *DynamoDbApiKeyStore {
+	return &DynamoDbApiKeyStore{
+		Client:    service.Client,
+		TableName: tableName,
+		Timeout:   service.Timeout,
+	}
+}
+
+type DynamoDbApiKeyStore struct {
+	Client    *dynamodb.Client
+	TableName string
+	Timeout   *QueryTimeout
+}
+
+func (this *DynamoDbApiKeyStore) GetApiKey(ctx context.Context, id string) (*api.ApiKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	params := dynamodb.GetItemInput{
+		TableName: aws.String(this.TableName),
+		Key: map[string]types.AttributeValue{
+			"Id": &types.AttributeValueMemberS{Value: id},
+		},
+		ConsistentRead: aws.Bool(true),
+	}
+	output, err := this.Client.GetItem(ctx, &params)
+	if err != nil {
+		return nil, err
+	}
+	if output.Item == nil {
+		return nil, nil
+	}
+
+	var key api.ApiKey
+	if err := attributevalue.UnmarshalMap(output.Item, &key); err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+func (this *DynamoDbApiKeyStore) PutApiKey(ctx context.Context, key api.ApiKey) error {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	item, err := attributevalue.MarshalMap(key)
+	if err != nil {
+		return err
+	}
+
+	params := dynamodb.PutItemInput{
+		TableName: aws.String(this.TableName),
+		Item:      item,
+	}
+	_, err = this.Client.PutItem(ctx, &params)
+	return err
+}
+
+// TouchApiKey only updates keys that still exist, so a key deleted meanwhile
+// isn't recreated with LastUsedAt alone.
+func (this *DynamoDbApiKeyStore) TouchApiKey(ctx context.Context, id string, usedAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	usedAtValue, err := attributevalue.Marshal(usedAt)
+	if err != nil {
+		return err
+	}
+
+	expr, err := expression.NewBuilder().
+		WithUpdate(expression.Set(expression.Name("LastUsedAt"), expression.Value(usedAtValue))).
+		WithCondition(expression.AttributeExists(expression.Name("Id"))).
+		Build()
+	if err != nil {
+		return err
+	}
+
+	params := dynamodb.UpdateItemInput{
+		TableName: aws.String(this.TableName),
+		Key: map[string]types.AttributeValue{
+			"Id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}
+	_, err = this.Client.UpdateItem(ctx, &params)
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return nil
+	}
+	return err
+}
+
+func (this *DynamoDbApiKeyStore) CheckHealth(ctx context.Context) error {
+	return checkDynamoDbTable(ctx, this.Client, this.TableName)
+}
@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+/*
+CLI command for local table creation :
+aws dynamodb create-table \
+--endpoint-url http://localhost:8000 \
+--table-name audit_log \
+--billing-mode PAY_PER_REQUEST \
+--attribute-definitions AttributeName=Id,AttributeType=S AttributeName=AlbumKey,AttributeType=S AttributeName=TenantKey,AttributeType=S AttributeName=Time,AttributeType=N \
+--key-schema AttributeName=Id,KeyType=HASH \
+--global-secondary-indexes \
+'[{"IndexName":"gsi_album_time","KeySchema":[{"AttributeName":"AlbumKey","KeyType":"HASH"},{"AttributeName":"Time","KeyType":"RANGE"}],"Projection":{"ProjectionType":"ALL"}},{"IndexName":"gsi_tenant_time","KeySchema":[{"AttributeName":"TenantKey","KeyType":"HASH"},{"AttributeName":"Time","KeyType":"RANGE"}],"Projection":{"ProjectionType":"ALL"}}]'
+
+*/
+
+const (
+	dynamoDbAuditAlbumIndex  = "gsi_album_time"
+	dynamoDbAuditTenantIndex = "gsi_tenant_time"
+)
+
+func NewDynamoDbAuditSink(service *DynamoDbService, tableName string) *DynamoDbAuditSink {
+	return &DynamoDbAuditSink{
+		Client:    service.Client,
+		TableName: tableName,
+		Timeout:   service.Timeout,
+	}
+}
+
+// DynamoDbAuditSink queries the records of an album through AlbumKey, and
+// the other ones through TenantKey, the actor being filtered.
+type DynamoDbAuditSink struct {
+	Client    *dynamodb.Client
+	TableName string
+	Timeout   *QueryTimeout
+}
+
+// dynamoDbAuditItem adds the index keys to a record, index keys can't be empty
+// so denials without an album are left out of the album index.
+type dynamoDbAuditItem struct {
+	api.AuditRecord
+	AlbumKey  string `dynamodbav:",omitempty"`
+	TenantKey string
+}
+
+func (this *DynamoDbAuditSink) Append(ctx context.Context, record api.AuditRecord) error {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	item := dynamoDbAuditItem{AuditRecord: record, TenantKey: dynamoDbTenantPartition(record.Tenant)}
+	if record.AlbumId != "" {
+		item.AlbumKey = dynamoDbTenantKey(record.Tenant, record.AlbumId)
+	}
+	av, err := attributevalue.MarshalMap(item)
+	if err != nil {
+		return err
+	}
+
+	// records are immutable, an id generated twice must not replace one
+	expr, err := expression.NewBuilder().
+		WithCondition(expression.AttributeNotExists(expression.Name("Id"))).
+		Build()
+	if err != nil {
+		return err
+	}
+
+	params := dynamodb.PutItemInput{
+		TableName:                aws.String(this.TableName),
+		Item:                     av,
+		ExpressionAttributeNames: expr.Names(),
+		ConditionExpression:      expr.Condition(),
+	}
+	_, err = this.Client.PutItem(ctx, &params)
+	return err
+}
+
+func (this *DynamoDbAuditSink) Query(ctx context.Context, query api.AuditQuery) ([]api.AuditRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	index := dynamoDbAuditTenantIndex
+	keyCondition := expression.Key("TenantKey").Equal(expression.Value(dynamoDbTenantPartition(query.Tenant)))
+	if query.AlbumId != "" {
+		index = dynamoDbAuditAlbumIndex
+		keyCondition = expression.Key("AlbumKey").Equal(expression.Value(dynamoDbTenantKey(query.Tenant, query.AlbumId)))
+	}
+	keyCondition = keyCondition.And(expression.Key("Time").GreaterThanEqual(expression.Value(query.Since)))
+
+	builder := expression.NewBuilder().WithKeyCondition(keyCondition)
+	if query.Actor != "" {
+		builder = builder.WithFilter(expression.Name("Actor").Equal(expression.Value(query.Actor)))
+	}
+	expr, err := builder.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	params := dynamodb.QueryInput{
+		TableName:                 aws.String(this.TableName),
+		IndexName:                 aws.String(index),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ScanIndexForward:          aws.Bool(true),
+	}
+
+	// the filter applies after Limit, so pages are read until enough records match
+	records := []api.AuditRecord{}
+	paginator := dynamodb.NewQueryPaginator(this.Client, &params)
+	for paginator.HasMorePages() && len(records) < query.Limit {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range output.Items {
+			if len(records) == query.Limit {
+				break
+			}
+			var record api.AuditRecord
+			if err := attributevalue.UnmarshalMap(item, &record); err != nil {
+				return nil, err
+			}
+			records = append(records, record)
+		}
+	}
+
+	return records, nil
+}
+
+func (this *DynamoDbAuditSink) CheckHealth(ctx context.Context) error {
+	return checkDynamoDbTable(ctx, this.Client, this.TableName)
+}
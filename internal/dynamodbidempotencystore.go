@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+/*
+CLI command for local table creation :
+aws dynamodb create-table \
+--endpoint-url http://localhost:8000 \
+--table-name idempotency_keys \
+--billing-mode PAY_PER_REQUEST \
+--attribute-definitions AttributeName=Key,AttributeType=S \
+--key-schema AttributeName=Key,KeyType=HASH
+
+aws dynamodb update-time-to-live \
+--endpoint-url http://localhost:8000 \
+--table-name idempotency_keys \
+--time-to-live-specification Enabled=true,AttributeName=ExpiresAt
+
+*/
+
+func NewDynamoDbIdempotencyStore(service *DynamoDbService, tableName string) *DynamoDbIdempotencyStore {
+	return &DynamoDbIdempotencyStore{
+		Client:    service.Client,
+		TableName: tableName,
+		Timeout:   service.Timeout,
+	}
+}
+
+type DynamoDbIdempotencyStore struct {
+	Client    *dynamodb.Client
+	TableName string
+	Timeout   *QueryTimeout
+}
+
+func (this *DynamoDbIdempotencyStore) Reserve(ctx context.Context, record api.IdempotencyRecord) (*api.IdempotencyRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	item, err := attributevalue.MarshalMap(record)
+	if err != nil {
+		return nil, err
+	}
+
+	// TTL deletion lags behind expiry, an expired record may be overwritten
+	condition := expression.AttributeNotExists(expression.Name("Key")).
+		Or(expression.Name("ExpiresAt").LessThanEqual(expression.Value(time.Now().Unix())))
+	expr, err := expression.NewBuilder().WithCondition(condition).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	params := dynamodb.PutItemInput{
+		TableName:                           aws.String(this.TableName),
+		Item:                                item,
+		ExpressionAttributeNames:            expr.Names(),
+		ExpressionAttributeValues:           expr.Values(),
+		ConditionExpression:                 expr.Condition(),
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	}
+	_, err = this.Client.PutItem(ctx, &params)
+	if err == nil {
+		return nil, nil
+	}
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if !errors.As(err, &conditionErr) {
+		return nil, err
+	}
+
+	var existing api.IdempotencyRecord
+	if err := attributevalue.UnmarshalMap(conditionErr.Item, &existing); err != nil {
+		return nil, err
+	}
+
+	return &existing, nil
+}
+
+func (this *DynamoDbIdempotencyStore) Complete(ctx context.Context, record api.IdempotencyRecord) error {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	item, err := attributevalue.MarshalMap(record)
+	if err != nil {
+		return err
+	}
+
+	params := dynamodb.PutItemInput{
+		TableName: aws.String(this.TableName),
+		Item:      item,
+	}
+	_, err = this.Client.PutItem(ctx, &params)
+	return err
+}
+
+func (this *DynamoDbIdempotencyStore) Release(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	params := dynamodb.DeleteItemInput{
+		TableName: aws.String(this.TableName),
+		Key: map[string]types.AttributeValue{
+			"Key": &types.AttributeValueMemberS{Value: key},
+		},
+	}
+	_, err := this.Client.DeleteItem(ctx, &params)
+	return err
+}
+
+func (this *DynamoDbIdempotencyStore) CheckHealth(ctx context.Context) error {
+	return checkDynamoDbTable(ctx, this.Client, this.TableName)
+}
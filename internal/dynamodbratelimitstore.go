@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+/*
+CLI command for local table creation :
+aws dynamodb create-table \
+--endpoint-url http://localhost:8000 \
+--table-name rate_limits \
+--billing-mode PAY_PER_REQUEST \
+--attribute-definitions AttributeName=Key,AttributeType=S \
+--key-schema AttributeName=Key,KeyType=HASH
+
+aws dynamodb update-time-to-live \
+--endpoint-url http://localhost:8000 \
+--table-name rate_limits \
+--time-to-live-specification Enabled=true,AttributeName=ExpiresAt
+
+*/
+
+func NewDynamoDbRateLimitStore(service *DynamoDbService, tableName string) *DynamoDbRateLimitStore {
+	return &DynamoDbRateLimitStore{
+		Client:    service.Client,
+		TableName: tableName,
+		Timeout:   service.Timeout,
+	}
+}
+
+type DynamoDbRateLimitStore struct {
+	Client    *dynamodb.Client
+	TableName string
+	Timeout   *QueryTimeout
+}
+
+func (this *DynamoDbRateLimitStore) GetBucket(ctx context.Context, key string) (*api.RateLimitBucket, error) {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	params := dynamodb.GetItemInput{
+		TableName: aws.String(this.TableName),
+		Key: map[string]types.AttributeValue{
+			"Key": &types.AttributeValueMemberS{Value: key},
+		},
+		ConsistentRead: aws.Bool(true),
+	}
+	output, err := this.Client.GetItem(ctx, &params)
+	if err != nil {
+		return nil, err
+	}
+	if output.Item == nil {
+		return nil, nil
+	}
+
+	var bucket api.RateLimitBucket
+	if err := attributevalue.UnmarshalMap(output.Item, &bucket); err != nil {
+		return nil, err
+	}
+
+	return &bucket, nil
+}
+
+func (this *DynamoDbRateLimitStore) PutBucket(ctx context.Context, bucket api.RateLimitBucket, revision int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	item, err := attributevalue.MarshalMap(bucket)
+	if err != nil {
+		return false, err
+	}
+
+	condition := expression.Name("Revision").Equal(expression.Value(revision))
+	if revision == 0 {
+		condition = expression.AttributeNotExists(expression.Name("Key"))
+	}
+	expr, err := expression.NewBuilder().WithCondition(condition).Build()
+	if err != nil {
+		return false, err
+	}
+
+	params := dynamodb.PutItemInput{
+		TableName:                 aws.String(this.TableName),
+		Item:                      item,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ConditionExpression:       expr.Condition(),
+	}
+	_, err = this.Client.PutItem(ctx, &params)
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (this *DynamoDbRateLimitStore) CheckHealth(ctx context.Context) error {
+	return checkDynamoDbTable(ctx, this.Client, this.TableName)
+}
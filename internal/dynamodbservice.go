@@ -4,16 +4,20 @@ import (
 	"andrewsaputra/go-rest-sample/api"
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/aws/aws-sdk-go-v2/otelaws"
 )
 
 /*
@@ -22,21 +26,71 @@ aws dynamodb create-table \
 --endpoint-url http://localhost:8000 \
 --table-name albums \
 --billing-mode PAY_PER_REQUEST \
---attribute-definitions AttributeName=Id,AttributeType=S AttributeName=TimeCreated,AttributeType=N AttributeName=Artist,AttributeType=S \
+--attribute-definitions AttributeName=Id,AttributeType=S AttributeName=TimeCreated,AttributeType=N AttributeName=Artist,AttributeType=S AttributeName=TenantKey,AttributeType=S \
 --key-schema AttributeName=Id,KeyType=HASH \
---global-secondary-indexes '[{"IndexName":"gsi_id_timecreated","KeySchema":[{"AttributeName":"Id","KeyType":"HASH"},{"AttributeName":"TimeCreated","KeyType":"RANGE"}],"Projection":{"ProjectionType":"ALL"}},{"IndexName":"gsi_artist_timecreated","KeySchema":[{"AttributeName":"Artist","KeyType":"HASH"},{"AttributeName":"TimeCreated","KeyType":"RANGE"}],"Projection":{"ProjectionType":"ALL"}}]'
+--global-secondary-indexes '[{"IndexName":"gsi_id_timecreated","KeySchema":[{"AttributeName":"Id","KeyType":"HASH"},{"AttributeName":"TimeCreated","KeyType":"RANGE"}],"Projection":{"ProjectionType":"ALL"}},{"IndexName":"gsi_tenant_timecreated","KeySchema":[{"AttributeName":"TenantKey","KeyType":"HASH"},{"AttributeName":"TimeCreated","KeyType":"RANGE"}],"Projection":{"ProjectionType":"ALL"}},{"IndexName":"gsi_artist_timecreated","KeySchema":[{"AttributeName":"Artist","KeyType":"HASH"},{"AttributeName":"TimeCreated","KeyType":"RANGE"}],"Projection":{"ProjectionType":"ALL"}}]'
 
 */
 
+func init() {
+	api.RegisterBackend(api.Backend{
+		Name:         "dynamodb",
+		Description:  "DynamoDB table, listings by timeCreated page through gsi_tenant_timecreated and gsi_artist_timecreated, other orders are sorted in memory",
+		ConfigKey:    "dynamoDbConfig",
+		ConfigSchema: api.DynamoDbConfig{},
+		NewService: func(config api.AppConfig, idGen api.IdGenerator) (api.Service, error) {
+			return NewDynamoDbService(config.DynamoDbConfig, idGen)
+		},
+		NewIdempotencyStore: func(config api.AppConfig, service api.Service) (api.IdempotencyStore, error) {
+			return NewDynamoDbIdempotencyStore(service.(*DynamoDbService), config.DynamoDbConfig.IdempotencyTableName), nil
+		},
+		NewApiKeyStore: func(config api.AppConfig, service api.Service) (api.ApiKeyStore, error) {
+			return NewDynamoDbApiKeyStore(service.(*DynamoDbService), config.DynamoDbConfig.ApiKeyTableName), nil
+		},
+		NewRateLimitStore: func(config api.AppConfig, service api.Service) (api.RateLimitStore, error) {
+			return NewDynamoDbRateLimitStore(service.(*DynamoDbService), config.DynamoDbConfig.RateLimitTableName), nil
+		},
+		NewAuditSink: func(config api.AppConfig, service api.Service) (api.AuditSink, error) {
+			return NewDynamoDbAuditSink(service.(*DynamoDbService), config.DynamoDbConfig.AuditTableName), nil
+		},
+		ValidateConfig: func(config api.AppConfig) error {
+			errs := []error{
+				requireConfig("dynamoDbConfig.tableName", config.DynamoDbConfig.TableName),
+				requireConfig("dynamoDbConfig.idempotencyTableName", config.DynamoDbConfig.IdempotencyTableName),
+				requireConfig("dynamoDbConfig.apiKeyTableName", config.DynamoDbConfig.ApiKeyTableName),
+				requireConfig("dynamoDbConfig.queryTimeoutSeconds", config.DynamoDbConfig.QueryTimeoutSeconds),
+			}
+			if sharesRateLimits(config) {
+				errs = append(errs, requireConfig("dynamoDbConfig.rateLimitTableName", config.DynamoDbConfig.RateLimitTableName))
+			}
+			if auditsToBackend(config) {
+				errs = append(errs, requireConfig("dynamoDbConfig.auditTableName", config.DynamoDbConfig.AuditTableName))
+			}
+			return errors.Join(errs...)
+		},
+	})
+}
+
 func NewDynamoDbService(config api.DynamoDbConfig, idGen api.IdGenerator) (api.Service, error) {
 	timeout := time.Duration(config.QueryTimeoutSeconds) * time.Second
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(config.Region))
+	// the SDK client only hands out copies of its transport, so one is kept
+	// here for Close to release the pooled connections
+	transport := awshttp.NewBuildableClient().GetTransport()
+	httpClient := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(config.Region), awsconfig.WithHTTPClient(httpClient))
 	if err != nil {
 		return nil, err
 	}
+	otelaws.AppendMiddlewares(&cfg.APIOptions)
 
 	client := dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
 		if config.LocalEndpoint != "" {
@@ -47,70 +101,374 @@ func NewDynamoDbService(config api.DynamoDbConfig, idGen api.IdGenerator) (api.S
 	return &DynamoDbService{
 		IdGen:     idGen,
 		Client:    client,
+		Transport: transport,
 		TableName: config.TableName,
-		Timeout:   timeout,
+		Timeout:   NewQueryTimeout(timeout),
 	}, nil
 }
 
 type DynamoDbService struct {
 	IdGen     api.IdGenerator
 	Client    *dynamodb.Client
+	Transport *http.Transport
 	TableName string
-	Timeout   time.Duration
+	Timeout   *QueryTimeout
 }
 
-func (this *DynamoDbService) GetAlbums() api.HandlerResponse {
-	ctx, cancel := context.WithTimeout(context.Background(), this.Timeout)
-	defer cancel()
+// CreateIndexes fills in the TenantKey of the albums written before
+// gsi_tenant_timecreated existed, which would be missing from listings
+// otherwise. The indexes themselves are created with the table.
+func (this *DynamoDbService) CreateIndexes(ctx context.Context) error {
+	expr, err := expression.NewBuilder().
+		WithFilter(expression.AttributeNotExists(expression.Name("TenantKey"))).
+		WithProjection(expression.NamesList(expression.Name("Id"))).
+		Build()
+	if err != nil {
+		return err
+	}
 
 	params := dynamodb.ScanInput{
-		TableName:      aws.String(this.TableName),
-		ConsistentRead: aws.Bool(false),
+		TableName:                 aws.String(this.TableName),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		FilterExpression:          expr.Filter(),
+		ProjectionExpression:      expr.Projection(),
 	}
-	res, err := this.Client.Scan(ctx, &params)
+	paginator := dynamodb.NewScanPaginator(this.Client, &params)
+	for paginator.HasMorePages() {
+		scanCtx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+		res, err := paginator.NextPage(scanCtx)
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		for _, item := range res.Items {
+			if err := this.backfillTenantKey(ctx, item["Id"]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// backfillTenantKey sets the TenantKey of the album with id, the tenant being
+// the prefix of its id. Albums changed or deleted meanwhile are left alone.
+func (this *DynamoDbService) backfillTenantKey(ctx context.Context, id types.AttributeValue) error {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	key, ok := id.(*types.AttributeValueMemberS)
+	if !ok {
+		return nil
+	}
+	tenant, _, found := strings.Cut(key.Value, "#")
+	if !found {
+		tenant = ""
+	}
+
+	expr, err := expression.NewBuilder().
+		WithUpdate(expression.Set(expression.Name("TenantKey"), expression.Value(dynamoDbTenantPartition(tenant)))).
+		WithCondition(expression.AttributeExists(expression.Name("Id")).And(expression.AttributeNotExists(expression.Name("TenantKey")))).
+		Build()
 	if err != nil {
-		return api.HandlerResponse{Code: http.StatusInternalServerError, Error: err}
+		return err
+	}
+
+	_, err = this.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(this.TableName),
+		Key:                       map[string]types.AttributeValue{"Id": key},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return nil
+	}
+	return err
+}
+
+// dynamoDbCursor is the key of the last album of a page read from an index,
+// Artist is only set when paging over gsi_artist_timecreated. Other orders
+// are sorted here, and continue from the Offset of the next album instead.
+// Sort is the order the cursor was issued for, it can't continue another one.
+type dynamoDbCursor struct {
+	Id          string `json:",omitempty"`
+	Artist      string `json:",omitempty"`
+	TimeCreated int64  `json:",omitempty"`
+	Sort        string
+	Offset      int `json:",omitempty"`
+}
+
+const (
+	artistIndexName = "gsi_artist_timecreated"
+	tenantIndexName = "gsi_tenant_timecreated"
+)
+
+// GetAlbums pages through gsi_tenant_timecreated, or gsi_artist_timecreated
+// for an artist, when ordering by timeCreated. Any other order means reading
+// every match and sorting it here.
+func (this *DynamoDbService) GetAlbums(ctx context.Context, query api.AlbumQueryDTO) api.HandlerResponse {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	var position dynamoDbCursor
+	if query.Cursor != "" {
+		if err := decodeCursor(query.Cursor, &position); err != nil {
+			return invalidCursorResponse()
+		}
+	}
+
+	sortFields := resolveSort(query.Sort)
+	if len(sortFields) == 1 && sortFields[0].Field == "timeCreated" {
+		return this.getIndexedAlbums(ctx, query, position, sortFields)
+	}
+
+	return this.getSortedAlbums(ctx, query, position, sortFields)
+}
+
+func (this *DynamoDbService) getIndexedAlbums(ctx context.Context, query api.AlbumQueryDTO, position dynamoDbCursor, sortFields []api.SortField) api.HandlerResponse {
+	signature := sortSignature(sortFields)
+	if query.Cursor != "" && (position.Id == "" || position.Offset != 0 || position.Sort != signature || position.Artist != query.Artist) {
+		return invalidCursorResponse()
+	}
+
+	tenant := api.TenantFromContext(ctx)
+	expr, err := dynamoDbAlbumFilter(tenant, query, true)
+	if err != nil {
+		return NewErrorResponse(err)
+	}
+
+	params := dynamodb.QueryInput{
+		TableName:                 aws.String(this.TableName),
+		IndexName:                 aws.String(dynamoDbAlbumIndex(query)),
+		ScanIndexForward:          aws.Bool(!sortFields[0].Descending),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+	}
+	if query.Limit > 0 {
+		params.Limit = aws.Int32(int32(query.Limit))
+	}
+	if query.Cursor != "" {
+		params.ExclusiveStartKey = position.startKey(tenant)
+	}
+
+	albums := []api.Album{}
+	var next string
+	for {
+		res, err := this.Client.Query(ctx, &params)
+		if err != nil {
+			return NewErrorResponse(err)
+		}
+
+		for i, v := range res.Items {
+			alb, err := unmarshalDynamoDbAlbum(tenant, v)
+			if err != nil {
+				return NewErrorResponse(err)
+			}
+			albums = append(albums, alb)
+
+			pageFull := query.Limit > 0 && len(albums) == query.Limit
+			if pageFull && (i < len(res.Items)-1 || len(res.LastEvaluatedKey) > 0) {
+				next, _ = encodeCursor(dynamoDbCursor{Id: alb.Id, Artist: query.Artist, TimeCreated: alb.TimeCreated, Sort: signature})
+				break
+			}
+		}
+
+		// filters apply after Limit, so a short page continues where it stopped
+		if next != "" || len(res.LastEvaluatedKey) == 0 {
+			break
+		}
+		params.ExclusiveStartKey = res.LastEvaluatedKey
+	}
+
+	return api.HandlerResponse{
+		Code: http.StatusOK,
+		Body: api.ResponseBody{Data: albums, Next: next},
+	}
+}
+
+// getSortedAlbums reads every match, from the artist index for an artist and
+// by scanning the table otherwise, and returns the page at the cursor offset.
+func (this *DynamoDbService) getSortedAlbums(ctx context.Context, query api.AlbumQueryDTO, position dynamoDbCursor, sortFields []api.SortField) api.HandlerResponse {
+	signature := sortSignature(sortFields)
+	if query.Cursor != "" && (position.Id != "" || position.Offset <= 0 || position.Sort != signature) {
+		return invalidCursorResponse()
+	}
+
+	tenant := api.TenantFromContext(ctx)
+	expr, err := dynamoDbAlbumFilter(tenant, query, query.Artist != "")
+	if err != nil {
+		return NewErrorResponse(err)
 	}
 
 	albums := []api.Album{}
-	for _, v := range res.Items {
-		var alb api.Album
-		if err := attributevalue.UnmarshalMap(v, &alb); err != nil {
-			return api.HandlerResponse{Code: http.StatusInternalServerError, Error: err}
+	var startKey map[string]types.AttributeValue
+	for {
+		var items []map[string]types.AttributeValue
+		if query.Artist != "" {
+			res, err := this.Client.Query(ctx, &dynamodb.QueryInput{
+				TableName:                 aws.String(this.TableName),
+				IndexName:                 aws.String(artistIndexName),
+				ExclusiveStartKey:         startKey,
+				ExpressionAttributeNames:  expr.Names(),
+				ExpressionAttributeValues: expr.Values(),
+				KeyConditionExpression:    expr.KeyCondition(),
+				FilterExpression:          expr.Filter(),
+			})
+			if err != nil {
+				return NewErrorResponse(err)
+			}
+			items, startKey = res.Items, res.LastEvaluatedKey
+		} else {
+			res, err := this.Client.Scan(ctx, &dynamodb.ScanInput{
+				TableName:                 aws.String(this.TableName),
+				ExclusiveStartKey:         startKey,
+				ExpressionAttributeNames:  expr.Names(),
+				ExpressionAttributeValues: expr.Values(),
+				FilterExpression:          expr.Filter(),
+			})
+			if err != nil {
+				return NewErrorResponse(err)
+			}
+			items, startKey = res.Items, res.LastEvaluatedKey
 		}
 
-		albums = append(albums, alb)
+		for _, v := range items {
+			alb, err := unmarshalDynamoDbAlbum(tenant, v)
+			if err != nil {
+				return NewErrorResponse(err)
+			}
+			albums = append(albums, alb)
+		}
+
+		if len(startKey) == 0 {
+			break
+		}
+	}
+	sortAlbums(albums, sortFields)
+
+	start, end := min(position.Offset, len(albums)), len(albums)
+	if query.Limit > 0 && start+query.Limit < end {
+		end = start + query.Limit
+	}
+
+	var next string
+	if end < len(albums) {
+		next, _ = encodeCursor(dynamoDbCursor{Sort: signature, Offset: end})
 	}
 
 	return api.HandlerResponse{
 		Code: http.StatusOK,
-		Body: api.ResponseBody{Data: albums},
+		Body: api.ResponseBody{Data: albums[start:end], Next: next},
+	}
+}
+
+// dynamoDbAlbumIndex is the index listing the albums of query by TimeCreated.
+func dynamoDbAlbumIndex(query api.AlbumQueryDTO) string {
+	if query.Artist != "" {
+		return artistIndexName
+	}
+	return tenantIndexName
+}
+
+// startKey is the index key of the album at position, of the artist index
+// when Artist is set and of the tenant index otherwise.
+func (position dynamoDbCursor) startKey(tenant string) map[string]types.AttributeValue {
+	key := map[string]types.AttributeValue{
+		"Id":          &types.AttributeValueMemberS{Value: dynamoDbTenantKey(tenant, position.Id)},
+		"TimeCreated": &types.AttributeValueMemberN{Value: strconv.FormatInt(position.TimeCreated, 10)},
+	}
+	if position.Artist != "" {
+		key["Artist"] = &types.AttributeValueMemberS{Value: dynamoDbTenantKey(tenant, position.Artist)}
+	} else {
+		key["TenantKey"] = &types.AttributeValueMemberS{Value: dynamoDbTenantPartition(tenant)}
+	}
+
+	return key
+}
+
+// dynamoDbAlbumFilter builds the filter for query, with the key condition of
+// the dynamoDbAlbumIndex of query when keyed, for a scan otherwise. The filter
+// always keeps the listing to the albums of tenant.
+func dynamoDbAlbumFilter(tenant string, query api.AlbumQueryDTO, keyed bool) (*expression.Expression, error) {
+	builder := expression.NewBuilder()
+	conditions := []expression.ConditionBuilder{dynamoDbTenantCondition(tenant)}
+
+	if keyed {
+		keyCond := expression.Key("TenantKey").Equal(expression.Value(dynamoDbTenantPartition(tenant)))
+		if query.Artist != "" {
+			keyCond = expression.Key("Artist").Equal(expression.Value(dynamoDbTenantKey(tenant, query.Artist)))
+		}
+		if query.CreatedAfter > 0 {
+			keyCond = keyCond.And(expression.Key("TimeCreated").GreaterThan(expression.Value(query.CreatedAfter)))
+		}
+		builder = builder.WithKeyCondition(keyCond)
+	} else {
+		if query.Artist != "" {
+			conditions = append(conditions, expression.Name("Artist").Equal(expression.Value(dynamoDbTenantKey(tenant, query.Artist))))
+		}
+		if query.CreatedAfter > 0 {
+			conditions = append(conditions, expression.Name("TimeCreated").GreaterThan(expression.Value(query.CreatedAfter)))
+		}
+	}
+
+	if query.TitleContains != "" {
+		conditions = append(conditions, expression.Contains(expression.Name("Title"), query.TitleContains))
+	}
+	if query.MinPrice > 0 {
+		conditions = append(conditions, expression.Name("Price").GreaterThanEqual(expression.Value(query.MinPrice)))
+	}
+	if query.MaxPrice > 0 {
+		conditions = append(conditions, expression.Name("Price").LessThanEqual(expression.Value(query.MaxPrice)))
+	}
+
+	filter := conditions[0]
+	for _, cond := range conditions[1:] {
+		filter = filter.And(cond)
+	}
+	builder = builder.WithFilter(filter)
+
+	expr, err := builder.Build()
+	if err != nil {
+		return nil, err
 	}
+
+	return &expr, nil
 }
 
-func (this *DynamoDbService) GetAlbumById(id string) api.HandlerResponse {
-	ctx, cancel := context.WithTimeout(context.Background(), this.Timeout)
+func (this *DynamoDbService) GetAlbumById(ctx context.Context, id string) api.HandlerResponse {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
 	defer cancel()
 
+	tenant := api.TenantFromContext(ctx)
+	key, ok := dynamoDbAlbumKey(tenant, id)
+	if !ok {
+		return notFoundResponse()
+	}
+
 	params := dynamodb.GetItemInput{
 		TableName: aws.String(this.TableName),
-		Key: map[string]types.AttributeValue{
-			"Id": &types.AttributeValueMemberS{Value: id},
-		},
+		Key:       key,
 	}
 
 	res, err := this.Client.GetItem(ctx, &params)
 	if err != nil {
-		return api.HandlerResponse{Code: http.StatusInternalServerError, Error: err}
+		return NewErrorResponse(err)
 	}
 
 	if len(res.Item) == 0 {
-		return api.HandlerResponse{Code: http.StatusNotFound, Error: errors.New("album data not found")}
+		return notFoundResponse()
 	}
 
-	var alb api.Album
-	if err := attributevalue.UnmarshalMap(res.Item, &alb); err != nil {
-		return api.HandlerResponse{Code: http.StatusInternalServerError, Error: err}
+	alb, err := unmarshalDynamoDbAlbum(tenant, res.Item)
+	if err != nil {
+		return NewErrorResponse(err)
 	}
 
 	return api.HandlerResponse{
@@ -119,26 +477,37 @@ func (this *DynamoDbService) GetAlbumById(id string) api.HandlerResponse {
 	}
 }
 
-func (this *DynamoDbService) InsertAlbum(props api.AlbumPropertiesDTO) api.HandlerResponse {
+func (this *DynamoDbService) InsertAlbum(ctx context.Context, props api.AlbumPropertiesDTO) api.HandlerResponse {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	now := time.Now().UnixMilli()
 	newData := api.Album{
 		Id:          this.IdGen.NextId(),
 		Title:       props.Title,
 		Artist:      props.Artist,
 		Price:       props.Price,
-		TimeCreated: time.Now().UnixMilli(),
+		TimeCreated: now,
+		TimeUpdated: now,
+		Version:     1,
+		OwnerId:     api.SubjectFromContext(ctx),
 	}
 
 	item, err := attributevalue.MarshalMap(newData)
 	if err != nil {
-		return api.HandlerResponse{Code: http.StatusInternalServerError, Error: err}
+		return NewErrorResponse(err)
 	}
+	tenant := api.TenantFromContext(ctx)
+	item["Id"] = &types.AttributeValueMemberS{Value: dynamoDbTenantKey(tenant, newData.Id)}
+	item["Artist"] = &types.AttributeValueMemberS{Value: dynamoDbTenantKey(tenant, newData.Artist)}
+	item["TenantKey"] = &types.AttributeValueMemberS{Value: dynamoDbTenantPartition(tenant)}
 
 	params := dynamodb.PutItemInput{
 		TableName: aws.String(this.TableName),
 		Item:      item,
 	}
-	if _, err := this.Client.PutItem(context.Background(), &params); err != nil {
-		return api.HandlerResponse{Code: http.StatusInternalServerError, Error: err}
+	if _, err := this.Client.PutItem(ctx, &params); err != nil {
+		return NewErrorResponse(err)
 	}
 
 	return api.HandlerResponse{
@@ -150,43 +519,50 @@ func (this *DynamoDbService) InsertAlbum(props api.AlbumPropertiesDTO) api.Handl
 	}
 }
 
-func (this *DynamoDbService) ReplaceAlbum(id string, props api.AlbumPropertiesDTO) api.HandlerResponse {
+func (this *DynamoDbService) ReplaceAlbum(ctx context.Context, id string, props api.AlbumPropertiesDTO, expectedVersion int64) api.HandlerResponse {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	tenant := api.TenantFromContext(ctx)
+	key, ok := dynamoDbAlbumKey(tenant, id)
+	if !ok {
+		return notFoundResponse()
+	}
+
 	update := expression.
 		Set(expression.Name("Title"), expression.Value(props.Title)).
-		Set(expression.Name("Artist"), expression.Value(props.Artist)).
-		Set(expression.Name("Price"), expression.Value(props.Price))
+		Set(expression.Name("Artist"), expression.Value(dynamoDbTenantKey(tenant, props.Artist))).
+		Set(expression.Name("Price"), expression.Value(props.Price)).
+		Set(expression.Name("TimeUpdated"), expression.Value(time.Now().UnixMilli())).
+		Set(expression.Name("Version"), dynamoDbNextVersion())
 
 	expr, err := expression.NewBuilder().
 		WithUpdate(update).
-		WithCondition(expression.AttributeExists(expression.Name("Id"))).
+		WithCondition(dynamoDbWriteCondition(expectedVersion)).
 		Build()
 	if err != nil {
-		return api.HandlerResponse{Code: http.StatusInternalServerError, Error: err}
+		return NewErrorResponse(err)
 	}
 
 	params := dynamodb.UpdateItemInput{
-		TableName: aws.String(this.TableName),
-		Key: map[string]types.AttributeValue{
-			"Id": &types.AttributeValueMemberS{Value: id},
-		},
+		TableName:                 aws.String(this.TableName),
+		Key:                       key,
 		ExpressionAttributeNames:  expr.Names(),
 		ExpressionAttributeValues: expr.Values(),
 		UpdateExpression:          expr.Update(),
 		ConditionExpression:       expr.Condition(),
 		ReturnValues:              types.ReturnValueAllNew,
+		// the stored item tells a stale version apart from a missing album
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
 	}
-	result, err := this.Client.UpdateItem(context.Background(), &params)
+	result, err := this.Client.UpdateItem(ctx, &params)
 	if err != nil {
-		if strings.Contains(err.Error(), "ConditionalCheckFailedException") {
-			return api.HandlerResponse{Code: http.StatusNotFound, Error: errors.New("album data not found")}
-		}
-
-		return api.HandlerResponse{Code: http.StatusInternalServerError, Error: err}
+		return dynamoDbWriteErrorResponse(err)
 	}
 
-	var alb api.Album
-	if err := attributevalue.UnmarshalMap(result.Attributes, &alb); err != nil {
-		return api.HandlerResponse{Code: http.StatusInternalServerError, Error: err}
+	alb, err := unmarshalDynamoDbAlbum(tenant, result.Attributes)
+	if err != nil {
+		return NewErrorResponse(err)
 	}
 
 	return api.HandlerResponse{
@@ -195,49 +571,57 @@ func (this *DynamoDbService) ReplaceAlbum(id string, props api.AlbumPropertiesDT
 	}
 }
 
-func (this *DynamoDbService) UpdateAlbum(id string, updates api.AlbumUpdatesDTO) api.HandlerResponse {
+func (this *DynamoDbService) UpdateAlbum(ctx context.Context, id string, updates api.AlbumUpdatesDTO, expectedVersion int64) api.HandlerResponse {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	tenant := api.TenantFromContext(ctx)
+	key, ok := dynamoDbAlbumKey(tenant, id)
+	if !ok {
+		return notFoundResponse()
+	}
+
 	var update expression.UpdateBuilder
 	if updates.Title != "" {
 		update = update.Set(expression.Name("Title"), expression.Value(updates.Title))
 	}
 	if updates.Artist != "" {
-		update = update.Set(expression.Name("Artist"), expression.Value(updates.Artist))
+		update = update.Set(expression.Name("Artist"), expression.Value(dynamoDbTenantKey(tenant, updates.Artist)))
 	}
 	if updates.Price > 0 {
 		update = update.Set(expression.Name("Price"), expression.Value(updates.Price))
 	}
+	update = update.
+		Set(expression.Name("TimeUpdated"), expression.Value(time.Now().UnixMilli())).
+		Set(expression.Name("Version"), dynamoDbNextVersion())
 
 	expr, err := expression.NewBuilder().
 		WithUpdate(update).
-		WithCondition(expression.AttributeExists(expression.Name("Id"))).
+		WithCondition(dynamoDbWriteCondition(expectedVersion)).
 		Build()
 	if err != nil {
-		return api.HandlerResponse{Code: http.StatusInternalServerError, Error: err}
+		return NewErrorResponse(err)
 	}
 
 	params := dynamodb.UpdateItemInput{
-		TableName: aws.String(this.TableName),
-		Key: map[string]types.AttributeValue{
-			"Id": &types.AttributeValueMemberS{Value: id},
-		},
+		TableName:                 aws.String(this.TableName),
+		Key:                       key,
 		ExpressionAttributeNames:  expr.Names(),
 		ExpressionAttributeValues: expr.Values(),
 		UpdateExpression:          expr.Update(),
 		ConditionExpression:       expr.Condition(),
 		ReturnValues:              types.ReturnValueAllNew,
+		// the stored item tells a stale version apart from a missing album
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
 	}
-	result, err := this.Client.UpdateItem(context.Background(), &params)
+	result, err := this.Client.UpdateItem(ctx, &params)
 	if err != nil {
-		if strings.Contains(err.Error(), "ConditionalCheckFailedException") {
-			return api.HandlerResponse{Code: http.StatusNotFound, Error: errors.New("album data not found")}
-		}
-
-		return api.HandlerResponse{Code: http.StatusInternalServerError, Error: err}
+		return dynamoDbWriteErrorResponse(err)
 	}
 
-	var alb api.Album
-	if err := attributevalue.UnmarshalMap(result.Attributes, &alb); err != nil {
-		return api.HandlerResponse{Code: http.StatusInternalServerError, Error: err}
+	alb, err := unmarshalDynamoDbAlbum(tenant, result.Attributes)
+	if err != nil {
+		return NewErrorResponse(err)
 	}
 
 	return api.HandlerResponse{
@@ -246,20 +630,148 @@ func (this *DynamoDbService) UpdateAlbum(id string, updates api.AlbumUpdatesDTO)
 	}
 }
 
-func (this *DynamoDbService) DeleteAlbum(id string) api.HandlerResponse {
-	params := dynamodb.DeleteItemInput{
-		TableName: aws.String(this.TableName),
-		Key: map[string]types.AttributeValue{
-			"Id": &types.AttributeValueMemberS{Value: id},
-		},
+func (this *DynamoDbService) DeleteAlbum(ctx context.Context, id string, expectedVersion int64) api.HandlerResponse {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	key, ok := dynamoDbAlbumKey(api.TenantFromContext(ctx), id)
+	if !ok {
+		return notFoundResponse()
 	}
 
-	if _, err := this.Client.DeleteItem(context.Background(), &params); err != nil {
-		return api.HandlerResponse{Code: http.StatusInternalServerError, Error: err}
+	expr, err := expression.NewBuilder().
+		WithCondition(dynamoDbWriteCondition(expectedVersion)).
+		Build()
+	if err != nil {
+		return NewErrorResponse(err)
+	}
+
+	params := dynamodb.DeleteItemInput{
+		TableName:                 aws.String(this.TableName),
+		Key:                       key,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ConditionExpression:       expr.Condition(),
+		// the stored item tells a stale version apart from a missing album
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	}
+	if _, err := this.Client.DeleteItem(ctx, &params); err != nil {
+		return dynamoDbWriteErrorResponse(err)
 	}
 
 	return api.HandlerResponse{
 		Code: http.StatusOK,
-		Body: api.ResponseBody{Message: "album data removal processed"},
+		Body: api.ResponseBody{Message: "album data removed"},
+	}
+}
+
+// ApplyConfig changes the query timeout of the calls that follow.
+func (this *DynamoDbService) ApplyConfig(config api.AppConfig) {
+	this.Timeout.Set(time.Duration(config.DynamoDbConfig.QueryTimeoutSeconds) * time.Second)
+}
+
+// Close releases the idle connections to DynamoDB, the client itself holds
+// no other resources.
+func (this *DynamoDbService) Close(ctx context.Context) error {
+	if this.Transport != nil {
+		this.Transport.CloseIdleConnections()
+	}
+
+	return nil
+}
+
+// CheckHealth describes the albums table, which fails when DynamoDB can't be
+// reached or the table is missing.
+func (this *DynamoDbService) CheckHealth(ctx context.Context) error {
+	return checkDynamoDbTable(ctx, this.Client, this.TableName)
+}
+
+func checkDynamoDbTable(ctx context.Context, client *dynamodb.Client, tableName string) error {
+	output, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+	if err != nil {
+		return err
+	}
+
+	switch status := output.Table.TableStatus; status {
+	case types.TableStatusActive, types.TableStatusUpdating:
+		return nil
+	default:
+		return fmt.Errorf("table %s is %s", tableName, status)
+	}
+}
+
+// dynamoDbTenantKey prefixes the Id and Artist partition keys with the tenant,
+// so tenants never share an item or a partition of the artist index. Tenant
+// names can't contain '#', the albums of the default tenant are unprefixed.
+func dynamoDbTenantKey(tenant string, value string) string {
+	if tenant == "" {
+		return value
+	}
+	return tenant + "#" + value
+}
+
+// dynamoDbTenantPartition is the gsi_tenant_timecreated partition of tenant,
+// never empty since index keys can't be.
+func dynamoDbTenantPartition(tenant string) string {
+	return "tenant#" + tenant
+}
+
+// dynamoDbTenantCondition matches the items of tenant, which also guards the
+// artist index against an artist named like another tenant's prefix.
+func dynamoDbTenantCondition(tenant string) expression.ConditionBuilder {
+	if tenant == "" {
+		return expression.Not(expression.Contains(expression.Name("Id"), "#"))
+	}
+	return expression.BeginsWith(expression.Name("Id"), tenant+"#")
+}
+
+// dynamoDbAlbumKey is the key of album id of tenant, ok is false for ids that
+// could only name an album of another tenant.
+func dynamoDbAlbumKey(tenant string, id string) (map[string]types.AttributeValue, bool) {
+	if tenant == "" && strings.Contains(id, "#") {
+		return nil, false
+	}
+
+	return map[string]types.AttributeValue{
+		"Id": &types.AttributeValueMemberS{Value: dynamoDbTenantKey(tenant, id)},
+	}, true
+}
+
+func unmarshalDynamoDbAlbum(tenant string, item map[string]types.AttributeValue) (api.Album, error) {
+	var alb api.Album
+	if err := attributevalue.UnmarshalMap(item, &alb); err != nil {
+		return alb, err
+	}
+
+	if tenant != "" {
+		alb.Id = strings.TrimPrefix(alb.Id, tenant+"#")
+		alb.Artist = strings.TrimPrefix(alb.Artist, tenant+"#")
 	}
+	return alb, nil
+}
+
+func dynamoDbNextVersion() expression.SetValueBuilder {
+	return expression.Plus(expression.IfNotExists(expression.Name("Version"), expression.Value(0)), expression.Value(1))
+}
+
+func dynamoDbWriteCondition(expectedVersion int64) expression.ConditionBuilder {
+	condition := expression.AttributeExists(expression.Name("Id"))
+	if expectedVersion != 0 {
+		condition = condition.And(expression.Name("Version").Equal(expression.Value(expectedVersion)))
+	}
+
+	return condition
+}
+
+func dynamoDbWriteErrorResponse(err error) api.HandlerResponse {
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		if len(conditionErr.Item) > 0 {
+			return versionMismatchResponse()
+		}
+
+		return notFoundResponse()
+	}
+
+	return NewErrorResponse(err)
 }
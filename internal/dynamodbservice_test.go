@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"andrewsaputra/go-rest-sample/api/servicetest"
+	"context"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/require"
+)
+
+// InitDynamoDbService connects to the DynamoDB Local instance at
+// DYNAMODB_TEST_ENDPOINT and gives every test its own albums table.
+func InitDynamoDbService(t *testing.T) *DynamoDbService {
+	endpoint := os.Getenv("DYNAMODB_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("DYNAMODB_TEST_ENDPOINT not set")
+	}
+	// DynamoDB Local accepts any credentials but the SDK still requires some
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+		t.Setenv("AWS_ACCESS_KEY_ID", "local")
+		t.Setenv("AWS_SECRET_ACCESS_KEY", "local")
+	}
+
+	idGen := NewXidGenerator()
+	config := api.DynamoDbConfig{
+		LocalEndpoint:       endpoint,
+		TableName:           "albums_" + idGen.NextId(),
+		Region:              "ap-southeast-1",
+		QueryTimeoutSeconds: 5,
+	}
+	service, err := NewDynamoDbService(config, idGen)
+	require.Nil(t, err)
+
+	dynamoDbService := service.(*DynamoDbService)
+	createDynamoDbAlbumsTable(t, dynamoDbService)
+
+	return dynamoDbService
+}
+
+// createDynamoDbAlbumsTable mirrors the create-table command in dynamodbservice.go.
+func createDynamoDbAlbumsTable(t *testing.T, service *DynamoDbService) {
+	ctx := context.Background()
+	indexProjection := &types.Projection{ProjectionType: types.ProjectionTypeAll}
+	_, err := service.Client.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName:   aws.String(service.TableName),
+		BillingMode: types.BillingModePayPerRequest,
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("Id"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("TimeCreated"), AttributeType: types.ScalarAttributeTypeN},
+			{AttributeName: aws.String("Artist"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("TenantKey"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("Id"), KeyType: types.KeyTypeHash},
+		},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String("gsi_id_timecreated"),
+				KeySchema: []types.KeySchemaElement{
+					{AttributeName: aws.String("Id"), KeyType: types.KeyTypeHash},
+					{AttributeName: aws.String("TimeCreated"), KeyType: types.KeyTypeRange},
+				},
+				Projection: indexProjection,
+			},
+			{
+				IndexName: aws.String(tenantIndexName),
+				KeySchema: []types.KeySchemaElement{
+					{AttributeName: aws.String("TenantKey"), KeyType: types.KeyTypeHash},
+					{AttributeName: aws.String("TimeCreated"), KeyType: types.KeyTypeRange},
+				},
+				Projection: indexProjection,
+			},
+			{
+				IndexName: aws.String(artistIndexName),
+				KeySchema: []types.KeySchemaElement{
+					{AttributeName: aws.String("Artist"), KeyType: types.KeyTypeHash},
+					{AttributeName: aws.String("TimeCreated"), KeyType: types.KeyTypeRange},
+				},
+				Projection: indexProjection,
+			},
+		},
+	})
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		service.Client.DeleteTable(context.Background(), &dynamodb.DeleteTableInput{TableName: aws.String(service.TableName)})
+	})
+
+	waiter := dynamodb.NewTableExistsWaiter(service.Client)
+	err = waiter.Wait(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(service.TableName)}, 30*time.Second)
+	require.Nil(t, err)
+}
+
+func TestDynamoDbService_AlbumsWithoutTenantKey_ListedAfterBackfill(t *testing.T) {
+	service := InitDynamoDbService(t)
+	ctx := context.Background()
+	for _, id := range []string{"legacy-1", "acme#legacy-2"} {
+		_, err := service.Client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(service.TableName),
+			Item: map[string]types.AttributeValue{
+				"Id":          &types.AttributeValueMemberS{Value: id},
+				"Title":       &types.AttributeValueMemberS{Value: "title"},
+				"Artist":      &types.AttributeValueMemberS{Value: "artist"},
+				"TimeCreated": &types.AttributeValueMemberN{Value: "1"},
+				"Version":     &types.AttributeValueMemberN{Value: "1"},
+			},
+		})
+		require.Nil(t, err)
+	}
+
+	require.Nil(t, service.CreateIndexes(ctx))
+
+	response := service.GetAlbums(ctx, api.AlbumQueryDTO{Limit: 10})
+	require.Equal(t, "legacy-1", response.Body.Data.([]api.Album)[0].Id)
+	response = service.GetAlbums(api.ContextWithTenant(ctx, "acme"), api.AlbumQueryDTO{Limit: 10})
+	require.Equal(t, "legacy-2", response.Body.Data.([]api.Album)[0].Id)
+}
+
+func TestDynamoDbService_Conformance(t *testing.T) {
+	servicetest.Run(t, func(t *testing.T) api.Service {
+		return InitDynamoDbService(t)
+	})
+}
+
+func TestDynamoDbService_CursorOfOtherOrder_ReturnBadRequest(t *testing.T) {
+	// cursors are checked before the table is read
+	service := &DynamoDbService{TableName: "albums", Timeout: NewQueryTimeout(5 * time.Second)}
+	ascending, _ := encodeCursor(dynamoDbCursor{Id: "albumId", TimeCreated: 1, Sort: "timeCreated"})
+	byPrice, _ := encodeCursor(dynamoDbCursor{Sort: "price", Offset: 3})
+
+	for name, query := range map[string]api.AlbumQueryDTO{
+		"reversed":        {Cursor: ascending, Sort: []api.SortField{{Field: "timeCreated", Descending: true}}},
+		"index to sorted": {Cursor: ascending, Sort: []api.SortField{{Field: "price"}}},
+		"sorted to index": {Cursor: byPrice},
+	} {
+		response := service.GetAlbums(context.Background(), query)
+		require.Equal(t, http.StatusBadRequest, response.Code, name)
+	}
+}
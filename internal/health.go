@@ -0,0 +1,201 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultHealthCacheMillis        = 1000
+	defaultHealthCheckTimeoutMillis = 2000
+)
+
+const (
+	healthStatusUp       = "up"
+	healthStatusDown     = "down"
+	healthStatusDraining = "draining"
+)
+
+// Dependency is an external service the app needs to serve requests.
+type Dependency struct {
+	Name    string
+	Checker api.HealthChecker
+}
+
+// DependencyStatus is the outcome of checking a single Dependency.
+type DependencyStatus struct {
+	Name          string  `json:"name"`
+	Status        string  `json:"status"`
+	LatencyMillis float64 `json:"latencyMillis"`
+}
+
+// ReadinessReport is the body of /readyz.
+type ReadinessReport struct {
+	Status       string             `json:"status"`
+	CheckedAt    time.Time          `json:"checkedAt"`
+	Dependencies []DependencyStatus `json:"dependencies"`
+}
+
+// NewReadinessChecker checks dependencies concurrently, each bounded by
+// config.CheckTimeoutMillis, and reuses the report for config.CacheMillis.
+func NewReadinessChecker(config api.HealthConfig, dependencies []Dependency, logger *slog.Logger) *ReadinessChecker {
+	readiness := &ReadinessChecker{
+		Dependencies: dependencies,
+		Logger:       logger,
+	}
+	readiness.setDurations(config)
+
+	return readiness
+}
+
+type ReadinessChecker struct {
+	Dependencies []Dependency
+	CacheTtl     time.Duration
+	Timeout      time.Duration
+	Logger       *slog.Logger
+
+	draining atomic.Bool
+	// mutex also makes concurrent probes wait for the check in progress
+	// instead of starting their own
+	mutex  sync.Mutex
+	report *ReadinessReport
+}
+
+// HealthDependencies lists the parts of service and of the stores that can
+// be checked, in the order they are reported. Stores the app doesn't use are
+// passed as nil.
+func HealthDependencies(service api.Service, idempotencyStore api.IdempotencyStore, apiKeyStore api.ApiKeyStore, rateLimitStore api.RateLimitStore, auditSink api.AuditSink) []Dependency {
+	parts := []struct {
+		name string
+		part any
+	}{
+		{"albums", service},
+		{"idempotency", idempotencyStore},
+		{"apiKeys", apiKeyStore},
+		{"rateLimits", rateLimitStore},
+		{"audit", auditSink},
+	}
+
+	var dependencies []Dependency
+	for _, part := range parts {
+		if checker, ok := part.part.(api.HealthChecker); ok {
+			dependencies = append(dependencies, Dependency{Name: part.name, Checker: checker})
+		}
+	}
+
+	return dependencies
+}
+
+// ApplyConfig changes the cache and timeout of the checks that follow, a
+// report cached before keeps being served until it expires.
+func (this *ReadinessChecker) ApplyConfig(config api.AppConfig) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.setDurations(config.HealthConfig)
+}
+
+func (this *ReadinessChecker) setDurations(config api.HealthConfig) {
+	if config.CacheMillis <= 0 {
+		config.CacheMillis = defaultHealthCacheMillis
+	}
+	if config.CheckTimeoutMillis <= 0 {
+		config.CheckTimeoutMillis = defaultHealthCheckTimeoutMillis
+	}
+
+	this.CacheTtl = time.Duration(config.CacheMillis) * time.Millisecond
+	this.Timeout = time.Duration(config.CheckTimeoutMillis) * time.Millisecond
+}
+
+// SetDraining makes every later check report the app as not ready, so load
+// balancers stop routing to it while in-flight requests complete.
+func (this *ReadinessChecker) SetDraining() {
+	this.draining.Store(true)
+}
+
+// Check returns the cached report, or checks every dependency once it expired.
+func (this *ReadinessChecker) Check(ctx context.Context) ReadinessReport {
+	if this.draining.Load() {
+		return ReadinessReport{Status: healthStatusDraining, CheckedAt: time.Now(), Dependencies: []DependencyStatus{}}
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.report != nil && time.Since(this.report.CheckedAt) < this.CacheTtl {
+		return *this.report
+	}
+
+	report := ReadinessReport{
+		Status:       healthStatusUp,
+		CheckedAt:    time.Now(),
+		Dependencies: make([]DependencyStatus, len(this.Dependencies)),
+	}
+	var wg sync.WaitGroup
+	for i, dependency := range this.Dependencies {
+		wg.Add(1)
+		go func(i int, dependency Dependency) {
+			defer wg.Done()
+			report.Dependencies[i] = this.checkDependency(ctx, dependency)
+		}(i, dependency)
+	}
+	wg.Wait()
+
+	for _, status := range report.Dependencies {
+		if status.Status != healthStatusUp {
+			report.Status = healthStatusDown
+		}
+	}
+
+	this.report = &report
+	return report
+}
+
+// checkDependency runs a single check, detached from the cancellation of the
+// probe that triggered it since its result is shared with later probes.
+func (this *ReadinessChecker) checkDependency(ctx context.Context, dependency Dependency) DependencyStatus {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), this.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := dependency.Checker.CheckHealth(ctx)
+	status := DependencyStatus{
+		Name:          dependency.Name,
+		Status:        healthStatusUp,
+		LatencyMillis: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		status.Status = healthStatusDown
+		this.Logger.WarnContext(ctx, "dependency health check failed",
+			slog.String("dependency", dependency.Name),
+			slog.Any("error", err),
+		)
+	}
+
+	return status
+}
+
+// Readyz reports 200 when every dependency is up and 503 otherwise, including
+// while draining. Check errors are only logged, as with other backend errors.
+func (this *ReadinessChecker) Readyz(c *gin.Context) {
+	report := this.Check(c.Request.Context())
+	code := http.StatusOK
+	if report.Status != healthStatusUp {
+		code = http.StatusServiceUnavailable
+	}
+
+	c.JSON(code, report)
+}
+
+// Livez reports that the process is able to serve requests, without looking
+// at any dependency so a backend outage doesn't get the app restarted.
+func Livez(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": healthStatusUp})
+}
@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type stubHealthChecker struct {
+	err   error
+	calls atomic.Int32
+}
+
+func (this *stubHealthChecker) CheckHealth(ctx context.Context) error {
+	this.calls.Add(1)
+	return this.err
+}
+
+func SendReadinessProbe(readiness *ReadinessChecker) (*httptest.ResponseRecorder, ReadinessReport) {
+	router := gin.New()
+	router.GET("/readyz", readiness.Readyz)
+
+	request, _ := http.NewRequest(http.MethodGet, "/readyz", nil)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	var report ReadinessReport
+	json.Unmarshal(response.Body.Bytes(), &report)
+	return response, report
+}
+
+func TestReadinessChecker_AllDependenciesUp_ReturnOk(t *testing.T) {
+	dependencies := []Dependency{
+		{Name: "albums", Checker: &InitSqliteService(t, ":memory:").SqlService},
+		{Name: "idempotency", Checker: &stubHealthChecker{}},
+	}
+	readiness := NewReadinessChecker(api.HealthConfig{}, dependencies, slog.Default())
+
+	response, report := SendReadinessProbe(readiness)
+
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, healthStatusUp, report.Status)
+	assert.Len(t, report.Dependencies, 2)
+	assert.Equal(t, DependencyStatus{Name: "albums", Status: healthStatusUp, LatencyMillis: report.Dependencies[0].LatencyMillis}, report.Dependencies[0])
+	assert.Equal(t, "idempotency", report.Dependencies[1].Name)
+}
+
+func TestReadinessChecker_DependencyDown_ReturnServiceUnavailable(t *testing.T) {
+	dependencies := []Dependency{
+		{Name: "albums", Checker: &stubHealthChecker{err: errors.New("connection refused")}},
+		{Name: "idempotency", Checker: &stubHealthChecker{}},
+	}
+	readiness := NewReadinessChecker(api.HealthConfig{}, dependencies, slog.Default())
+
+	response, report := SendReadinessProbe(readiness)
+
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code)
+	assert.Equal(t, healthStatusDown, report.Status)
+	assert.Equal(t, healthStatusDown, report.Dependencies[0].Status)
+	assert.Equal(t, healthStatusUp, report.Dependencies[1].Status)
+	assert.NotContains(t, response.Body.String(), "connection refused")
+}
+
+func TestReadinessChecker_RepeatedProbes_CheckOncePerCacheTtl(t *testing.T) {
+	checker := &stubHealthChecker{}
+	readiness := NewReadinessChecker(api.HealthConfig{CacheMillis: 60000}, []Dependency{{Name: "albums", Checker: checker}}, slog.Default())
+
+	first := readiness.Check(context.Background())
+	second := readiness.Check(context.Background())
+	assert.Equal(t, int32(1), checker.calls.Load())
+	assert.Equal(t, first, second)
+
+	readiness.CacheTtl = 0
+	readiness.Check(context.Background())
+	assert.Equal(t, int32(2), checker.calls.Load())
+}
+
+func TestHealthDependencies_InMemoryBackend_NoDependencies(t *testing.T) {
+	dependencies := HealthDependencies(InitServiceWithMocks(), NewInMemoryIdempotencyStore(), NewInMemoryApiKeyStore(), NewInMemoryRateLimitStore(), NewInMemoryAuditSink())
+	assert.Empty(t, dependencies)
+
+	service := InitSqliteService(t, ":memory:")
+	dependencies = HealthDependencies(service, NewSqlIdempotencyStore(&service.SqlService), nil, nil, nil)
+	assert.Len(t, dependencies, 1)
+	assert.Equal(t, "albums", dependencies[0].Name)
+}
+
+func TestHealthDependencies_DynamoDbStores_CheckEveryTable(t *testing.T) {
+	service := &DynamoDbService{TableName: "albums", Timeout: NewQueryTimeout(time.Second)}
+
+	dependencies := HealthDependencies(service, NewDynamoDbIdempotencyStore(service, "idempotency_keys"), NewDynamoDbApiKeyStore(service, "api_keys"), NewDynamoDbRateLimitStore(service, "rate_limits"), NewDynamoDbAuditSink(service, "audit_log"))
+
+	names := []string{}
+	for _, dependency := range dependencies {
+		names = append(names, dependency.Name)
+	}
+	assert.Equal(t, []string{"albums", "idempotency", "apiKeys", "rateLimits", "audit"}, names)
+}
+
+func TestLivez_ReturnOk(t *testing.T) {
+	router := gin.New()
+	router.GET("/livez", Livez)
+
+	request, _ := http.NewRequest(http.MethodGet, "/livez", nil)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `{"status":"up"}`, response.Body.String())
+}
+
+func TestReadinessChecker_Draining_ReturnServiceUnavailableWithoutChecking(t *testing.T) {
+	checker := &stubHealthChecker{}
+	readiness := NewReadinessChecker(api.HealthConfig{}, []Dependency{{Name: "albums", Checker: checker}}, slog.Default())
+
+	readiness.SetDraining()
+	response, report := SendReadinessProbe(readiness)
+
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code)
+	assert.Equal(t, healthStatusDraining, report.Status)
+	assert.Equal(t, int32(0), checker.calls.Load())
+}
@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+	defaultIdempotencyTtl     = 24 * time.Hour
+)
+
+// NewIdempotencyMiddleware replays the stored response when a request repeats
+// an Idempotency-Key. Only responses the client could act on are kept, server
+// errors and cancellations release the key so the retry runs again.
+func NewIdempotencyMiddleware(store api.IdempotencyStore, config api.IdempotencyConfig) gin.HandlerFunc {
+	ttl := time.Duration(config.TtlSeconds) * time.Second
+	if ttl <= 0 {
+		ttl = defaultIdempotencyTtl
+	}
+
+	return func(c *gin.Context) {
+		key := c.GetHeader(idempotencyKeyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			writeProblem(c, http.StatusBadRequest, fieldError(idempotencyKeyHeader, "max", "must be at most 255 characters", nil))
+			return
+		}
+
+		fingerprint, err := requestFingerprint(c)
+		if err != nil {
+			writeProblem(c, http.StatusBadRequest, requestError(err))
+			return
+		}
+
+		ctx := c.Request.Context()
+		key = idempotencyScope(ctx) + key
+		record := api.IdempotencyRecord{
+			Key:         key,
+			Fingerprint: fingerprint,
+			ExpiresAt:   time.Now().Add(ttl),
+		}
+		existing, err := store.Reserve(ctx, record)
+		if err != nil {
+			resp := NewErrorResponse(err)
+			writeProblem(c, resp.Code, resp.Error)
+			return
+		}
+
+		if existing != nil {
+			replayIdempotentResponse(c, existing, fingerprint)
+			return
+		}
+
+		recorder := &bodyRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+
+		// the stored outcome must not depend on whether this client is still waiting
+		ctx = context.WithoutCancel(ctx)
+		status := recorder.Status()
+		if status >= http.StatusInternalServerError || status == api.StatusClientClosedRequest {
+			store.Release(ctx, key)
+			return
+		}
+
+		record.StatusCode = status
+		record.Header = recorder.Header().Clone()
+		record.Body = recorder.Body.Bytes()
+		if err := store.Complete(ctx, record); err != nil {
+			store.Release(ctx, key)
+		}
+	}
+}
+
+// idempotencyScope prefixes the keys of a caller, keys are only unique to the
+// caller who picked them so a replay must never cross tenants or callers. The
+// caller is hashed since subjects may contain the separator.
+func idempotencyScope(ctx context.Context) string {
+	var caller string
+	if principal := api.PrincipalFromContext(ctx); principal != nil {
+		hash := sha256.Sum256([]byte(principal.Method + "\n" + principal.Subject))
+		caller = hex.EncodeToString(hash[:])
+	}
+	return api.TenantFromContext(ctx) + ":" + caller + ":"
+}
+
+func replayIdempotentResponse(c *gin.Context, existing *api.IdempotencyRecord, fingerprint string) {
+	switch {
+	case existing.Fingerprint != fingerprint:
+		writeProblem(c, http.StatusUnprocessableEntity, api.NewError(api.KindUnprocessable, "Idempotency-Key was already used with a different request payload"))
+	case existing.StatusCode == 0:
+		writeProblem(c, http.StatusConflict, api.NewError(api.KindConflict, "a request with this Idempotency-Key is still being processed"))
+	default:
+		for name, values := range existing.Header {
+			if !perRequestHeader(name) {
+				c.Writer.Header()[name] = values
+			}
+		}
+		c.Header(idempotencyReplayedHeader, "true")
+		c.Status(existing.StatusCode)
+		c.Writer.Write(existing.Body)
+		c.Abort()
+	}
+}
+
+// perRequestHeader reports whether the header named name describes the
+// request that stored a response rather than the response, such headers are
+// set anew for the replaying request.
+func perRequestHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	return name == http.CanonicalHeaderKey(RequestIdHeader) || name == "Retry-After" || strings.HasPrefix(name, "Ratelimit-")
+}
+
+// requestFingerprint hashes the request target and body, restoring the body for the handler.
+func requestFingerprint(c *gin.Context) (string, error) {
+	var body []byte
+	if c.Request.Body != nil {
+		raw, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			return "", err
+		}
+		body = raw
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	hash := sha256.New()
+	io.WriteString(hash, c.Request.Method+" "+c.Request.URL.Path+"\n")
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// bodyRecorder keeps a copy of everything written so it can be replayed later.
+type bodyRecorder struct {
+	gin.ResponseWriter
+	Body bytes.Buffer
+}
+
+func (this *bodyRecorder) Write(data []byte) (int, error) {
+	this.Body.Write(data)
+	return this.ResponseWriter.Write(data)
+}
+
+func (this *bodyRecorder) WriteString(data string) (int, error) {
+	this.Body.WriteString(data)
+	return this.ResponseWriter.WriteString(data)
+}
@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func InitIdempotentRouter(status int) (*gin.Engine, *int) {
+	calls := 0
+	router := gin.New()
+	router.POST("/albums", NewIdempotencyMiddleware(NewInMemoryIdempotencyStore(), api.IdempotencyConfig{}), func(c *gin.Context) {
+		calls++
+		c.JSON(status, gin.H{"call": calls})
+	})
+
+	return router, &calls
+}
+
+func SendIdempotentRequest(router *gin.Engine, key string, payload string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(http.MethodPost, "/albums", bytes.NewReader([]byte(payload)))
+	if key != "" {
+		request.Header.Set(idempotencyKeyHeader, key)
+	}
+
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	return response
+}
+
+func TestIdempotency_RepeatedKey_ReplayFirstResponse(t *testing.T) {
+	router, calls := InitIdempotentRouter(http.StatusOK)
+
+	first := SendIdempotentRequest(router, "key-1", `{"title":"title"}`)
+	second := SendIdempotentRequest(router, "key-1", `{"title":"title"}`)
+
+	assert.Equal(t, 1, *calls)
+	assert.Equal(t, first.Code, second.Code)
+	assert.Equal(t, first.Body.Bytes(), second.Body.Bytes())
+	assert.Equal(t, first.Header().Get("Content-Type"), second.Header().Get("Content-Type"))
+	assert.Equal(t, "true", second.Header().Get(idempotencyReplayedHeader))
+}
+
+func TestIdempotency_Replay_KeepHeadersOfReplayingRequest(t *testing.T) {
+	router := gin.New()
+	router.POST("/albums", NewRequestIdMiddleware(NewXidGenerator()), func(c *gin.Context) {
+		c.Header("RateLimit-Remaining", "9")
+		c.Next()
+	}, NewIdempotencyMiddleware(NewInMemoryIdempotencyStore(), api.IdempotencyConfig{}), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{})
+	})
+
+	first := SendIdempotentRequest(router, "key-1", `{"title":"title"}`)
+	second := SendIdempotentRequest(router, "key-1", `{"title":"title"}`)
+
+	assert.Equal(t, "true", second.Header().Get(idempotencyReplayedHeader))
+	assert.NotEqual(t, first.Header().Get(RequestIdHeader), second.Header().Get(RequestIdHeader))
+	assert.Equal(t, []string{"9"}, second.Header().Values("RateLimit-Remaining"))
+}
+
+func TestIdempotency_KeyReusedWithDifferentPayload_ReturnUnprocessableEntity(t *testing.T) {
+	router, calls := InitIdempotentRouter(http.StatusOK)
+
+	SendIdempotentRequest(router, "key-1", `{"title":"title"}`)
+	response := SendIdempotentRequest(router, "key-1", `{"title":"other"}`)
+
+	assert.Equal(t, 1, *calls)
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+}
+
+func TestIdempotency_ServerError_KeyReleasedForRetry(t *testing.T) {
+	router, calls := InitIdempotentRouter(http.StatusInternalServerError)
+
+	SendIdempotentRequest(router, "key-1", `{"title":"title"}`)
+	SendIdempotentRequest(router, "key-1", `{"title":"title"}`)
+
+	assert.Equal(t, 2, *calls)
+}
+
+func TestIdempotency_NoKey_AlwaysProcessed(t *testing.T) {
+	router, calls := InitIdempotentRouter(http.StatusOK)
+
+	SendIdempotentRequest(router, "", `{"title":"title"}`)
+	SendIdempotentRequest(router, "", `{"title":"title"}`)
+
+	assert.Equal(t, 2, *calls)
+}
+
+func TestIdempotency_KeyInFlight_ReturnConflict(t *testing.T) {
+	store := NewInMemoryIdempotencyStore()
+	router := gin.New()
+	router.POST("/albums", NewIdempotencyMiddleware(store, api.IdempotencyConfig{}), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{})
+	})
+
+	// the original request for key-1 is reserved but has not completed yet
+	ginContext, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ginContext.Request, _ = http.NewRequest(http.MethodPost, "/albums", bytes.NewReader([]byte("{}")))
+	fingerprint, _ := requestFingerprint(ginContext)
+	store.Reserve(context.Background(), api.IdempotencyRecord{Key: idempotencyScope(context.Background()) + "key-1", Fingerprint: fingerprint, ExpiresAt: time.Now().Add(time.Minute)})
+
+	response := SendIdempotentRequest(router, "key-1", "{}")
+	assert.Equal(t, http.StatusConflict, response.Code)
+}
+
+func TestIdempotency_SameKeyOtherTenant_ProcessedSeparately(t *testing.T) {
+	calls := 0
+	router := gin.New()
+	router.POST("/albums", NewTenantMiddleware(api.TenancyConfig{Enabled: true}), NewIdempotencyMiddleware(NewInMemoryIdempotencyStore(), api.IdempotencyConfig{}), func(c *gin.Context) {
+		calls++
+		c.JSON(http.StatusOK, gin.H{"tenant": api.TenantFromContext(c.Request.Context())})
+	})
+	send := func(tenant string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(http.MethodPost, "/albums", bytes.NewReader([]byte(`{"title":"title"}`)))
+		request.Header.Set(idempotencyKeyHeader, "key-1")
+		request.Header.Set(defaultTenantHeader, tenant)
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		return response
+	}
+
+	send("acme")
+	response := send("globex")
+
+	assert.Equal(t, 2, calls)
+	assert.JSONEq(t, `{"tenant":"globex"}`, response.Body.String())
+	assert.Empty(t, response.Header().Get(idempotencyReplayedHeader))
+}
+
+func TestIdempotency_SameKeyOtherCaller_ProcessedSeparately(t *testing.T) {
+	calls := 0
+	router := gin.New()
+	router.POST("/albums", func(c *gin.Context) {
+		principal := &api.Principal{Subject: c.GetHeader("X-Subject"), Method: authModeJwt}
+		c.Request = c.Request.WithContext(api.ContextWithPrincipal(c.Request.Context(), principal))
+	}, NewIdempotencyMiddleware(NewInMemoryIdempotencyStore(), api.IdempotencyConfig{}), func(c *gin.Context) {
+		calls++
+		c.JSON(http.StatusOK, gin.H{"subject": api.SubjectFromContext(c.Request.Context())})
+	})
+	send := func(subject string, payload string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(http.MethodPost, "/albums", bytes.NewReader([]byte(payload)))
+		request.Header.Set(idempotencyKeyHeader, "key-1")
+		request.Header.Set("X-Subject", subject)
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		return response
+	}
+
+	send("user-1", `{"title":"title"}`)
+	other := send("user-2", `{"title":"other"}`)
+
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, http.StatusOK, other.Code)
+	assert.Contains(t, other.Body.String(), "user-2")
+	assert.Contains(t, send("user-1", `{"title":"title"}`).Body.String(), "user-1")
+	assert.Equal(t, 2, calls)
+}
@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"sync"
+	"time"
+)
+
+func NewInMemoryApiKeyStore() *InMemoryApiKeyStore {
+	return &InMemoryApiKeyStore{
+		Keys: map[string]api.ApiKey{},
+	}
+}
+
+type InMemoryApiKeyStore struct {
+	Keys map[string]api.ApiKey
+	Lock sync.RWMutex
+}
+
+func (this *InMemoryApiKeyStore) GetApiKey(ctx context.Context, id string) (*api.ApiKey, error) {
+	this.Lock.RLock()
+	defer this.Lock.RUnlock()
+
+	key, ok := this.Keys[id]
+	if !ok {
+		return nil, nil
+	}
+
+	key.Scopes = append([]string(nil), key.Scopes...)
+	key.Roles = append([]string(nil), key.Roles...)
+	return &key, nil
+}
+
+func (this *InMemoryApiKeyStore) PutApiKey(ctx context.Context, key api.ApiKey) error {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+
+	this.Keys[key.Id] = key
+	return nil
+}
+
+func (this *InMemoryApiKeyStore) TouchApiKey(ctx context.Context, id string, usedAt time.Time) error {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+
+	if key, ok := this.Keys[id]; ok {
+		key.LastUsedAt = usedAt
+		this.Keys[id] = key
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"sync"
+)
+
+func NewInMemoryAuditSink() *InMemoryAuditSink {
+	return &InMemoryAuditSink{
+		Records: []api.AuditRecord{},
+	}
+}
+
+type InMemoryAuditSink struct {
+	Records []api.AuditRecord
+	Lock    sync.RWMutex
+}
+
+func (this *InMemoryAuditSink) Append(ctx context.Context, record api.AuditRecord) error {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+
+	this.Records = append(this.Records, record)
+	return nil
+}
+
+func (this *InMemoryAuditSink) Query(ctx context.Context, query api.AuditQuery) ([]api.AuditRecord, error) {
+	this.Lock.RLock()
+	defer this.Lock.RUnlock()
+
+	records := []api.AuditRecord{}
+	for _, record := range this.Records {
+		if len(records) == query.Limit {
+			break
+		}
+		if matchesAuditQuery(record, query) {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
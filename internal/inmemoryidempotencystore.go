@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"sync"
+	"time"
+)
+
+func NewInMemoryIdempotencyStore() *InMemoryIdempotencyStore {
+	return &InMemoryIdempotencyStore{
+		Records: map[string]api.IdempotencyRecord{},
+	}
+}
+
+type InMemoryIdempotencyStore struct {
+	Records map[string]api.IdempotencyRecord
+	Lock    sync.Mutex
+}
+
+func (this *InMemoryIdempotencyStore) Reserve(ctx context.Context, record api.IdempotencyRecord) (*api.IdempotencyRecord, error) {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if existing, ok := this.Records[record.Key]; ok && existing.ExpiresAt.After(now) {
+		return &existing, nil
+	}
+
+	// expired records are swept lazily whenever a new key is claimed
+	for key, v := range this.Records {
+		if !v.ExpiresAt.After(now) {
+			delete(this.Records, key)
+		}
+	}
+
+	this.Records[record.Key] = record
+	return nil, nil
+}
+
+func (this *InMemoryIdempotencyStore) Complete(ctx context.Context, record api.IdempotencyRecord) error {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+
+	this.Records[record.Key] = record
+	return nil
+}
+
+func (this *InMemoryIdempotencyStore) Release(ctx context.Context, key string) error {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+
+	delete(this.Records, key)
+	return nil
+}
@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"sync"
+	"time"
+)
+
+const rateLimitSweepInterval = time.Minute
+
+func NewInMemoryRateLimitStore() *InMemoryRateLimitStore {
+	return &InMemoryRateLimitStore{
+		Buckets: map[string]api.RateLimitBucket{},
+	}
+}
+
+type InMemoryRateLimitStore struct {
+	Buckets   map[string]api.RateLimitBucket
+	LastSweep time.Time
+	Lock      sync.RWMutex
+}
+
+func (this *InMemoryRateLimitStore) GetBucket(ctx context.Context, key string) (*api.RateLimitBucket, error) {
+	this.Lock.RLock()
+	defer this.Lock.RUnlock()
+
+	bucket, ok := this.Buckets[key]
+	if !ok {
+		return nil, nil
+	}
+	return &bucket, nil
+}
+
+func (this *InMemoryRateLimitStore) PutBucket(ctx context.Context, bucket api.RateLimitBucket, revision int64) (bool, error) {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+
+	if this.Buckets[bucket.Key].Revision != revision {
+		return false, nil
+	}
+
+	// full buckets are the same as missing ones, they are swept now and then
+	// so that clients seen once don't stay around
+	now := time.Now()
+	if now.Sub(this.LastSweep) >= rateLimitSweepInterval {
+		for key, v := range this.Buckets {
+			if !v.ExpiresAt.After(now) {
+				delete(this.Buckets, key)
+			}
+		}
+		this.LastSweep = now
+	}
+
+	this.Buckets[bucket.Key] = bucket
+	return true, nil
+}
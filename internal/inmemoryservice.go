@@ -2,40 +2,94 @@ package internal
 
 import (
 	"andrewsaputra/go-rest-sample/api"
-	"errors"
+	"context"
 	"net/http"
 	"sync"
 	"time"
 )
 
+func init() {
+	api.RegisterBackend(api.Backend{
+		Name:        "inmemory",
+		Description: "Ephemeral in process storage, data is lost on restart",
+		NewService: func(config api.AppConfig, idGen api.IdGenerator) (api.Service, error) {
+			return NewInMemoryService(idGen)
+		},
+	})
+}
+
 func NewInMemoryService(idGen api.IdGenerator) (*InMemoryService, error) {
 	return &InMemoryService{
-		Albums: []api.Album{},
+		Albums: map[string][]api.Album{},
 		IdGen:  idGen,
 	}, nil
 }
 
+// InMemoryService keeps the albums of every tenant in a slice of their own.
 type InMemoryService struct {
-	Albums []api.Album
+	Albums map[string][]api.Album
 	IdGen  api.IdGenerator
 	Lock   sync.RWMutex
 }
 
-func (this *InMemoryService) GetAlbums() api.HandlerResponse {
+type inMemoryCursor struct {
+	Sort   string
+	Offset int
+}
+
+func (this *InMemoryService) GetAlbums(ctx context.Context, query api.AlbumQueryDTO) api.HandlerResponse {
 	this.Lock.RLock()
 	defer this.Lock.RUnlock()
 
+	if err := ctx.Err(); err != nil {
+		return NewErrorResponse(err)
+	}
+
+	var position inMemoryCursor
+	if query.Cursor != "" {
+		err := decodeCursor(query.Cursor, &position)
+		if err != nil || position.Offset < 0 || position.Sort != sortSignature(query.Sort) {
+			return invalidCursorResponse()
+		}
+	}
+
+	matches := []api.Album{}
+	for _, v := range this.Albums[api.TenantFromContext(ctx)] {
+		if matchesQuery(v, query) {
+			matches = append(matches, v)
+		}
+	}
+	sortAlbums(matches, query.Sort)
+
+	start, end := position.Offset, len(matches)
+	if start > end {
+		start = end
+	}
+	if query.Limit > 0 && start+query.Limit < end {
+		end = start + query.Limit
+	}
+	albums := matches[start:end]
+
+	var next string
+	if end < len(matches) {
+		next, _ = encodeCursor(inMemoryCursor{Sort: sortSignature(query.Sort), Offset: end})
+	}
+
 	return api.HandlerResponse{
 		Code: http.StatusOK,
-		Body: api.ResponseBody{Data: this.Albums},
+		Body: api.ResponseBody{Data: albums, Next: next},
 	}
 }
 
-func (this *InMemoryService) GetAlbumById(id string) api.HandlerResponse {
+func (this *InMemoryService) GetAlbumById(ctx context.Context, id string) api.HandlerResponse {
 	this.Lock.RLock()
 	defer this.Lock.RUnlock()
 
-	for _, v := range this.Albums {
+	if err := ctx.Err(); err != nil {
+		return NewErrorResponse(err)
+	}
+
+	for _, v := range this.Albums[api.TenantFromContext(ctx)] {
 		if v.Id == id {
 			return api.HandlerResponse{
 				Code: http.StatusOK,
@@ -44,21 +98,30 @@ func (this *InMemoryService) GetAlbumById(id string) api.HandlerResponse {
 		}
 	}
 
-	return api.HandlerResponse{Code: http.StatusNotFound, Error: errors.New("album data not found")}
+	return notFoundResponse()
 }
 
-func (this *InMemoryService) InsertAlbum(props api.AlbumPropertiesDTO) api.HandlerResponse {
+func (this *InMemoryService) InsertAlbum(ctx context.Context, props api.AlbumPropertiesDTO) api.HandlerResponse {
 	this.Lock.Lock()
 	defer this.Lock.Unlock()
 
+	if err := ctx.Err(); err != nil {
+		return NewErrorResponse(err)
+	}
+
+	now := time.Now().UnixMilli()
 	newData := api.Album{
 		Id:          this.IdGen.NextId(),
 		Title:       props.Title,
 		Artist:      props.Artist,
 		Price:       props.Price,
-		TimeCreated: time.Now().UnixMilli(),
+		TimeCreated: now,
+		TimeUpdated: now,
+		Version:     1,
+		OwnerId:     api.SubjectFromContext(ctx),
 	}
-	this.Albums = append(this.Albums, newData)
+	tenant := api.TenantFromContext(ctx)
+	this.Albums[tenant] = append(this.Albums[tenant], newData)
 
 	return api.HandlerResponse{
 		Code: http.StatusOK,
@@ -66,16 +129,27 @@ func (this *InMemoryService) InsertAlbum(props api.AlbumPropertiesDTO) api.Handl
 	}
 }
 
-func (this *InMemoryService) ReplaceAlbum(id string, props api.AlbumPropertiesDTO) api.HandlerResponse {
+func (this *InMemoryService) ReplaceAlbum(ctx context.Context, id string, props api.AlbumPropertiesDTO, expectedVersion int64) api.HandlerResponse {
 	this.Lock.Lock()
 	defer this.Lock.Unlock()
 
-	for i, _ := range this.Albums {
-		album := &this.Albums[i]
+	if err := ctx.Err(); err != nil {
+		return NewErrorResponse(err)
+	}
+
+	albums := this.Albums[api.TenantFromContext(ctx)]
+	for i, _ := range albums {
+		album := &albums[i]
 		if album.Id == id {
+			if expectedVersion != 0 && album.Version != expectedVersion {
+				return versionMismatchResponse()
+			}
+
 			album.Title = props.Title
 			album.Artist = props.Artist
 			album.Price = props.Price
+			album.TimeUpdated = time.Now().UnixMilli()
+			album.Version++
 
 			return api.HandlerResponse{
 				Code: http.StatusOK,
@@ -84,16 +158,25 @@ func (this *InMemoryService) ReplaceAlbum(id string, props api.AlbumPropertiesDT
 		}
 	}
 
-	return api.HandlerResponse{Code: http.StatusNotFound, Error: errors.New("album data not found")}
+	return notFoundResponse()
 }
 
-func (this *InMemoryService) UpdateAlbum(id string, updates api.AlbumUpdatesDTO) api.HandlerResponse {
+func (this *InMemoryService) UpdateAlbum(ctx context.Context, id string, updates api.AlbumUpdatesDTO, expectedVersion int64) api.HandlerResponse {
 	this.Lock.Lock()
 	defer this.Lock.Unlock()
 
-	for i, _ := range this.Albums {
-		album := &this.Albums[i]
+	if err := ctx.Err(); err != nil {
+		return NewErrorResponse(err)
+	}
+
+	albums := this.Albums[api.TenantFromContext(ctx)]
+	for i, _ := range albums {
+		album := &albums[i]
 		if album.Id == id {
+			if expectedVersion != 0 && album.Version != expectedVersion {
+				return versionMismatchResponse()
+			}
+
 			if updates.Title != "" {
 				album.Title = updates.Title
 			}
@@ -103,6 +186,8 @@ func (this *InMemoryService) UpdateAlbum(id string, updates api.AlbumUpdatesDTO)
 			if updates.Price > 0 {
 				album.Price = updates.Price
 			}
+			album.TimeUpdated = time.Now().UnixMilli()
+			album.Version++
 
 			return api.HandlerResponse{
 				Code: http.StatusOK,
@@ -111,16 +196,26 @@ func (this *InMemoryService) UpdateAlbum(id string, updates api.AlbumUpdatesDTO)
 		}
 	}
 
-	return api.HandlerResponse{Code: http.StatusNotFound, Error: errors.New("album data not found")}
+	return notFoundResponse()
 }
 
-func (this *InMemoryService) DeleteAlbum(id string) api.HandlerResponse {
+func (this *InMemoryService) DeleteAlbum(ctx context.Context, id string, expectedVersion int64) api.HandlerResponse {
 	this.Lock.Lock()
 	defer this.Lock.Unlock()
 
-	for i, v := range this.Albums {
+	if err := ctx.Err(); err != nil {
+		return NewErrorResponse(err)
+	}
+
+	tenant := api.TenantFromContext(ctx)
+	albums := this.Albums[tenant]
+	for i, v := range albums {
 		if v.Id == id {
-			this.Albums = append(this.Albums[:i], this.Albums[i+1:]...)
+			if expectedVersion != 0 && v.Version != expectedVersion {
+				return versionMismatchResponse()
+			}
+
+			this.Albums[tenant] = append(albums[:i], albums[i+1:]...)
 
 			return api.HandlerResponse{
 				Code: http.StatusOK,
@@ -129,5 +224,21 @@ func (this *InMemoryService) DeleteAlbum(id string) api.HandlerResponse {
 		}
 	}
 
-	return api.HandlerResponse{Code: http.StatusNotFound, Error: errors.New("album data not found")}
+	return notFoundResponse()
+}
+
+// Close is a no-op, the albums are only kept for the life of the process.
+func (this *InMemoryService) Close(ctx context.Context) error {
+	return nil
+}
+
+func (this *InMemoryService) AlbumCount() int {
+	this.Lock.RLock()
+	defer this.Lock.RUnlock()
+
+	count := 0
+	for _, albums := range this.Albums {
+		count += len(albums)
+	}
+	return count
 }
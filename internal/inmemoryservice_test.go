@@ -2,6 +2,8 @@ package internal
 
 import (
 	"andrewsaputra/go-rest-sample/api"
+	"andrewsaputra/go-rest-sample/api/servicetest"
+	"context"
 	"net/http"
 	"testing"
 
@@ -17,7 +19,7 @@ func InitServiceWithMocks() api.Service {
 func TestServiceInsertAlbum_InsertSuccess_ReturnData(t *testing.T) {
 	service := InitServiceWithMocks()
 	props := api.AlbumPropertiesDTO{Title: "title 1", Artist: "artist 1", Price: 1.11}
-	response := service.InsertAlbum(props)
+	response := service.InsertAlbum(context.Background(), props)
 	albumResp := response.Body.Data.(api.Album)
 
 	assert.Equal(t, http.StatusOK, response.Code)
@@ -26,12 +28,14 @@ func TestServiceInsertAlbum_InsertSuccess_ReturnData(t *testing.T) {
 	assert.Equal(t, props.Artist, albumResp.Artist)
 	assert.Equal(t, props.Price, albumResp.Price)
 	assert.NotEmpty(t, albumResp.TimeCreated)
+	assert.Equal(t, int64(1), albumResp.Version)
+	assert.Equal(t, albumResp.TimeCreated, albumResp.TimeUpdated)
 	assert.Nil(t, response.Error)
 }
 
 func TestServiceGetAlbums_NoData_ReturnEmpty(t *testing.T) {
 	service := InitServiceWithMocks()
-	response := service.GetAlbums()
+	response := service.GetAlbums(context.Background(), api.AlbumQueryDTO{})
 
 	assert.Equal(t, http.StatusOK, response.Code)
 	assert.Equal(t, []api.Album{}, response.Body.Data)
@@ -46,10 +50,10 @@ func TestServiceGetAlbums_HasData_ReturnData(t *testing.T) {
 		{Title: "title 2", Artist: "artist 2", Price: 2.22},
 	}
 	for _, props := range albumProps {
-		service.InsertAlbum(props)
+		service.InsertAlbum(context.Background(), props)
 	}
 
-	response := service.GetAlbums()
+	response := service.GetAlbums(context.Background(), api.AlbumQueryDTO{})
 
 	assert.Equal(t, http.StatusOK, response.Code)
 	assert.Nil(t, response.Error)
@@ -66,7 +70,7 @@ func TestServiceGetAlbums_HasData_ReturnData(t *testing.T) {
 
 func TestServiceGetAlbumById_NoData_ReturnErrorNotFound(t *testing.T) {
 	service := InitServiceWithMocks()
-	response := service.GetAlbumById("id")
+	response := service.GetAlbumById(context.Background(), "id")
 
 	assert.Equal(t, http.StatusNotFound, response.Code)
 	assert.NotNil(t, response.Error)
@@ -76,10 +80,10 @@ func TestServiceGetAlbumById_HasData_ReturnData(t *testing.T) {
 	service := InitServiceWithMocks()
 
 	props := api.AlbumPropertiesDTO{Title: "title 1", Artist: "artist 1", Price: 1.11}
-	insertResp := service.InsertAlbum(props)
+	insertResp := service.InsertAlbum(context.Background(), props)
 	albumResp := insertResp.Body.Data.(api.Album)
 
-	response := service.GetAlbumById(albumResp.Id)
+	response := service.GetAlbumById(context.Background(), albumResp.Id)
 	respData := response.Body.Data.(api.Album)
 
 	assert.Equal(t, http.StatusOK, response.Code)
@@ -95,7 +99,7 @@ func TestServiceReplaceAlbum_NoData_ReturnErrorNotFound(t *testing.T) {
 	service := InitServiceWithMocks()
 
 	replacementProps := api.AlbumPropertiesDTO{Title: "title 2", Artist: "artist 2", Price: 2.22}
-	response := service.ReplaceAlbum("id", replacementProps)
+	response := service.ReplaceAlbum(context.Background(), "id", replacementProps, 0)
 
 	assert.Equal(t, http.StatusNotFound, response.Code)
 	assert.NotNil(t, response.Error)
@@ -105,11 +109,11 @@ func TestServiceReplaceAlbum_HasData_ReplaceAndReturnData(t *testing.T) {
 	service := InitServiceWithMocks()
 
 	props := api.AlbumPropertiesDTO{Title: "title 1", Artist: "artist 1", Price: 1.11}
-	insertResp := service.InsertAlbum(props)
+	insertResp := service.InsertAlbum(context.Background(), props)
 	albumResp := insertResp.Body.Data.(api.Album)
 
 	replacementProps := api.AlbumPropertiesDTO{Title: "title 2", Artist: "artist 2", Price: 2.22}
-	response := service.ReplaceAlbum(albumResp.Id, replacementProps)
+	response := service.ReplaceAlbum(context.Background(), albumResp.Id, replacementProps, 0)
 	respData := response.Body.Data.(api.Album)
 
 	assert.Equal(t, http.StatusOK, response.Code)
@@ -125,7 +129,7 @@ func TestServiceUpdateAlbum_NoData_ReturnErrorNotFound(t *testing.T) {
 	service := InitServiceWithMocks()
 
 	replacementProps := api.AlbumUpdatesDTO{Title: "title 2", Artist: "artist 2", Price: 2.22}
-	response := service.UpdateAlbum("id", replacementProps)
+	response := service.UpdateAlbum(context.Background(), "id", replacementProps, 0)
 
 	assert.Equal(t, http.StatusNotFound, response.Code)
 	assert.NotNil(t, response.Error)
@@ -135,11 +139,11 @@ func TestServiceUpdateAlbum_HasData_ReplaceAndReturnData(t *testing.T) {
 	service := InitServiceWithMocks()
 
 	props := api.AlbumPropertiesDTO{Title: "title 1", Artist: "artist 1", Price: 1.11}
-	insertResp := service.InsertAlbum(props)
+	insertResp := service.InsertAlbum(context.Background(), props)
 	albumResp := insertResp.Body.Data.(api.Album)
 
 	replacementProps := api.AlbumUpdatesDTO{Title: "title 2", Artist: "artist 2", Price: 2.22}
-	response := service.UpdateAlbum(albumResp.Id, replacementProps)
+	response := service.UpdateAlbum(context.Background(), albumResp.Id, replacementProps, 0)
 	respData := response.Body.Data.(api.Album)
 
 	assert.Equal(t, http.StatusOK, response.Code)
@@ -154,7 +158,7 @@ func TestServiceUpdateAlbum_HasData_ReplaceAndReturnData(t *testing.T) {
 func TestServiceDeleteAlbum_NoData_ReturnErrorNotFound(t *testing.T) {
 	service := InitServiceWithMocks()
 
-	response := service.DeleteAlbum("id")
+	response := service.DeleteAlbum(context.Background(), "id", 0)
 
 	assert.Equal(t, http.StatusNotFound, response.Code)
 	assert.NotNil(t, response.Error)
@@ -164,14 +168,171 @@ func TestServiceDeleteAlbum_HasData_ReturnOK(t *testing.T) {
 	service := InitServiceWithMocks()
 
 	props := api.AlbumPropertiesDTO{Title: "title 1", Artist: "artist 1", Price: 1.11}
-	insertResp := service.InsertAlbum(props)
+	insertResp := service.InsertAlbum(context.Background(), props)
 	albumResp := insertResp.Body.Data.(api.Album)
 
-	response := service.DeleteAlbum(albumResp.Id)
+	response := service.DeleteAlbum(context.Background(), albumResp.Id, 0)
 	assert.Equal(t, http.StatusOK, response.Code)
 	assert.Nil(t, response.Error)
 
-	response = service.GetAlbumById(albumResp.Id)
+	response = service.GetAlbumById(context.Background(), albumResp.Id)
 	assert.Equal(t, http.StatusNotFound, response.Code)
 	assert.NotNil(t, response.Error)
 }
+
+func TestServiceGetAlbums_ContextCancelled_ReturnClientClosedRequest(t *testing.T) {
+	service := InitServiceWithMocks()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	response := service.GetAlbums(ctx, api.AlbumQueryDTO{})
+
+	assert.Equal(t, api.StatusClientClosedRequest, response.Code)
+	assert.NotNil(t, response.Error)
+}
+
+func TestServiceInsertAlbum_DeadlineExceeded_ReturnGatewayTimeout(t *testing.T) {
+	service := InitServiceWithMocks()
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+
+	props := api.AlbumPropertiesDTO{Title: "title 1", Artist: "artist 1", Price: 1.11}
+	response := service.InsertAlbum(ctx, props)
+
+	assert.Equal(t, http.StatusGatewayTimeout, response.Code)
+	assert.NotNil(t, response.Error)
+
+	response = service.GetAlbums(context.Background(), api.AlbumQueryDTO{})
+	assert.Empty(t, response.Body.Data)
+}
+
+func TestServiceGetAlbums_Paginated_ReturnPagesWithCursor(t *testing.T) {
+	service := InitServiceWithMocks()
+	for _, title := range []string{"title 1", "title 2", "title 3"} {
+		service.InsertAlbum(context.Background(), api.AlbumPropertiesDTO{Title: title, Artist: "artist", Price: 1.11})
+	}
+
+	response := service.GetAlbums(context.Background(), api.AlbumQueryDTO{Limit: 2})
+	albums := response.Body.Data.([]api.Album)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Len(t, albums, 2)
+	assert.Equal(t, "title 1", albums[0].Title)
+	assert.NotEmpty(t, response.Body.Next)
+
+	response = service.GetAlbums(context.Background(), api.AlbumQueryDTO{Limit: 2, Cursor: response.Body.Next})
+	albums = response.Body.Data.([]api.Album)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Len(t, albums, 1)
+	assert.Equal(t, "title 3", albums[0].Title)
+	assert.Empty(t, response.Body.Next)
+}
+
+func TestServiceGetAlbums_InvalidCursor_ReturnBadRequest(t *testing.T) {
+	service := InitServiceWithMocks()
+	response := service.GetAlbums(context.Background(), api.AlbumQueryDTO{Limit: 2, Cursor: "not a cursor"})
+
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	assert.NotNil(t, response.Error)
+}
+
+func TestServiceGetAlbums_Filtered_ReturnMatchingData(t *testing.T) {
+	service := InitServiceWithMocks()
+	albumProps := []api.AlbumPropertiesDTO{
+		{Title: "first song", Artist: "artist 1", Price: 1.11},
+		{Title: "second song", Artist: "artist 1", Price: 5.55},
+		{Title: "third song", Artist: "artist 2", Price: 5.55},
+		{Title: "interlude", Artist: "artist 1", Price: 9.99},
+	}
+	for _, props := range albumProps {
+		service.InsertAlbum(context.Background(), props)
+	}
+
+	query := api.AlbumQueryDTO{Artist: "artist 1", TitleContains: "song", MinPrice: 2, MaxPrice: 9}
+	response := service.GetAlbums(context.Background(), query)
+	albums := response.Body.Data.([]api.Album)
+
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Len(t, albums, 1)
+	assert.Equal(t, "second song", albums[0].Title)
+
+	query = api.AlbumQueryDTO{CreatedAfter: albums[0].TimeCreated + 1}
+	response = service.GetAlbums(context.Background(), query)
+	for _, album := range response.Body.Data.([]api.Album) {
+		assert.Greater(t, album.TimeCreated, query.CreatedAfter)
+	}
+}
+
+func TestServiceGetAlbums_Sorted_ReturnOrderedPages(t *testing.T) {
+	service := InitServiceWithMocks()
+	albumProps := []api.AlbumPropertiesDTO{
+		{Title: "title 1", Artist: "artist 1", Price: 3.33},
+		{Title: "title 2", Artist: "artist 2", Price: 1.11},
+		{Title: "title 3", Artist: "artist 3", Price: 3.33},
+		{Title: "title 4", Artist: "artist 4", Price: 2.22},
+	}
+	for _, props := range albumProps {
+		service.InsertAlbum(context.Background(), props)
+	}
+
+	sortFields := []api.SortField{{Field: "price", Descending: true}, {Field: "title"}}
+	response := service.GetAlbums(context.Background(), api.AlbumQueryDTO{Limit: 3, Sort: sortFields})
+	albums := response.Body.Data.([]api.Album)
+
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "title 1", albums[0].Title)
+	assert.Equal(t, "title 3", albums[1].Title)
+	assert.Equal(t, "title 4", albums[2].Title)
+
+	response = service.GetAlbums(context.Background(), api.AlbumQueryDTO{Limit: 3, Sort: sortFields, Cursor: response.Body.Next})
+	albums = response.Body.Data.([]api.Album)
+
+	assert.Len(t, albums, 1)
+	assert.Equal(t, "title 2", albums[0].Title)
+	assert.Empty(t, response.Body.Next)
+}
+
+func TestServiceWrites_VersionMatches_IncrementVersion(t *testing.T) {
+	service := InitServiceWithMocks()
+
+	props := api.AlbumPropertiesDTO{Title: "title 1", Artist: "artist 1", Price: 1.11}
+	albumResp := service.InsertAlbum(context.Background(), props).Body.Data.(api.Album)
+
+	response := service.ReplaceAlbum(context.Background(), albumResp.Id, props, 1)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, int64(2), response.Body.Data.(api.Album).Version)
+	assert.GreaterOrEqual(t, response.Body.Data.(api.Album).TimeUpdated, albumResp.TimeUpdated)
+
+	response = service.UpdateAlbum(context.Background(), albumResp.Id, api.AlbumUpdatesDTO{Price: 2.22}, 2)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, int64(3), response.Body.Data.(api.Album).Version)
+
+	response = service.DeleteAlbum(context.Background(), albumResp.Id, 3)
+	assert.Equal(t, http.StatusOK, response.Code)
+}
+
+func TestServiceWrites_StaleVersion_ReturnPreconditionFailed(t *testing.T) {
+	service := InitServiceWithMocks()
+
+	props := api.AlbumPropertiesDTO{Title: "title 1", Artist: "artist 1", Price: 1.11}
+	albumResp := service.InsertAlbum(context.Background(), props).Body.Data.(api.Album)
+	service.UpdateAlbum(context.Background(), albumResp.Id, api.AlbumUpdatesDTO{Price: 2.22}, 0)
+
+	response := service.ReplaceAlbum(context.Background(), albumResp.Id, props, 1)
+	assert.Equal(t, http.StatusPreconditionFailed, response.Code)
+
+	response = service.UpdateAlbum(context.Background(), albumResp.Id, api.AlbumUpdatesDTO{Price: 3.33}, 1)
+	assert.Equal(t, http.StatusPreconditionFailed, response.Code)
+
+	response = service.DeleteAlbum(context.Background(), albumResp.Id, 1)
+	assert.Equal(t, http.StatusPreconditionFailed, response.Code)
+
+	response = service.GetAlbumById(context.Background(), albumResp.Id)
+	assert.Equal(t, 2.22, response.Body.Data.(api.Album).Price)
+	assert.Equal(t, int64(2), response.Body.Data.(api.Album).Version)
+}
+
+func TestInMemoryService_Conformance(t *testing.T) {
+	servicetest.Run(t, func(t *testing.T) api.Service {
+		return InitServiceWithMocks()
+	})
+}
@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// NewInstrumentedService decorates any backend with per method latency and
+// error metrics, labelled with the backend name, and logs its errors.
+func NewInstrumentedService(service api.Service, backend string, metrics *Metrics, logger *slog.Logger) *InstrumentedService {
+	return &InstrumentedService{
+		Service: service,
+		Backend: backend,
+		Metrics: metrics,
+		Logger:  logger,
+	}
+}
+
+type InstrumentedService struct {
+	Service api.Service
+	Backend string
+	Metrics *Metrics
+	Logger  *slog.Logger
+}
+
+func (this *InstrumentedService) observe(ctx context.Context, operation string, start time.Time, resp api.HandlerResponse) api.HandlerResponse {
+	elapsed := time.Since(start)
+	this.Metrics.BackendDuration.WithLabelValues(this.Backend, operation).Observe(elapsed.Seconds())
+	if resp.Error != nil {
+		this.Metrics.BackendErrors.WithLabelValues(this.Backend, operation, strconv.Itoa(resp.Code)).Inc()
+		this.logError(ctx, operation, elapsed, resp)
+	}
+
+	return resp
+}
+
+// logError logs server side failures with their cause, which clients never
+// see. Client errors such as a missing album are only logged at debug level.
+func (this *InstrumentedService) logError(ctx context.Context, operation string, elapsed time.Duration, resp api.HandlerResponse) {
+	apiErr := api.AsError(resp.Error, resp.Code)
+	level := slog.LevelDebug
+	if resp.Code >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+
+	attrs := []slog.Attr{
+		slog.String("backend", this.Backend),
+		slog.String("operation", operation),
+		slog.Int("status", resp.Code),
+		slog.String("kind", apiErr.Kind.Type),
+		slog.String("detail", apiErr.Error()),
+		slog.Duration("elapsed", elapsed),
+	}
+	if apiErr.Cause != nil {
+		attrs = append(attrs, slog.String("cause", apiErr.Cause.Error()))
+	}
+	this.Logger.LogAttrs(ctx, level, "backend operation failed", attrs...)
+}
+
+func (this *InstrumentedService) GetAlbums(ctx context.Context, query api.AlbumQueryDTO) api.HandlerResponse {
+	start := time.Now()
+	resp := this.Service.GetAlbums(ctx, query)
+	return this.observe(ctx, "GetAlbums", start, resp)
+}
+
+func (this *InstrumentedService) GetAlbumById(ctx context.Context, id string) api.HandlerResponse {
+	start := time.Now()
+	resp := this.Service.GetAlbumById(ctx, id)
+	return this.observe(ctx, "GetAlbumById", start, resp)
+}
+
+func (this *InstrumentedService) InsertAlbum(ctx context.Context, props api.AlbumPropertiesDTO) api.HandlerResponse {
+	start := time.Now()
+	resp := this.Service.InsertAlbum(ctx, props)
+	return this.observe(ctx, "InsertAlbum", start, resp)
+}
+
+func (this *InstrumentedService) ReplaceAlbum(ctx context.Context, id string, props api.AlbumPropertiesDTO, expectedVersion int64) api.HandlerResponse {
+	start := time.Now()
+	resp := this.Service.ReplaceAlbum(ctx, id, props, expectedVersion)
+	return this.observe(ctx, "ReplaceAlbum", start, resp)
+}
+
+func (this *InstrumentedService) UpdateAlbum(ctx context.Context, id string, updates api.AlbumUpdatesDTO, expectedVersion int64) api.HandlerResponse {
+	start := time.Now()
+	resp := this.Service.UpdateAlbum(ctx, id, updates, expectedVersion)
+	return this.observe(ctx, "UpdateAlbum", start, resp)
+}
+
+func (this *InstrumentedService) DeleteAlbum(ctx context.Context, id string, expectedVersion int64) api.HandlerResponse {
+	start := time.Now()
+	resp := this.Service.DeleteAlbum(ctx, id, expectedVersion)
+	return this.observe(ctx, "DeleteAlbum", start, resp)
+}
+
+func (this *InstrumentedService) Close(ctx context.Context) error {
+	return this.Service.Close(ctx)
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// maxAuditLineSize bounds the records read back from an audit file.
+const maxAuditLineSize = 1 << 20
+
+// NewFileAuditSink appends records as JSON lines to the file at path, which
+// is created when missing and never truncated.
+func NewFileAuditSink(path string) (*JsonLinesAuditSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JsonLinesAuditSink{Writer: file, Path: path}, nil
+}
+
+// NewStdoutAuditSink writes records as JSON lines to the standard output, for
+// a log collector to keep them.
+func NewStdoutAuditSink() *JsonLinesAuditSink {
+	return &JsonLinesAuditSink{Writer: os.Stdout}
+}
+
+// JsonLinesAuditSink writes every record as a JSON line to Writer. Records
+// can only be queried when they are written to the file at Path, which is
+// read through for every query.
+type JsonLinesAuditSink struct {
+	Writer io.Writer
+	Path   string
+
+	mutex sync.Mutex
+}
+
+func (this *JsonLinesAuditSink) Append(ctx context.Context, record api.AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	_, err = this.Writer.Write(append(line, '\n'))
+	return err
+}
+
+func (this *JsonLinesAuditSink) Query(ctx context.Context, query api.AuditQuery) ([]api.AuditRecord, error) {
+	if this.Path == "" {
+		return nil, api.NewError(api.KindForStatus(http.StatusNotImplemented), "the audit trail is only written to the standard output")
+	}
+
+	file, err := os.Open(this.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records := []api.AuditRecord{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, maxAuditLineSize)
+	for len(records) < query.Limit && scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		var record api.AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, err
+		}
+		if matchesAuditQuery(record, query) {
+			records = append(records, record)
+		}
+	}
+
+	return records, scanner.Err()
+}
+
+// Close closes the audit file, the standard output is left open.
+func (this *JsonLinesAuditSink) Close() error {
+	if closer, ok := this.Writer.(io.Closer); ok && this.Path != "" {
+		return closer.Close()
+	}
+	return nil
+}
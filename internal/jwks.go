@@ -0,0 +1,253 @@
+package internal
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// jwksRefreshInterval limits how often an unknown key id refetches JwksUrl.
+const jwksRefreshInterval = time.Minute
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	K   string `json:"k"`
+}
+
+// verificationKey is a JWKS key able to check signatures made with Algorithm.
+type verificationKey struct {
+	Id        string
+	Algorithm string
+	Key       any
+}
+
+// parseJwks reads the signing keys of a JWK set. Keys of other types or
+// curves than the supported algorithms need are skipped.
+func parseJwks(raw []byte) ([]verificationKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	var keys []verificationKey
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := parseJwk(jwk)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWKS key %q: %w", jwk.Kid, err)
+		}
+		if key != nil {
+			keys = append(keys, *key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no HS256, RS256 or ES256 signing key")
+	}
+
+	return keys, nil
+}
+
+func parseJwk(jwk jsonWebKey) (*verificationKey, error) {
+	key := &verificationKey{Id: jwk.Kid, Algorithm: jwk.Alg}
+	switch {
+	case jwk.Kty == "oct" && (jwk.Alg == "" || jwk.Alg == "HS256"):
+		secret, err := base64.RawURLEncoding.DecodeString(jwk.K)
+		if err != nil || len(secret) == 0 {
+			return nil, errors.New("k is not a base64url encoded secret")
+		}
+		key.Algorithm, key.Key = "HS256", secret
+	case jwk.Kty == "RSA" && (jwk.Alg == "" || jwk.Alg == "RS256"):
+		n, errN := decodeJwkInt(jwk.N)
+		e, errE := decodeJwkInt(jwk.E)
+		if errN != nil || errE != nil || !e.IsInt64() {
+			return nil, errors.New("n and e must be base64url encoded integers")
+		}
+		key.Algorithm, key.Key = "RS256", &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case jwk.Kty == "EC" && jwk.Crv == "P-256" && (jwk.Alg == "" || jwk.Alg == "ES256"):
+		x, errX := decodeJwkInt(jwk.X)
+		y, errY := decodeJwkInt(jwk.Y)
+		if errX != nil || errY != nil || !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("x and y must be a point of P-256")
+		}
+		key.Algorithm, key.Key = "ES256", &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	default:
+		return nil, nil
+	}
+
+	return key, nil
+}
+
+func decodeJwkInt(value string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(raw) == 0 {
+		return nil, errors.New("not a base64url encoded integer")
+	}
+
+	return new(big.Int).SetBytes(raw), nil
+}
+
+// NewJwksKeySource reads keys from file, or else from url. Keys fetched from
+// url are refetched when a token names a key id that isn't known yet, at most
+// once per jwksRefreshInterval.
+func NewJwksKeySource(ctx context.Context, file string, url string) (*JwksKeySource, error) {
+	source := &JwksKeySource{File: file, Url: url, Client: &http.Client{Timeout: 10 * time.Second}}
+	if err := source.load(ctx); err != nil {
+		return nil, err
+	}
+
+	return source, nil
+}
+
+type JwksKeySource struct {
+	File   string
+	Url    string
+	Client *http.Client
+
+	mutex     sync.Mutex
+	keys      []verificationKey
+	fetchedAt time.Time
+	// refreshing is closed once the refetch in progress, if any, is over
+	refreshing chan struct{}
+}
+
+func (this *JwksKeySource) load(ctx context.Context) error {
+	keys, err := this.read(ctx)
+	if err != nil {
+		return err
+	}
+
+	this.keys, this.fetchedAt = keys, time.Now()
+	return nil
+}
+
+func (this *JwksKeySource) read(ctx context.Context) ([]verificationKey, error) {
+	var raw []byte
+	var err error
+	if this.File != "" {
+		raw, err = os.ReadFile(this.File)
+	} else {
+		raw, err = this.fetch(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load JWKS: %w", err)
+	}
+
+	return parseJwks(raw)
+}
+
+func (this *JwksKeySource) fetch(ctx context.Context) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, this.Url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := this.Client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned %s", this.Url, response.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(response.Body, 1<<20))
+}
+
+// Lookup returns the key named id for algorithm. An empty id matches the only
+// key of a single key set.
+func (this *JwksKeySource) Lookup(ctx context.Context, id string, algorithm string) (any, error) {
+	this.mutex.Lock()
+	key := this.find(id, algorithm)
+	stale := this.File == "" && time.Since(this.fetchedAt) >= jwksRefreshInterval
+	this.mutex.Unlock()
+
+	if key == nil && stale {
+		if err := this.refresh(ctx); err != nil {
+			return nil, err
+		}
+
+		this.mutex.Lock()
+		key = this.find(id, algorithm)
+		this.mutex.Unlock()
+	}
+	if key == nil {
+		return nil, fmt.Errorf("no %s key with id %q", algorithm, id)
+	}
+
+	return key.Key, nil
+}
+
+// refresh refetches the keys without holding the mutex, so that tokens of
+// known keys are still verified meanwhile. Concurrent callers wait for the
+// refetch already in progress instead of starting their own.
+func (this *JwksKeySource) refresh(ctx context.Context) error {
+	this.mutex.Lock()
+	if done := this.refreshing; done != nil {
+		this.mutex.Unlock()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if time.Since(this.fetchedAt) < jwksRefreshInterval {
+		this.mutex.Unlock()
+		return nil
+	}
+	done := make(chan struct{})
+	this.refreshing = done
+	this.mutex.Unlock()
+
+	// the keys are shared with the waiting callers, whose requests may outlive this one
+	keys, err := this.read(context.WithoutCancel(ctx))
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if err == nil {
+		this.keys, this.fetchedAt = keys, time.Now()
+	}
+	this.refreshing = nil
+	close(done)
+
+	return err
+}
+
+func (this *JwksKeySource) find(id string, algorithm string) *verificationKey {
+	if id == "" && len(this.keys) == 1 && this.keys[0].Algorithm == algorithm {
+		return &this.keys[0]
+	}
+
+	for i, key := range this.keys {
+		if id != "" && key.Id == id && key.Algorithm == algorithm {
+			return &this.keys[i]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestIdHeader carries the id correlating a request with its log lines.
+const RequestIdHeader = "X-Request-ID"
+
+// maxRequestIdLength bounds client supplied ids, longer ones are replaced.
+const maxRequestIdLength = 128
+
+type requestIdKey struct{}
+
+// NewLogger builds a logger writing config.Format ("json" or "text", json by
+// default) at config.Level and above. Records logged with a request context
+// carry its request_id and trace_id. A non nil level is set to config.Level
+// and keeps controlling the logger, so the level can be changed later.
+func NewLogger(config api.LoggingConfig, w io.Writer, level *LogLevel) (*slog.Logger, error) {
+	parsed, err := parseLogLevel(config.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	var leveler slog.Leveler = parsed
+	if level != nil {
+		level.Set(parsed)
+		leveler = level
+	}
+
+	options := &slog.HandlerOptions{Level: leveler}
+	var handler slog.Handler
+	switch config.Format {
+	case "", "json":
+		handler = slog.NewJSONHandler(w, options)
+	case "text":
+		handler = slog.NewTextHandler(w, options)
+	default:
+		return nil, fmt.Errorf("unsupported log format %q, expected json or text", config.Format)
+	}
+
+	return slog.New(contextHandler{handler}), nil
+}
+
+// LogLevel is the level of a running logger, a config reload applies
+// loggingConfig.level to it.
+type LogLevel struct {
+	slog.LevelVar
+}
+
+func (this *LogLevel) ApplyConfig(config api.AppConfig) {
+	if level, err := parseLogLevel(config.LoggingConfig.Level); err == nil {
+		this.Set(level)
+	}
+}
+
+func parseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if name == "" {
+		return level, nil
+	}
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return level, fmt.Errorf("unsupported log level %q, expected debug, info, warn or error", name)
+	}
+
+	return level, nil
+}
+
+// contextHandler adds the request and trace ids found in the record context.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (this contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestIdFromContext(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		record.AddAttrs(slog.String("trace_id", spanContext.TraceID().String()))
+	}
+
+	return this.Handler.Handle(ctx, record)
+}
+
+func (this contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{this.Handler.WithAttrs(attrs)}
+}
+
+func (this contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{this.Handler.WithGroup(name)}
+}
+
+// ContextWithRequestId returns a copy of ctx carrying the request id.
+func ContextWithRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, id)
+}
+
+// RequestIdFromContext returns the request id of ctx, or "" when there is none.
+func RequestIdFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// NewRequestIdMiddleware keeps the X-Request-ID sent by the client, or
+// generates one with idGen, and echoes it in the response. Ids that are too
+// long or not printable ASCII are replaced so they can't forge log lines.
+func NewRequestIdMiddleware(idGen api.IdGenerator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIdHeader)
+		if !isValidRequestId(id) {
+			id = idGen.NextId()
+		}
+
+		c.Header(RequestIdHeader, id)
+		c.Request = c.Request.WithContext(ContextWithRequestId(c.Request.Context(), id))
+		c.Next()
+	}
+}
+
+func isValidRequestId(id string) bool {
+	if id == "" || len(id) > maxRequestIdLength {
+		return false
+	}
+
+	return strings.IndexFunc(id, func(r rune) bool { return r < '!' || r > '~' }) < 0
+}
+
+// NewAccessLogMiddleware logs one line per request, replacing the plain text
+// logger of gin.Default.
+func NewAccessLogMiddleware(logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		if status >= 500 {
+			level = slog.LevelError
+		}
+
+		logger.LogAttrs(c.Request.Context(), level, "request completed",
+			slog.String("method", c.Request.Method),
+			slog.String("path", c.Request.URL.Path),
+			slog.String("route", c.FullPath()),
+			slog.Int("status", status),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("client_ip", c.ClientIP()),
+		)
+	}
+}
@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type fixedIdGenerator string
+
+func (this fixedIdGenerator) NextId() string {
+	return string(this)
+}
+
+func InitLoggedRouter(t *testing.T) (*gin.Engine, *bytes.Buffer) {
+	var output bytes.Buffer
+	logger, err := NewLogger(api.LoggingConfig{Level: "debug"}, &output, nil)
+	assert.Nil(t, err)
+
+	service := NewInstrumentedService(InitServiceWithMocks(), "inmemory", NewMetrics(), logger)
+	router := gin.New()
+	router.Use(NewRequestIdMiddleware(fixedIdGenerator("generated-id")), NewAccessLogMiddleware(logger))
+	router.GET("/albums/:id", NewApiHandler(service, api.AppConfig{}).GetAlbumById)
+
+	return router, &output
+}
+
+func SendLoggedRequest(router *gin.Engine, requestId string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(http.MethodGet, "/albums/missing", nil)
+	if requestId != "" {
+		request.Header.Set(RequestIdHeader, requestId)
+	}
+
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	return response
+}
+
+func DecodeLogLines(t *testing.T, output *bytes.Buffer) []map[string]any {
+	var lines []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		var entry map[string]any
+		assert.Nil(t, json.Unmarshal([]byte(line), &entry))
+		lines = append(lines, entry)
+	}
+
+	return lines
+}
+
+func TestRequestIdMiddleware_HeaderAbsent_GenerateAndEcho(t *testing.T) {
+	router, output := InitLoggedRouter(t)
+
+	response := SendLoggedRequest(router, "")
+
+	assert.Equal(t, "generated-id", response.Header().Get(RequestIdHeader))
+	for _, line := range DecodeLogLines(t, output) {
+		assert.Equal(t, "generated-id", line["request_id"])
+	}
+}
+
+func TestRequestIdMiddleware_ValidHeader_KeepClientId(t *testing.T) {
+	router, _ := InitLoggedRouter(t)
+
+	response := SendLoggedRequest(router, "client-id-1")
+
+	assert.Equal(t, "client-id-1", response.Header().Get(RequestIdHeader))
+}
+
+func TestRequestIdMiddleware_InvalidHeader_ReplaceWithGeneratedId(t *testing.T) {
+	router, _ := InitLoggedRouter(t)
+
+	for _, id := range []string{"has space", "line\nbreak", strings.Repeat("x", maxRequestIdLength+1)} {
+		response := SendLoggedRequest(router, id)
+		assert.Equal(t, "generated-id", response.Header().Get(RequestIdHeader))
+	}
+}
+
+func TestInstrumentedService_BackendError_LoggedWithRequestId(t *testing.T) {
+	router, output := InitLoggedRouter(t)
+
+	SendLoggedRequest(router, "client-id-1")
+
+	lines := DecodeLogLines(t, output)
+	assert.Len(t, lines, 2)
+	assert.Equal(t, "backend operation failed", lines[0]["msg"])
+	assert.Equal(t, "DEBUG", lines[0]["level"])
+	assert.Equal(t, "GetAlbumById", lines[0]["operation"])
+	assert.Equal(t, api.KindNotFound.Type, lines[0]["kind"])
+	assert.Equal(t, "client-id-1", lines[0]["request_id"])
+	assert.Equal(t, "request completed", lines[1]["msg"])
+	assert.Equal(t, "/albums/:id", lines[1]["route"])
+	assert.Equal(t, float64(http.StatusNotFound), lines[1]["status"])
+}
+
+type failingService struct {
+	api.Service
+}
+
+func (this failingService) GetAlbumById(ctx context.Context, id string) api.HandlerResponse {
+	return NewErrorResponse(errors.New("connection reset by peer"))
+}
+
+func TestInstrumentedService_ServerError_LoggedWithCause(t *testing.T) {
+	var output bytes.Buffer
+	logger, _ := NewLogger(api.LoggingConfig{}, &output, nil)
+	service := NewInstrumentedService(failingService{}, "inmemory", NewMetrics(), logger)
+
+	response := service.GetAlbumById(ContextWithRequestId(context.Background(), "client-id-1"), "id")
+
+	lines := DecodeLogLines(t, &output)
+	assert.Equal(t, http.StatusInternalServerError, response.Code)
+	assert.Len(t, lines, 1)
+	assert.Equal(t, "ERROR", lines[0]["level"])
+	assert.Equal(t, "connection reset by peer", lines[0]["cause"])
+	assert.Equal(t, "client-id-1", lines[0]["request_id"])
+}
+
+func TestNewLogger_UnsupportedConfig_ReturnError(t *testing.T) {
+	_, err := NewLogger(api.LoggingConfig{Level: "verbose"}, &bytes.Buffer{}, nil)
+	assert.NotNil(t, err)
+
+	_, err = NewLogger(api.LoggingConfig{Format: "xml"}, &bytes.Buffer{}, nil)
+	assert.NotNil(t, err)
+
+	logger, err := NewLogger(api.LoggingConfig{Level: "warn", Format: "text"}, &bytes.Buffer{}, nil)
+	assert.Nil(t, err)
+	assert.False(t, logger.Enabled(context.Background(), slog.LevelInfo))
+}
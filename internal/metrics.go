@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// NewMetrics registers the http, backend and Go runtime collectors on a
+// registry of its own, so tests can build as many as they need.
+func NewMetrics() *Metrics {
+	registry := prometheus.NewRegistry()
+	metrics := &Metrics{
+		Registry: registry,
+		RequestsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "HTTP requests handled, by route template and status.",
+		}, []string{"method", "route", "status"}),
+		RequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "HTTP request latency, by route template and status.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		BackendDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "album_backend_operation_duration_seconds",
+			Help:    "api.Service call latency, by backend and method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"backend", "operation"}),
+		BackendErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "album_backend_operation_errors_total",
+			Help: "api.Service calls that returned an error, by backend, method and status.",
+		}, []string{"backend", "operation", "status"}),
+	}
+
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		metrics.RequestsTotal,
+		metrics.RequestDuration,
+		metrics.BackendDuration,
+		metrics.BackendErrors,
+	)
+
+	return metrics
+}
+
+type Metrics struct {
+	Registry        *prometheus.Registry
+	RequestsTotal   *prometheus.CounterVec
+	RequestDuration *prometheus.HistogramVec
+	BackendDuration *prometheus.HistogramVec
+	BackendErrors   *prometheus.CounterVec
+}
+
+// albumCounter is implemented by backends that can report their size cheaply.
+type albumCounter interface {
+	AlbumCount() int
+}
+
+// RegisterAlbumCount exposes the number of stored albums when the backend can
+// count them without a query, it is a no-op for any other backend.
+func (this *Metrics) RegisterAlbumCount(backend string, service any) {
+	counter, ok := service.(albumCounter)
+	if !ok {
+		return
+	}
+
+	this.Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "albums_stored",
+		Help:        "Albums currently held by the backend.",
+		ConstLabels: prometheus.Labels{"backend": backend},
+	}, func() float64 {
+		return float64(counter.AlbumCount())
+	}))
+}
+
+// Middleware records every request under its route template, so ids in the
+// path don't create a series each. Unmatched paths share a single route label.
+func (this *Metrics) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		labels := prometheus.Labels{
+			"method": c.Request.Method,
+			"route":  route,
+			"status": strconv.Itoa(c.Writer.Status()),
+		}
+		this.RequestsTotal.With(labels).Inc()
+		this.RequestDuration.With(labels).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Handler serves the registry in the Prometheus text exposition format.
+func (this *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(this.Registry, promhttp.HandlerOpts{Registry: this.Registry})
+}
@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"andrewsaputra/go-rest-sample/api/servicetest"
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstrumentedService_ErrorResponse_CountedPerOperation(t *testing.T) {
+	metrics := NewMetrics()
+	service := NewInstrumentedService(InitServiceWithMocks(), "inmemory", metrics, slog.Default())
+
+	service.InsertAlbum(context.Background(), api.AlbumPropertiesDTO{Title: "title 1", Artist: "artist 1", Price: 1.11})
+	service.GetAlbumById(context.Background(), "missing")
+
+	assert.Equal(t, 2, testutil.CollectAndCount(metrics.BackendDuration))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.BackendErrors.WithLabelValues("inmemory", "GetAlbumById", "404")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.BackendErrors.WithLabelValues("inmemory", "InsertAlbum", "404")))
+}
+
+func TestMetricsRegisterAlbumCount_InMemoryService_ReportStoredAlbums(t *testing.T) {
+	metrics := NewMetrics()
+	service := InitServiceWithMocks()
+	metrics.RegisterAlbumCount("inmemory", service)
+
+	service.InsertAlbum(context.Background(), api.AlbumPropertiesDTO{Title: "title 1", Artist: "artist 1", Price: 1.11})
+
+	count, err := testutil.GatherAndCount(metrics.Registry, "albums_stored")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	families, _ := metrics.Registry.Gather()
+	for _, family := range families {
+		if family.GetName() == "albums_stored" {
+			assert.Equal(t, 1.0, family.GetMetric()[0].GetGauge().GetValue())
+		}
+	}
+}
+
+func TestInstrumentedService_Conformance(t *testing.T) {
+	servicetest.Run(t, func(t *testing.T) api.Service {
+		return NewInstrumentedService(InitServiceWithMocks(), "inmemory", NewMetrics(), slog.Default())
+	})
+}
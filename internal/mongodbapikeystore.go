@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// NewMongoDBApiKeyStore keeps API keys in a collection next to the albums.
+func NewMongoDBApiKeyStore(service *MongoDBService, collectionName string) *MongoDBApiKeyStore {
+	return &MongoDBApiKeyStore{
+		Collection: service.Collection.Database().Collection(collectionName),
+		Timeout:    service.Timeout,
+	}
+}
+
+type MongoDBApiKeyStore struct {
+	Collection *mongo.Collection
+	Timeout    *QueryTimeout
+}
+
+func (this *MongoDBApiKeyStore) GetApiKey(ctx context.Context, id string) (*api.ApiKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	var key api.ApiKey
+	err := this.Collection.FindOne(ctx, bson.M{"_id": id}).Decode(&key)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+func (this *MongoDBApiKeyStore) PutApiKey(ctx context.Context, key api.ApiKey) error {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	_, err := this.Collection.ReplaceOne(ctx, bson.M{"_id": key.Id}, key, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (this *MongoDBApiKeyStore) TouchApiKey(ctx context.Context, id string, usedAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	_, err := this.Collection.UpdateByID(ctx, id, bson.M{"$set": bson.M{"lastusedat": usedAt}})
+	return err
+}
@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// NewMongoDBAuditSink keeps records in a collection next to the albums, with
+// an index for each kind of query.
+func NewMongoDBAuditSink(service *MongoDBService, collectionName string) (*MongoDBAuditSink, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), service.Timeout.Get())
+	defer cancel()
+
+	collection := service.Collection.Database().Collection(collectionName)
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "albumid", Value: 1}, {Key: "time", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "actor", Value: 1}, {Key: "time", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "time", Value: 1}, {Key: "_id", Value: 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &MongoDBAuditSink{
+		Collection: collection,
+		Timeout:    service.Timeout,
+	}, nil
+}
+
+type MongoDBAuditSink struct {
+	Collection *mongo.Collection
+	Timeout    *QueryTimeout
+}
+
+func (this *MongoDBAuditSink) Append(ctx context.Context, record api.AuditRecord) error {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	_, err := this.Collection.InsertOne(ctx, record)
+	return err
+}
+
+func (this *MongoDBAuditSink) Query(ctx context.Context, query api.AuditQuery) ([]api.AuditRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	filter := bson.M{"tenant": query.Tenant, "time": bson.M{"$gte": query.Since}}
+	if query.AlbumId != "" {
+		filter["albumid"] = query.AlbumId
+	}
+	if query.Actor != "" {
+		filter["actor"] = query.Actor
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "time", Value: 1}, {Key: "_id", Value: 1}}).
+		SetLimit(int64(query.Limit))
+
+	cursor, err := this.Collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []api.AuditRecord{}
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
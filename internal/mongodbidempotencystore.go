@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// NewMongoDBIdempotencyStore keeps records next to the albums collection, a
+// TTL index on expiresat lets the server reap them once they expire.
+func NewMongoDBIdempotencyStore(service *MongoDBService, collectionName string) (*MongoDBIdempotencyStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), service.Timeout.Get())
+	defer cancel()
+
+	collection := service.Collection.Database().Collection(collectionName)
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"expiresat": 1},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &MongoDBIdempotencyStore{
+		Collection: collection,
+		Timeout:    service.Timeout,
+	}, nil
+}
+
+type MongoDBIdempotencyStore struct {
+	Collection *mongo.Collection
+	Timeout    *QueryTimeout
+}
+
+func (this *MongoDBIdempotencyStore) Reserve(ctx context.Context, record api.IdempotencyRecord) (*api.IdempotencyRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	// the TTL monitor only runs periodically, so an expired record may still be
+	// holding the key and is dropped before claiming it
+	_, err := this.Collection.DeleteOne(ctx, bson.M{"_id": record.Key, "expiresat": bson.M{"$lte": time.Now()}})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = this.Collection.InsertOne(ctx, record)
+	if err == nil {
+		return nil, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return nil, err
+	}
+
+	var existing api.IdempotencyRecord
+	if err := this.Collection.FindOne(ctx, bson.M{"_id": record.Key}).Decode(&existing); err != nil {
+		return nil, err
+	}
+
+	return &existing, nil
+}
+
+func (this *MongoDBIdempotencyStore) Complete(ctx context.Context, record api.IdempotencyRecord) error {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	_, err := this.Collection.ReplaceOne(ctx, bson.M{"_id": record.Key}, record, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (this *MongoDBIdempotencyStore) Release(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	_, err := this.Collection.DeleteOne(ctx, bson.M{"_id": key})
+	return err
+}
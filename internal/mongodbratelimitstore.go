@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// NewMongoDBRateLimitStore keeps buckets next to the albums collection, a TTL
+// index on expiresat drops them once they are full again.
+func NewMongoDBRateLimitStore(service *MongoDBService, collectionName string) (*MongoDBRateLimitStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), service.Timeout.Get())
+	defer cancel()
+
+	collection := service.Collection.Database().Collection(collectionName)
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"expiresat": 1},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &MongoDBRateLimitStore{
+		Collection: collection,
+		Timeout:    service.Timeout,
+	}, nil
+}
+
+type MongoDBRateLimitStore struct {
+	Collection *mongo.Collection
+	Timeout    *QueryTimeout
+}
+
+func (this *MongoDBRateLimitStore) GetBucket(ctx context.Context, key string) (*api.RateLimitBucket, error) {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	var bucket api.RateLimitBucket
+	err := this.Collection.FindOne(ctx, bson.M{"_id": key}).Decode(&bucket)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &bucket, nil
+}
+
+func (this *MongoDBRateLimitStore) PutBucket(ctx context.Context, bucket api.RateLimitBucket, revision int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	if revision == 0 {
+		_, err := this.Collection.InsertOne(ctx, bucket)
+		if mongo.IsDuplicateKeyError(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	result, err := this.Collection.ReplaceOne(ctx, bson.M{"_id": bucket.Key, "revision": revision}, bucket)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
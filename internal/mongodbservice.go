@@ -5,13 +5,73 @@ import (
 	"context"
 	"errors"
 	"net/http"
+	"regexp"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
 )
 
+func init() {
+	api.RegisterBackend(api.Backend{
+		Name:         "mongodb",
+		Description:  "MongoDB collection, idempotency records expire through a TTL index",
+		ConfigKey:    "mongoConfig",
+		ConfigSchema: api.MongoConfig{},
+		NewService: func(config api.AppConfig, idGen api.IdGenerator) (api.Service, error) {
+			service, err := NewMongoDBService(config, idGen)
+			if err != nil {
+				return nil, err
+			}
+			return service, nil
+		},
+		NewIdempotencyStore: func(config api.AppConfig, service api.Service) (api.IdempotencyStore, error) {
+			store, err := NewMongoDBIdempotencyStore(service.(*MongoDBService), config.MongoConfig.IdempotencyCollection)
+			if err != nil {
+				return nil, err
+			}
+			return store, nil
+		},
+		NewApiKeyStore: func(config api.AppConfig, service api.Service) (api.ApiKeyStore, error) {
+			return NewMongoDBApiKeyStore(service.(*MongoDBService), config.MongoConfig.ApiKeyCollection), nil
+		},
+		NewRateLimitStore: func(config api.AppConfig, service api.Service) (api.RateLimitStore, error) {
+			store, err := NewMongoDBRateLimitStore(service.(*MongoDBService), config.MongoConfig.RateLimitCollection)
+			if err != nil {
+				return nil, err
+			}
+			return store, nil
+		},
+		NewAuditSink: func(config api.AppConfig, service api.Service) (api.AuditSink, error) {
+			sink, err := NewMongoDBAuditSink(service.(*MongoDBService), config.MongoConfig.AuditCollection)
+			if err != nil {
+				return nil, err
+			}
+			return sink, nil
+		},
+		ValidateConfig: func(config api.AppConfig) error {
+			errs := []error{
+				requireConfig("mongoConfig.hosts", config.MongoConfig.Hosts),
+				requireConfig("mongoConfig.database", config.MongoConfig.Database),
+				requireConfig("mongoConfig.collection", config.MongoConfig.Collection),
+				requireConfig("mongoConfig.idempotencyCollection", config.MongoConfig.IdempotencyCollection),
+				requireConfig("mongoConfig.apiKeyCollection", config.MongoConfig.ApiKeyCollection),
+				requireConfig("mongoConfig.queryTimeoutSeconds", config.MongoConfig.QueryTimeoutSeconds),
+			}
+			if sharesRateLimits(config) {
+				errs = append(errs, requireConfig("mongoConfig.rateLimitCollection", config.MongoConfig.RateLimitCollection))
+			}
+			if auditsToBackend(config) {
+				errs = append(errs, requireConfig("mongoConfig.auditCollection", config.MongoConfig.AuditCollection))
+			}
+			return errors.Join(errs...)
+		},
+	})
+}
+
 func NewMongoDBService(config api.AppConfig, idGen api.IdGenerator) (*MongoDBService, error) {
 	timeout := time.Duration(config.MongoConfig.QueryTimeoutSeconds) * time.Second
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
@@ -20,7 +80,8 @@ func NewMongoDBService(config api.AppConfig, idGen api.IdGenerator) (*MongoDBSer
 	client, err := mongo.Connect(
 		ctx,
 		options.Client().
-			SetHosts(config.MongoConfig.Hosts),
+			SetHosts(config.MongoConfig.Hosts).
+			SetMonitor(otelmongo.NewMonitor()),
 	)
 	if err != nil {
 		return nil, err
@@ -33,77 +94,196 @@ func NewMongoDBService(config api.AppConfig, idGen api.IdGenerator) (*MongoDBSer
 	return &MongoDBService{
 		IdGen:      idGen,
 		Collection: collection,
-		Timeout:    timeout,
+		Timeout:    NewQueryTimeout(timeout),
 	}, nil
 }
 
 type MongoDBService struct {
 	IdGen      api.IdGenerator
 	Collection *mongo.Collection
-	Timeout    time.Duration
+	Timeout    *QueryTimeout
+}
+
+// IndexedBackend is implemented by backends whose indexes are created, or
+// backfilled, at startup rather than by migrations.
+type IndexedBackend interface {
+	CreateIndexes(ctx context.Context) error
 }
 
-func (this *MongoDBService) GetAlbums() api.HandlerResponse {
-	ctx, cancel := context.WithTimeout(context.Background(), this.Timeout)
+// CreateIndexes creates the compound indexes the album queries rely on, every
+// query filters on the tenant first, then on artist or creation time.
+func (this *MongoDBService) CreateIndexes(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
 	defer cancel()
 
-	findOpts := options.Find().SetSort(bson.M{"timecreated": 1})
-	cursor, err := this.Collection.Find(ctx, bson.D{}, findOpts)
-	if err != nil {
-		return api.HandlerResponse{
-			Code:  http.StatusInternalServerError,
-			Error: err,
+	_, err := this.Collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "tenantId", Value: 1}, {Key: "artist", Value: 1}, {Key: "timecreated", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "tenantId", Value: 1}, {Key: "timecreated", Value: 1}, {Key: "_id", Value: 1}}},
+	})
+	return err
+}
+
+// mongoAlbum is the stored document. tenantId is left out for the default
+// tenant, so albums written before multi-tenancy keep belonging to it.
+type mongoAlbum struct {
+	api.Album `bson:",inline"`
+	TenantId  string `bson:"tenantId,omitempty"`
+}
+
+// mongoCursor holds the sort values and id of the last album on a page.
+type mongoCursor struct {
+	Sort   string
+	Values []any
+	Id     string
+}
+
+func (this *MongoDBService) GetAlbums(ctx context.Context, query api.AlbumQueryDTO) api.HandlerResponse {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	sortFields := resolveSort(query.Sort)
+	filter := mongoAlbumFilter(api.TenantFromContext(ctx), query)
+	if query.Cursor != "" {
+		var position mongoCursor
+		if err := decodeCursor(query.Cursor, &position); err != nil {
+			return invalidCursorResponse()
+		}
+		if position.Sort != sortSignature(sortFields) || len(position.Values) != len(sortFields) {
+			return invalidCursorResponse()
 		}
+		for i, field := range sortFields {
+			value, ok := albumSortKeys[field.Field].FromCursor(position.Values[i])
+			if !ok {
+				return invalidCursorResponse()
+			}
+			position.Values[i] = value
+		}
+
+		filter["$or"] = mongoKeysetFilter(sortFields, position)
 	}
 
+	sortSpec := bson.D{}
+	for _, field := range sortFields {
+		direction := 1
+		if field.Descending {
+			direction = -1
+		}
+		sortSpec = append(sortSpec, bson.E{Key: albumSortKeys[field.Field].MongoField, Value: direction})
+	}
+	sortSpec = append(sortSpec, bson.E{Key: "_id", Value: 1})
+
+	findOpts := options.Find().SetSort(sortSpec)
+	if query.Limit > 0 {
+		// one extra document tells whether another page exists
+		findOpts.SetLimit(int64(query.Limit) + 1)
+	}
+
+	cursor, err := this.Collection.Find(ctx, filter, findOpts)
+	if err != nil {
+		return mongoErrorResponse(err)
+	}
+	defer cursor.Close(ctx)
+
 	albums := []api.Album{}
-	for cursor.Next(nil) {
+	for cursor.Next(ctx) {
 		var alb api.Album
 		if err := cursor.Decode(&alb); err != nil {
-			return api.HandlerResponse{
-				Code:  http.StatusInternalServerError,
-				Error: err,
-			}
+			return NewErrorResponse(err)
 		}
 
 		albums = append(albums, alb)
 	}
+	if err := cursor.Err(); err != nil {
+		return mongoErrorResponse(err)
+	}
+
+	var next string
+	if query.Limit > 0 && len(albums) > query.Limit {
+		albums = albums[:query.Limit]
+		last := albums[len(albums)-1]
+		position := mongoCursor{Sort: sortSignature(sortFields), Id: last.Id}
+		for _, field := range sortFields {
+			position.Values = append(position.Values, albumSortKeys[field.Field].Value(last))
+		}
+		next, _ = encodeCursor(position)
+	}
 
 	return api.HandlerResponse{
 		Code: http.StatusOK,
 		Body: api.ResponseBody{
 			Data: albums,
+			Next: next,
 		},
 	}
 }
 
-func (this *MongoDBService) GetAlbumById(id string) api.HandlerResponse {
-	ctx, cancel := context.WithTimeout(context.Background(), this.Timeout)
+// mongoKeysetFilter matches the albums ordered after position, comparing the
+// sort fields in turn and finally the id.
+func mongoKeysetFilter(fields []api.SortField, position mongoCursor) bson.A {
+	clauses := bson.A{}
+	for i, field := range fields {
+		clause := bson.M{}
+		for j, prev := range fields[:i] {
+			clause[albumSortKeys[prev.Field].MongoField] = position.Values[j]
+		}
+
+		operator := "$gt"
+		if field.Descending {
+			operator = "$lt"
+		}
+		clause[albumSortKeys[field.Field].MongoField] = bson.M{operator: position.Values[i]}
+		clauses = append(clauses, clause)
+	}
+
+	tieBreak := bson.M{"_id": bson.M{"$gt": position.Id}}
+	for i, field := range fields {
+		tieBreak[albumSortKeys[field.Field].MongoField] = position.Values[i]
+	}
+
+	return append(clauses, tieBreak)
+}
+
+func mongoAlbumFilter(tenant string, query api.AlbumQueryDTO) bson.M {
+	filter := mongoTenantFilter(tenant)
+	if query.Artist != "" {
+		filter["artist"] = query.Artist
+	}
+	if query.TitleContains != "" {
+		filter["title"] = bson.M{"$regex": regexp.QuoteMeta(query.TitleContains)}
+	}
+
+	price := bson.M{}
+	if query.MinPrice > 0 {
+		price["$gte"] = query.MinPrice
+	}
+	if query.MaxPrice > 0 {
+		price["$lte"] = query.MaxPrice
+	}
+	if len(price) > 0 {
+		filter["price"] = price
+	}
+
+	if query.CreatedAfter > 0 {
+		filter["timecreated"] = bson.M{"$gt": query.CreatedAfter}
+	}
+
+	return filter
+}
+
+func (this *MongoDBService) GetAlbumById(ctx context.Context, id string) api.HandlerResponse {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
 	defer cancel()
 
-	filter := bson.M{"_id": id}
+	filter := mongoTenantFilter(api.TenantFromContext(ctx))
+	filter["_id"] = id
 	result := this.Collection.FindOne(ctx, filter)
 	if err := result.Err(); err != nil {
-		var code int
-		switch err {
-		case mongo.ErrNoDocuments:
-			code = http.StatusNotFound
-		default:
-			code = http.StatusInternalServerError
-		}
-
-		return api.HandlerResponse{
-			Code:  code,
-			Error: err,
-		}
+		return mongoErrorResponse(err)
 	}
 
 	var alb api.Album
 	if err := result.Decode(&alb); err != nil {
-		return api.HandlerResponse{
-			Code:  http.StatusInternalServerError,
-			Error: err,
-		}
+		return NewErrorResponse(err)
 	}
 
 	return api.HandlerResponse{
@@ -112,21 +292,25 @@ func (this *MongoDBService) GetAlbumById(id string) api.HandlerResponse {
 	}
 }
 
-func (this *MongoDBService) InsertAlbum(props api.AlbumPropertiesDTO) api.HandlerResponse {
+func (this *MongoDBService) InsertAlbum(ctx context.Context, props api.AlbumPropertiesDTO) api.HandlerResponse {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	now := time.Now().UnixMilli()
 	newData := api.Album{
 		Id:          this.IdGen.NextId(),
 		Title:       props.Title,
 		Artist:      props.Artist,
 		Price:       props.Price,
-		TimeCreated: time.Now().UnixMilli(),
+		TimeCreated: now,
+		TimeUpdated: now,
+		Version:     1,
+		OwnerId:     api.SubjectFromContext(ctx),
 	}
 
-	_, err := this.Collection.InsertOne(nil, newData)
+	_, err := this.Collection.InsertOne(ctx, mongoAlbum{Album: newData, TenantId: api.TenantFromContext(ctx)})
 	if err != nil {
-		return api.HandlerResponse{
-			Code:  http.StatusInternalServerError,
-			Error: err,
-		}
+		return mongoErrorResponse(err)
 	}
 
 	return api.HandlerResponse{
@@ -135,38 +319,35 @@ func (this *MongoDBService) InsertAlbum(props api.AlbumPropertiesDTO) api.Handle
 	}
 }
 
-func (this *MongoDBService) ReplaceAlbum(id string, props api.AlbumPropertiesDTO) api.HandlerResponse {
-	filter := bson.M{"_id": id}
-	update := bson.M{"$set": bson.M{
-		"title":  props.Title,
-		"artist": props.Artist,
-		"price":  props.Price,
-	}}
+func (this *MongoDBService) ReplaceAlbum(ctx context.Context, id string, props api.AlbumPropertiesDTO, expectedVersion int64) api.HandlerResponse {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	filter := mongoVersionFilter(api.TenantFromContext(ctx), id, expectedVersion)
+	update := bson.M{
+		"$set": bson.M{
+			"title":       props.Title,
+			"artist":      props.Artist,
+			"price":       props.Price,
+			"timeupdated": time.Now().UnixMilli(),
+		},
+		"$inc": bson.M{"version": 1},
+	}
 	opts := options.FindOneAndUpdate().
 		SetReturnDocument(options.After)
 
-	result := this.Collection.FindOneAndUpdate(nil, filter, update, opts)
+	result := this.Collection.FindOneAndUpdate(ctx, filter, update, opts)
 	if err := result.Err(); err != nil {
-		var code int
-		switch err {
-		case mongo.ErrNoDocuments:
-			code = http.StatusNotFound
-		default:
-			code = http.StatusInternalServerError
+		if err == mongo.ErrNoDocuments {
+			return this.notMatchedResponse(ctx, id, expectedVersion)
 		}
 
-		return api.HandlerResponse{
-			Code:  code,
-			Error: err,
-		}
+		return mongoErrorResponse(err)
 	}
 
 	var alb api.Album
 	if err := result.Decode(&alb); err != nil {
-		return api.HandlerResponse{
-			Code:  http.StatusInternalServerError,
-			Error: err,
-		}
+		return NewErrorResponse(err)
 	}
 
 	return api.HandlerResponse{
@@ -175,7 +356,10 @@ func (this *MongoDBService) ReplaceAlbum(id string, props api.AlbumPropertiesDTO
 	}
 }
 
-func (this *MongoDBService) UpdateAlbum(id string, updates api.AlbumUpdatesDTO) api.HandlerResponse {
+func (this *MongoDBService) UpdateAlbum(ctx context.Context, id string, updates api.AlbumUpdatesDTO, expectedVersion int64) api.HandlerResponse {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
 	updateMap := bson.M{}
 	if updates.Title != "" {
 		updateMap["title"] = updates.Title
@@ -186,34 +370,25 @@ func (this *MongoDBService) UpdateAlbum(id string, updates api.AlbumUpdatesDTO)
 	if updates.Price > 0 {
 		updateMap["price"] = updates.Price
 	}
+	updateMap["timeupdated"] = time.Now().UnixMilli()
 
-	filter := bson.M{"_id": id}
-	update := bson.M{"$set": updateMap}
+	filter := mongoVersionFilter(api.TenantFromContext(ctx), id, expectedVersion)
+	update := bson.M{"$set": updateMap, "$inc": bson.M{"version": 1}}
 	opts := options.FindOneAndUpdate().
 		SetReturnDocument(options.After)
 
-	result := this.Collection.FindOneAndUpdate(nil, filter, update, opts)
+	result := this.Collection.FindOneAndUpdate(ctx, filter, update, opts)
 	if err := result.Err(); err != nil {
-		var code int
-		switch err {
-		case mongo.ErrNoDocuments:
-			code = http.StatusNotFound
-		default:
-			code = http.StatusInternalServerError
+		if err == mongo.ErrNoDocuments {
+			return this.notMatchedResponse(ctx, id, expectedVersion)
 		}
 
-		return api.HandlerResponse{
-			Code:  code,
-			Error: err,
-		}
+		return mongoErrorResponse(err)
 	}
 
 	var alb api.Album
 	if err := result.Decode(&alb); err != nil {
-		return api.HandlerResponse{
-			Code:  http.StatusInternalServerError,
-			Error: err,
-		}
+		return NewErrorResponse(err)
 	}
 
 	return api.HandlerResponse{
@@ -222,21 +397,18 @@ func (this *MongoDBService) UpdateAlbum(id string, updates api.AlbumUpdatesDTO)
 	}
 }
 
-func (this *MongoDBService) DeleteAlbum(id string) api.HandlerResponse {
-	filter := bson.M{"_id": id}
-	result, err := this.Collection.DeleteOne(nil, filter)
+func (this *MongoDBService) DeleteAlbum(ctx context.Context, id string, expectedVersion int64) api.HandlerResponse {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	filter := mongoVersionFilter(api.TenantFromContext(ctx), id, expectedVersion)
+	result, err := this.Collection.DeleteOne(ctx, filter)
 	if err != nil {
-		return api.HandlerResponse{
-			Code:  http.StatusInternalServerError,
-			Error: err,
-		}
+		return mongoErrorResponse(err)
 	}
 
 	if result.DeletedCount == 0 {
-		return api.HandlerResponse{
-			Code:  http.StatusNotFound,
-			Error: errors.New("album data not found"),
-		}
+		return this.notMatchedResponse(ctx, id, expectedVersion)
 	}
 
 	return api.HandlerResponse{
@@ -244,3 +416,67 @@ func (this *MongoDBService) DeleteAlbum(id string) api.HandlerResponse {
 		Body: api.ResponseBody{Message: "album data removed"},
 	}
 }
+
+// ApplyConfig changes the query timeout of the calls that follow.
+func (this *MongoDBService) ApplyConfig(config api.AppConfig) {
+	this.Timeout.Set(time.Duration(config.MongoConfig.QueryTimeoutSeconds) * time.Second)
+}
+
+// Close disconnects the client, waiting for in-use connections until ctx is done.
+func (this *MongoDBService) Close(ctx context.Context) error {
+	return this.Collection.Database().Client().Disconnect(ctx)
+}
+
+// CheckHealth pings the primary of the replica set the albums are written to.
+func (this *MongoDBService) CheckHealth(ctx context.Context) error {
+	return this.Collection.Database().Client().Ping(ctx, readpref.Primary())
+}
+
+// mongoTenantFilter matches the albums of tenant, a missing tenantId
+// matching the default tenant.
+func mongoTenantFilter(tenant string) bson.M {
+	if tenant == "" {
+		return bson.M{"tenantId": nil}
+	}
+	return bson.M{"tenantId": tenant}
+}
+
+func mongoVersionFilter(tenant string, id string, expectedVersion int64) bson.M {
+	filter := mongoTenantFilter(tenant)
+	filter["_id"] = id
+	if expectedVersion != 0 {
+		filter["version"] = expectedVersion
+	}
+
+	return filter
+}
+
+// notMatchedResponse tells a missing album from a stale version once a write filter matched nothing.
+func (this *MongoDBService) notMatchedResponse(ctx context.Context, id string, expectedVersion int64) api.HandlerResponse {
+	if expectedVersion != 0 {
+		filter := mongoTenantFilter(api.TenantFromContext(ctx))
+		filter["_id"] = id
+		count, err := this.Collection.CountDocuments(ctx, filter)
+		if err != nil {
+			return mongoErrorResponse(err)
+		}
+		if count > 0 {
+			return versionMismatchResponse()
+		}
+	}
+
+	return notFoundResponse()
+}
+
+func mongoErrorResponse(err error) api.HandlerResponse {
+	switch {
+	case err == mongo.ErrNoDocuments:
+		return notFoundResponse()
+	case !errors.Is(err, context.Canceled) && mongo.IsTimeout(err):
+		return newError(api.KindTimeout, "backend query timed out", err).Response()
+	case mongo.IsNetworkError(err):
+		return newError(api.KindBackendUnavailable, "backend is unreachable", err).Response()
+	default:
+		return NewErrorResponse(err)
+	}
+}
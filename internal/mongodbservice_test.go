@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"andrewsaputra/go-rest-sample/api/servicetest"
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// InitMongoDBService connects to MONGODB_TEST_HOSTS, e.g. a local mongod
+// container, and gives every test its own collection.
+func InitMongoDBService(t *testing.T) *MongoDBService {
+	hosts := os.Getenv("MONGODB_TEST_HOSTS")
+	if hosts == "" {
+		t.Skip("MONGODB_TEST_HOSTS not set")
+	}
+
+	idGen := NewXidGenerator()
+	config := api.AppConfig{
+		MongoConfig: api.MongoConfig{
+			Hosts:               strings.Split(hosts, ","),
+			Database:            "db-music-test",
+			Collection:          "albums_" + idGen.NextId(),
+			QueryTimeoutSeconds: 5,
+		},
+	}
+	service, err := NewMongoDBService(config, idGen)
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		service.Collection.Drop(context.Background())
+		service.Collection.Database().Client().Disconnect(context.Background())
+	})
+
+	return service
+}
+
+func TestMongoDBService_Conformance(t *testing.T) {
+	servicetest.Run(t, func(t *testing.T) api.Service {
+		return InitMongoDBService(t)
+	})
+}
+
+func TestMongoDBServiceGetAlbums_CursorValueOfWrongType_ReturnBadRequest(t *testing.T) {
+	// the cursor is rejected before the collection is queried
+	service := &MongoDBService{Timeout: NewQueryTimeout(time.Second)}
+	cursor, _ := encodeCursor(mongoCursor{Sort: "timeCreated", Values: []any{"not a time"}, Id: "id"})
+
+	response := service.GetAlbums(context.Background(), api.AlbumQueryDTO{Limit: 2, Cursor: cursor})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	assert.Equal(t, invalidCursorResponse(), response)
+}
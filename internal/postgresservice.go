@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+func init() {
+	api.RegisterBackend(api.Backend{
+		Name:         "postgres",
+		Description:  "PostgreSQL database, schema is migrated on startup",
+		ConfigKey:    "postgresConfig",
+		ConfigSchema: api.PostgresConfig{},
+		NewService: func(config api.AppConfig, idGen api.IdGenerator) (api.Service, error) {
+			service, err := NewPostgresService(config, idGen)
+			if err != nil {
+				return nil, err
+			}
+			return service, nil
+		},
+		NewIdempotencyStore: func(config api.AppConfig, service api.Service) (api.IdempotencyStore, error) {
+			return NewSqlIdempotencyStore(&service.(*PostgresService).SqlService), nil
+		},
+		NewApiKeyStore: func(config api.AppConfig, service api.Service) (api.ApiKeyStore, error) {
+			return NewSqlApiKeyStore(&service.(*PostgresService).SqlService), nil
+		},
+		NewRateLimitStore: func(config api.AppConfig, service api.Service) (api.RateLimitStore, error) {
+			return NewSqlRateLimitStore(&service.(*PostgresService).SqlService), nil
+		},
+		NewAuditSink: func(config api.AppConfig, service api.Service) (api.AuditSink, error) {
+			return NewSqlAuditSink(&service.(*PostgresService).SqlService), nil
+		},
+		ValidateConfig: func(config api.AppConfig) error {
+			return errors.Join(
+				requireConfig("postgresConfig.dsn", config.PostgresConfig.Dsn),
+				requireConfig("postgresConfig.queryTimeoutSeconds", config.PostgresConfig.QueryTimeoutSeconds),
+			)
+		},
+	})
+}
+
+// postgresMigrations are applied in order by migrateSql. Append new
+// migrations, never edit the ones already released.
+var postgresMigrations = [][]string{
+	{
+		`CREATE TABLE albums (
+			id           TEXT PRIMARY KEY,
+			title        TEXT NOT NULL,
+			artist       TEXT NOT NULL,
+			price        DOUBLE PRECISION NOT NULL,
+			time_created BIGINT NOT NULL,
+			time_updated BIGINT NOT NULL,
+			version      BIGINT NOT NULL
+		)`,
+	},
+	{
+		`CREATE INDEX idx_albums_artist_time_created ON albums (artist, time_created, id)`,
+		`CREATE INDEX idx_albums_time_created ON albums (time_created, id)`,
+	},
+	{
+		`CREATE TABLE idempotency_keys (
+			key         TEXT PRIMARY KEY,
+			fingerprint TEXT NOT NULL,
+			status_code INTEGER NOT NULL,
+			header      TEXT NOT NULL,
+			body        BYTEA,
+			expires_at  BIGINT NOT NULL
+		)`,
+	},
+	{
+		`CREATE TABLE api_keys (
+			id           TEXT PRIMARY KEY,
+			hash         TEXT NOT NULL,
+			subject      TEXT NOT NULL,
+			scopes       TEXT NOT NULL,
+			time_created BIGINT NOT NULL,
+			not_before   BIGINT NOT NULL,
+			expires_at   BIGINT NOT NULL,
+			last_used_at BIGINT NOT NULL
+		)`,
+	},
+	{
+		`ALTER TABLE albums ADD COLUMN owner_id TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE api_keys ADD COLUMN roles TEXT NOT NULL DEFAULT ''`,
+	},
+	{
+		`ALTER TABLE albums ADD COLUMN tenant_id TEXT NOT NULL DEFAULT ''`,
+		`DROP INDEX idx_albums_artist_time_created`,
+		`DROP INDEX idx_albums_time_created`,
+		`CREATE INDEX idx_albums_tenant_artist_time_created ON albums (tenant_id, artist, time_created, id)`,
+		`CREATE INDEX idx_albums_tenant_time_created ON albums (tenant_id, time_created, id)`,
+		`ALTER TABLE api_keys ADD COLUMN tenant TEXT NOT NULL DEFAULT ''`,
+	},
+	{
+		`CREATE TABLE rate_limits (
+			key        TEXT PRIMARY KEY,
+			tokens     DOUBLE PRECISION NOT NULL,
+			revision   BIGINT NOT NULL,
+			updated_at BIGINT NOT NULL,
+			expires_at BIGINT NOT NULL
+		)`,
+		`CREATE INDEX idx_rate_limits_expires_at ON rate_limits (expires_at)`,
+	},
+	{
+		`CREATE TABLE audit_log (
+			id         TEXT PRIMARY KEY,
+			tenant_id  TEXT NOT NULL,
+			album_id   TEXT NOT NULL,
+			action     TEXT NOT NULL,
+			actor      TEXT NOT NULL,
+			method     TEXT NOT NULL,
+			request_id TEXT NOT NULL,
+			time       BIGINT NOT NULL,
+			before     TEXT,
+			after      TEXT
+		)`,
+		`CREATE INDEX idx_audit_log_tenant_album_time ON audit_log (tenant_id, album_id, time, id)`,
+		`CREATE INDEX idx_audit_log_tenant_actor_time ON audit_log (tenant_id, actor, time, id)`,
+		`CREATE INDEX idx_audit_log_tenant_time ON audit_log (tenant_id, time, id)`,
+	},
+	{
+		`ALTER TABLE audit_log ADD COLUMN unverified BOOLEAN NOT NULL DEFAULT FALSE`,
+	},
+}
+
+// postgresQueryCanceled is the SQLSTATE reported when statement_timeout fires.
+const postgresQueryCanceled = "57014"
+
+var postgresDialect = sqlDialect{
+	Name:                 "postgres",
+	NumberedPlaceholders: true,
+	TitleContains:        "strpos(title, ?) > 0",
+	LockMigrations:       "SELECT pg_advisory_xact_lock(hashtext('albums_schema_migrations'))",
+	TranslateError: func(err error) error {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == postgresQueryCanceled {
+			return context.DeadlineExceeded
+		}
+
+		return err
+	},
+}
+
+func NewPostgresService(config api.AppConfig, idGen api.IdGenerator) (*PostgresService, error) {
+	connConfig, err := pgx.ParseConfig(config.PostgresConfig.Dsn)
+	if err != nil {
+		return nil, err
+	}
+	if config.PostgresConfig.StatementTimeoutMillis > 0 {
+		connConfig.RuntimeParams["statement_timeout"] = strconv.Itoa(config.PostgresConfig.StatementTimeoutMillis)
+	}
+
+	db := stdlib.OpenDB(*connConfig)
+	db.SetMaxOpenConns(config.PostgresConfig.MaxOpenConns)
+	db.SetMaxIdleConns(config.PostgresConfig.MaxIdleConns)
+	db.SetConnMaxLifetime(time.Duration(config.PostgresConfig.ConnMaxLifetimeSeconds) * time.Second)
+
+	timeout := time.Duration(config.PostgresConfig.QueryTimeoutSeconds) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := migrateSql(ctx, db, postgresDialect, postgresMigrations); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &PostgresService{
+		SqlService: SqlService{
+			IdGen:   idGen,
+			Db:      db,
+			Timeout: NewQueryTimeout(timeout),
+			Dialect: postgresDialect,
+		},
+	}, nil
+}
+
+type PostgresService struct {
+	SqlService
+}
+
+// ApplyConfig changes the query timeout of the calls that follow.
+func (this *PostgresService) ApplyConfig(config api.AppConfig) {
+	this.Timeout.Set(time.Duration(config.PostgresConfig.QueryTimeoutSeconds) * time.Second)
+}
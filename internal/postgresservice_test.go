@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"andrewsaputra/go-rest-sample/api/servicetest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// InitPostgresService connects to the database named by POSTGRES_TEST_DSN,
+// e.g. a local container, and starts every test from an empty albums table.
+func InitPostgresService(t *testing.T) *PostgresService {
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_TEST_DSN not set")
+	}
+
+	config := api.AppConfig{
+		PostgresConfig: api.PostgresConfig{Dsn: dsn, MaxOpenConns: 4, StatementTimeoutMillis: 5000, QueryTimeoutSeconds: 5},
+	}
+	service, err := NewPostgresService(config, NewXidGenerator())
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { service.Db.Close() })
+
+	_, err = service.Db.Exec("TRUNCATE albums, idempotency_keys")
+	assert.Nil(t, err)
+
+	return service
+}
+
+func TestPostgresDialectRebind_Placeholders_NumberInOrder(t *testing.T) {
+	statement := postgresDialect.Rebind("UPDATE albums SET title = ? WHERE id = ? AND version = ?")
+	assert.Equal(t, "UPDATE albums SET title = $1 WHERE id = $2 AND version = $3", statement)
+
+	statement = sqliteDialect.Rebind("SELECT id FROM albums WHERE id = ?")
+	assert.Equal(t, "SELECT id FROM albums WHERE id = ?", statement)
+}
+
+func TestPostgresService_Conformance(t *testing.T) {
+	servicetest.Run(t, func(t *testing.T) api.Service {
+		return InitPostgresService(t)
+	})
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// albumETag renders the strong entity tag for an album version.
+func albumETag(album api.Album) string {
+	return `"` + strconv.FormatInt(album.Version, 10) + `"`
+}
+
+// albumLastModified falls back to TimeCreated for albums stored before TimeUpdated existed.
+func albumLastModified(album api.Album) time.Time {
+	millis := album.TimeUpdated
+	if millis < album.TimeCreated {
+		millis = album.TimeCreated
+	}
+	if millis <= 0 {
+		return time.Time{}
+	}
+
+	return time.UnixMilli(millis)
+}
+
+// responseValidators derives the ETag and Last-Modified for a response body.
+// A single album is tagged by its version, a listing by a weak hash of the
+// whole page since any album or the next cursor changing alters it.
+func responseValidators(body api.ResponseBody) (etag string, lastModified time.Time) {
+	switch data := body.Data.(type) {
+	case api.Album:
+		if data.Version > 0 {
+			etag = albumETag(data)
+		}
+		return etag, albumLastModified(data)
+	case []api.Album:
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return "", time.Time{}
+		}
+
+		sum := sha256.Sum256(raw)
+		for _, album := range data {
+			if modified := albumLastModified(album); modified.After(lastModified) {
+				lastModified = modified
+			}
+		}
+		return `W/"` + hex.EncodeToString(sum[:16]) + `"`, lastModified
+	default:
+		return "", time.Time{}
+	}
+}
+
+// isNotModified evaluates If-None-Match, or If-Modified-Since when no entity
+// tags were sent, against the current validators of a GET response.
+func isNotModified(request *http.Request, etag string, lastModified time.Time) bool {
+	if ifNoneMatch := request.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if etag == "" {
+			return false
+		}
+
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ifModifiedSince := request.Header.Get("If-Modified-Since"); ifModifiedSince != "" && !lastModified.IsZero() {
+		since, err := http.ParseTime(ifModifiedSince)
+		if err != nil {
+			return false
+		}
+
+		return !lastModified.Truncate(time.Second).After(since)
+	}
+
+	return false
+}
+
+// parseIfMatch returns the album version required by an If-Match header. An
+// absent header or "*" requires no particular version and yields zero, ok is
+// false when the header can never match a stored album.
+func parseIfMatch(header string) (version int64, ok bool) {
+	header = strings.TrimSpace(header)
+	if header == "" || header == "*" {
+		return 0, true
+	}
+
+	if len(header) < 2 || !strings.HasPrefix(header, `"`) || !strings.HasSuffix(header, `"`) {
+		return 0, false
+	}
+
+	version, err := strconv.ParseInt(header[1:len(header)-1], 10, 64)
+	if err != nil || version <= 0 {
+		return 0, false
+	}
+
+	return version, true
+}
@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+// writeProblem renders err as application/problem+json. Untyped errors are
+// reported with the kind matching status and without their message.
+func writeProblem(c *gin.Context, status int, err error) {
+	apiErr := api.AsError(err, status)
+	c.Header("Content-Type", api.ProblemContentType)
+	c.AbortWithStatusJSON(apiErr.Kind.Status, apiErr.Problem(c.Request.URL.Path))
+}
+
+// requestError describes why a request could not be bound or validated.
+func requestError(err error) *api.Error {
+	var validationErrs validator.ValidationErrors
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &validationErrs):
+		fields := make([]api.FieldError, 0, len(validationErrs))
+		for _, fieldErr := range validationErrs {
+			fields = append(fields, api.FieldError{
+				Field:  fieldErr.Field(),
+				Rule:   fieldErr.Tag(),
+				Detail: validationRuleDetail(fieldErr),
+			})
+		}
+		return &api.Error{Kind: api.KindValidationFailed, Detail: "request has invalid fields", Fields: fields, Cause: err}
+	case errors.As(err, &typeErr):
+		detail := "must be a " + typeErr.Type.Kind().String()
+		return fieldError(typeErr.Field, "type", detail, err)
+	case errors.As(err, &syntaxErr), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return &api.Error{Kind: api.KindMalformedRequest, Detail: "request body is not valid JSON", Cause: err}
+	default:
+		return &api.Error{Kind: api.KindMalformedRequest, Detail: "request could not be parsed", Cause: err}
+	}
+}
+
+func fieldError(field, rule, detail string, cause error) *api.Error {
+	return &api.Error{
+		Kind:   api.KindValidationFailed,
+		Detail: "request has invalid fields",
+		Fields: []api.FieldError{{Field: field, Rule: rule, Detail: detail}},
+		Cause:  cause,
+	}
+}
+
+func validationRuleDetail(fieldErr validator.FieldError) string {
+	switch fieldErr.Tag() {
+	case "required":
+		return "is required"
+	case "required_without_all":
+		return "is required when none of " + strings.ReplaceAll(fieldErr.Param(), " ", ", ") + " is set"
+	case "gt":
+		return "must be greater than " + fieldErr.Param()
+	case "gte":
+		return "must be greater than or equal to " + fieldErr.Param()
+	case "lt":
+		return "must be less than " + fieldErr.Param()
+	case "lte":
+		return "must be less than or equal to " + fieldErr.Param()
+	case "gtefield":
+		return "must be greater than or equal to " + fieldErr.Param()
+	default:
+		return fmt.Sprintf("failed the %s rule", fieldErr.Tag())
+	}
+}
+
+// requestFieldName reports fields by the name clients send them with, the
+// form tag for query parameters and the Go name for JSON bodies.
+func requestFieldName(field reflect.StructField) string {
+	if name, _, _ := strings.Cut(field.Tag.Get("form"), ","); name != "" && name != "-" {
+		return name
+	}
+
+	return field.Name
+}
@@ -0,0 +1,27 @@
+package internal
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// QueryTimeout bounds every call to a backend. It is shared by a service and
+// its idempotency store, and a config reload can change it while requests
+// are reading it.
+type QueryTimeout struct {
+	nanos atomic.Int64
+}
+
+func NewQueryTimeout(timeout time.Duration) *QueryTimeout {
+	queryTimeout := &QueryTimeout{}
+	queryTimeout.Set(timeout)
+	return queryTimeout
+}
+
+func (this *QueryTimeout) Get() time.Duration {
+	return time.Duration(this.nanos.Load())
+}
+
+func (this *QueryTimeout) Set(timeout time.Duration) {
+	this.nanos.Store(int64(timeout))
+}
@@ -0,0 +1,239 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	rateLimitStoreMemory  = "memory"
+	rateLimitStoreBackend = "backend"
+	// maxRateLimitAttempts bounds the retries of a bucket update racing
+	// other instances for the same client
+	maxRateLimitAttempts = 5
+)
+
+// sharesRateLimits reports whether config keeps rate limit buckets in the backend.
+func sharesRateLimits(config api.AppConfig) bool {
+	return config.RateLimitConfig.Enabled && config.RateLimitConfig.Store == rateLimitStoreBackend
+}
+
+// NewRateLimiter enforces the rules of config on buckets kept in store.
+func NewRateLimiter(config api.RateLimitConfig, store api.RateLimitStore, logger *slog.Logger) *RateLimiter {
+	return &RateLimiter{
+		Store:  store,
+		Logger: logger,
+		config: config,
+	}
+}
+
+type RateLimiter struct {
+	Store  api.RateLimitStore
+	Logger *slog.Logger
+
+	mutex  sync.RWMutex
+	config api.RateLimitConfig
+}
+
+func (this *RateLimiter) ApplyConfig(config api.AppConfig) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.config = config.RateLimitConfig
+}
+
+// ipRule returns the rule every request of an IP is held to before
+// authentication.
+func (this *RateLimiter) ipRule() api.RateLimitRule {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	rule := this.config.Ip
+	if rule.RequestsPerMinute <= 0 {
+		rule = this.config.Read
+	}
+	if rule.Burst <= 0 {
+		rule.Burst = rule.RequestsPerMinute
+	}
+	return rule
+}
+
+// rule returns the read or write rule of the client named name.
+func (this *RateLimiter) rule(name string, write bool) api.RateLimitRule {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	rule, override := this.config.Read, this.config.Clients[name].Read
+	if write {
+		rule, override = this.config.Write, this.config.Clients[name].Write
+	}
+	if override != nil {
+		rule = *override
+	}
+	if rule.Burst <= 0 {
+		rule.Burst = rule.RequestsPerMinute
+	}
+	return rule
+}
+
+type rateLimitResult struct {
+	Allowed   bool
+	Remaining int
+	// Reset is when the bucket is full again
+	Reset time.Duration
+	// RetryAfter is when the next request is allowed, zero when it already is
+	RetryAfter time.Duration
+}
+
+// Take takes a token from the bucket with key, retrying when another
+// instance updated the bucket in between.
+func (this *RateLimiter) Take(ctx context.Context, key string, rule api.RateLimitRule) (rateLimitResult, error) {
+	for attempt := 0; attempt < maxRateLimitAttempts; attempt++ {
+		stored, err := this.Store.GetBucket(ctx, key)
+		if err != nil {
+			return rateLimitResult{}, err
+		}
+
+		bucket := api.RateLimitBucket{Key: key, Tokens: float64(rule.Burst)}
+		if stored != nil {
+			bucket = *stored
+		}
+		revision := bucket.Revision
+		result := takeRateLimitToken(&bucket, rule, time.Now())
+		// a rejected request takes nothing, the bucket refills on its own
+		if !result.Allowed {
+			return result, nil
+		}
+
+		saved, err := this.Store.PutBucket(ctx, bucket, revision)
+		if err != nil {
+			return rateLimitResult{}, err
+		}
+		if saved {
+			return result, nil
+		}
+	}
+
+	return rateLimitResult{}, fmt.Errorf("rate limit bucket %s is updated too often concurrently", key)
+}
+
+// takeRateLimitToken refills bucket for the time elapsed since it was last
+// updated, then takes a token from it when one is left.
+func takeRateLimitToken(bucket *api.RateLimitBucket, rule api.RateLimitRule, now time.Time) rateLimitResult {
+	perSecond := float64(rule.RequestsPerMinute) / 60
+	burst := float64(rule.Burst)
+	elapsed := math.Max(0, now.Sub(bucket.UpdatedAt).Seconds())
+	tokens := math.Min(burst, bucket.Tokens+elapsed*perSecond)
+
+	var result rateLimitResult
+	if tokens >= 1 {
+		tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsDuration((1 - tokens) / perSecond)
+	}
+	result.Remaining = int(tokens)
+	result.Reset = secondsDuration((burst - tokens) / perSecond)
+
+	bucket.Tokens = tokens
+	bucket.Revision++
+	bucket.UpdatedAt = now
+	bucket.ExpiresAt = now.Add(result.Reset)
+	return result
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// NewRateLimitMiddleware takes a token from the read or write bucket of the
+// client for every request, and rejects the request with 429 when it is empty.
+// Responses tell the client its limits through the RateLimit-* headers. The
+// limits aren't enforced while the store is unavailable.
+func NewRateLimitMiddleware(limiter *RateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		write := c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead
+		client, name := rateLimitClient(c)
+
+		operation := "read"
+		if write {
+			operation = "write"
+		}
+		if limiter.enforce(c, operation+":"+client, limiter.rule(name, write), operation) {
+			c.Next()
+		}
+	}
+}
+
+// NewIpRateLimitMiddleware takes a token from the bucket of the client IP for
+// every request, so that it runs before authentication and requests with
+// invalid credentials are limited too.
+func NewIpRateLimitMiddleware(limiter *RateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if limiter.enforce(c, "any:ip:"+c.ClientIP(), limiter.ipRule(), "") {
+			c.Next()
+		}
+	}
+}
+
+// enforce takes a token from the bucket with key and sets the RateLimit-*
+// headers, it reports whether the request may continue and otherwise answers
+// it with 429.
+func (this *RateLimiter) enforce(c *gin.Context, key string, rule api.RateLimitRule, operation string) bool {
+	if rule.RequestsPerMinute <= 0 {
+		return true
+	}
+
+	ctx := c.Request.Context()
+	result, err := this.Take(ctx, key, rule)
+	if err != nil {
+		this.Logger.WarnContext(ctx, "rate limit not enforced", slog.String("client", key), slog.Any("error", err))
+		return true
+	}
+
+	header := c.Writer.Header()
+	header.Set("RateLimit-Policy", fmt.Sprintf("%d;w=60;burst=%d", rule.RequestsPerMinute, rule.Burst))
+	header.Set("RateLimit-Limit", strconv.Itoa(rule.Burst))
+	header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	header.Set("RateLimit-Reset", ceilSeconds(result.Reset))
+	if !result.Allowed {
+		header.Set("Retry-After", ceilSeconds(result.RetryAfter))
+		detail := fmt.Sprintf("limit of %d requests per minute exceeded", rule.RequestsPerMinute)
+		if operation != "" {
+			detail = fmt.Sprintf("limit of %d %s requests per minute exceeded", rule.RequestsPerMinute, operation)
+		}
+		writeProblem(c, http.StatusTooManyRequests, api.NewError(api.KindTooManyRequests, detail))
+		return false
+	}
+
+	return true
+}
+
+// rateLimitClient returns the bucket key of the caller, and the name its
+// rules can be overridden with in RateLimitConfig.Clients.
+func rateLimitClient(c *gin.Context) (string, string) {
+	principal := api.PrincipalFromContext(c.Request.Context())
+	switch {
+	case principal == nil:
+		ip := c.ClientIP()
+		return "ip:" + ip, ip
+	case principal.Claims["apiKeyId"] != nil:
+		id := fmt.Sprint(principal.Claims["apiKeyId"])
+		return "apikey:" + id, id
+	default:
+		return "subject:" + principal.Subject, principal.Subject
+	}
+}
+
+func ceilSeconds(duration time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(duration.Seconds())))
+}
@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func InitRateLimitRouter(config api.RateLimitConfig, store api.RateLimitStore, principal *api.Principal) *gin.Engine {
+	logger, _ := NewLogger(api.LoggingConfig{}, &bytes.Buffer{}, nil)
+	limiter := NewRateLimiter(config, store, logger)
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		if principal != nil {
+			c.Request = c.Request.WithContext(api.ContextWithPrincipal(c.Request.Context(), principal))
+		}
+	}, NewRateLimitMiddleware(limiter))
+	router.GET("/albums", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.POST("/albums", func(c *gin.Context) { c.Status(http.StatusOK) })
+	return router
+}
+
+func SendRateLimitedRequest(router *gin.Engine, method string, ip string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(method, "/albums", nil)
+	request.RemoteAddr = ip + ":1234"
+
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	return response
+}
+
+func TestRateLimitMiddleware_BurstExceeded_ReturnTooManyRequests(t *testing.T) {
+	config := api.RateLimitConfig{Enabled: true, Read: api.RateLimitRule{RequestsPerMinute: 60, Burst: 2}}
+	router := InitRateLimitRouter(config, NewInMemoryRateLimitStore(), nil)
+
+	first := SendRateLimitedRequest(router, http.MethodGet, "10.0.0.1")
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.Equal(t, "2", first.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", first.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "60;w=60;burst=2", first.Header().Get("RateLimit-Policy"))
+
+	assert.Equal(t, http.StatusOK, SendRateLimitedRequest(router, http.MethodGet, "10.0.0.1").Code)
+	response := SendRateLimitedRequest(router, http.MethodGet, "10.0.0.1")
+
+	var problem api.Problem
+	json.Unmarshal(response.Body.Bytes(), &problem)
+	assert.Equal(t, http.StatusTooManyRequests, response.Code)
+	assert.Equal(t, api.KindTooManyRequests.Type, problem.Type)
+	assert.Equal(t, "0", response.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "1", response.Header().Get("Retry-After"))
+
+	assert.Equal(t, http.StatusOK, SendRateLimitedRequest(router, http.MethodGet, "10.0.0.2").Code, "other clients keep their own bucket")
+}
+
+func TestRateLimitMiddleware_ReadsAndWrites_SeparateLimits(t *testing.T) {
+	config := api.RateLimitConfig{
+		Enabled: true,
+		Read:    api.RateLimitRule{RequestsPerMinute: 60},
+		Write:   api.RateLimitRule{RequestsPerMinute: 1},
+	}
+	router := InitRateLimitRouter(config, NewInMemoryRateLimitStore(), nil)
+
+	assert.Equal(t, http.StatusOK, SendRateLimitedRequest(router, http.MethodPost, "10.0.0.1").Code)
+	assert.Equal(t, http.StatusTooManyRequests, SendRateLimitedRequest(router, http.MethodPost, "10.0.0.1").Code)
+	assert.Equal(t, http.StatusOK, SendRateLimitedRequest(router, http.MethodGet, "10.0.0.1").Code)
+}
+
+func TestRateLimitMiddleware_ClientOverride_ApplyToApiKey(t *testing.T) {
+	config := api.RateLimitConfig{
+		Enabled: true,
+		Read:    api.RateLimitRule{RequestsPerMinute: 1},
+		Clients: map[string]api.RateLimitRules{"key-1": {Read: &api.RateLimitRule{RequestsPerMinute: 600, Burst: 50}}},
+	}
+	store := NewInMemoryRateLimitStore()
+	principal := &api.Principal{Subject: "billing", Method: authModeApiKey, Claims: map[string]any{"apiKeyId": "key-1"}}
+	router := InitRateLimitRouter(config, store, principal)
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, SendRateLimitedRequest(router, http.MethodGet, "10.0.0.1").Code)
+	}
+	assert.Contains(t, store.Buckets, "read:apikey:key-1")
+	assert.NotContains(t, store.Buckets, "read:ip:10.0.0.1")
+}
+
+func TestIpRateLimitMiddleware_InvalidCredentials_LimitedBeforeAuthentication(t *testing.T) {
+	logger, _ := NewLogger(api.LoggingConfig{}, &bytes.Buffer{}, nil)
+	limiter := NewRateLimiter(api.RateLimitConfig{Enabled: true, Read: api.RateLimitRule{RequestsPerMinute: 1, Burst: 2}}, NewInMemoryRateLimitStore(), logger)
+	router := gin.New()
+	router.Use(NewIpRateLimitMiddleware(limiter), NewAuthMiddleware([]Authenticator{NewApiKeyAuthenticator(NewInMemoryApiKeyStore(), logger)}))
+	router.POST("/albums", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	send := func() int {
+		request, _ := http.NewRequest(http.MethodPost, "/albums", nil)
+		request.RemoteAddr = "10.0.0.1:1234"
+		request.Header.Set(ApiKeyHeader, "id.secret")
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		return response.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, send())
+	assert.Equal(t, http.StatusUnauthorized, send())
+	assert.Equal(t, http.StatusTooManyRequests, send(), "the ip limit defaults to the read rule")
+}
+
+func TestRateLimitMiddleware_StoreFailure_AllowRequest(t *testing.T) {
+	config := api.RateLimitConfig{Enabled: true, Read: api.RateLimitRule{RequestsPerMinute: 1}}
+	router := InitRateLimitRouter(config, failingRateLimitStore{}, nil)
+
+	response := SendRateLimitedRequest(router, http.MethodGet, "10.0.0.1")
+
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Empty(t, response.Header().Get("RateLimit-Limit"))
+}
+
+func TestTakeRateLimitToken_TimeElapsed_RefillUpToBurst(t *testing.T) {
+	rule := api.RateLimitRule{RequestsPerMinute: 60, Burst: 5}
+	now := time.Now()
+	bucket := api.RateLimitBucket{Tokens: 0.5, Revision: 3, UpdatedAt: now}
+
+	result := takeRateLimitToken(&bucket, rule, now)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 500*time.Millisecond, result.RetryAfter)
+
+	result = takeRateLimitToken(&bucket, rule, now.Add(2*time.Second))
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 1, result.Remaining)
+	assert.Equal(t, int64(5), bucket.Revision)
+	assert.InDelta(t, 1.5, bucket.Tokens, 0.001)
+
+	result = takeRateLimitToken(&bucket, rule, now.Add(time.Hour))
+	assert.Equal(t, 4, result.Remaining)
+	assert.Equal(t, time.Second, result.Reset)
+}
+
+func TestSqliteRateLimitStore_ConcurrentRevision_RejectStaleWrite(t *testing.T) {
+	store := NewSqlRateLimitStore(&InitSqliteService(t, ":memory:").SqlService)
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Millisecond)
+	bucket := api.RateLimitBucket{Key: "read:ip:10.0.0.1", Tokens: 4, Revision: 1, UpdatedAt: now, ExpiresAt: now.Add(time.Minute)}
+
+	saved, err := store.PutBucket(ctx, bucket, 0)
+	assert.Nil(t, err)
+	assert.True(t, saved)
+	saved, _ = store.PutBucket(ctx, bucket, 0)
+	assert.False(t, saved, "a bucket created meanwhile must not be overwritten")
+
+	bucket.Tokens, bucket.Revision = 3, 2
+	saved, _ = store.PutBucket(ctx, bucket, 1)
+	assert.True(t, saved)
+	saved, _ = store.PutBucket(ctx, bucket, 1)
+	assert.False(t, saved, "a bucket updated meanwhile must not be overwritten")
+
+	stored, err := store.GetBucket(ctx, bucket.Key)
+	assert.Nil(t, err)
+	assert.Equal(t, bucket, *stored)
+}
+
+type failingRateLimitStore struct{}
+
+func (failingRateLimitStore) GetBucket(ctx context.Context, key string) (*api.RateLimitBucket, error) {
+	return nil, errors.New("connection refused")
+}
+
+func (failingRateLimitStore) PutBucket(ctx context.Context, bucket api.RateLimitBucket, revision int64) (bool, error) {
+	return false, errors.New("connection refused")
+}
@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net"
+)
+
+// NewErrorResponse maps a backend error into a HandlerResponse, reporting
+// cancelled requests as 499, expired deadlines as 504 and unreachable
+// backends as 503. Any other error is a 500 whose detail doesn't leak driver
+// messages, the driver error stays available as the Cause.
+func NewErrorResponse(err error) api.HandlerResponse {
+	var apiErr *api.Error
+	var netErr net.Error
+	isNetErr := errors.As(err, &netErr)
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr.Response()
+	case errors.Is(err, context.Canceled):
+		return newError(api.KindRequestCancelled, "request cancelled", err).Response()
+	case errors.Is(err, context.DeadlineExceeded), isNetErr && netErr.Timeout():
+		return newError(api.KindTimeout, "backend query timed out", err).Response()
+	case isNetErr, errors.Is(err, driver.ErrBadConn):
+		return newError(api.KindBackendUnavailable, "backend is unreachable", err).Response()
+	default:
+		return newError(api.KindInternal, "backend request failed", err).Response()
+	}
+}
+
+func newError(kind api.ErrorKind, detail string, cause error) *api.Error {
+	return &api.Error{Kind: kind, Detail: detail, Cause: cause}
+}
+
+func notFoundResponse() api.HandlerResponse {
+	return api.ErrAlbumNotFound.Response()
+}
+
+func versionMismatchResponse() api.HandlerResponse {
+	return api.NewError(api.KindPreconditionFailed, "album data version does not match").Response()
+}
@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// NewSqlApiKeyStore keeps keys in the api_keys table of the albums database.
+// Scopes and roles are stored space separated and times as unix milliseconds, 0 for
+// a zero time.
+func NewSqlApiKeyStore(service *SqlService) *SqlApiKeyStore {
+	return &SqlApiKeyStore{
+		Db:      service.Db,
+		Timeout: service.Timeout,
+		Dialect: service.Dialect,
+	}
+}
+
+type SqlApiKeyStore struct {
+	Db      *sql.DB
+	Timeout *QueryTimeout
+	Dialect sqlDialect
+}
+
+func (this *SqlApiKeyStore) GetApiKey(ctx context.Context, id string) (*api.ApiKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	var key api.ApiKey
+	var scopes, roles string
+	var timeCreated, notBefore, expiresAt, lastUsedAt int64
+	err := this.Db.QueryRowContext(
+		ctx,
+		this.Dialect.Rebind("SELECT id, hash, subject, scopes, roles, tenant, time_created, not_before, expires_at, last_used_at FROM api_keys WHERE id = ?"),
+		id,
+	).Scan(&key.Id, &key.Hash, &key.Subject, &scopes, &roles, &key.Tenant, &timeCreated, &notBefore, &expiresAt, &lastUsedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key.Scopes = strings.Fields(scopes)
+	key.Roles = strings.Fields(roles)
+	key.TimeCreated = fromUnixMilli(timeCreated)
+	key.NotBefore = fromUnixMilli(notBefore)
+	key.ExpiresAt = fromUnixMilli(expiresAt)
+	key.LastUsedAt = fromUnixMilli(lastUsedAt)
+
+	return &key, nil
+}
+
+func (this *SqlApiKeyStore) PutApiKey(ctx context.Context, key api.ApiKey) error {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	_, err := this.Db.ExecContext(
+		ctx,
+		this.Dialect.Rebind(`INSERT INTO api_keys (id, hash, subject, scopes, roles, tenant, time_created, not_before, expires_at, last_used_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			hash = excluded.hash,
+			subject = excluded.subject,
+			scopes = excluded.scopes,
+			roles = excluded.roles,
+			tenant = excluded.tenant,
+			time_created = excluded.time_created,
+			not_before = excluded.not_before,
+			expires_at = excluded.expires_at,
+			last_used_at = excluded.last_used_at`),
+		key.Id, key.Hash, key.Subject, strings.Join(key.Scopes, " "), strings.Join(key.Roles, " "), key.Tenant,
+		toUnixMilli(key.TimeCreated), toUnixMilli(key.NotBefore), toUnixMilli(key.ExpiresAt), toUnixMilli(key.LastUsedAt),
+	)
+	return err
+}
+
+func (this *SqlApiKeyStore) TouchApiKey(ctx context.Context, id string, usedAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	_, err := this.Db.ExecContext(ctx, this.Dialect.Rebind("UPDATE api_keys SET last_used_at = ? WHERE id = ?"), toUnixMilli(usedAt), id)
+	return err
+}
+
+func toUnixMilli(value time.Time) int64 {
+	if value.IsZero() {
+		return 0
+	}
+	return value.UnixMilli()
+}
+
+func fromUnixMilli(value int64) time.Time {
+	if value == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(value)
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"database/sql"
+	"encoding/json"
+)
+
+// NewSqlAuditSink keeps records in the audit_log table of the albums
+// database, album snapshots being stored as JSON.
+func NewSqlAuditSink(service *SqlService) *SqlAuditSink {
+	return &SqlAuditSink{
+		Db:      service.Db,
+		Timeout: service.Timeout,
+		Dialect: service.Dialect,
+	}
+}
+
+type SqlAuditSink struct {
+	Db      *sql.DB
+	Timeout *QueryTimeout
+	Dialect sqlDialect
+}
+
+func (this *SqlAuditSink) Append(ctx context.Context, record api.AuditRecord) error {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	before, err := marshalAuditSnapshot(record.Before)
+	if err != nil {
+		return err
+	}
+	after, err := marshalAuditSnapshot(record.After)
+	if err != nil {
+		return err
+	}
+
+	_, err = this.Db.ExecContext(
+		ctx,
+		this.Dialect.Rebind(`INSERT INTO audit_log (id, tenant_id, album_id, action, actor, method, request_id, time, before, after, unverified)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		record.Id, record.Tenant, record.AlbumId, record.Action, record.Actor, record.Method, record.RequestId, record.Time, before, after, record.Unverified,
+	)
+	return err
+}
+
+func (this *SqlAuditSink) Query(ctx context.Context, query api.AuditQuery) ([]api.AuditRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	statement := "SELECT id, tenant_id, album_id, action, actor, method, request_id, time, before, after, unverified FROM audit_log WHERE tenant_id = ? AND time >= ?"
+	args := []any{query.Tenant, query.Since}
+	if query.AlbumId != "" {
+		statement += " AND album_id = ?"
+		args = append(args, query.AlbumId)
+	}
+	if query.Actor != "" {
+		statement += " AND actor = ?"
+		args = append(args, query.Actor)
+	}
+	statement += " ORDER BY time, id LIMIT ?"
+	args = append(args, query.Limit)
+
+	rows, err := this.Db.QueryContext(ctx, this.Dialect.Rebind(statement), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []api.AuditRecord{}
+	for rows.Next() {
+		var record api.AuditRecord
+		var before, after sql.NullString
+		err := rows.Scan(&record.Id, &record.Tenant, &record.AlbumId, &record.Action, &record.Actor, &record.Method, &record.RequestId, &record.Time, &before, &after, &record.Unverified)
+		if err != nil {
+			return nil, err
+		}
+		if record.Before, err = unmarshalAuditSnapshot(before); err != nil {
+			return nil, err
+		}
+		if record.After, err = unmarshalAuditSnapshot(after); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
+func marshalAuditSnapshot(album *api.Album) (sql.NullString, error) {
+	if album == nil {
+		return sql.NullString{}, nil
+	}
+	raw, err := json.Marshal(album)
+	return sql.NullString{String: string(raw), Valid: err == nil}, err
+}
+
+func unmarshalAuditSnapshot(raw sql.NullString) (*api.Album, error) {
+	if !raw.Valid {
+		return nil, nil
+	}
+	var album api.Album
+	if err := json.Unmarshal([]byte(raw.String), &album); err != nil {
+		return nil, err
+	}
+	return &album, nil
+}
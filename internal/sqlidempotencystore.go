@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// NewSqlIdempotencyStore keeps records in the idempotency_keys table of the
+// albums database, expired rows are dropped when their key is claimed again.
+func NewSqlIdempotencyStore(service *SqlService) *SqlIdempotencyStore {
+	return &SqlIdempotencyStore{
+		Db:      service.Db,
+		Timeout: service.Timeout,
+		Dialect: service.Dialect,
+	}
+}
+
+type SqlIdempotencyStore struct {
+	Db      *sql.DB
+	Timeout *QueryTimeout
+	Dialect sqlDialect
+}
+
+func (this *SqlIdempotencyStore) Reserve(ctx context.Context, record api.IdempotencyRecord) (*api.IdempotencyRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	header, err := json.Marshal(record.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := this.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, this.Dialect.Rebind("DELETE FROM idempotency_keys WHERE key = ? AND expires_at <= ?"), record.Key, time.Now().UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := tx.ExecContext(
+		ctx,
+		this.Dialect.Rebind(`INSERT INTO idempotency_keys (key, fingerprint, status_code, header, body, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT (key) DO NOTHING`),
+		record.Key, record.Fingerprint, record.StatusCode, string(header), record.Body, record.ExpiresAt.UnixMilli(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if inserted > 0 {
+		return nil, tx.Commit()
+	}
+
+	var existing api.IdempotencyRecord
+	var existingHeader string
+	var expiresAt int64
+	err = tx.QueryRowContext(
+		ctx,
+		this.Dialect.Rebind("SELECT key, fingerprint, status_code, header, body, expires_at FROM idempotency_keys WHERE key = ?"),
+		record.Key,
+	).Scan(&existing.Key, &existing.Fingerprint, &existing.StatusCode, &existingHeader, &existing.Body, &expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(existingHeader), &existing.Header); err != nil {
+		return nil, err
+	}
+	existing.ExpiresAt = time.UnixMilli(expiresAt)
+
+	return &existing, tx.Commit()
+}
+
+func (this *SqlIdempotencyStore) Complete(ctx context.Context, record api.IdempotencyRecord) error {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	header, err := json.Marshal(record.Header)
+	if err != nil {
+		return err
+	}
+
+	_, err = this.Db.ExecContext(
+		ctx,
+		this.Dialect.Rebind(`INSERT INTO idempotency_keys (key, fingerprint, status_code, header, body, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			fingerprint = excluded.fingerprint,
+			status_code = excluded.status_code,
+			header = excluded.header,
+			body = excluded.body,
+			expires_at = excluded.expires_at`),
+		record.Key, record.Fingerprint, record.StatusCode, string(header), record.Body, record.ExpiresAt.UnixMilli(),
+	)
+	return err
+}
+
+func (this *SqlIdempotencyStore) Release(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	_, err := this.Db.ExecContext(ctx, this.Dialect.Rebind("DELETE FROM idempotency_keys WHERE key = ?"), key)
+	return err
+}
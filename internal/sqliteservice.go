@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+func init() {
+	api.RegisterBackend(api.Backend{
+		Name:         "sqlite",
+		Description:  "embedded SQLite database file, schema is migrated on startup",
+		ConfigKey:    "sqliteConfig",
+		ConfigSchema: api.SqliteConfig{},
+		NewService: func(config api.AppConfig, idGen api.IdGenerator) (api.Service, error) {
+			service, err := NewSqliteService(config, idGen)
+			if err != nil {
+				return nil, err
+			}
+			return service, nil
+		},
+		NewIdempotencyStore: func(config api.AppConfig, service api.Service) (api.IdempotencyStore, error) {
+			return NewSqlIdempotencyStore(&service.(*SqliteService).SqlService), nil
+		},
+		NewApiKeyStore: func(config api.AppConfig, service api.Service) (api.ApiKeyStore, error) {
+			return NewSqlApiKeyStore(&service.(*SqliteService).SqlService), nil
+		},
+		NewRateLimitStore: func(config api.AppConfig, service api.Service) (api.RateLimitStore, error) {
+			return NewSqlRateLimitStore(&service.(*SqliteService).SqlService), nil
+		},
+		NewAuditSink: func(config api.AppConfig, service api.Service) (api.AuditSink, error) {
+			return NewSqlAuditSink(&service.(*SqliteService).SqlService), nil
+		},
+		ValidateConfig: func(config api.AppConfig) error {
+			return errors.Join(
+				requireConfig("sqliteConfig.path", config.SqliteConfig.Path),
+				requireConfig("sqliteConfig.queryTimeoutSeconds", config.SqliteConfig.QueryTimeoutSeconds),
+			)
+		},
+	})
+}
+
+// sqliteMigrations are applied in order by migrateSql. Append new migrations,
+// never edit the ones already released.
+var sqliteMigrations = [][]string{
+	{
+		`CREATE TABLE albums (
+			id           TEXT PRIMARY KEY,
+			title        TEXT NOT NULL,
+			artist       TEXT NOT NULL,
+			price        REAL NOT NULL,
+			time_created INTEGER NOT NULL,
+			time_updated INTEGER NOT NULL,
+			version      INTEGER NOT NULL
+		)`,
+	},
+	{
+		`CREATE INDEX idx_albums_artist_time_created ON albums (artist, time_created, id)`,
+		`CREATE INDEX idx_albums_time_created ON albums (time_created, id)`,
+	},
+	{
+		`CREATE TABLE idempotency_keys (
+			key         TEXT PRIMARY KEY,
+			fingerprint TEXT NOT NULL,
+			status_code INTEGER NOT NULL,
+			header      TEXT NOT NULL,
+			body        BLOB,
+			expires_at  INTEGER NOT NULL
+		)`,
+	},
+	{
+		`CREATE TABLE api_keys (
+			id           TEXT PRIMARY KEY,
+			hash         TEXT NOT NULL,
+			subject      TEXT NOT NULL,
+			scopes       TEXT NOT NULL,
+			time_created INTEGER NOT NULL,
+			not_before   INTEGER NOT NULL,
+			expires_at   INTEGER NOT NULL,
+			last_used_at INTEGER NOT NULL
+		)`,
+	},
+	{
+		`ALTER TABLE albums ADD COLUMN owner_id TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE api_keys ADD COLUMN roles TEXT NOT NULL DEFAULT ''`,
+	},
+	{
+		`ALTER TABLE albums ADD COLUMN tenant_id TEXT NOT NULL DEFAULT ''`,
+		`DROP INDEX idx_albums_artist_time_created`,
+		`DROP INDEX idx_albums_time_created`,
+		`CREATE INDEX idx_albums_tenant_artist_time_created ON albums (tenant_id, artist, time_created, id)`,
+		`CREATE INDEX idx_albums_tenant_time_created ON albums (tenant_id, time_created, id)`,
+		`ALTER TABLE api_keys ADD COLUMN tenant TEXT NOT NULL DEFAULT ''`,
+	},
+	{
+		`CREATE TABLE rate_limits (
+			key        TEXT PRIMARY KEY,
+			tokens     REAL NOT NULL,
+			revision   INTEGER NOT NULL,
+			updated_at INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL
+		)`,
+		`CREATE INDEX idx_rate_limits_expires_at ON rate_limits (expires_at)`,
+	},
+	{
+		`CREATE TABLE audit_log (
+			id         TEXT PRIMARY KEY,
+			tenant_id  TEXT NOT NULL,
+			album_id   TEXT NOT NULL,
+			action     TEXT NOT NULL,
+			actor      TEXT NOT NULL,
+			method     TEXT NOT NULL,
+			request_id TEXT NOT NULL,
+			time       INTEGER NOT NULL,
+			before     TEXT,
+			after      TEXT
+		)`,
+		`CREATE INDEX idx_audit_log_tenant_album_time ON audit_log (tenant_id, album_id, time, id)`,
+		`CREATE INDEX idx_audit_log_tenant_actor_time ON audit_log (tenant_id, actor, time, id)`,
+		`CREATE INDEX idx_audit_log_tenant_time ON audit_log (tenant_id, time, id)`,
+	},
+	{
+		`ALTER TABLE audit_log ADD COLUMN unverified INTEGER NOT NULL DEFAULT 0`,
+	},
+}
+
+var sqliteDialect = sqlDialect{
+	Name: "sqlite",
+	// instr is case sensitive, unlike LIKE
+	TitleContains: "instr(title, ?) > 0",
+}
+
+func NewSqliteService(config api.AppConfig, idGen api.IdGenerator) (*SqliteService, error) {
+	path := config.SqliteConfig.Path
+	if path == "" {
+		return nil, errors.New("sqliteConfig.path is required")
+	}
+	if path != ":memory:" {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	pragmas := url.Values{"_pragma": {
+		fmt.Sprintf("busy_timeout(%d)", config.SqliteConfig.BusyTimeoutMillis),
+		"journal_mode(WAL)",
+	}}
+	db, err := sql.Open("sqlite", "file:"+path+"?"+pragmas.Encode())
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer, sharing one connection serializes writes
+	// instead of failing them with SQLITE_BUSY, and keeps a :memory: database
+	// from being split across connections
+	db.SetMaxOpenConns(1)
+
+	timeout := time.Duration(config.SqliteConfig.QueryTimeoutSeconds) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := migrateSql(ctx, db, sqliteDialect, sqliteMigrations); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SqliteService{
+		SqlService: SqlService{
+			IdGen:   idGen,
+			Db:      db,
+			Timeout: NewQueryTimeout(timeout),
+			Dialect: sqliteDialect,
+		},
+	}, nil
+}
+
+type SqliteService struct {
+	SqlService
+}
+
+// ApplyConfig changes the query timeout of the calls that follow.
+func (this *SqliteService) ApplyConfig(config api.AppConfig) {
+	this.Timeout.Set(time.Duration(config.SqliteConfig.QueryTimeoutSeconds) * time.Second)
+}
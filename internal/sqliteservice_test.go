@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"andrewsaputra/go-rest-sample/api/servicetest"
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func InitSqliteService(t *testing.T, path string) *SqliteService {
+	config := api.AppConfig{
+		SqliteConfig: api.SqliteConfig{Path: path, BusyTimeoutMillis: 1000, QueryTimeoutSeconds: 5},
+	}
+	service, err := NewSqliteService(config, NewXidGenerator())
+	assert.Nil(t, err)
+	t.Cleanup(func() { service.Db.Close() })
+
+	return service
+}
+
+func TestSqliteService_Reopened_KeepDataAndSchemaVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "albums.db")
+	service := InitSqliteService(t, path)
+	props := api.AlbumPropertiesDTO{Title: "title 1", Artist: "artist 1", Price: 1.11}
+	albumResp := service.InsertAlbum(context.Background(), props).Body.Data.(api.Album)
+	service.Db.Close()
+
+	service = InitSqliteService(t, path)
+	response := service.GetAlbumById(context.Background(), albumResp.Id)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, albumResp, response.Body.Data)
+
+	var version int
+	service.Db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version)
+	assert.Equal(t, len(sqliteMigrations), version)
+}
+
+func TestSqliteIdempotencyStore_ReserveTwice_ReturnExistingRecord(t *testing.T) {
+	store := NewSqlIdempotencyStore(&InitSqliteService(t, ":memory:").SqlService)
+	record := api.IdempotencyRecord{Key: "key", Fingerprint: "fp", ExpiresAt: time.Now().Add(time.Hour)}
+
+	existing, err := store.Reserve(context.Background(), record)
+	assert.Nil(t, err)
+	assert.Nil(t, existing)
+
+	record.StatusCode = http.StatusOK
+	record.Header = http.Header{"Content-Type": {"application/json"}}
+	record.Body = []byte(`{}`)
+	assert.Nil(t, store.Complete(context.Background(), record))
+
+	existing, err = store.Reserve(context.Background(), api.IdempotencyRecord{Key: "key", ExpiresAt: time.Now().Add(time.Hour)})
+	assert.Nil(t, err)
+	assert.Equal(t, "fp", existing.Fingerprint)
+	assert.Equal(t, http.StatusOK, existing.StatusCode)
+	assert.Equal(t, record.Header, existing.Header)
+	assert.Equal(t, record.Body, existing.Body)
+
+	assert.Nil(t, store.Release(context.Background(), "key"))
+	existing, err = store.Reserve(context.Background(), record)
+	assert.Nil(t, err)
+	assert.Nil(t, existing)
+}
+
+func TestSqliteServiceGetAlbums_CursorValueOfWrongType_ReturnBadRequest(t *testing.T) {
+	service := InitSqliteService(t, ":memory:")
+	cursor, _ := encodeCursor(sqlCursor{Sort: "timeCreated", Values: []any{"not a time"}, Id: "id"})
+
+	response := service.GetAlbums(context.Background(), api.AlbumQueryDTO{Limit: 2, Cursor: cursor})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+}
+
+func TestSqliteService_FailedRowQuery_RecordSpanError(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	SetGlobalTracing(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { SetGlobalTracing(noop.NewTracerProvider()) })
+	service := InitSqliteService(t, ":memory:")
+
+	var count int
+	err := service.queryRow(context.Background(), "SELECT COUNT(*) FROM missing").Scan(&count)
+	assert.NotNil(t, err)
+	service.GetAlbumById(context.Background(), "missing")
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, codes.Error, spans[0].Status.Code)
+	assert.Len(t, spans[0].Events, 1, "the error is recorded as an event")
+	assert.Equal(t, codes.Unset, spans[1].Status.Code, "a missing row is not a failure")
+}
+
+func TestSqliteService_Conformance(t *testing.T) {
+	servicetest.Run(t, func(t *testing.T) api.Service {
+		return InitSqliteService(t, filepath.Join(t.TempDir(), "albums.db"))
+	})
+}
@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+)
+
+// NewSqlRateLimitStore keeps buckets in the rate_limits table of the albums
+// database, rows full again are deleted now and then.
+func NewSqlRateLimitStore(service *SqlService) *SqlRateLimitStore {
+	return &SqlRateLimitStore{
+		Db:      service.Db,
+		Timeout: service.Timeout,
+		Dialect: service.Dialect,
+	}
+}
+
+type SqlRateLimitStore struct {
+	Db      *sql.DB
+	Timeout *QueryTimeout
+	Dialect sqlDialect
+
+	mutex     sync.Mutex
+	lastSweep time.Time
+}
+
+func (this *SqlRateLimitStore) GetBucket(ctx context.Context, key string) (*api.RateLimitBucket, error) {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	bucket := api.RateLimitBucket{Key: key}
+	var updatedAt, expiresAt int64
+	err := this.Db.QueryRowContext(
+		ctx,
+		this.Dialect.Rebind("SELECT tokens, revision, updated_at, expires_at FROM rate_limits WHERE key = ?"),
+		key,
+	).Scan(&bucket.Tokens, &bucket.Revision, &updatedAt, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	bucket.UpdatedAt = time.UnixMilli(updatedAt)
+	bucket.ExpiresAt = time.UnixMilli(expiresAt)
+	return &bucket, nil
+}
+
+func (this *SqlRateLimitStore) PutBucket(ctx context.Context, bucket api.RateLimitBucket, revision int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	if err := this.sweep(ctx); err != nil {
+		return false, err
+	}
+
+	var result sql.Result
+	var err error
+	if revision == 0 {
+		result, err = this.Db.ExecContext(
+			ctx,
+			this.Dialect.Rebind(`INSERT INTO rate_limits (key, tokens, revision, updated_at, expires_at)
+			VALUES (?, ?, ?, ?, ?) ON CONFLICT (key) DO NOTHING`),
+			bucket.Key, bucket.Tokens, bucket.Revision, bucket.UpdatedAt.UnixMilli(), bucket.ExpiresAt.UnixMilli(),
+		)
+	} else {
+		result, err = this.Db.ExecContext(
+			ctx,
+			this.Dialect.Rebind("UPDATE rate_limits SET tokens = ?, revision = ?, updated_at = ?, expires_at = ? WHERE key = ? AND revision = ?"),
+			bucket.Tokens, bucket.Revision, bucket.UpdatedAt.UnixMilli(), bucket.ExpiresAt.UnixMilli(), bucket.Key, revision,
+		)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// sweep deletes the buckets full again, at most once per rateLimitSweepInterval.
+func (this *SqlRateLimitStore) sweep(ctx context.Context) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(this.lastSweep) < rateLimitSweepInterval {
+		return nil
+	}
+
+	_, err := this.Db.ExecContext(ctx, this.Dialect.Rebind("DELETE FROM rate_limits WHERE expires_at <= ?"), now.UnixMilli())
+	if err == nil {
+		this.lastSweep = now
+	}
+	return err
+}
@@ -0,0 +1,501 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// sqlDialect holds what differs between the SQL databases sharing SqlService.
+// Statements are written with ? placeholders and rebound for the dialect.
+type sqlDialect struct {
+	Name string
+	// NumberedPlaceholders rewrites ? as $1, $2, ...
+	NumberedPlaceholders bool
+	// TitleContains is a case sensitive substring match of the title against
+	// a single placeholder, LIKE is case insensitive on some databases
+	TitleContains string
+	// LockMigrations is run at the start of every migration transaction so
+	// that concurrently starting instances apply each migration once
+	LockMigrations string
+	// TranslateError maps driver errors onto the context errors NewErrorResponse understands
+	TranslateError func(err error) error
+}
+
+func (this sqlDialect) Rebind(statement string) string {
+	if !this.NumberedPlaceholders {
+		return statement
+	}
+
+	var builder strings.Builder
+	n := 0
+	for _, r := range statement {
+		if r == '?' {
+			n++
+			builder.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		builder.WriteRune(r)
+	}
+
+	return builder.String()
+}
+
+const sqlAlbumColumns = "id, title, artist, price, time_created, time_updated, version, owner_id"
+
+// SqlService implements api.Service over database/sql, the backend specific
+// services embed it with their dialect and migrations.
+type SqlService struct {
+	IdGen   api.IdGenerator
+	Db      *sql.DB
+	Timeout *QueryTimeout
+	Dialect sqlDialect
+}
+
+// migrateSql brings the schema up to the latest entry in migrations. Migration
+// i+1 is recorded in schema_migrations once all of its statements succeed.
+func migrateSql(ctx context.Context, db *sql.DB, dialect sqlDialect, migrations [][]string) error {
+	for {
+		applied, err := applyNextMigration(ctx, db, dialect, migrations)
+		if err != nil || !applied {
+			return err
+		}
+	}
+}
+
+func applyNextMigration(ctx context.Context, db *sql.DB, dialect sqlDialect, migrations [][]string) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if dialect.LockMigrations != "" {
+		if _, err := tx.ExecContext(ctx, dialect.LockMigrations); err != nil {
+			return false, err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return false, err
+	}
+
+	var current int
+	if err := tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return false, err
+	}
+	if current >= len(migrations) {
+		return false, tx.Commit()
+	}
+
+	for _, statement := range migrations[current] {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return false, fmt.Errorf("%s migration %d: %w", dialect.Name, current+1, err)
+		}
+	}
+	_, err = tx.ExecContext(ctx, dialect.Rebind("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)"), current+1, time.Now().UnixMilli())
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+func (this *SqlService) query(ctx context.Context, statement string, args ...any) (*sql.Rows, error) {
+	ctx, span := this.startSpan(ctx, "query", statement)
+	defer span.End()
+
+	rows, err := this.Db.QueryContext(ctx, this.Dialect.Rebind(statement), args...)
+	recordError(span, err)
+	return rows, err
+}
+
+// queryRow leaves the span open until the row is scanned, since errors of a
+// single row query are only reported then.
+func (this *SqlService) queryRow(ctx context.Context, statement string, args ...any) *tracedRow {
+	ctx, span := this.startSpan(ctx, "query", statement)
+
+	return &tracedRow{Row: this.Db.QueryRowContext(ctx, this.Dialect.Rebind(statement), args...), Span: span}
+}
+
+type tracedRow struct {
+	Row  *sql.Row
+	Span trace.Span
+}
+
+// Scan ends the span, a missing row is an answer rather than a failure.
+func (this *tracedRow) Scan(dest ...any) error {
+	defer this.Span.End()
+
+	err := this.Row.Scan(dest...)
+	if !errors.Is(err, sql.ErrNoRows) {
+		recordError(this.Span, err)
+	}
+	return err
+}
+
+func (this *SqlService) exec(ctx context.Context, statement string, args ...any) (sql.Result, error) {
+	ctx, span := this.startSpan(ctx, "exec", statement)
+	defer span.End()
+
+	result, err := this.Db.ExecContext(ctx, this.Dialect.Rebind(statement), args...)
+	recordError(span, err)
+	return result, err
+}
+
+// startSpan starts the client span of a single statement, named after the
+// dialect like the spans of the mongo and dynamodb instrumentation.
+func (this *SqlService) startSpan(ctx context.Context, operation string, statement string) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, this.Dialect.Name+"."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemKey.String(this.Dialect.Name),
+			semconv.DBStatement(statement),
+		),
+	)
+}
+
+func (this *SqlService) errorResponse(err error) api.HandlerResponse {
+	if this.Dialect.TranslateError != nil {
+		err = this.Dialect.TranslateError(err)
+	}
+
+	return NewErrorResponse(err)
+}
+
+// sqlCursor holds the sort values and id of the last album on a page.
+type sqlCursor struct {
+	Sort   string
+	Values []any
+	Id     string
+}
+
+func (this *SqlService) GetAlbums(ctx context.Context, query api.AlbumQueryDTO) api.HandlerResponse {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	sortFields := resolveSort(query.Sort)
+	conditions, args := sqlAlbumFilter(api.TenantFromContext(ctx), query, this.Dialect)
+	if query.Cursor != "" {
+		var position sqlCursor
+		if err := decodeCursor(query.Cursor, &position); err != nil {
+			return invalidCursorResponse()
+		}
+		if position.Sort != sortSignature(sortFields) || len(position.Values) != len(sortFields) {
+			return invalidCursorResponse()
+		}
+		for i, field := range sortFields {
+			value, ok := albumSortKeys[field.Field].FromCursor(position.Values[i])
+			if !ok {
+				return invalidCursorResponse()
+			}
+			position.Values[i] = value
+		}
+
+		keyset, keysetArgs := sqlKeysetCondition(sortFields, position)
+		conditions = append(conditions, keyset)
+		args = append(args, keysetArgs...)
+	}
+
+	statement := "SELECT " + sqlAlbumColumns + " FROM albums WHERE " + strings.Join(conditions, " AND ")
+
+	orderBy := []string{}
+	for _, field := range sortFields {
+		column := albumSortKeys[field.Field].SqlColumn
+		if field.Descending {
+			column += " DESC"
+		}
+		orderBy = append(orderBy, column)
+	}
+	statement += " ORDER BY " + strings.Join(append(orderBy, "id"), ", ")
+
+	if query.Limit > 0 {
+		// one extra row tells whether another page exists
+		statement += " LIMIT ?"
+		args = append(args, query.Limit+1)
+	}
+
+	rows, err := this.query(ctx, statement, args...)
+	if err != nil {
+		return this.errorResponse(err)
+	}
+	defer rows.Close()
+
+	albums := []api.Album{}
+	for rows.Next() {
+		alb, err := scanSqlAlbum(rows)
+		if err != nil {
+			return this.errorResponse(err)
+		}
+
+		albums = append(albums, alb)
+	}
+	if err := rows.Err(); err != nil {
+		return this.errorResponse(err)
+	}
+
+	var next string
+	if query.Limit > 0 && len(albums) > query.Limit {
+		albums = albums[:query.Limit]
+		last := albums[len(albums)-1]
+		position := sqlCursor{Sort: sortSignature(sortFields), Id: last.Id}
+		for _, field := range sortFields {
+			position.Values = append(position.Values, albumSortKeys[field.Field].Value(last))
+		}
+		next, _ = encodeCursor(position)
+	}
+
+	return api.HandlerResponse{
+		Code: http.StatusOK,
+		Body: api.ResponseBody{
+			Data: albums,
+			Next: next,
+		},
+	}
+}
+
+// sqlKeysetCondition matches the albums ordered after position, comparing
+// the sort columns in turn and finally the id.
+func sqlKeysetCondition(fields []api.SortField, position sqlCursor) (string, []any) {
+	clauses := []string{}
+	args := []any{}
+	for i, field := range fields {
+		parts := []string{}
+		for j, prev := range fields[:i] {
+			parts = append(parts, albumSortKeys[prev.Field].SqlColumn+" = ?")
+			args = append(args, position.Values[j])
+		}
+
+		operator := " > ?"
+		if field.Descending {
+			operator = " < ?"
+		}
+		parts = append(parts, albumSortKeys[field.Field].SqlColumn+operator)
+		args = append(args, position.Values[i])
+		clauses = append(clauses, "("+strings.Join(parts, " AND ")+")")
+	}
+
+	tieBreak := []string{}
+	for i, field := range fields {
+		tieBreak = append(tieBreak, albumSortKeys[field.Field].SqlColumn+" = ?")
+		args = append(args, position.Values[i])
+	}
+	tieBreak = append(tieBreak, "id > ?")
+	args = append(args, position.Id)
+	clauses = append(clauses, "("+strings.Join(tieBreak, " AND ")+")")
+
+	return "(" + strings.Join(clauses, " OR ") + ")", args
+}
+
+func sqlAlbumFilter(tenant string, query api.AlbumQueryDTO, dialect sqlDialect) ([]string, []any) {
+	conditions := []string{"tenant_id = ?"}
+	args := []any{tenant}
+	if query.Artist != "" {
+		conditions = append(conditions, "artist = ?")
+		args = append(args, query.Artist)
+	}
+	if query.TitleContains != "" {
+		conditions = append(conditions, dialect.TitleContains)
+		args = append(args, query.TitleContains)
+	}
+	if query.MinPrice > 0 {
+		conditions = append(conditions, "price >= ?")
+		args = append(args, query.MinPrice)
+	}
+	if query.MaxPrice > 0 {
+		conditions = append(conditions, "price <= ?")
+		args = append(args, query.MaxPrice)
+	}
+	if query.CreatedAfter > 0 {
+		conditions = append(conditions, "time_created > ?")
+		args = append(args, query.CreatedAfter)
+	}
+
+	return conditions, args
+}
+
+func (this *SqlService) GetAlbumById(ctx context.Context, id string) api.HandlerResponse {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	row := this.queryRow(ctx, "SELECT "+sqlAlbumColumns+" FROM albums WHERE tenant_id = ? AND id = ?", api.TenantFromContext(ctx), id)
+	alb, err := scanSqlAlbum(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return notFoundResponse()
+		}
+
+		return this.errorResponse(err)
+	}
+
+	return api.HandlerResponse{
+		Code: http.StatusOK,
+		Body: api.ResponseBody{Data: alb},
+	}
+}
+
+func (this *SqlService) InsertAlbum(ctx context.Context, props api.AlbumPropertiesDTO) api.HandlerResponse {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	now := time.Now().UnixMilli()
+	newData := api.Album{
+		Id:          this.IdGen.NextId(),
+		Title:       props.Title,
+		Artist:      props.Artist,
+		Price:       props.Price,
+		TimeCreated: now,
+		TimeUpdated: now,
+		Version:     1,
+		OwnerId:     api.SubjectFromContext(ctx),
+	}
+
+	_, err := this.exec(
+		ctx,
+		"INSERT INTO albums ("+sqlAlbumColumns+", tenant_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		newData.Id, newData.Title, newData.Artist, newData.Price, newData.TimeCreated, newData.TimeUpdated, newData.Version, newData.OwnerId,
+		api.TenantFromContext(ctx),
+	)
+	if err != nil {
+		return this.errorResponse(err)
+	}
+
+	return api.HandlerResponse{
+		Code: http.StatusOK,
+		Body: api.ResponseBody{Data: newData, Message: "new album data created"},
+	}
+}
+
+func (this *SqlService) ReplaceAlbum(ctx context.Context, id string, props api.AlbumPropertiesDTO, expectedVersion int64) api.HandlerResponse {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	assignments := []string{"title = ?", "artist = ?", "price = ?"}
+	args := []any{props.Title, props.Artist, props.Price}
+
+	return this.updateAlbum(ctx, id, assignments, args, expectedVersion, "album data replaced")
+}
+
+func (this *SqlService) UpdateAlbum(ctx context.Context, id string, updates api.AlbumUpdatesDTO, expectedVersion int64) api.HandlerResponse {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	assignments := []string{}
+	args := []any{}
+	if updates.Title != "" {
+		assignments = append(assignments, "title = ?")
+		args = append(args, updates.Title)
+	}
+	if updates.Artist != "" {
+		assignments = append(assignments, "artist = ?")
+		args = append(args, updates.Artist)
+	}
+	if updates.Price > 0 {
+		assignments = append(assignments, "price = ?")
+		args = append(args, updates.Price)
+	}
+
+	return this.updateAlbum(ctx, id, assignments, args, expectedVersion, "album data updated")
+}
+
+// updateAlbum applies assignments to the album, bumping its version and update time.
+func (this *SqlService) updateAlbum(ctx context.Context, id string, assignments []string, args []any, expectedVersion int64, message string) api.HandlerResponse {
+	assignments = append(assignments, "time_updated = ?", "version = version + 1")
+	args = append(args, time.Now().UnixMilli())
+
+	condition, conditionArgs := sqlVersionCondition(api.TenantFromContext(ctx), id, expectedVersion)
+	statement := "UPDATE albums SET " + strings.Join(assignments, ", ") +
+		" WHERE " + condition +
+		" RETURNING " + sqlAlbumColumns
+
+	row := this.queryRow(ctx, statement, append(args, conditionArgs...)...)
+	alb, err := scanSqlAlbum(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return this.notMatchedResponse(ctx, id, expectedVersion)
+		}
+
+		return this.errorResponse(err)
+	}
+
+	return api.HandlerResponse{
+		Code: http.StatusOK,
+		Body: api.ResponseBody{Data: alb, Message: message},
+	}
+}
+
+func (this *SqlService) DeleteAlbum(ctx context.Context, id string, expectedVersion int64) api.HandlerResponse {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout.Get())
+	defer cancel()
+
+	condition, args := sqlVersionCondition(api.TenantFromContext(ctx), id, expectedVersion)
+	result, err := this.exec(ctx, "DELETE FROM albums WHERE "+condition, args...)
+	if err != nil {
+		return this.errorResponse(err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return this.errorResponse(err)
+	}
+	if deleted == 0 {
+		return this.notMatchedResponse(ctx, id, expectedVersion)
+	}
+
+	return api.HandlerResponse{
+		Code: http.StatusOK,
+		Body: api.ResponseBody{Message: "album data removed"},
+	}
+}
+
+// Close closes the connection pool once the queries in progress are done.
+func (this *SqlService) Close(ctx context.Context) error {
+	return this.Db.Close()
+}
+
+func (this *SqlService) CheckHealth(ctx context.Context) error {
+	return this.Db.PingContext(ctx)
+}
+
+func sqlVersionCondition(tenant string, id string, expectedVersion int64) (string, []any) {
+	if expectedVersion != 0 {
+		return "tenant_id = ? AND id = ? AND version = ?", []any{tenant, id, expectedVersion}
+	}
+
+	return "tenant_id = ? AND id = ?", []any{tenant, id}
+}
+
+// notMatchedResponse tells a missing album from a stale version once a write matched no rows.
+func (this *SqlService) notMatchedResponse(ctx context.Context, id string, expectedVersion int64) api.HandlerResponse {
+	if expectedVersion != 0 {
+		var count int
+		if err := this.queryRow(ctx, "SELECT COUNT(*) FROM albums WHERE tenant_id = ? AND id = ?", api.TenantFromContext(ctx), id).Scan(&count); err != nil {
+			return this.errorResponse(err)
+		}
+		if count > 0 {
+			return versionMismatchResponse()
+		}
+	}
+
+	return notFoundResponse()
+}
+
+func scanSqlAlbum(row interface{ Scan(dest ...any) error }) (api.Album, error) {
+	var alb api.Album
+	err := row.Scan(&alb.Id, &alb.Title, &alb.Artist, &alb.Price, &alb.TimeCreated, &alb.TimeUpdated, &alb.Version, &alb.OwnerId)
+	return alb, err
+}
@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultTenantHeader = "X-Tenant-ID"
+
+// tenantPattern keeps tenant names usable as key prefixes and subdomains.
+var tenantPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// NewTenantMiddleware scopes the request context to the tenant resolved as
+// described by api.TenancyConfig, see api.TenantFromContext. It runs after
+// authentication, so the tenant of the caller takes precedence.
+func NewTenantMiddleware(config api.TenancyConfig) gin.HandlerFunc {
+	header := config.Header
+	if header == "" {
+		header = defaultTenantHeader
+	}
+
+	return func(c *gin.Context) {
+		tenant, err := resolveTenant(c.Request, header, config)
+		if err != nil {
+			writeProblem(c, err.Kind.Status, err)
+			return
+		}
+
+		c.Request = c.Request.WithContext(api.ContextWithTenant(c.Request.Context(), tenant))
+		c.Next()
+	}
+}
+
+func resolveTenant(request *http.Request, header string, config api.TenancyConfig) (string, *api.Error) {
+	requested := request.Header.Get(header)
+	if requested == "" {
+		requested = subdomainTenant(request.Host, config.Domain)
+	}
+
+	tenant := requested
+	if principal := api.PrincipalFromContext(request.Context()); principal != nil {
+		// callers without a tenant of their own only get the default tenant
+		bound := principal.Tenant
+		if bound == "" {
+			bound = config.DefaultTenant
+		}
+		if bound == "" {
+			return "", api.NewError(api.KindForbidden, "caller isn't bound to a tenant")
+		}
+		if requested != "" && requested != bound {
+			return "", api.NewError(api.KindForbidden, "caller doesn't belong to tenant "+requested)
+		}
+		tenant = bound
+	}
+	if tenant == "" {
+		tenant = config.DefaultTenant
+	}
+
+	_, known := config.Tenants[tenant]
+	switch {
+	case tenant == "":
+		return "", fieldError(header, "required", "is required", nil)
+	case !tenantPattern.MatchString(tenant):
+		return "", fieldError(header, "tenant", "must be lowercase letters, digits and dashes", nil)
+	case len(config.Tenants) > 0 && !known:
+		return "", api.NewError(api.KindNotFound, "tenant "+tenant+" doesn't exist")
+	}
+
+	return tenant, nil
+}
+
+// subdomainTenant returns the label before domain in host, or an empty
+// string when host isn't a direct subdomain of domain.
+func subdomainTenant(host string, domain string) string {
+	if domain == "" {
+		return ""
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	label, found := strings.CutSuffix(strings.ToLower(host), "."+strings.ToLower(domain))
+	if !found || strings.Contains(label, ".") {
+		return ""
+	}
+	return label
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func InitTenantRouter(config api.TenancyConfig, principal *api.Principal) *gin.Engine {
+	router := gin.New()
+	router.GET("/albums", func(c *gin.Context) {
+		if principal != nil {
+			c.Request = c.Request.WithContext(api.ContextWithPrincipal(c.Request.Context(), principal))
+		}
+	}, NewTenantMiddleware(config), func(c *gin.Context) {
+		c.String(http.StatusOK, api.TenantFromContext(c.Request.Context()))
+	})
+	return router
+}
+
+func SendTenantRequest(router *gin.Engine, host string, tenant string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(http.MethodGet, "/albums", nil)
+	request.Host = host
+	if tenant != "" {
+		request.Header.Set(defaultTenantHeader, tenant)
+	}
+
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	return response
+}
+
+func TestTenantMiddleware_HeaderOrSubdomain_TenantInContext(t *testing.T) {
+	router := InitTenantRouter(api.TenancyConfig{Enabled: true, Domain: "albums.example"}, nil)
+
+	response := SendTenantRequest(router, "api.example", "acme")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "acme", response.Body.String())
+
+	response = SendTenantRequest(router, "globex.albums.example:8080", "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "globex", response.Body.String())
+
+	response = SendTenantRequest(router, "globex.albums.example", "acme")
+	assert.Equal(t, "acme", response.Body.String())
+}
+
+func TestTenantMiddleware_PrincipalTenant_TakePrecedence(t *testing.T) {
+	router := InitTenantRouter(api.TenancyConfig{Enabled: true}, &api.Principal{Subject: "user-1", Tenant: "acme"})
+
+	response := SendTenantRequest(router, "api.example", "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "acme", response.Body.String())
+
+	response = SendTenantRequest(router, "api.example", "globex")
+	var problem api.Problem
+	json.Unmarshal(response.Body.Bytes(), &problem)
+	assert.Equal(t, http.StatusForbidden, response.Code)
+	assert.Equal(t, api.KindForbidden.Type, problem.Type)
+}
+
+func TestTenantMiddleware_UnboundPrincipal_OnlyDefaultTenant(t *testing.T) {
+	principal := &api.Principal{Subject: "user-1"}
+	router := InitTenantRouter(api.TenancyConfig{Enabled: true}, principal)
+
+	assert.Equal(t, http.StatusForbidden, SendTenantRequest(router, "api.example", "acme").Code)
+	assert.Equal(t, http.StatusForbidden, SendTenantRequest(router, "api.example", "").Code)
+
+	router = InitTenantRouter(api.TenancyConfig{Enabled: true, DefaultTenant: "acme"}, principal)
+
+	response := SendTenantRequest(router, "api.example", "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "acme", response.Body.String())
+	assert.Equal(t, http.StatusForbidden, SendTenantRequest(router, "api.example", "globex").Code)
+}
+
+func TestTenantMiddleware_InvalidTenant_ReturnProblem(t *testing.T) {
+	config := api.TenancyConfig{
+		Enabled: true,
+		Tenants: map[string]api.TenantConfig{"acme": {}},
+	}
+	router := InitTenantRouter(config, nil)
+
+	assert.Equal(t, http.StatusBadRequest, SendTenantRequest(router, "api.example", "").Code)
+	assert.Equal(t, http.StatusBadRequest, SendTenantRequest(router, "api.example", "Acme#1").Code)
+	assert.Equal(t, http.StatusNotFound, SendTenantRequest(router, "api.example", "globex").Code)
+	assert.Equal(t, http.StatusOK, SendTenantRequest(router, "api.example", "acme").Code)
+
+	config.DefaultTenant = "acme"
+	response := SendTenantRequest(InitTenantRouter(config, nil), "api.example", "")
+	assert.Equal(t, "acme", response.Body.String())
+}
+
+func TestSubdomainTenant_NotDirectSubdomain_ReturnEmpty(t *testing.T) {
+	assert.Equal(t, "acme", subdomainTenant("ACME.albums.example", "albums.example"))
+	assert.Empty(t, subdomainTenant("albums.example", "albums.example"))
+	assert.Empty(t, subdomainTenant("eu.acme.albums.example", "albums.example"))
+	assert.Empty(t, subdomainTenant("acme.other.example", "albums.example"))
+	assert.Empty(t, subdomainTenant("acme.albums.example", ""))
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"andrewsaputra/go-rest-sample/api"
+	"context"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// instrumentationName names the tracer used for the spans started by this module.
+const instrumentationName = "andrewsaputra/go-rest-sample"
+
+const defaultServiceName = "go-rest-sample"
+
+// NewTracerProvider builds the provider for config.Exporter. The returned
+// function flushes buffered spans and must be called before exiting.
+func NewTracerProvider(config api.TracingConfig) (trace.TracerProvider, func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.Exporter {
+	case "", "off":
+		return noop.NewTracerProvider(), func(context.Context) error { return nil }, nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "otlp":
+		opts := []otlptracehttp.Option{}
+		if config.OtlpEndpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(config.OtlpEndpoint))
+		}
+		if config.OtlpInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	default:
+		return nil, nil, fmt.Errorf("unsupported tracing exporter %q, expected otlp, stdout or off", config.Exporter)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sampler := sdktrace.AlwaysSample()
+	if config.SampleRatio > 0 {
+		sampler = sdktrace.TraceIDRatioBased(config.SampleRatio)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(tracingServiceName(config)))),
+	)
+	return provider, provider.Shutdown, nil
+}
+
+// SetGlobalTracing makes provider the one used by the instrumented drivers and
+// handlers, and propagates W3C trace context and baggage.
+func SetGlobalTracing(provider trace.TracerProvider) {
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+// startSpan starts an internal span from the global provider, so spans follow
+// whatever provider main or a test installed.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// NewTracingMiddleware starts the server span of every request, continuing
+// the trace of an incoming traceparent header.
+func NewTracingMiddleware(config api.TracingConfig) gin.HandlerFunc {
+	return otelgin.Middleware(tracingServiceName(config))
+}
+
+func tracingServiceName(config api.TracingConfig) string {
+	if config.ServiceName == "" {
+		return defaultServiceName
+	}
+
+	return config.ServiceName
+}
+
+// recordResponse marks span as failed when resp carries an error.
+func recordResponse(span trace.Span, resp api.HandlerResponse) {
+	span.SetAttributes(semconv.HTTPStatusCode(resp.Code))
+	if resp.Error != nil {
+		span.SetStatus(codes.Error, resp.Error.Error())
+	}
+}
+
+// recordError marks span as failed with err, it is a no-op for a nil err.
+func recordError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
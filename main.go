@@ -3,11 +3,19 @@ package main
 import (
 	"andrewsaputra/go-rest-sample/api"
 	"andrewsaputra/go-rest-sample/internal"
-	"encoding/json"
+	"context"
 	"errors"
-	"log"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -15,67 +23,342 @@ import (
 
 var startTime time.Time = time.Now()
 
+const (
+	defaultConfigPath   = "configs/appconfig.json"
+	defaultDrainTimeout = 30 * time.Second
+	backendCloseTimeout = 5 * time.Second
+)
+
 func main() {
-	config, err := GetAppConfig("configs/appconfig.json")
+	configPath := flag.String("config", "", "path of the JSON config file, defaults to $"+internal.ConfigFileEnv+" or "+defaultConfigPath)
+	flag.Parse()
+
+	if err := run(resolveConfigPath(*configPath), flag.Args()); err != nil {
+		slog.Error("app stopped", slog.Any("error", err))
+		os.Exit(1)
+	}
+}
+
+// run starts the app, or the command of args, and returns once it stopped.
+// Errors are returned rather than exiting, so that the deferred cleanup runs.
+func run(path string, args []string) error {
+	config, err := GetAppConfig(path)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("failed to load config: %w", err)
 	}
 
+	logLevel := new(internal.LogLevel)
+	logger, err := internal.NewLogger(config.LoggingConfig, os.Stdout, logLevel)
+	if err != nil {
+		return fmt.Errorf("invalid logging config: %w", err)
+	}
+	slog.SetDefault(logger)
+
+	if len(args) > 0 && args[0] == "apikey" {
+		if err := RunApiKeyCommand(context.Background(), *config, args[1:], os.Stdout); err != nil {
+			return fmt.Errorf("apikey command failed: %w", err)
+		}
+		return nil
+	}
+
+	tracerProvider, shutdownTracing, err := internal.NewTracerProvider(config.TracingConfig)
+	if err != nil {
+		return fmt.Errorf("invalid tracing config: %w", err)
+	}
+	defer shutdownTracing(context.Background())
+	internal.SetGlobalTracing(tracerProvider)
+
 	idGenerator := internal.NewXidGenerator()
 	service, err := InitService(*config, idGenerator)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("failed to initialize %s backend: %w", config.DbType, err)
+	}
+	if indexed, ok := service.(internal.IndexedBackend); ok {
+		if err := indexed.CreateIndexes(context.Background()); err != nil {
+			return fmt.Errorf("failed to create %s indexes: %w", config.DbType, err)
+		}
 	}
 
-	handler := internal.NewApiHandler(service)
-	router := InitRouter(handler)
+	idempotencyStore, err := InitIdempotencyStore(*config, service)
+	if err != nil {
+		return fmt.Errorf("failed to initialize %s idempotency store: %w", config.DbType, err)
+	}
 
-	router.Run(":8080")
+	apiKeyStore, err := InitApiKeyStore(*config, service)
+	if err != nil {
+		return fmt.Errorf("failed to initialize %s api key store: %w", config.DbType, err)
+	}
+
+	var rateLimitStore api.RateLimitStore
+	if config.RateLimitConfig.Enabled {
+		rateLimitStore, err = InitRateLimitStore(*config, service)
+		if err != nil {
+			return fmt.Errorf("failed to initialize %s rate limit store: %w", config.DbType, err)
+		}
+	}
+
+	auditSink, err := InitAuditSink(*config, service)
+	if err != nil {
+		return fmt.Errorf("failed to initialize %s audit sink: %w", config.AuditConfig.Sink, err)
+	}
+	if closer, ok := auditSink.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	// api keys are only checked when they are used, their table may not exist otherwise
+	checkedApiKeyStore := apiKeyStore
+	if !slices.Contains(config.AuthConfig.Modes, "apiKey") {
+		checkedApiKeyStore = nil
+	}
+	dependencies := internal.HealthDependencies(service, idempotencyStore, checkedApiKeyStore, rateLimitStore, auditSink)
+	readiness := internal.NewReadinessChecker(config.HealthConfig, dependencies, logger)
+	reloadable := []internal.Reloadable{logLevel, readiness}
+	if backend, ok := service.(internal.Reloadable); ok {
+		reloadable = append(reloadable, backend)
+	}
+
+	var rateLimiter *internal.RateLimiter
+	if rateLimitStore != nil {
+		rateLimiter = internal.NewRateLimiter(config.RateLimitConfig, rateLimitStore, logger)
+		reloadable = append(reloadable, rateLimiter)
+	}
+
+	metrics := internal.NewMetrics()
+	metrics.RegisterAlbumCount(config.DbType, service)
+	service = internal.NewInstrumentedService(service, config.DbType, metrics, logger)
+	var auditHandler *internal.AuditHandler
+	if auditSink != nil {
+		service = internal.NewAuditedService(service, auditSink, idGenerator, logger)
+		auditHandler = internal.NewAuditHandler(auditSink, *config)
+	}
+	service = internal.NewAuthorizedService(service, *config, auditSink, idGenerator, logger)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	authenticators, err := internal.NewAuthenticators(ctx, config.AuthConfig, apiKeyStore, logger)
+	if err != nil {
+		return fmt.Errorf("failed to initialize authentication: %w", err)
+	}
+
+	handler := internal.NewApiHandler(service, *config)
+	router := InitRouter(*config, handler, idGenerator, idempotencyStore, authenticators, rateLimiter, auditHandler, readiness, metrics)
+
+	reloader := internal.NewConfigReloader(path, *config, reloadable, logger)
+	go reloader.Watch(ctx, time.Duration(config.ReloadConfig.WatchIntervalSeconds)*time.Second)
+
+	listener, err := net.Listen("tcp", config.ServerConfig.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	slog.Info("starting server", slog.String("addr", listener.Addr().String()), slog.String("backend", config.DbType))
+	if err := RunServer(ctx, &http.Server{Handler: router}, listener, readiness, service, config.ServerConfig); err != nil {
+		return fmt.Errorf("server stopped uncleanly: %w", err)
+	}
+	slog.Info("server stopped")
+	return nil
 }
 
+// GetAppConfig loads the config file at path, if any, with the APP_*
+// environment variables applied over it and validates the result.
 func GetAppConfig(path string) (*api.AppConfig, error) {
-	rawConfig, _ := os.ReadFile(path)
-	var config *api.AppConfig
-	err := json.Unmarshal(rawConfig, &config)
-	if err != nil {
-		return nil, err
+	return internal.LoadAppConfig(path, os.Environ())
+}
+
+// resolveConfigPath prefers the -config flag, then APP_CONFIG_FILE, which may
+// be set empty to configure from the environment only.
+func resolveConfigPath(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if path, ok := os.LookupEnv(internal.ConfigFileEnv); ok {
+		return path
+	}
+
+	return defaultConfigPath
+}
+
+// RunServer serves on listener until ctx is done, then drains: readiness
+// fails, new connections are still accepted for DrainDelayMillis, and
+// in-flight requests get DrainTimeoutSeconds to complete before the server
+// and the backend connections are closed.
+func RunServer(ctx context.Context, server *http.Server, listener net.Listener, readiness *internal.ReadinessChecker, service api.Service, config api.ServerConfig) error {
+	drainTimeout := time.Duration(config.DrainTimeoutSeconds) * time.Second
+	if drainTimeout <= 0 {
+		drainTimeout = defaultDrainTimeout
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return errors.Join(err, service.Close(context.Background()))
+	case <-ctx.Done():
+	}
+
+	slog.Info("draining requests", slog.Duration("timeout", drainTimeout))
+	if readiness != nil {
+		readiness.SetDraining()
 	}
+	time.Sleep(time.Duration(config.DrainDelayMillis) * time.Millisecond)
 
-	return config, nil
+	drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	var shutdownErr error
+	if err := server.Shutdown(drainCtx); err != nil {
+		shutdownErr = fmt.Errorf("requests still in flight after %s: %w", drainTimeout, err)
+		server.Close()
+	}
+	<-serveErr
+
+	closeCtx, cancelClose := context.WithTimeout(context.Background(), backendCloseTimeout)
+	defer cancelClose()
+	if err := service.Close(closeCtx); err != nil {
+		return errors.Join(shutdownErr, fmt.Errorf("failed to close backend: %w", err))
+	}
+
+	return shutdownErr
 }
 
+// InitService builds the backend registered under config.DbType.
 func InitService(config api.AppConfig, idGenerator api.IdGenerator) (api.Service, error) {
-	var service api.Service
-	var err error
+	backend, ok := api.LookupBackend(config.DbType)
+	if !ok {
+		var names []string
+		for _, info := range api.Backends() {
+			names = append(names, info.Name)
+		}
+		return nil, fmt.Errorf("%w dbType %q, available backends: %s", errors.ErrUnsupported, config.DbType, strings.Join(names, ", "))
+	}
 
-	switch config.DbType {
-	case "inmemory":
-		service, err = internal.NewInMemoryService(idGenerator)
-	case "mongodb":
-		service, err = internal.NewMongoDBService(config, idGenerator)
-	case "dynamodb":
-		service, err = internal.NewDynamoDbService(config.DynamoDbConfig, idGenerator)
-	default:
-		return nil, errors.ErrUnsupported
+	return backend.NewService(config, idGenerator)
+}
+
+// InitIdempotencyStore keeps Idempotency-Key records in the same backend as
+// the albums, falling back to memory for backends without a store of their own.
+func InitIdempotencyStore(config api.AppConfig, service api.Service) (api.IdempotencyStore, error) {
+	backend, ok := api.LookupBackend(config.DbType)
+	if !ok || backend.NewIdempotencyStore == nil {
+		return internal.NewInMemoryIdempotencyStore(), nil
 	}
 
-	if err != nil {
-		return nil, err
+	return backend.NewIdempotencyStore(config, service)
+}
+
+// InitApiKeyStore keeps API keys in the same backend as the albums, falling
+// back to memory for backends without a store of their own.
+func InitApiKeyStore(config api.AppConfig, service api.Service) (api.ApiKeyStore, error) {
+	backend, ok := api.LookupBackend(config.DbType)
+	if !ok || backend.NewApiKeyStore == nil {
+		return internal.NewInMemoryApiKeyStore(), nil
 	}
 
-	return service, nil
+	return backend.NewApiKeyStore(config, service)
 }
-func InitRouter(handler api.Handler) *gin.Engine {
-	router := gin.Default()
+
+// InitRateLimitStore shares rate limit buckets through the backend when
+// rateLimitConfig.store is "backend" and the backend can keep them, otherwise
+// they are kept in memory.
+func InitRateLimitStore(config api.AppConfig, service api.Service) (api.RateLimitStore, error) {
+	backend, ok := api.LookupBackend(config.DbType)
+	if config.RateLimitConfig.Store != "backend" || !ok || backend.NewRateLimitStore == nil {
+		return internal.NewInMemoryRateLimitStore(), nil
+	}
+
+	return backend.NewRateLimitStore(config, service)
+}
+
+// InitAuditSink returns nil unless auditConfig is enabled. The "backend" sink
+// keeps records next to the albums, in memory for backends without a sink of
+// their own, "file" appends JSON lines to auditConfig.file and "stdout" writes
+// them to the standard output.
+func InitAuditSink(config api.AppConfig, service api.Service) (api.AuditSink, error) {
+	if !config.AuditConfig.Enabled {
+		return nil, nil
+	}
+
+	switch config.AuditConfig.Sink {
+	case "file":
+		return internal.NewFileAuditSink(config.AuditConfig.File)
+	case "stdout":
+		return internal.NewStdoutAuditSink(), nil
+	}
+
+	backend, ok := api.LookupBackend(config.DbType)
+	if !ok || backend.NewAuditSink == nil {
+		return internal.NewInMemoryAuditSink(), nil
+	}
+
+	return backend.NewAuditSink(config, service)
+}
+
+// InitRouter registers the api routes, /readyz and metrics are only served
+// when readiness and metrics are not nil. Requests without an X-Request-ID get
+// one from idGenerator and are logged with the default slog logger. The album
+// routes require a caller accepted by one of authenticators, unless there is
+// none, holding the albums:read scope to read and albums:write to change albums.
+// With tenancy enabled they are scoped to the tenant of the request, and they
+// are rate limited per IP before authentication and per client after it unless
+// rateLimiter is nil. The audit trail is
+// served, under the same rules and to the audit:read scope, unless
+// auditHandler is nil.
+func InitRouter(config api.AppConfig, handler api.Handler, idGenerator api.IdGenerator, idempotencyStore api.IdempotencyStore, authenticators []internal.Authenticator, rateLimiter *internal.RateLimiter, auditHandler *internal.AuditHandler, readiness *internal.ReadinessChecker, metrics *internal.Metrics) *gin.Engine {
+	router := gin.New()
+	// the proxies are validated with the config, none is trusted should one be invalid
+	if err := router.SetTrustedProxies(config.ServerConfig.TrustedProxies); err != nil {
+		router.SetTrustedProxies(nil)
+	}
+	router.Use(
+		internal.NewRequestIdMiddleware(idGenerator),
+		internal.NewTracingMiddleware(config.TracingConfig),
+		internal.NewAccessLogMiddleware(slog.Default()),
+		gin.Recovery(),
+	)
+	if metrics != nil {
+		router.Use(metrics.Middleware())
+		router.GET("/metrics", gin.WrapH(metrics.Handler()))
+	}
 
 	router.GET("/status", StatusCheck)
+	router.GET("/livez", internal.Livez)
+	if readiness != nil {
+		router.GET("/readyz", readiness.Readyz)
+	}
 
-	router.GET("/albums", handler.GetAlbums)
-	router.GET("/albums/:id", handler.GetAlbumById)
-	router.POST("/albums", handler.InsertAlbum)
-	router.PUT("/albums/:id", handler.ReplaceAlbum)
-	router.PATCH("/albums/:id", handler.UpdateAlbum)
-	router.DELETE("/albums/:id", handler.DeleteAlbum)
+	var guards []gin.HandlerFunc
+	if len(authenticators) > 0 {
+		if rateLimiter != nil {
+			guards = append(guards, internal.NewIpRateLimitMiddleware(rateLimiter))
+		}
+		guards = append(guards, internal.NewAuthMiddleware(authenticators))
+	}
+	if config.TenancyConfig.Enabled {
+		guards = append(guards, internal.NewTenantMiddleware(config.TenancyConfig))
+	}
+	if rateLimiter != nil {
+		guards = append(guards, internal.NewRateLimitMiddleware(rateLimiter))
+	}
+
+	albums := router.Group("/albums", guards...)
+	read := internal.NewScopeMiddleware(internal.ScopeAlbumsRead)
+	write := internal.NewScopeMiddleware(internal.ScopeAlbumsWrite)
+	albums.GET("", read, handler.GetAlbums)
+	albums.GET("/:id", read, handler.GetAlbumById)
+	albums.POST("", write, internal.NewIdempotencyMiddleware(idempotencyStore, config.IdempotencyConfig), handler.InsertAlbum)
+	albums.PUT("/:id", write, handler.ReplaceAlbum)
+	albums.PATCH("/:id", write, handler.UpdateAlbum)
+	albums.DELETE("/:id", write, handler.DeleteAlbum)
+
+	if auditHandler != nil {
+		auditRead := internal.NewRequiredScopeMiddleware(internal.ScopeAuditRead)
+		albums.GET("/:id/audit", auditRead, auditHandler.GetAlbumAudit)
+		router.Group("/audit", guards...).GET("", auditRead, auditHandler.GetAudit)
+	}
 
 	return router
 }
@@ -84,6 +367,7 @@ func StatusCheck(c *gin.Context) {
 	response := map[string]any{}
 	response["status"] = "Healthy"
 	response["startedAt"] = startTime.Format(time.RFC1123Z)
+	response["backends"] = api.Backends()
 
 	c.JSON(http.StatusOK, response)
 }
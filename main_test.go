@@ -3,14 +3,24 @@ package main
 import (
 	"andrewsaputra/go-rest-sample/api"
 	"andrewsaputra/go-rest-sample/internal"
+	"bytes"
+	"context"
 	"encoding/json"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 func TestGetAppConfig_ValidConfigPath_ReturnsConfig(t *testing.T) {
@@ -27,6 +37,12 @@ func TestGetAppConfig_InvalidConfigPath_ReturnsError(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestRun_InvalidConfigPath_ReturnError(t *testing.T) {
+	err := run("invalid-path.json", nil)
+
+	assert.ErrorContains(t, err, "failed to load config")
+}
+
 func TestInitService_ValidDbTypes_ReturnsService(t *testing.T) {
 	idGenerator := internal.NewXidGenerator()
 
@@ -57,6 +73,14 @@ func TestInitService_UnsupportedDbType_ReturnsError(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestInitIdempotencyStore_InMemoryService_ReturnsInMemoryStore(t *testing.T) {
+	service, _ := internal.NewInMemoryService(internal.NewXidGenerator())
+
+	store, err := InitIdempotencyStore(api.AppConfig{DbType: "inmemory"}, service)
+	assert.IsType(t, new(internal.InMemoryIdempotencyStore), store)
+	assert.NoError(t, err)
+}
+
 func TestInitRouter_RegisterRoutes_HandlerFunctionsCalled(t *testing.T) {
 	handler := new(MockHandler)
 	handler.On("GetAlbums", mock.Anything).Return()
@@ -66,7 +90,7 @@ func TestInitRouter_RegisterRoutes_HandlerFunctionsCalled(t *testing.T) {
 	handler.On("UpdateAlbum", mock.Anything).Return()
 	handler.On("DeleteAlbum", mock.Anything).Return()
 
-	router := InitRouter(handler)
+	router := InitRouter(api.AppConfig{}, handler, internal.NewXidGenerator(), internal.NewInMemoryIdempotencyStore(), nil, nil, nil, nil, nil)
 
 	request, _ := http.NewRequest(http.MethodGet, "/albums", nil)
 	router.ServeHTTP(httptest.NewRecorder(), request)
@@ -94,6 +118,197 @@ func TestInitRouter_RegisterRoutes_HandlerFunctionsCalled(t *testing.T) {
 	handler.AssertNumberOfCalls(t, "DeleteAlbum", 1)
 }
 
+func TestInitRouter_WithMetrics_ServeRequestMetrics(t *testing.T) {
+	handler := new(MockHandler)
+	handler.On("GetAlbumById", mock.Anything).Return()
+	metrics := internal.NewMetrics()
+
+	router := InitRouter(api.AppConfig{}, handler, internal.NewXidGenerator(), internal.NewInMemoryIdempotencyStore(), nil, nil, nil, nil, metrics)
+
+	request, _ := http.NewRequest(http.MethodGet, "/albums/testId", nil)
+	router.ServeHTTP(httptest.NewRecorder(), request)
+
+	request, _ = http.NewRequest(http.MethodGet, "/metrics", nil)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Contains(t, response.Body.String(), `http_requests_total{method="GET",route="/albums/:id",status="200"} 1`)
+	assert.Contains(t, response.Body.String(), "go_goroutines")
+}
+
+func TestInitRouter_TraceparentHeader_ContinueTraceWithHandlerAndBackendSpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	internal.SetGlobalTracing(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { internal.SetGlobalTracing(noop.NewTracerProvider()) })
+
+	service, err := internal.NewSqliteService(api.AppConfig{SqliteConfig: api.SqliteConfig{Path: ":memory:", QueryTimeoutSeconds: 5}}, internal.NewXidGenerator())
+	assert.Nil(t, err)
+	defer service.Db.Close()
+	router := InitRouter(api.AppConfig{}, internal.NewApiHandler(service, api.AppConfig{}), internal.NewXidGenerator(), internal.NewInMemoryIdempotencyStore(), nil, nil, nil, nil, nil)
+
+	request, _ := http.NewRequest(http.MethodGet, "/albums/testId", nil)
+	request.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+	assert.NotEmpty(t, response.Header().Get(internal.RequestIdHeader))
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	server, handlerSpan, backend := spans["/albums/:id"], spans["ApiHandler.GetAlbumById"], spans["sqlite.query"]
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", server.SpanContext.TraceID().String())
+	assert.Equal(t, "b7ad6b7169203331", server.Parent.SpanID().String())
+	assert.Equal(t, server.SpanContext.SpanID(), handlerSpan.Parent.SpanID())
+	assert.Equal(t, codes.Error, handlerSpan.Status.Code)
+	assert.Equal(t, handlerSpan.SpanContext.SpanID(), backend.Parent.SpanID())
+}
+
+func TestInitRouter_WithReadiness_ServeProbes(t *testing.T) {
+	readiness := internal.NewReadinessChecker(api.HealthConfig{}, nil, slog.Default())
+	router := InitRouter(api.AppConfig{}, new(MockHandler), internal.NewXidGenerator(), internal.NewInMemoryIdempotencyStore(), nil, nil, nil, readiness, nil)
+
+	for _, path := range []string{"/livez", "/readyz"} {
+		request, _ := http.NewRequest(http.MethodGet, path, nil)
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+
+		assert.Equal(t, http.StatusOK, response.Code, path)
+	}
+}
+
+func TestRunServer_ContextDone_DrainInFlightRequestsAndCloseService(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	readiness := internal.NewReadinessChecker(api.HealthConfig{}, nil, slog.Default())
+	service := new(MockService)
+	service.On("Close", mock.Anything).Return(nil)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	router := gin.New()
+	router.GET("/slow", func(c *gin.Context) {
+		close(started)
+		<-release
+		c.Status(http.StatusOK)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- RunServer(ctx, &http.Server{Handler: router}, listener, readiness, service, api.ServerConfig{DrainTimeoutSeconds: 5})
+	}()
+
+	responses := make(chan *http.Response)
+	go func() {
+		response, _ := http.Get("http://" + listener.Addr().String() + "/slow")
+		responses <- response
+	}()
+	<-started
+	cancel()
+
+	assert.Eventually(t, func() bool {
+		return readiness.Check(context.Background()).Status == "draining"
+	}, time.Second, 10*time.Millisecond)
+	service.AssertNotCalled(t, "Close", mock.Anything)
+
+	close(release)
+	response := <-responses
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Nil(t, <-stopped)
+	service.AssertNumberOfCalls(t, "Close", 1)
+}
+
+func TestInitRouter_WithAuthenticators_ProtectAlbumRoutesOnly(t *testing.T) {
+	handler := new(MockHandler)
+	router := InitRouter(api.AppConfig{}, handler, internal.NewXidGenerator(), internal.NewInMemoryIdempotencyStore(), []internal.Authenticator{anonymousAuthenticator{}}, nil, nil, nil, nil)
+
+	for path, expected := range map[string]int{"/albums": http.StatusUnauthorized, "/albums/testId": http.StatusUnauthorized, "/livez": http.StatusOK} {
+		request, _ := http.NewRequest(http.MethodGet, path, nil)
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+
+		assert.Equal(t, expected, response.Code, path)
+	}
+	handler.AssertNotCalled(t, "GetAlbums", mock.Anything)
+}
+
+func TestInitRouter_ReadOnlyScope_ForbidWrites(t *testing.T) {
+	handler := new(MockHandler)
+	handler.On("GetAlbums", mock.Anything).Return()
+	authenticator := scopedAuthenticator{Scopes: []string{internal.ScopeAlbumsRead}}
+	router := InitRouter(api.AppConfig{}, handler, internal.NewXidGenerator(), internal.NewInMemoryIdempotencyStore(), []internal.Authenticator{authenticator}, nil, nil, nil, nil)
+
+	for method, expected := range map[string]int{http.MethodGet: http.StatusOK, http.MethodPost: http.StatusForbidden} {
+		request, _ := http.NewRequest(method, "/albums", nil)
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+
+		assert.Equal(t, expected, response.Code, method)
+	}
+	handler.AssertNotCalled(t, "InsertAlbum", mock.Anything)
+}
+
+func TestInitRouter_ForwardedForWithoutTrustedProxies_LimitRemoteAddr(t *testing.T) {
+	handler := new(MockHandler)
+	handler.On("GetAlbums", mock.Anything).Return()
+	config := api.RateLimitConfig{Enabled: true, Read: api.RateLimitRule{RequestsPerMinute: 1}}
+	limiter := internal.NewRateLimiter(config, internal.NewInMemoryRateLimitStore(), slog.Default())
+	router := InitRouter(api.AppConfig{}, handler, internal.NewXidGenerator(), internal.NewInMemoryIdempotencyStore(), nil, limiter, nil, nil, nil)
+
+	var codes []int
+	for _, forwardedFor := range []string{"10.0.0.1", "10.0.0.2"} {
+		request, _ := http.NewRequest(http.MethodGet, "/albums", nil)
+		request.RemoteAddr = "192.0.2.1:1234"
+		request.Header.Set("X-Forwarded-For", forwardedFor)
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		codes = append(codes, response.Code)
+	}
+
+	assert.Equal(t, []int{http.StatusOK, http.StatusTooManyRequests}, codes)
+}
+
+func TestRunApiKeyCommand_TenancyWithoutTenant_ReturnError(t *testing.T) {
+	config := internal.DefaultAppConfig()
+	config.DbType = "sqlite"
+	config.SqliteConfig.Path = filepath.Join(t.TempDir(), "albums.db")
+	config.TenancyConfig.Enabled = true
+	var out bytes.Buffer
+
+	err := RunApiKeyCommand(context.Background(), config, []string{"issue", "-subject", "billing"}, &out)
+	assert.ErrorContains(t, err, "-tenant is required")
+
+	err = RunApiKeyCommand(context.Background(), config, []string{"issue", "-subject", "billing", "-tenant", "acme"}, &out)
+	assert.Nil(t, err)
+	assert.Contains(t, out.String(), "key: ")
+}
+
+// scopedAuthenticator accepts every request as an API key holding Scopes.
+type scopedAuthenticator struct {
+	Scopes []string
+}
+
+func (this scopedAuthenticator) Authenticate(request *http.Request) (*api.Principal, error) {
+	return &api.Principal{Subject: "tester", Method: "apiKey", Scopes: this.Scopes}, nil
+}
+
+func (this scopedAuthenticator) Challenge() string {
+	return "Bearer"
+}
+
+// anonymousAuthenticator never finds credentials in a request.
+type anonymousAuthenticator struct{}
+
+func (this anonymousAuthenticator) Authenticate(request *http.Request) (*api.Principal, error) {
+	return nil, nil
+}
+
+func (this anonymousAuthenticator) Challenge() string {
+	return "Bearer"
+}
+
 func TestStatusCheck_StatusCheckSuccess(t *testing.T) {
 	router := gin.Default()
 	router.GET("/status", StatusCheck)
@@ -107,6 +322,12 @@ func TestStatusCheck_StatusCheckSuccess(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, response.Code)
 	assert.Equal(t, "Healthy", responseBody["status"])
+
+	var names []any
+	for _, backend := range responseBody["backends"].([]any) {
+		names = append(names, backend.(map[string]any)["name"])
+	}
+	assert.Subset(t, names, []any{"inmemory", "mongodb", "dynamodb"})
 }
 
 type MockHandler struct {
@@ -136,3 +357,14 @@ func (this *MockHandler) UpdateAlbum(c *gin.Context) {
 func (this *MockHandler) DeleteAlbum(c *gin.Context) {
 	this.Called(c)
 }
+
+// MockService only records Close, the album methods are never called by RunServer.
+type MockService struct {
+	api.Service
+	mock.Mock
+}
+
+func (this *MockService) Close(ctx context.Context) error {
+	args := this.Called(ctx)
+	return args.Error(0)
+}
@@ -1,11 +1,24 @@
 #!/bin/bash
 
+# seconds to wait for a graceful shutdown, keep above serverConfig drain delay + timeout
+STOP_TIMEOUT=40
+
 PID=$(pidof go-rest-sample)
 
 if [ -z "$PID" ]
 then
     echo "application not running"
 else 
+    kill -TERM $PID
+    for i in $(seq $STOP_TIMEOUT)
+    do
+        if ! kill -0 $PID 2>/dev/null
+        then
+            exit 0
+        fi
+        sleep 1
+    done
+
+    echo "application did not stop within $STOP_TIMEOUT seconds, killing it"
     kill -9 $PID
 fi
-